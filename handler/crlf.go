@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"bufio"
+	"io"
+)
+
+// crlfReader converts lone "\r" and lone "\n" line endings to "\r\n".
+//
+// Messages stored with inconsistent line endings, e.g. Mac-style "\r", can
+// cause mail.ReadMessage to misparse the header/body split.
+type crlfReader struct {
+	r         *bufio.Reader
+	pendingLF bool
+}
+
+func newCrlfReader(r io.Reader) *crlfReader {
+	return &crlfReader{r: bufio.NewReader(r)}
+}
+
+func (cr *crlfReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		if cr.pendingLF {
+			p[n] = '\n'
+			n++
+			cr.pendingLF = false
+			continue
+		}
+
+		// Copy everything up to the next lone "\r" or "\n" directly from the
+		// buffer.
+		if _, err = cr.r.Peek(1); err != nil {
+			break
+		}
+		chunk, _ := cr.r.Peek(min(cr.r.Buffered(), len(p)-n))
+		if size := crlfPrefixLen(chunk); size != 0 {
+			n += copy(p[n:], chunk[:size])
+			cr.r.Discard(size)
+			continue
+		}
+
+		b, _ := cr.r.ReadByte()
+		if b == '\r' {
+			if next, _ := cr.r.Peek(1); len(next) != 0 && next[0] == '\n' {
+				cr.r.Discard(1)
+			}
+		}
+		p[n] = '\r'
+		n++
+		cr.pendingLF = true
+	}
+	return
+}
+
+// crlfPrefixLen returns the length of the prefix of chunk that contains no lone
+// "\r" or "\n". A "\r" at the end of chunk counts as a lone "\r".
+func crlfPrefixLen(chunk []byte) int {
+	for i := 0; i < len(chunk); i++ {
+		switch chunk[i] {
+		case '\r':
+			if i+1 == len(chunk) || chunk[i+1] != '\n' {
+				return i
+			}
+			i++
+		case '\n':
+			return i
+		}
+	}
+	return len(chunk)
+}
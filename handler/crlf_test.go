@@ -0,0 +1,54 @@
+//go:build small_tests || all_tests
+
+package handler
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"gotest.tools/assert"
+)
+
+func TestCrlfReader(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"LeavesCrlfUnchanged", "foo\r\nbar\r\n", "foo\r\nbar\r\n"},
+		{"ConvertsLoneLf", "foo\nbar\n", "foo\r\nbar\r\n"},
+		{"ConvertsLoneCr", "foo\rbar\r", "foo\r\nbar\r\n"},
+		{"ConvertsMixed", "foo\rbar\nbaz\r\n", "foo\r\nbar\r\nbaz\r\n"},
+		{"ConvertsLfCrAsTwoLineEndings", "foo\n\rbar", "foo\r\n\r\nbar"},
+		{"HandlesEmptyInput", "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newCrlfReader(strings.NewReader(tc.input))
+
+			result, err := io.ReadAll(r)
+
+			assert.NilError(t, err)
+			assert.Equal(t, string(result), tc.expected)
+		})
+	}
+
+	t.Run("HandlesSmallReads", func(t *testing.T) {
+		r := newCrlfReader(iotest.OneByteReader(strings.NewReader("a\rb\nc")))
+
+		result, err := io.ReadAll(iotest.OneByteReader(r))
+
+		assert.NilError(t, err)
+		assert.Equal(t, string(result), "a\r\nb\r\nc")
+	})
+
+	t.Run("ReturnsReadErrors", func(t *testing.T) {
+		r := newCrlfReader(&ErrReader{errors.New("test read error")})
+
+		_, err := io.ReadAll(r)
+
+		assert.ErrorContains(t, err, "test read error")
+	})
+}
@@ -0,0 +1,23 @@
+package handler
+
+import (
+	"io"
+	"net/mail"
+	"regexp"
+)
+
+// defangedUrlScheme matches the "http://" and "https://" URL schemes, which
+// defangUrls rewrites as "hxxp://" and "hxxps://".
+var defangedUrlScheme = regexp.MustCompile(`(?i)\b(h)tt(ps?://)`)
+
+// defangUrls rewrites the URLs in every text/plain and text/html part of a
+// message so mail clients don't make them clickable.
+//
+// See transformTextParts for how it updates header and body.
+func defangUrls(header mail.Header, body io.Reader) (io.Reader, error) {
+	return transformTextParts(
+		header, body, func(_ string, content []byte) []byte {
+			return defangedUrlScheme.ReplaceAll(content, []byte("${1}xx$2"))
+		},
+	)
+}
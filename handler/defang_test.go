@@ -0,0 +1,143 @@
+//go:build small_tests || all_tests
+
+package handler
+
+import (
+	"errors"
+	"io"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+const defangMultipart = `multipart/mixed; boundary="xyzzy"`
+
+const defangMsgBody = "--xyzzy\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"plugh\"\r\n" +
+	"\r\n" +
+	"--plugh\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Visit https://evil.com/login or HTTP://example.com now.\r\n" +
+	"--plugh\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"<a href=3D\"https://evil.com/login\">Log in</a>\r\n" +
+	"--plugh--\r\n" +
+	"--xyzzy\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"\r\n" +
+	"http://binary.example.com\r\n" +
+	"--xyzzy\r\n" +
+	"Content-Disposition: attachment; filename=\"urls.txt\"\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"http://attached.example.com\r\n" +
+	"--xyzzy--\r\n"
+
+func TestDefangUrls(t *testing.T) {
+	readParts := func(t *testing.T, r io.Reader, boundary string) []string {
+		t.Helper()
+		parts := []string{}
+		mr := multipart.NewReader(r, boundary)
+
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return parts
+			}
+			assert.NilError(t, err)
+			content, err := io.ReadAll(part)
+			assert.NilError(t, err)
+			parts = append(parts, string(content))
+		}
+	}
+
+	t.Run("DefangsPlainTextMessage", func(t *testing.T) {
+		header, body := plainTextInput(
+			"text/plain", "", "See http://foo.com and httpd.conf.\r\n",
+		)
+
+		result, err := defangUrls(header, body)
+
+		assert.NilError(t, err)
+		assert.Equal(
+			t, header.Get("Content-Transfer-Encoding"), "quoted-printable",
+		)
+		content, err := io.ReadAll(quotedprintable.NewReader(result))
+		assert.NilError(t, err)
+		assert.Equal(t, string(content), "See hxxp://foo.com and httpd.conf.\r\n")
+	})
+
+	t.Run("DefangsTextPartsOfMultipartMessage", func(t *testing.T) {
+		header, body := plainTextInput(defangMultipart, "", defangMsgBody)
+
+		result, err := defangUrls(header, body)
+
+		assert.NilError(t, err)
+		assert.Equal(t, header.Get("Content-Transfer-Encoding"), "")
+		parts := readParts(t, result, "xyzzy")
+		assert.Equal(t, len(parts), 3)
+		assert.Equal(t, parts[1], "http://binary.example.com")
+		assert.Equal(t, parts[2], "http://attached.example.com")
+
+		alternatives := readParts(t, strings.NewReader(parts[0]), "plugh")
+		assert.DeepEqual(t, alternatives, []string{
+			"Visit hxxps://evil.com/login or HxxP://example.com now.",
+			"<a href=\"hxxps://evil.com/login\">Log in</a>",
+		})
+	})
+
+	t.Run("LeavesMessageWithoutUrlsUnchanged", func(t *testing.T) {
+		const body = "--xyzzy\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"No links here.\r\n" +
+			"--xyzzy--\r\n" +
+			"epilogue\r\n"
+		header, r := plainTextInput(defangMultipart, "7bit", body)
+
+		result, err := defangUrls(header, r)
+
+		assert.NilError(t, err)
+		assert.Equal(t, header.Get("Content-Transfer-Encoding"), "7bit")
+		content, err := io.ReadAll(result)
+		assert.NilError(t, err)
+		assert.Equal(t, string(content), body)
+	})
+
+	t.Run("DoesNotReadOtherContentTypes", func(t *testing.T) {
+		header, body := plainTextInput("image/png", "base64", "aHR0cDovLw==")
+
+		result, err := defangUrls(header, body)
+
+		assert.NilError(t, err)
+		assert.Equal(t, result, io.Reader(body))
+		assert.Equal(t, body.Len(), len("aHR0cDovLw=="))
+	})
+
+	t.Run("ErrorsIfDecodingPartFails", func(t *testing.T) {
+		header, body := plainTextInput(
+			defangMultipart,
+			"",
+			"--xyzzy\r\n"+
+				"Content-Type: text/plain\r\n"+
+				"Content-Transfer-Encoding: base64\r\n"+
+				"\r\n"+
+				"not base64!\r\n"+
+				"--xyzzy--\r\n",
+		)
+
+		result, err := defangUrls(header, body)
+
+		assert.Assert(t, is.Nil(result))
+		assert.ErrorContains(t, err, "illegal base64 data")
+		var transformErr *ErrTransform
+		assert.Assert(t, errors.As(err, &transformErr))
+	})
+}
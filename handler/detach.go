@@ -0,0 +1,290 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// defaultDetachThreshold is the encoded size above which an attachment is
+// detached if DETACH_ATTACHMENTS_PREFIX is set, unless
+// DETACH_ATTACHMENTS_THRESHOLD overrides it.
+const defaultDetachThreshold = 1024 * 1024
+
+// maxPresignedLinkTtl is the longest expiration time S3 allows for presigned
+// URLs signed with Signature Version 4.
+//
+// - https://docs.aws.amazon.com/AmazonS3/latest/userguide/ShareObjectPreSignedURL.html
+const maxPresignedLinkTtl = 7 * 24 * time.Hour
+
+func (h *Handler) detachThreshold() int64 {
+	if h.Options.DetachAttachmentsThreshold != 0 {
+		return h.Options.DetachAttachmentsThreshold
+	}
+	return defaultDetachThreshold
+}
+
+// detachAttachments uploads every top level attachment of a multipart
+// message larger than detachThreshold to DetachAttachmentsPrefix, replacing
+// each with a text/plain part containing a link to the uploaded object.
+//
+// The link is presigned if DetachAttachmentsLinkTtl is set. Otherwise it's an
+// s3:// or S3 console URL, per OriginLinkFormat, which only principals with
+// access to BucketName can follow.
+//
+// It replaces m.Body with the rewritten body, and leaves m unchanged if the
+// message isn't multipart or no attachment exceeds the threshold. Attachments
+// nested within other multipart parts are kept inline.
+//
+// If a detached part had a Content-ID, such as an inline image, it also
+// replaces the "cid:" references to it in every text/html part with the link,
+// so they don't refer to a missing part.
+func (h *Handler) detachAttachments(
+	ctx context.Context, m *mail.Message, key string,
+) error {
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") ||
+		params["boundary"] == "" {
+		return nil
+	}
+
+	orig, err := io.ReadAll(m.Body)
+	if err != nil {
+		return err
+	}
+	m.Body = bytes.NewReader(orig)
+
+	_, messageId, _ := cutLast(key, "/")
+	body, detached, cidLinks, err := h.detachParts(
+		ctx, params["boundary"], orig, messageId,
+	)
+	if err != nil {
+		return err
+	} else if detached == 0 {
+		return nil
+	}
+
+	h.logf(ctx, "detached %d attachment(s) from %s", detached, key)
+	m.Body = bytes.NewReader(body)
+	if len(cidLinks) != 0 {
+		m.Body, err = rewriteCidReferences(m.Header, m.Body, cidLinks)
+	}
+	return err
+}
+
+// detachParts returns the rewritten body, the number of detached parts, and
+// a map from the Content-ID of each detached part, if any, to its link.
+func (h *Handler) detachParts(
+	ctx context.Context, boundary string, orig []byte, messageId string,
+) (body []byte, detached int, cidLinks map[string]string, err error) {
+	b := &bytes.Buffer{}
+	mw := multipart.NewWriter(b)
+	if err = mw.SetBoundary(boundary); err != nil {
+		return nil, 0, nil, &ErrTransform{err}
+	}
+	cidLinks = map[string]string{}
+	mr := multipart.NewReader(bytes.NewReader(orig), boundary)
+	threshold := h.detachThreshold()
+
+	for i := 1; ; i++ {
+		// NextRawPart doesn't decode quoted-printable parts, so kept parts
+		// are written back exactly as they were.
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, nil, &ErrTransform{err}
+		}
+
+		content, err := io.ReadAll(part)
+		if err != nil {
+			return nil, 0, nil, &ErrTransform{err}
+		}
+		header := part.Header
+
+		if isAttachment(part) && int64(len(content)) > threshold {
+			prefix := h.Options.DetachAttachmentsPrefix
+			objKey := detachedKey(prefix, messageId, i, part.FileName())
+			var link string
+			if header, content, link, err = h.detachPart(
+				ctx, part, content, objKey,
+			); err != nil {
+				return nil, 0, nil, err
+			} else if cid := contentId(part.Header); cid != "" {
+				cidLinks[cid] = link
+			}
+			detached++
+		}
+
+		// Writing to a bytes.Buffer can't fail, so we can ignore the errors.
+		w, _ := mw.CreatePart(header)
+		w.Write(content)
+	}
+	mw.Close()
+	return b.Bytes(), detached, cidLinks, nil
+}
+
+// isAttachment returns true if part has an "attachment" Content-Disposition
+// or a file name.
+//
+// - https://www.rfc-editor.org/rfc/rfc2183#section-2
+func isAttachment(part *multipart.Part) bool {
+	disposition, _, _ := mime.ParseMediaType(
+		part.Header.Get("Content-Disposition"),
+	)
+	return disposition == "attachment" || part.FileName() != ""
+}
+
+// detachedKey returns the S3 object key for the attachment at the 1-based
+// index of the message's top level parts. The index keeps keys unique even
+// if attachments share the same file name.
+func detachedKey(prefix, messageId string, index int, fileName string) string {
+	fileName = path.Base(strings.ReplaceAll(fileName, "\\", "/"))
+	if fileName == "." || fileName == "/" {
+		fileName = "attachment"
+	}
+	return fmt.Sprintf("%s/%s/%d/%s", prefix, messageId, index, fileName)
+}
+
+// detachPart uploads the decoded content of part to objKey and returns the
+// header and content of the text/plain part replacing it, plus the link to
+// the uploaded object.
+func (h *Handler) detachPart(
+	ctx context.Context, part *multipart.Part, content []byte, objKey string,
+) (textproto.MIMEHeader, []byte, string, error) {
+	cte := part.Header.Get("Content-Transfer-Encoding")
+	decoded, err := io.ReadAll(
+		decodeTransferEncoding(cte, bytes.NewReader(content)),
+	)
+	if err != nil {
+		return nil, nil, "", &ErrTransform{err}
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:       aws.String(h.Options.BucketName),
+		Key:          aws.String(objKey),
+		Body:         bytes.NewReader(decoded),
+		RequestPayer: h.requestPayer(),
+	}
+	if contentType := part.Header.Get("Content-Type"); contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	if _, err = h.S3.PutObject(ctx, input); err != nil {
+		err = fmt.Errorf("failed to detach attachment %s: %w", objKey, err)
+		return nil, nil, "", &ErrForward{err}
+	}
+
+	link, err := h.detachedLink(ctx, objKey)
+	if err != nil {
+		return nil, nil, "", &ErrForward{err}
+	}
+
+	name := part.FileName()
+	if name == "" {
+		name = path.Base(objKey)
+	}
+	note := fmt.Sprintf(
+		"The attachment %q (%d bytes) was removed from this message.\r\n"+
+			"Download it from:\r\n\r\n%s\r\n",
+		name, len(decoded), link,
+	)
+	if ttl := h.Options.DetachAttachmentsLinkTtl; ttl != 0 {
+		note += fmt.Sprintf("\r\nThis link expires after %s.\r\n", ttl)
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Content-Disposition", "inline")
+	return header, []byte(note), link, nil
+}
+
+// contentId returns a part's Content-ID without its angle brackets.
+//
+// - https://www.rfc-editor.org/rfc/rfc2045#section-7
+func contentId(header textproto.MIMEHeader) string {
+	cid := strings.TrimSpace(header.Get("Content-Id"))
+	return strings.TrimSuffix(strings.TrimPrefix(cid, "<"), ">")
+}
+
+// rewriteCidReferences replaces every "cid:" URL referring to a key of
+// cidLinks in the text/html parts of a message with the corresponding link.
+//
+// - https://www.rfc-editor.org/rfc/rfc2392
+func rewriteCidReferences(
+	header mail.Header, body io.Reader, cidLinks map[string]string,
+) (io.Reader, error) {
+	type cidReplacement struct {
+		ref  *regexp.Regexp
+		repl []byte
+	}
+	replacements := make([]cidReplacement, 0, len(cidLinks))
+
+	for cid, link := range cidLinks {
+		// The ref must end at a delimiter so that, for example, "cid:img1"
+		// doesn't match the start of "cid:img10".
+		ref := regexp.MustCompile(
+			`(?i)cid:` + regexp.QuoteMeta(cid) + `(["'\s)>]|$)`,
+		)
+		escaped := strings.ReplaceAll(html.EscapeString(link), "$", "$$")
+		replacements = append(
+			replacements, cidReplacement{ref, []byte(escaped + "$1")},
+		)
+	}
+
+	return transformTextParts(
+		header, body, func(mediaType string, content []byte) []byte {
+			if mediaType != "text/html" {
+				return content
+			}
+			for _, r := range replacements {
+				content = r.ref.ReplaceAll(content, r.repl)
+			}
+			return content
+		},
+	)
+}
+
+func (h *Handler) detachedLink(
+	ctx context.Context, objKey string,
+) (string, error) {
+	ttl := h.Options.DetachAttachmentsLinkTtl
+
+	if ttl == 0 {
+		objPath := h.Options.BucketName + "/" + objKey
+		if h.Options.OriginLinkFormat == OriginLinkFormatConsole {
+			return consoleLink(objPath, h.Options.AwsRegion), nil
+		}
+		return "s3://" + objPath, nil
+	} else if h.S3Presign == nil {
+		return "", errors.New(
+			"DETACH_ATTACHMENTS_LINK_TTL set, but S3Presign is nil",
+		)
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket:       aws.String(h.Options.BucketName),
+		Key:          aws.String(objKey),
+		RequestPayer: h.requestPayer(),
+	}
+	req, err := h.S3Presign.PresignGetObject(
+		ctx, input, s3.WithPresignExpires(ttl),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to presign %s: %w", objKey, err)
+	}
+	return req.URL, nil
+}
@@ -0,0 +1,318 @@
+//go:build small_tests || all_tests
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/mbland/ses-forwarder/handler/handlertest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+type TestS3Presign struct {
+	input   *s3.GetObjectInput
+	expires time.Duration
+	err     error
+}
+
+func (p *TestS3Presign) PresignGetObject(
+	_ context.Context,
+	input *s3.GetObjectInput,
+	optFns ...func(*s3.PresignOptions),
+) (*v4.PresignedHTTPRequest, error) {
+	p.input = input
+	opts := &s3.PresignOptions{}
+	for _, fn := range optFns {
+		fn(opts)
+	}
+	p.expires = opts.Expires
+
+	if p.err != nil {
+		return nil, p.err
+	}
+	url := "https://" + *input.Bucket + ".s3.amazonaws.com/" + *input.Key +
+		"?X-Amz-Signature=deadbeef"
+	return &v4.PresignedHTTPRequest{URL: url}, nil
+}
+
+// largeAttachment is longer than the DetachAttachmentsThreshold set by the
+// TestDetachAttachments setup. It decodes to "Lorem ipsum dolor sit amet, "
+// repeated three times.
+const largeAttachment = "TG9yZW0gaXBzdW0gZG9sb3Igc2l0IGFtZXQsIExvcmVtIGlwc3" +
+	"VtIGRvbG9yIHNpdCBhbWV0LCBMb3JlbSBpcHN1bSBkb2xvciBzaXQgYW1ldCwg"
+
+const detachMsg = "From: Mike <mbland@acm.org>\r\n" +
+	"To: foo@bar.com\r\n" +
+	"Subject: Attachments\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"xyzzy\"\r\n" +
+	"\r\n" +
+	"--xyzzy\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"See attached.\r\n" +
+	"--xyzzy\r\n" +
+	"Content-Disposition: attachment; filename=\"large.txt\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	largeAttachment + "\r\n" +
+	"--xyzzy\r\n" +
+	"Content-Disposition: attachment; filename=\"small.txt\"\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Keep me.\r\n" +
+	"--xyzzy--\r\n"
+
+func TestDetachAttachments(t *testing.T) {
+	setup := func() (*handlertest.S3, *Handler, *mail.Message) {
+		objS3 := &handlertest.S3{}
+		_, logger := testLogger()
+		h := &Handler{
+			S3: objS3,
+			Options: &Options{
+				BucketName:                 "mail.bar.com",
+				DetachAttachmentsPrefix:    "detached",
+				DetachAttachmentsThreshold: 64,
+			},
+			Log: logger,
+		}
+		m, err := mail.ReadMessage(strings.NewReader(detachMsg))
+		assert.NilError(t, err)
+		return objS3, h, m
+	}
+
+	readParts := func(t *testing.T, m *mail.Message) []string {
+		t.Helper()
+		parts := []string{}
+		mr := multipart.NewReader(m.Body, "xyzzy")
+
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return parts
+			}
+			assert.NilError(t, err)
+			content, err := io.ReadAll(part)
+			assert.NilError(t, err)
+			parts = append(parts, string(content))
+		}
+	}
+
+	t.Run("DetachesLargeAttachmentAndKeepsSmallOneInline", func(t *testing.T) {
+		objS3, h, m := setup()
+
+		err := h.detachAttachments(context.Background(), m, "incoming/msgId")
+
+		assert.NilError(t, err)
+		key := "detached/msgId/2/large.txt"
+		assert.Equal(
+			t,
+			string(objS3.Objects[key]),
+			strings.Repeat("Lorem ipsum dolor sit amet, ", 3),
+		)
+		assert.Equal(t, *objS3.PutObjectInputs[0].ContentType, "text/plain")
+
+		parts := readParts(t, m)
+		assert.Equal(t, len(parts), 3)
+		assert.Equal(t, parts[0], "See attached.")
+		expected := "The attachment \"large.txt\" (84 bytes) was removed " +
+			"from this message.\r\nDownload it from:\r\n\r\n" +
+			"s3://mail.bar.com/" + key + "\r\n"
+		assert.Equal(t, parts[1], expected)
+		assert.Equal(t, parts[2], "Keep me.")
+	})
+
+	t.Run("LeavesMessageUnchangedIfNoAttachmentExceedsThreshold",
+		func(t *testing.T) {
+			objS3, h, m := setup()
+			h.Options.DetachAttachmentsThreshold = 1024
+
+			err := h.detachAttachments(
+				context.Background(), m, "incoming/msgId",
+			)
+
+			assert.NilError(t, err)
+			assert.Equal(t, len(objS3.PutObjectInputs), 0)
+			body, err := io.ReadAll(m.Body)
+			assert.NilError(t, err)
+			_, origBody, _ := strings.Cut(detachMsg, "\r\n\r\n")
+			assert.Equal(t, string(body), origBody)
+		},
+	)
+
+	t.Run("IgnoresNonMultipartMessage", func(t *testing.T) {
+		objS3, h, _ := setup()
+		m, err := mail.ReadMessage(bytes.NewReader(testMsg))
+		assert.NilError(t, err)
+
+		err = h.detachAttachments(context.Background(), m, "incoming/msgId")
+
+		assert.NilError(t, err)
+		assert.Equal(t, len(objS3.PutObjectInputs), 0)
+	})
+
+	t.Run("UsesPresignedLinkIfLinkTtlSet", func(t *testing.T) {
+		_, h, m := setup()
+		presign := &TestS3Presign{}
+		h.S3Presign = presign
+		h.Options.DetachAttachmentsLinkTtl = 24 * time.Hour
+
+		err := h.detachAttachments(context.Background(), m, "incoming/msgId")
+
+		assert.NilError(t, err)
+		assert.Equal(t, *presign.input.Key, "detached/msgId/2/large.txt")
+		assert.Equal(t, presign.expires, 24*time.Hour)
+		parts := readParts(t, m)
+		assert.Assert(t, is.Contains(
+			parts[1],
+			"https://mail.bar.com.s3.amazonaws.com/"+
+				"detached/msgId/2/large.txt?X-Amz-Signature=deadbeef\r\n",
+		))
+		assert.Assert(t, is.Contains(
+			parts[1], "This link expires after 24h0m0s.",
+		))
+	})
+
+	t.Run("ErrorsIfUploadFails", func(t *testing.T) {
+		objS3, h, m := setup()
+		objS3.PutObjectErr = errors.New("test error")
+
+		err := h.detachAttachments(context.Background(), m, "incoming/msgId")
+
+		expected := "failed to detach attachment " +
+			"detached/msgId/2/large.txt: test error"
+		assert.ErrorContains(t, err, expected)
+		var forwardErr *ErrForward
+		assert.Assert(t, errors.As(err, &forwardErr))
+	})
+
+	t.Run("ErrorsIfPresignFails", func(t *testing.T) {
+		_, h, m := setup()
+		h.S3Presign = &TestS3Presign{err: errors.New("test error")}
+		h.Options.DetachAttachmentsLinkTtl = time.Hour
+
+		err := h.detachAttachments(context.Background(), m, "incoming/msgId")
+
+		expected := "failed to presign detached/msgId/2/large.txt: test error"
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+const detachInlineImageMsg = "From: Mike <mbland@acm.org>\r\n" +
+	"To: foo@bar.com\r\n" +
+	"Subject: Inline image\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/related; boundary=\"xyzzy\"\r\n" +
+	"\r\n" +
+	"--xyzzy\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<img src=\"cid:logo@acm.org\"><img src='cid:logo@acm.org2'>\r\n" +
+	"--xyzzy\r\n" +
+	"Content-Type: image/png\r\n" +
+	"Content-Disposition: inline; filename=\"logo.png\"\r\n" +
+	"Content-ID: <logo@acm.org>\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	largeAttachment + "\r\n" +
+	"--xyzzy--\r\n"
+
+func TestDetachAttachmentsRewritesCidReferences(t *testing.T) {
+	setup := func() (*Handler, *mail.Message) {
+		_, logger := testLogger()
+		h := &Handler{
+			S3: &handlertest.S3{},
+			Options: &Options{
+				BucketName:                 "mail.bar.com",
+				DetachAttachmentsPrefix:    "detached",
+				DetachAttachmentsThreshold: 64,
+			},
+			Log: logger,
+		}
+		m, err := mail.ReadMessage(strings.NewReader(detachInlineImageMsg))
+		assert.NilError(t, err)
+		return h, m
+	}
+
+	htmlPart := func(t *testing.T, m *mail.Message) string {
+		t.Helper()
+		mr := multipart.NewReader(m.Body, "xyzzy")
+		part, err := mr.NextPart()
+		assert.NilError(t, err)
+		content, err := io.ReadAll(part)
+		assert.NilError(t, err)
+		return string(content)
+	}
+
+	t.Run("ReplacesReferenceToDetachedImage", func(t *testing.T) {
+		h, m := setup()
+
+		err := h.detachAttachments(context.Background(), m, "incoming/msgId")
+
+		assert.NilError(t, err)
+		expected := "<img src=\"s3://mail.bar.com/" +
+			"detached/msgId/2/logo.png\"><img src='cid:logo@acm.org2'>"
+		assert.Equal(t, htmlPart(t, m), expected)
+	})
+
+	t.Run("UsesPresignedLink", func(t *testing.T) {
+		h, m := setup()
+		h.S3Presign = &TestS3Presign{}
+		h.Options.DetachAttachmentsLinkTtl = time.Hour
+
+		err := h.detachAttachments(context.Background(), m, "incoming/msgId")
+
+		assert.NilError(t, err)
+		assert.Assert(t, is.Contains(
+			htmlPart(t, m),
+			"<img src=\"https://mail.bar.com.s3.amazonaws.com/"+
+				"detached/msgId/2/logo.png?X-Amz-Signature=deadbeef\">",
+		))
+	})
+
+	t.Run("LeavesReferencesIfImageKeptInline", func(t *testing.T) {
+		h, m := setup()
+		h.Options.DetachAttachmentsThreshold = 1024
+
+		err := h.detachAttachments(context.Background(), m, "incoming/msgId")
+
+		assert.NilError(t, err)
+		assert.Assert(t, is.Contains(
+			htmlPart(t, m), "<img src=\"cid:logo@acm.org\">",
+		))
+	})
+}
+
+func TestContentId(t *testing.T) {
+	header := textproto.MIMEHeader{"Content-Id": {" <logo@acm.org> "}}
+
+	assert.Equal(t, contentId(header), "logo@acm.org")
+	assert.Equal(t, contentId(textproto.MIMEHeader{}), "")
+}
+
+func TestDetachedKey(t *testing.T) {
+	t.Run("UsesBaseFileName", func(t *testing.T) {
+		key := detachedKey("detached", "msgId", 2, `..\..\evil/foo.pdf`)
+
+		assert.Equal(t, key, "detached/msgId/2/foo.pdf")
+	})
+
+	t.Run("UsesDefaultFileNameIfEmpty", func(t *testing.T) {
+		key := detachedKey("detached", "msgId", 3, "")
+
+		assert.Equal(t, key, "detached/msgId/3/attachment")
+	})
+}
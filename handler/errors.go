@@ -0,0 +1,56 @@
+package handler
+
+// ErrValidation indicates that an incoming message failed DMARC, spam, or
+// other validation checks and wasn't forwarded.
+type ErrValidation struct {
+	Err error
+}
+
+func (e *ErrValidation) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ErrValidation) Unwrap() error {
+	return e.Err
+}
+
+// ErrFetch indicates that the original message couldn't be retrieved from S3.
+type ErrFetch struct {
+	Err error
+}
+
+func (e *ErrFetch) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ErrFetch) Unwrap() error {
+	return e.Err
+}
+
+// ErrTransform indicates that the original message couldn't be parsed or
+// rewritten for forwarding.
+type ErrTransform struct {
+	Err error
+}
+
+func (e *ErrTransform) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ErrTransform) Unwrap() error {
+	return e.Err
+}
+
+// ErrForward indicates that sending the rewritten message, or a DMARC bounce,
+// via SES failed.
+type ErrForward struct {
+	Err error
+}
+
+func (e *ErrForward) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ErrForward) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	sestypes "github.com/aws/aws-sdk-go-v2/service/ses/types"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	sesv2types "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+)
+
+// RawEmail is a prepared message and the envelope information used to send
+// it, independent of the SES API version that sends it.
+//
+// From is the envelope sender, which SES derives from the message's From
+// header if empty. Bcc recipients receive the message without appearing in
+// its headers.
+type RawEmail struct {
+	Data      []byte
+	From      string
+	To        []string
+	Bcc       []string
+	ConfigSet string
+	Tags      []MessageTag
+}
+
+// Forwarder sends a RawEmail, returning the SES message ID of the sent
+// message.
+type Forwarder interface {
+	Forward(ctx context.Context, email *RawEmail) (messageId string, err error)
+}
+
+// forwarder returns the Forwarder selected by SES_API_VERSION.
+func (h *Handler) forwarder() Forwarder {
+	if h.Options.SesApiVersion == SesApiVersionV1 {
+		return &sesV1Forwarder{h}
+	}
+	return &sesV2Forwarder{h}
+}
+
+// sesV2Forwarder sends messages via the SES v2 SendEmail API.
+type sesV2Forwarder struct {
+	h *Handler
+}
+
+func (f *sesV2Forwarder) Forward(
+	ctx context.Context, email *RawEmail,
+) (string, error) {
+	input := &sesv2.SendEmailInput{
+		ConfigurationSetName: aws.String(email.ConfigSet),
+		Content: &sesv2types.EmailContent{
+			Raw: &sesv2types.RawMessage{Data: email.Data},
+		},
+		Destination: &sesv2types.Destination{
+			ToAddresses:  email.To,
+			BccAddresses: email.Bcc,
+		},
+	}
+	if email.From != "" {
+		input.FromEmailAddress = aws.String(email.From)
+	}
+	for _, tag := range email.Tags {
+		input.EmailTags = append(input.EmailTags, sesv2types.MessageTag{
+			Name: aws.String(tag.Name), Value: aws.String(tag.Value),
+		})
+	}
+
+	output, err := f.h.sendEmailToConfigSet(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(output.MessageId), nil
+}
+
+// sesV1Forwarder sends messages via the SES v1 SendRawEmail API.
+//
+// SendRawEmail has no separate Bcc field, so the Bcc recipients become
+// additional Destinations. Unlike sesV2Forwarder, it doesn't apply
+// FALLBACK_NO_CONFIG_SET.
+//
+// - https://docs.aws.amazon.com/ses/latest/APIReference/API_SendRawEmail.html
+type sesV1Forwarder struct {
+	h *Handler
+}
+
+func (f *sesV1Forwarder) Forward(
+	ctx context.Context, email *RawEmail,
+) (string, error) {
+	input := &ses.SendRawEmailInput{
+		RawMessage:   &sestypes.RawMessage{Data: email.Data},
+		Destinations: append(append([]string{}, email.To...), email.Bcc...),
+	}
+	if email.ConfigSet != "" {
+		input.ConfigurationSetName = aws.String(email.ConfigSet)
+	}
+	if email.From != "" {
+		input.Source = aws.String(email.From)
+	}
+	for _, tag := range email.Tags {
+		input.Tags = append(input.Tags, sestypes.MessageTag{
+			Name: aws.String(tag.Name), Value: aws.String(tag.Value),
+		})
+	}
+
+	output, err := f.h.sendRawEmail(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(output.MessageId), nil
+}
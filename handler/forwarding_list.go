@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// forwardingListTtl determines how long the forwarding list retrieved from
+// FORWARDING_LIST_S3 remains cached before it's retrieved again.
+// CONFIG_CACHE_TTL overrides it.
+const forwardingListTtl = 5 * time.Minute
+
+// maxSesDestinations is the most recipients SES accepts for a single message.
+//
+// - https://docs.aws.amazon.com/ses/latest/dg/quotas.html
+const maxSesDestinations = 50
+
+type forwardingListCache struct {
+	mu        sync.Mutex
+	addresses []string
+	expires   time.Time
+}
+
+// forwardingAddresses returns the ForwardingAddress plus any addresses from the
+// FORWARDING_LIST_S3 object, without duplicates.
+func (h *Handler) forwardingAddresses(ctx context.Context) ([]string, error) {
+	if h.Options.ForwardingListS3 == "" {
+		return []string{h.Options.ForwardingAddress}, nil
+	}
+	return h.forwardingList(ctx)
+}
+
+// forwardingList returns the cached forwarding addresses, retrieving the
+// FORWARDING_LIST_S3 object again once the cache expires. If retrieving it
+// fails after a prior success, it returns the last good list, and tries again
+// on the next call.
+func (h *Handler) forwardingList(ctx context.Context) ([]string, error) {
+	cache := &h.forwardingListCache
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := h.now()
+	if cache.addresses != nil && now.Before(cache.expires) {
+		return cache.addresses, nil
+	}
+
+	list, err := h.getForwardingList(ctx)
+	if err != nil && cache.addresses != nil {
+		h.logf(ctx, "WARNING: using last good forwarding list: %s", err)
+		return cache.addresses, nil
+	} else if err != nil {
+		return nil, err
+	}
+	cache.addresses = list
+	cache.expires = now.Add(h.cacheTtl(forwardingListTtl))
+	return list, nil
+}
+
+func (h *Handler) getForwardingList(
+	ctx context.Context,
+) (list []string, err error) {
+	ctx, cancel := withTimeout(ctx, h.Options.S3Timeout)
+	defer cancel()
+
+	input := &s3.GetObjectInput{
+		Bucket:       aws.String(h.Options.BucketName),
+		Key:          aws.String(h.Options.ForwardingListS3),
+		RequestPayer: h.requestPayer(),
+	}
+	var output *s3.GetObjectOutput
+	var content []byte
+
+	if output, err = h.getObject(ctx, input); err == nil {
+		defer output.Body.Close()
+		if content, err = io.ReadAll(output.Body); err == nil {
+			list, err = parseForwardingList(content)
+		}
+	}
+	if err == nil {
+		list, err = h.addForwardingAddress(list)
+	}
+	if err != nil {
+		err = &ErrFetch{fmt.Errorf("failed to get forwarding list: %w", err)}
+	}
+	return
+}
+
+// addForwardingAddress returns the ForwardingAddress followed by the
+// addresses from list, without duplicates. Addresses that differ only in case
+// per normalizeAddress are duplicates, and the first one listed is kept.
+//
+// It returns an error if there are more than maxSesDestinations addresses,
+// since SES would reject every message sent to them. Checking here, as well as
+// in forwardMessage, keeps the last good list in use if the new one is too
+// long.
+func (h *Handler) addForwardingAddress(list []string) ([]string, error) {
+	caseSensitive := h.Options.CaseSensitiveLocalpart
+	seen := map[string]bool{
+		normalizeAddress(h.Options.ForwardingAddress, caseSensitive): true,
+	}
+	addresses := []string{h.Options.ForwardingAddress}
+
+	for _, addr := range list {
+		if key := normalizeAddress(addr, caseSensitive); !seen[key] {
+			seen[key] = true
+			addresses = append(addresses, addr)
+		}
+	}
+	if len(addresses) > maxSesDestinations {
+		return nil, fmt.Errorf(
+			"%d addresses, including FORWARDING_ADDRESS, "+
+				"exceed the SES limit of %d recipients",
+			len(addresses), maxSesDestinations,
+		)
+	}
+	return addresses, nil
+}
+
+// parseForwardingList parses newline-separated addresses, ignoring blank lines
+// and lines beginning with "#".
+func parseForwardingList(content []byte) ([]string, error) {
+	list := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		} else if addr, err := mail.ParseAddress(line); err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", lineNum, line, err)
+		} else {
+			list = append(list, addr.Address)
+		}
+	}
+	return list, scanner.Err()
+}
@@ -0,0 +1,283 @@
+//go:build small_tests || all_tests
+
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/mbland/ses-forwarder/handler/handlertest"
+	"gotest.tools/assert"
+)
+
+const forwardingListKey = "config/forwarding-list"
+
+const forwardingList = `
+# Team members
+foo@xyzzy.com
+Bar <bar@xyzzy.com>
+
+quux@xyzzy.com
+`
+
+func TestParseForwardingList(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		list, err := parseForwardingList([]byte(forwardingList))
+
+		assert.NilError(t, err)
+		assert.DeepEqual(
+			t,
+			list,
+			[]string{"foo@xyzzy.com", "bar@xyzzy.com", "quux@xyzzy.com"},
+		)
+	})
+
+	t.Run("ErrorsIfAddressInvalid", func(t *testing.T) {
+		list, err := parseForwardingList([]byte("foo@xyzzy.com\nnot valid\n"))
+
+		assert.Assert(t, list == nil)
+		assert.ErrorContains(t, err, "line 2: not valid: ")
+	})
+}
+
+func TestForwardingAddresses(t *testing.T) {
+	setup := func() (
+		*handlertest.S3, *Handler, *time.Time, context.Context,
+	) {
+		objS3 := &handlertest.S3{
+			Objects: map[string][]byte{
+				forwardingListKey: []byte(forwardingList),
+			},
+		}
+		now := time.Date(1970, time.September, 18, 12, 45, 0, 0, time.UTC)
+		h := &Handler{
+			S3: objS3,
+			Options: &Options{
+				BucketName:        "mail.xyzzy.com",
+				ForwardingAddress: "quux@xyzzy.com",
+				ForwardingListS3:  forwardingListKey,
+			},
+			Now: func() time.Time { return now },
+		}
+		return objS3, h, &now, context.Background()
+	}
+
+	t.Run("ReturnsOnlyForwardingAddressIfNoListConfigured", func(t *testing.T) {
+		objS3, h, _, ctx := setup()
+		h.Options.ForwardingListS3 = ""
+
+		addrs, err := h.forwardingAddresses(ctx)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, addrs, []string{"quux@xyzzy.com"})
+		assert.Equal(t, len(objS3.GetObjectInputs), 0)
+	})
+
+	t.Run("ReturnsUnionOfForwardingAddressAndList", func(t *testing.T) {
+		objS3, h, _, ctx := setup()
+
+		addrs, err := h.forwardingAddresses(ctx)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(
+			t,
+			addrs,
+			[]string{"quux@xyzzy.com", "foo@xyzzy.com", "bar@xyzzy.com"},
+		)
+		assert.Equal(t, len(objS3.GetObjectInputs), 1)
+		assert.Equal(t, *objS3.GetObjectInputs[0].Key, forwardingListKey)
+		assert.Equal(
+			t, objS3.GetObjectInputs[0].RequestPayer, s3types.RequestPayer(""),
+		)
+	})
+
+	t.Run("DropsDuplicatesDifferingOnlyInCase", func(t *testing.T) {
+		objS3, h, _, ctx := setup()
+		objS3.Objects[forwardingListKey] = []byte(
+			"Quux@XYZZY.com\nfoo@xyzzy.com\nFOO@xyzzy.com\n",
+		)
+
+		addrs, err := h.forwardingAddresses(ctx)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, addrs, []string{"quux@xyzzy.com", "foo@xyzzy.com"})
+	})
+
+	t.Run("KeepsLocalpartsDifferingInCaseIfCaseSensitive",
+		func(t *testing.T) {
+			objS3, h, _, ctx := setup()
+			h.Options.CaseSensitiveLocalpart = true
+			objS3.Objects[forwardingListKey] = []byte(
+				"quux@XYZZY.com\nfoo@xyzzy.com\nFOO@xyzzy.com\n",
+			)
+
+			addrs, err := h.forwardingAddresses(ctx)
+
+			assert.NilError(t, err)
+			assert.DeepEqual(
+				t,
+				addrs,
+				[]string{"quux@xyzzy.com", "foo@xyzzy.com", "FOO@xyzzy.com"},
+			)
+		},
+	)
+
+	t.Run("SetsRequestPayerIfRequesterPays", func(t *testing.T) {
+		objS3, h, _, ctx := setup()
+		h.Options.RequesterPays = true
+
+		_, err := h.forwardingAddresses(ctx)
+
+		assert.NilError(t, err)
+		requestPayer := objS3.GetObjectInputs[0].RequestPayer
+		assert.Equal(t, requestPayer, s3types.RequestPayerRequester)
+	})
+
+	t.Run("CachesListUntilTtlExpires", func(t *testing.T) {
+		objS3, h, now, ctx := setup()
+
+		_, err := h.forwardingAddresses(ctx)
+		assert.NilError(t, err)
+		objS3.Objects[forwardingListKey] = []byte("plugh@xyzzy.com")
+		*now = now.Add(forwardingListTtl - time.Second)
+
+		addrs, err := h.forwardingAddresses(ctx)
+
+		assert.NilError(t, err)
+		assert.Equal(t, len(addrs), 3)
+		assert.Equal(t, len(objS3.GetObjectInputs), 1)
+
+		*now = now.Add(time.Second)
+
+		addrs, err = h.forwardingAddresses(ctx)
+
+		assert.NilError(t, err)
+		expected := []string{"quux@xyzzy.com", "plugh@xyzzy.com"}
+		assert.DeepEqual(t, addrs, expected)
+		assert.Equal(t, len(objS3.GetObjectInputs), 2)
+	})
+
+	t.Run("CachesListUntilConfigCacheTtlExpires", func(t *testing.T) {
+		objS3, h, now, ctx := setup()
+		h.Options.ConfigCacheTtl = time.Minute
+
+		_, err := h.forwardingAddresses(ctx)
+		assert.NilError(t, err)
+		objS3.Objects[forwardingListKey] = []byte("plugh@xyzzy.com")
+		*now = now.Add(time.Minute)
+
+		addrs, err := h.forwardingAddresses(ctx)
+
+		assert.NilError(t, err)
+		expected := []string{"quux@xyzzy.com", "plugh@xyzzy.com"}
+		assert.DeepEqual(t, addrs, expected)
+		assert.Equal(t, len(objS3.GetObjectInputs), 2)
+	})
+
+	t.Run("KeepsLastGoodListIfRefreshFails", func(t *testing.T) {
+		objS3, h, now, ctx := setup()
+		logs, logger := testLogger()
+		h.Log = logger
+
+		_, err := h.forwardingAddresses(ctx)
+		assert.NilError(t, err)
+		delete(objS3.Objects, forwardingListKey)
+		*now = now.Add(forwardingListTtl)
+
+		addrs, err := h.forwardingAddresses(ctx)
+
+		assert.NilError(t, err)
+		assert.Equal(t, len(addrs), 3)
+		assert.Equal(t, len(objS3.GetObjectInputs), 2)
+		assertLogsContain(
+			t, logs, "WARNING: using last good forwarding list: "+
+				"failed to get forwarding list: NoSuchKey: no such key",
+		)
+
+		objS3.Objects[forwardingListKey] = []byte("plugh@xyzzy.com")
+
+		addrs, err = h.forwardingAddresses(ctx)
+
+		assert.NilError(t, err)
+		expected := []string{"quux@xyzzy.com", "plugh@xyzzy.com"}
+		assert.DeepEqual(t, addrs, expected)
+		assert.Equal(t, len(objS3.GetObjectInputs), 3)
+	})
+
+	t.Run("ErrorsIfListExceedsSesDestinationLimit", func(t *testing.T) {
+		objS3, h, _, ctx := setup()
+		list := &strings.Builder{}
+		for i := 0; i < maxSesDestinations; i++ {
+			fmt.Fprintf(list, "user%d@xyzzy.com\n", i)
+		}
+		objS3.Objects[forwardingListKey] = []byte(list.String())
+
+		addrs, err := h.forwardingAddresses(ctx)
+
+		assert.Assert(t, addrs == nil)
+		expected := "failed to get forwarding list: 51 addresses, including " +
+			"FORWARDING_ADDRESS, exceed the SES limit of 50 recipients"
+		assert.ErrorContains(t, err, expected)
+		var fetchErr *ErrFetch
+		assert.Assert(t, errors.As(err, &fetchErr))
+	})
+
+	t.Run("AllowsListAtSesDestinationLimit", func(t *testing.T) {
+		objS3, h, _, ctx := setup()
+		list := &strings.Builder{}
+		for i := 0; i < maxSesDestinations-1; i++ {
+			fmt.Fprintf(list, "user%d@xyzzy.com\n", i)
+		}
+		list.WriteString("QUUX@xyzzy.com\n")
+		objS3.Objects[forwardingListKey] = []byte(list.String())
+
+		addrs, err := h.forwardingAddresses(ctx)
+
+		assert.NilError(t, err)
+		assert.Equal(t, len(addrs), maxSesDestinations)
+	})
+
+	t.Run("ErrorsIfGettingListFails", func(t *testing.T) {
+		objS3, h, _, ctx := setup()
+		delete(objS3.Objects, forwardingListKey)
+
+		addrs, err := h.forwardingAddresses(ctx)
+
+		assert.Assert(t, addrs == nil)
+		expected := "failed to get forwarding list: NoSuchKey: no such key"
+		assert.ErrorContains(t, err, expected)
+		assert.Assert(t, errors.Is(err, handlertest.ErrNoSuchKey))
+		var fetchErr *ErrFetch
+		assert.Assert(t, errors.As(err, &fetchErr))
+	})
+}
+
+func TestForwardToForwardingList(t *testing.T) {
+	f := newHandleEventFixture()
+	f.h.Options.ForwardingListS3 = forwardingListKey
+	f.h.S3 = &handlertest.S3{
+		Objects: map[string][]byte{
+			"incoming/deadbeef": testMsg,
+			forwardingListKey:   []byte(forwardingList),
+		},
+	}
+
+	_, err := f.h.HandleEvent(context.Background(), f.event)
+
+	assert.NilError(t, err)
+	assert.DeepEqual(
+		t,
+		f.sesv2.sendEmailInput.Destination.ToAddresses,
+		[]string{
+			f.h.Options.ForwardingAddress,
+			"foo@xyzzy.com",
+			"bar@xyzzy.com",
+			"quux@xyzzy.com",
+		},
+	)
+}
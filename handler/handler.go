@@ -1,101 +1,511 @@
 package handler
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"mime"
 	"net/mail"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/aws-sdk-go-v2/service/ses"
 	sestypes "github.com/aws/aws-sdk-go-v2/service/ses/types"
 	"github.com/aws/aws-sdk-go-v2/service/sesv2"
-	sesv2types "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+	"github.com/aws/smithy-go"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type S3Api interface {
 	GetObject(
 		context.Context, *s3.GetObjectInput, ...func(*s3.Options),
 	) (*s3.GetObjectOutput, error)
+	PutObject(
+		context.Context, *s3.PutObjectInput, ...func(*s3.Options),
+	) (*s3.PutObjectOutput, error)
+}
+
+// S3PresignApi is required only if DETACH_ATTACHMENTS_LINK_TTL is set.
+type S3PresignApi interface {
+	PresignGetObject(
+		context.Context, *s3.GetObjectInput, ...func(*s3.PresignOptions),
+	) (*v4.PresignedHTTPRequest, error)
 }
 
 type SesApi interface {
 	SendBounce(
 		context.Context, *ses.SendBounceInput, ...func(*ses.Options),
 	) (*ses.SendBounceOutput, error)
+	SendRawEmail(
+		context.Context, *ses.SendRawEmailInput, ...func(*ses.Options),
+	) (*ses.SendRawEmailOutput, error)
 }
 
 type SesV2Api interface {
 	SendEmail(
 		context.Context, *sesv2.SendEmailInput, ...func(*sesv2.Options),
 	) (*sesv2.SendEmailOutput, error)
+	GetConfigurationSet(
+		context.Context,
+		*sesv2.GetConfigurationSetInput,
+		...func(*sesv2.Options),
+	) (*sesv2.GetConfigurationSetOutput, error)
+	GetEmailIdentity(
+		context.Context,
+		*sesv2.GetEmailIdentityInput,
+		...func(*sesv2.Options),
+	) (*sesv2.GetEmailIdentityOutput, error)
 }
 
 type Handler struct {
-	S3      S3Api
-	Ses     SesApi
-	SesV2   SesV2Api
-	Options *Options
-	Log     *log.Logger
+	S3        S3Api
+	S3Presign S3PresignApi
+	Ses       SesApi
+	SesV2     SesV2Api
+	Options   *Options
+	Log       *log.Logger
+
+	// Now returns the current time. Defaults to time.Now if nil.
+	Now func() time.Time
+
+	// Sleep pauses before retrying a throttled AWS operation, or before
+	// sending a message to stay within SEND_RATE_PER_SEC. Defaults to
+	// waiting for the duration or for ctx to be done if nil.
+	Sleep func(ctx context.Context, d time.Duration) error
+
+	// RequestId returns the ID of the current invocation, which prefixes
+	// every log line. Defaults to the Lambda request ID from the context if
+	// nil.
+	RequestId func(context.Context) string
+
+	// Tracer creates spans around the stages of processing each message.
+	// Defaults to a no-op tracer if nil.
+	Tracer trace.Tracer
+
+	// HttpClient POSTs messages to WEBHOOK_URL if FORWARD_TARGET is "http".
+	// Defaults to http.DefaultClient if nil.
+	HttpClient HttpApi
+
+	forwardingListCache forwardingListCache
+	routingMapCache     routingMapCache
+	senderIdentityCache senderIdentityCache
+	tlsPolicyVerified   sync.Map
+	sendRate            sendRateLimiter
+}
+
+func (h *Handler) now() time.Time {
+	if h.Now == nil {
+		return time.Now()
+	}
+	return h.Now()
+}
+
+// cacheTtl returns CONFIG_CACHE_TTL if set, or defaultTtl otherwise.
+func (h *Handler) cacheTtl(defaultTtl time.Duration) time.Duration {
+	if h.Options.ConfigCacheTtl != 0 {
+		return h.Options.ConfigCacheTtl
+	}
+	return defaultTtl
+}
+
+func (h *Handler) requestId(ctx context.Context) string {
+	if h.RequestId != nil {
+		return h.RequestId(ctx)
+	} else if lc, ok := lambdacontext.FromContext(ctx); ok {
+		return lc.AwsRequestID
+	}
+	return ""
+}
+
+// correlationIdKey is the context.Context key for the correlation ID added
+// by withCorrelationId.
+type correlationIdKey struct{}
+
+// withCorrelationId returns a copy of ctx causing logf to prefix each line
+// with id, after the request ID.
+//
+// processMessage uses the SES message ID, which is also the original message's
+// S3 key suffix, to make it possible to correlate all the lines for a single
+// message from an event containing multiple records.
+func withCorrelationId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIdKey{}, id)
+}
+
+// logf prefixes each log line with the request ID, if any, to make it possible
+// to correlate all the lines for every record from the same event. It then
+// adds the correlation ID from withCorrelationId, if any.
+func (h *Handler) logf(ctx context.Context, format string, v ...any) {
+	if id, _ := ctx.Value(correlationIdKey{}).(string); id != "" {
+		format = "[" + id + "] " + format
+	}
+	if reqId := h.requestId(ctx); reqId != "" {
+		format = "[" + reqId + "] " + format
+	}
+	h.Log.Printf(format, v...)
+}
+
+// EventStats summarizes the outcome of processing each record from a single
+// SES event.
+type EventStats struct {
+	// Processed is the number of records in the event.
+	Processed int
+
+	// Forwarded is the number of messages forwarded successfully.
+	Forwarded int
+
+	// Dropped is the number of records intentionally not forwarded, due to
+	// failed validation or duplicate or missing message IDs.
+	Dropped int
+
+	// Failed is the number of messages that couldn't be forwarded due to
+	// errors.
+	Failed int
 }
 
 func (h *Handler) HandleEvent(
 	ctx context.Context, e *events.SimpleEmailEvent,
 ) (*events.SimpleEmailDisposition, error) {
+	disposition, _, err := h.HandleEventWithStats(ctx, e)
+	return disposition, err
+}
+
+// HandleEventWithStats is the same as HandleEvent, but also returns the
+// EventStats for the event, since events.SimpleEmailDisposition can't carry
+// them.
+func (h *Handler) HandleEventWithStats(
+	ctx context.Context, e *events.SimpleEmailEvent,
+) (*events.SimpleEmailDisposition, *EventStats, error) {
 	if len(e.Records) == 0 {
-		return nil, fmt.Errorf("SES event contained no records: %+v", e)
+		err := fmt.Errorf("SES event contained no records: %+v", e)
+		return nil, nil, err
 	}
 
+	// SES occasionally delivers the same message more than once within the
+	// same event, so only process the first record for each message ID.
+	seen := make(map[string]bool, len(e.Records))
+	stats := &EventStats{Processed: len(e.Records)}
+
 	for i := range e.Records {
-		h.processMessage(ctx, &e.Records[i].SES)
+		sesInfo := &e.Records[i].SES
+		msgId := sesInfo.Mail.MessageID
+
+		if msgId != "" && seen[msgId] {
+			h.logf(ctx, "skipping duplicate record for message %s", msgId)
+			stats.Dropped++
+			continue
+		}
+		seen[msgId] = true
+
+		// The result carries the error, which processMessage already logged.
+		result, _ := h.processMessage(ctx, sesInfo)
+		stats.record(result)
 	}
 
-	return &events.SimpleEmailDisposition{
+	disposition := &events.SimpleEmailDisposition{
 		Disposition: events.SimpleEmailStopRuleSet,
-	}, nil
+	}
+	return disposition, stats, nil
+}
+
+func (stats *EventStats) record(result ProcessResult) {
+	if result.Err == nil {
+		stats.Forwarded++
+	} else if result.Dropped {
+		stats.Dropped++
+	} else {
+		stats.Failed++
+	}
+}
+
+// ErrInvalidMessageId indicates that an SES message ID contains characters
+// that SES never uses, so it can't name an object under INCOMING_PREFIX.
+var ErrInvalidMessageId = errors.New("invalid message ID")
+
+// validMessageId matches SES message IDs, which in practice consist of ASCII
+// letters and digits. It also allows, but doesn't begin with, dots, dashes,
+// and underscores. This rejects IDs that could escape INCOMING_PREFIX, such as
+// "../foo", instead of issuing a GetObject request that's bound to fail.
+var validMessageId = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// ProcessResult describes the outcome of processing a single SES record, so
+// the caller can aggregate the outcomes for every record from an event.
+type ProcessResult struct {
+	// Key is the S3 object key of the original message. It's empty if the
+	// record's message ID was empty or invalid.
+	Key string
+
+	// MessageId is the SES message ID from the record.
+	MessageId string
+
+	// ForwardedId identifies the forwarded message, per ForwardTarget: the
+	// SES message ID, the s3:// URL of the stored copy, or the WEBHOOK_URL
+	// endpoint. It's empty unless the message was forwarded.
+	ForwardedId string
+
+	// Dropped is true if the message was intentionally not forwarded due to
+	// failed validation.
+	Dropped bool
+
+	// Err is the error that prevented forwarding the message, if any.
+	Err error
 }
 
 func (h *Handler) processMessage(
 	ctx context.Context, sesInfo *events.SimpleEmailService,
-) {
+) (result ProcessResult, err error) {
+	result.MessageId = sesInfo.Mail.MessageID
+	defer func() {
+		var validationErr *ErrValidation
+		result.Err = err
+		result.Dropped = errors.As(err, &validationErr)
+	}()
+
+	if sesInfo.Mail.MessageID == "" {
+		h.logf(ctx, "skipping record with empty message ID")
+		return result, &ErrValidation{errors.New("empty message ID")}
+	} else if !validMessageId.MatchString(sesInfo.Mail.MessageID) {
+		msgId := strconv.Quote(sesInfo.Mail.MessageID)
+		h.logf(ctx, "skipping record with invalid message ID %s", msgId)
+		err = fmt.Errorf("%w: %s", ErrInvalidMessageId, msgId)
+		return result, &ErrValidation{err}
+	}
+
+	ctx = withCorrelationId(ctx, sesInfo.Mail.MessageID)
 	key := h.Options.IncomingPrefix + "/" + sesInfo.Mail.MessageID
-	logErr := func(err error) {
-		h.Log.Printf("failed to forward message %s: %s", key, err)
+	result.Key = key
+	logErr := func(e error) {
+		err = e
+		h.logf(ctx, "failed to forward message %s: %s", key, err)
 	}
 
-	h.Log.Printf("forwarding message %s", key)
+	h.logf(ctx, "forwarding message %s", key)
 
 	if err := h.validateMessage(ctx, sesInfo); err != nil {
 		logErr(err)
-	} else if orig, err := h.getOriginalMessage(ctx, key); err != nil {
-		logErr(err)
-	} else if updated, err := h.updateMessage(orig, key); err != nil {
+	} else if fwdId, err := h.forwardOriginal(ctx, key, sesInfo); err == nil {
+		result.ForwardedId = fwdId
+		h.logf(ctx, "successfully forwarded message %s as %s", key, fwdId)
+	} else if !h.canForwardUnparseable(err) {
 		logErr(err)
-	} else if fwdId, err := h.forwardMessage(ctx, updated); err != nil {
+	} else if fwdId, err = h.forwardUnparseable(ctx, key, err); err != nil {
 		logErr(err)
 	} else {
-		h.Log.Printf("successfully forwarded message %s as %s", key, fwdId)
+		result.ForwardedId = fwdId
+		h.logf(ctx, "forwarded unparseable message %s as %s", key, fwdId)
+	}
+	return
+}
+
+func (h *Handler) forwardOriginal(
+	ctx context.Context, key string, info *events.SimpleEmailService,
+) (forwardedMessageId string, err error) {
+	orig, err := h.getOriginalMessage(ctx, key)
+	if err != nil {
+		return
+	}
+	defer orig.Close()
+	key = orig.key
+
+	msg, r, err := h.prepareMessage(ctx, orig, key, info, orig.metadata)
+	if err != nil {
+		return "", err
+	}
+	h.writeDebugCopy(ctx, info.Mail.MessageID, msg)
+	h.logHeaders(ctx, key, msg)
+
+	fwdId, err := h.deliverMessage(ctx, info.Mail.MessageID, msg, r)
+	if err == nil {
+		h.emitMetric(metricMessageBytes, "Bytes", float64(len(msg)))
+	}
+	return fwdId, err
+}
+
+// deliverMessage sends the prepared message via SES, stores it in DestBucket
+// if ForwardTarget is ForwardTargetS3, or POSTs it to WebhookUrl if
+// ForwardTarget is ForwardTargetHttp.
+func (h *Handler) deliverMessage(
+	ctx context.Context, messageId string, msg []byte, r *route,
+) (string, error) {
+	switch h.Options.ForwardTarget {
+	case ForwardTargetS3:
+		return h.storeMessage(ctx, messageId, msg)
+	case ForwardTargetHttp:
+		return h.postWebhook(ctx, messageId, msg, r)
+	}
+	return h.forwardMessage(ctx, msg, r)
+}
+
+// writeDebugCopy writes the prepared message to DebugWritePrefix, if set.
+// Failures are only logged, since they shouldn't prevent forwarding.
+func (h *Handler) writeDebugCopy(
+	ctx context.Context, messageId string, msg []byte,
+) {
+	if h.Options.DebugWritePrefix == "" {
+		return
+	}
+
+	key := h.Options.DebugWritePrefix + "/" + messageId
+	input := &s3.PutObjectInput{
+		Bucket:       aws.String(h.Options.BucketName),
+		Key:          aws.String(key),
+		Body:         bytes.NewReader(msg),
+		RequestPayer: h.requestPayer(),
+	}
+
+	if _, err := h.S3.PutObject(ctx, input); err != nil {
+		h.logf(ctx, "failed to write debug copy %s: %s", key, err)
+	} else {
+		h.logf(ctx, "wrote debug copy %s", key)
+	}
+}
+
+// storeMessage writes the prepared message to DestBucket under DestPrefix
+// instead of sending it, returning its s3:// URL.
+func (h *Handler) storeMessage(
+	ctx context.Context, messageId string, msg []byte,
+) (storedPath string, err error) {
+	key := messageId
+	if h.Options.DestPrefix != "" {
+		key = h.Options.DestPrefix + "/" + messageId
+	}
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(h.Options.DestBucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(msg),
+	}
+	path := "s3://" + h.Options.DestBucket + "/" + key
+
+	if _, err = h.S3.PutObject(ctx, input); err != nil {
+		err = &ErrForward{fmt.Errorf("failed to store %s: %w", path, err)}
+	} else {
+		storedPath = path
+	}
+	return
+}
+
+// maxLoggedHeaderLineLen limits the length of each header line logged by
+// logHeaders, since some headers, such as DKIM-Signature, can be very long.
+const maxLoggedHeaderLineLen = 256
+
+// logHeaders logs the prepared message's header block, but never its body,
+// if LogHeaders is set.
+func (h *Handler) logHeaders(ctx context.Context, key string, msg []byte) {
+	if !h.Options.LogHeaders {
+		return
 	}
+
+	header, _, _ := bytes.Cut(msg, []byte("\r\n\r\n"))
+	lines := strings.Split(string(header), "\r\n")
+
+	for i, line := range lines {
+		if len(line) > maxLoggedHeaderLineLen {
+			end := maxLoggedHeaderLineLen
+			for end > 0 && !utf8.RuneStart(line[end]) {
+				end--
+			}
+			lines[i] = line[:end] + "...(truncated)"
+		}
+	}
+	h.logf(ctx, "headers for %s:\n%s", key, strings.Join(lines, "\n"))
 }
 
 func (h *Handler) validateMessage(
 	ctx context.Context, info *events.SimpleEmailService,
+) (err error) {
+	var bounceId string
+	var verdicts []string
+
+	// Some receipt rule configurations may produce receipts without
+	// recipients, leaving routing and DMARC bounces with nothing to use.
+	if len(info.Receipt.Recipients) == 0 {
+		h.logf(ctx, "no recipients in receipt")
+		if h.Options.EmptyRecipientsAction == EmptyRecipientsActionDrop {
+			return &ErrValidation{errors.New("no recipients in receipt")}
+		}
+	}
+
+	if age, stale := h.isStaleReceipt(&info.Receipt); stale {
+		err = &ErrValidation{fmt.Errorf(
+			"possible replay: receipt is %s old, exceeding REPLAY_WINDOW %s",
+			age.Truncate(time.Second), h.Options.ReplayWindow,
+		)}
+	} else if h.isSelfOriginated(info.Mail.CommonHeaders.From) {
+		err = &ErrValidation{errors.New("dropping self-originated message")}
+	} else if h.isPostmasterMessage(info.Receipt.Recipients) {
+		// The bypass mustn't become a way to deliver malware.
+		if isVirus(&info.Receipt) {
+			err = &ErrValidation{errors.New("virus detected, ignoring")}
+		}
+		return
+	} else if err = h.checkRouteEnabled(ctx, info); err != nil {
+		return
+	} else if mediaType, ok := h.isAllowedContentType(info); !ok {
+		err = &ErrValidation{
+			errors.New("content type not allowed: " + mediaType),
+		}
+	} else if bounceId, err = h.bounceIfDmarcFails(ctx, info); err != nil {
+		return
+	} else if bounceId != "" {
+		err = &ErrValidation{
+			errors.New("DMARC bounced with bounce ID: " + bounceId),
+		}
+	} else if h.Options.SpamAction == SpamActionTag {
+		// Tagging only suits spam. Forwarding malware is never acceptable.
+		if isVirus(&info.Receipt) {
+			err = &ErrValidation{errors.New("virus detected, ignoring")}
+		}
+		return
+	} else if verdicts, err = h.spamVerdicts(ctx, info); err != nil {
+		return
+	} else if isSpam(&info.Receipt, verdicts) {
+		err = &ErrValidation{errors.New("marked as spam, ignoring")}
+	}
+	return
+}
+
+// checkRouteEnabled returns an ErrValidation if the ROUTING_MAP_S3 entry for
+// the first matching recipient is disabled.
+func (h *Handler) checkRouteEnabled(
+	ctx context.Context, info *events.SimpleEmailService,
 ) error {
-	if bounceId, err := h.bounceIfDmarcFails(ctx, info); err != nil {
+	entry, err := h.routingMapEntry(ctx, info.Receipt.Recipients)
+	if err != nil {
 		return err
-	} else if bounceId != "" {
-		return errors.New("DMARC bounced with bounce ID: " + bounceId)
-	} else if isSpam(info) {
-		return errors.New("marked as spam, ignoring")
+	} else if !entry.disabled() {
+		return nil
 	}
-	return nil
+	h.logf(ctx, "ROUTING_MAP_S3 entry disabled, not forwarding")
+	return &ErrValidation{errors.New("routing map entry disabled, dropping")}
+}
+
+// spamVerdicts returns the spamVerdicts from the ROUTING_MAP_S3 entry for the
+// first matching recipient, falling back to SPAM_VERDICTS.
+func (h *Handler) spamVerdicts(
+	ctx context.Context, info *events.SimpleEmailService,
+) ([]string, error) {
+	entry, err := h.routingMapEntry(ctx, info.Receipt.Recipients)
+	if err != nil {
+		return nil, err
+	} else if len(entry.SpamVerdicts) != 0 {
+		return entry.SpamVerdicts, nil
+	}
+	return h.Options.SpamVerdicts, nil
 }
 
 // https://docs.aws.amazon.com/ses/latest/dg/receiving-email-action-lambda-example-functions.html
@@ -105,11 +515,24 @@ func (h *Handler) bounceIfDmarcFails(
 	verdict := strings.ToUpper(info.Receipt.DMARCVerdict.Status)
 	policy := strings.ToUpper(info.Receipt.DMARCPolicy)
 
-	if verdict != "FAIL" || policy != "REJECT" {
+	bounceAny := h.Options.DmarcBouncePolicy == DmarcBouncePolicyAny
+
+	if verdict != "FAIL" || (policy != "REJECT" && !bounceAny) {
 		return
 	}
 
 	recipients := info.Receipt.Recipients
+	if len(recipients) == 0 {
+		h.logf(
+			ctx,
+			"WARNING: not bouncing message %s: no recipients in SES receipt",
+			info.Mail.MessageID,
+		)
+		err = &ErrValidation{
+			errors.New("DMARC failed, but no recipients to bounce"),
+		}
+		return
+	}
 	recipientInfo := make([]sestypes.BouncedRecipientInfo, len(recipients))
 
 	for i, recipient := range recipients {
@@ -123,8 +546,8 @@ func (h *Handler) bounceIfDmarcFails(
 		),
 		OriginalMessageId: aws.String(info.Mail.MessageID),
 		MessageDsn: &sestypes.MessageDsn{
-			ReportingMta: aws.String("dns; " + h.Options.EmailDomainName),
-			ArrivalDate:  aws.Time(time.Now().Truncate(time.Second)),
+			ReportingMta: aws.String(h.reportingMta()),
+			ArrivalDate:  aws.Time(h.now().Truncate(time.Second)),
 		},
 		Explanation: aws.String(
 			"Unauthenticated email is not accepted due to " +
@@ -134,82 +557,864 @@ func (h *Handler) bounceIfDmarcFails(
 	}
 	var output *ses.SendBounceOutput
 
-	if output, err = h.Ses.SendBounce(ctx, input); err != nil {
-		err = fmt.Errorf("DMARC bounce failed: %s", err)
+	if output, err = h.sendBounce(ctx, input); err != nil {
+		// This is an SES failure, not a decision to drop the message, so
+		// EventStats should count it as Failed rather than Dropped.
+		err = &ErrForward{fmt.Errorf("DMARC bounce failed: %w", err)}
 	} else {
 		bounceMessageId = aws.ToString(output.MessageId)
 	}
 	return
 }
 
-// https://docs.aws.amazon.com/ses/latest/dg/receiving-email-action-lambda-example-functions.html
-func isSpam(info *events.SimpleEmailService) bool {
-	receipt := &info.Receipt
-	return strings.ToUpper(receipt.SPFVerdict.Status) == "FAIL" ||
-		strings.ToUpper(receipt.DKIMVerdict.Status) == "FAIL" ||
-		strings.ToUpper(receipt.SpamVerdict.Status) == "FAIL" ||
-		strings.ToUpper(receipt.VirusVerdict.Status) == "FAIL"
+// https://www.rfc-editor.org/rfc/rfc3464#section-2.2.2
+func (h *Handler) reportingMta() string {
+	if h.Options.ReportingMta != "" {
+		return h.Options.ReportingMta
+	}
+	return "dns; " + h.Options.EmailDomainName
 }
 
+// isSpam checks only the named verdicts, or all SpamVerdicts if verdicts is
+// empty. A failed virus verdict always marks a message as spam, even if
+// verdicts doesn't include SpamVerdictVirus.
+//
+// - https://docs.aws.amazon.com/ses/latest/dg/receiving-email-action-lambda-example-functions.html
+func isSpam(receipt *events.SimpleEmailReceipt, verdicts []string) bool {
+	if len(verdicts) == 0 {
+		verdicts = SpamVerdicts
+	}
+	statuses := map[string]string{
+		SpamVerdictSpf:   receipt.SPFVerdict.Status,
+		SpamVerdictDkim:  receipt.DKIMVerdict.Status,
+		SpamVerdictSpam:  receipt.SpamVerdict.Status,
+		SpamVerdictVirus: receipt.VirusVerdict.Status,
+	}
+
+	if isVirus(receipt) {
+		return true
+	}
+	for _, verdict := range verdicts {
+		if strings.ToUpper(statuses[verdict]) == "FAIL" {
+			return true
+		}
+	}
+	return false
+}
+
+// isVirus returns true if the message failed the SES virus scan.
+func isVirus(receipt *events.SimpleEmailReceipt) bool {
+	return strings.ToUpper(receipt.VirusVerdict.Status) == "FAIL"
+}
+
+// isAligned returns true if the message passed DMARC, meaning SPF or DKIM
+// passed for a domain aligned with its From address. Only then won't
+// forwarding it with its original From header undermine the sender's
+// reputation signals. Passing SPF and DKIM alone isn't enough, since either
+// may pass for an unrelated domain.
+//
+// - https://datatracker.ietf.org/doc/html/rfc7489#section-3.1
+func isAligned(receipt *events.SimpleEmailReceipt) bool {
+	return strings.ToUpper(receipt.DMARCVerdict.Status) == "PASS"
+}
+
+// getOriginalMessage returns a reader that streams the original message from
+// S3, along with its object metadata. Errors from reading the message are
+// wrapped in ErrFetch.
+//
+// S3_TIMEOUT applies to both the GetObject call and streaming the message, so
+// it doesn't expire until the reader is closed.
 func (h *Handler) getOriginalMessage(
 	ctx context.Context, key string,
-) (msg []byte, err error) {
+) (orig *originalMessageReader, err error) {
+	ctx, span := h.startSpan(ctx, "getOriginalMessage")
+	defer func() { endSpan(span, err) }()
+
 	input := &s3.GetObjectInput{
-		Bucket: aws.String(h.Options.BucketName), Key: aws.String(key),
+		Bucket:       aws.String(h.Options.BucketName),
+		Key:          aws.String(key),
+		RequestPayer: h.requestPayer(),
+	}
+	ctx, cancel := withTimeout(ctx, h.Options.S3Timeout)
+
+	output, err := h.getObject(ctx, input)
+	if err != nil && h.Options.KeyFallbacks && isNoSuchKey(err) {
+		output, key, err = h.getFallbackObject(ctx, input, err)
+	}
+	if err != nil {
+		cancel()
+		return nil, newFetchError(err)
+	}
+	return &originalMessageReader{
+		ReadCloser:    output.Body,
+		key:           key,
+		contentLength: output.ContentLength,
+		metadata:      output.Metadata,
+		cancel:        cancel,
+	}, nil
+}
+
+// getFallbackObject tries each of the originalKeyFallbacks for input.Key in
+// turn, returning the first one found along with its key. It returns keyErr,
+// the NoSuchKey error for input.Key, if none of them exist.
+//
+// Some pipelines store messages under a lowercased message ID, or without
+// INCOMING_PREFIX, while SES reports the original mixed case message ID.
+func (h *Handler) getFallbackObject(
+	ctx context.Context, input *s3.GetObjectInput, keyErr error,
+) (*s3.GetObjectOutput, string, error) {
+	key := aws.ToString(input.Key)
+
+	for _, fallback := range originalKeyFallbacks(key) {
+		fallbackInput := *input
+		fallbackInput.Key = aws.String(fallback)
+		output, err := h.getObject(ctx, &fallbackInput)
+
+		if err == nil {
+			h.logf(ctx, "found message %s at fallback key %s", key, fallback)
+			return output, fallback, nil
+		} else if !isNoSuchKey(err) {
+			return nil, "", err
+		}
+	}
+	return nil, "", keyErr
+}
+
+// originalKeyFallbacks returns the keys getFallbackObject tries, in order:
+// key with the message ID lowercased, then the message ID and its lowercased
+// form without the prefix. Duplicates of key and of each other are omitted.
+func originalKeyFallbacks(key string) []string {
+	prefix, messageId, found := cutLast(key, "/")
+	if !found {
+		messageId = prefix
+	}
+	lower := strings.ToLower(messageId)
+	candidates := []string{messageId, lower}
+	if found {
+		candidates = append([]string{prefix + "/" + lower}, candidates...)
+	}
+
+	fallbacks := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		if candidate != key && !slices.Contains(fallbacks, candidate) {
+			fallbacks = append(fallbacks, candidate)
+		}
+	}
+	return fallbacks
+}
+
+func isNoSuchKey(err error) bool {
+	var noSuchKey *s3types.NoSuchKey
+	return errors.As(err, &noSuchKey)
+}
+
+// ErrTruncatedMessage indicates that the original message stream ended before
+// the number of bytes reported by the S3 object's ContentLength.
+var ErrTruncatedMessage = errors.New("truncated message")
+
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/RequesterPaysBuckets.html
+func (h *Handler) requestPayer() s3types.RequestPayer {
+	if h.Options.RequesterPays {
+		return s3types.RequestPayerRequester
+	}
+	return ""
+}
+
+func newFetchError(err error) error {
+	return &ErrFetch{fmt.Errorf("failed to get original message: %w", err)}
+}
+
+// originalMessageReader streams the original message from S3, wrapping read
+// errors in ErrFetch. Message bodies parsed from it stream from it as well, so
+// reading one may also fail with an ErrFetch, which callers should return
+// as is instead of wrapping it in another error type.
+type originalMessageReader struct {
+	io.ReadCloser
+
+	// key is the S3 key of the original message, which differs from the
+	// requested key if getFallbackObject found it at a fallback key.
+	key string
+
+	contentLength int64
+	bytesRead     int64
+
+	// metadata is the S3 object's user-defined metadata.
+	metadata map[string]string
+
+	// cancel releases the S3_TIMEOUT context once the message is closed.
+	cancel context.CancelFunc
+}
+
+func (r *originalMessageReader) Close() error {
+	if r.cancel != nil {
+		defer r.cancel()
 	}
-	var output *s3.GetObjectOutput
+	return r.ReadCloser.Close()
+}
 
-	if output, err = h.S3.GetObject(ctx, input); err == nil {
-		defer output.Body.Close()
-		msg, err = io.ReadAll(output.Body)
+func (r *originalMessageReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	r.bytesRead += int64(n)
+
+	if err == io.EOF && r.contentLength > 0 && r.bytesRead != r.contentLength {
+		err = fmt.Errorf(
+			"%w: read %d of %d bytes",
+			ErrTruncatedMessage,
+			r.bytesRead,
+			r.contentLength,
+		)
+	}
+	if err != nil && err != io.EOF {
+		err = newFetchError(err)
 	}
+	return
+}
+
+// prepareMessage returns the message to forward and its destination addresses.
+//
+// Only the header block is parsed and rewritten in memory. The rest of the
+// message streams directly from orig into the prepared message. All line
+// endings are normalized to "\r\n" along the way, unless Rewrite is
+// RewriteNone.
+//
+// The bodies of delivery status notifications (i.e., bounces), and of other
+// reports if ForwardReports is set, are forwarded untouched, since
+// transforming them could invalidate the report. Their headers are still
+// rewritten, since SES won't send from the original From address. DSNs go to
+// the BounceHandlingAddress if set, or to the ForwardingAddress otherwise.
+func (h *Handler) prepareMessage(
+	ctx context.Context,
+	orig io.Reader,
+	key string,
+	info *events.SimpleEmailService,
+	metadata map[string]string,
+) (prepared []byte, r *route, err error) {
+	// RewriteNone forwards the original byte for byte, apart from the
+	// origLinkHeader.
+	if h.Options.Rewrite != RewriteNone {
+		orig = newCrlfReader(orig)
+	}
+	rawHeader, m, err := splitMessage(orig)
 	if err != nil {
-		err = fmt.Errorf("failed to get original message: %s", err)
+		return
+	} else if origLink := m.Header.Get(origLinkHeader); origLink != "" {
+		// Our own marker means the forwarded message came back to us, unless
+		// another forwarder or a user deliberately sent it again.
+		if !h.Options.AllowReforward {
+			h.logf(ctx, "re-ingested forward, skipping %s: %s", key, origLink)
+			return nil, nil, newForwardingLoopError(origLinkHeader + " present")
+		}
+		h.logf(ctx, "re-forwarding %s, originally %s", key, origLink)
+	}
+
+	isDsn := isDeliveryStatusNotification(m.Header)
+	asIsReport := h.Options.ForwardReports && isReport(m.Header)
+	recipients := info.Receipt.Recipients
+
+	if r, err = h.route(ctx, isDsn, recipients); err != nil {
+		return nil, nil, err
+	} else if !isDsn {
+		h.addSubjectRoutes(r, m.Header)
+	}
+	r.Recipients = recipients
+
+	if err = checkForwardingLoop(r.To, recipients); err != nil {
+		return nil, nil, err
+	} else if !isDsn && !asIsReport && h.Options.Rewrite == RewriteNone {
+		prepared, err = h.addOrigLink(rawHeader, m.Body, key)
+		return
+	} else if !isDsn && !asIsReport {
+		if h.Options.DetachAttachmentsPrefix != "" {
+			if err = h.detachAttachments(ctx, m, key); err != nil {
+				return nil, nil, err
+			}
+		}
+		_, span := h.startSpan(ctx, "updateMessage")
+		prepared, err = h.updateMessage(
+			ctx, m, key, info, r.Sender, metadata,
+		)
+		endSpan(span, err)
+		return
 	}
+
+	if isDsn {
+		h.logf(
+			ctx, "forwarding delivery status notification %s with body intact",
+			key,
+		)
+	} else {
+		h.logf(ctx, "forwarding report %s with body intact", key)
+	}
+	prepared, err = h.updateReport(ctx, m, key, info, r.Sender, metadata)
 	return
 }
 
-func (h *Handler) updateMessage(msg []byte, key string) ([]byte, error) {
-	m, err := mail.ReadMessage(bytes.NewReader(msg))
+// addOrigLink returns the original message unchanged, except for the
+// origLinkHeader appended to its header block, if Rewrite is RewriteNone.
+//
+// The origLinkHeader line ends with "\n" instead of "\r\n" if the header
+// block does, so the message keeps consistent line endings.
+func (h *Handler) addOrigLink(
+	rawHeader []byte, body io.Reader, key string,
+) ([]byte, error) {
+	var consoleLinkRegion string
+	if h.Options.OriginLinkFormat == OriginLinkFormatConsole {
+		consoleLinkRegion = h.Options.AwsRegion
+	}
+	msgPath := h.Options.BucketName + "/" + key
+	link := strings.TrimSuffix(origLinkLine(msgPath, consoleLinkRegion), "\r\n")
+
+	eol := "\r\n"
+	if bytes.HasSuffix(rawHeader, []byte("\n")) &&
+		!bytes.HasSuffix(rawHeader, []byte("\r\n")) {
+		eol = "\n"
+	}
+
+	b := &bytes.Buffer{}
+	b.Write(bytes.TrimRight(rawHeader, "\r\n"))
+	b.WriteString(eol + link + eol + eol)
+
+	if _, err := b.ReadFrom(body); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (h *Handler) route(
+	ctx context.Context, isDsn bool, recipients []string,
+) (*route, error) {
+	if !isDsn && h.isPostmasterMessage(recipients) {
+		return h.newRoute([]string{h.Options.PostmasterForward}), nil
+	} else if !isDsn {
+		return h.recipientRoute(ctx, recipients)
+	} else if h.Options.BounceHandlingAddress != "" {
+		return h.newRoute([]string{h.Options.BounceHandlingAddress}), nil
+	}
+	return h.newRoute([]string{h.Options.ForwardingAddress}), nil
+}
+
+// isStaleReceipt returns the age of the SES receipt timestamp and whether it
+// exceeds ReplayWindow. Unlike the message's Date header, SES sets the receipt
+// timestamp, so a sender can't forge it. A stale receipt suggests that an old
+// S3 object was resubmitted.
+func (h *Handler) isStaleReceipt(
+	receipt *events.SimpleEmailReceipt,
+) (age time.Duration, stale bool) {
+	if h.Options.ReplayWindow == 0 {
+		return 0, false
+	}
+	age = h.now().Sub(receipt.Timestamp)
+	return age, age > h.Options.ReplayWindow
+}
+
+// isSelfOriginated returns true if any From address matches SenderAddress,
+// unless ForwardSelfOriginated is set. Such messages would otherwise loop if
+// SenderAddress's mailbox delivers into the incoming bucket.
+func (h *Handler) isSelfOriginated(from []string) bool {
+	if h.Options.ForwardSelfOriginated {
+		return false
+	}
+	sender, err := mail.ParseAddress(h.Options.SenderAddress)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse message: %s", err)
+		return false
+	}
+	for _, value := range from {
+		addrs, err := mail.ParseAddressList(value)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if h.sameAddress(addr.Address, sender.Address) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isAllowedContentType returns the message's top-level media type and whether
+// it's in ContentTypeAllowlist. All types are allowed if ContentTypeAllowlist
+// is empty. A missing Content-Type header defaults to text/plain.
+//
+// - https://www.rfc-editor.org/rfc/rfc2045#section-5.2
+func (h *Handler) isAllowedContentType(
+	info *events.SimpleEmailService,
+) (mediaType string, ok bool) {
+	if len(h.Options.ContentTypeAllowlist) == 0 {
+		return "", true
+	}
+	mediaType = "text/plain"
+
+	for _, header := range info.Mail.Headers {
+		if !strings.EqualFold(header.Name, "Content-Type") {
+			continue
+		}
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(header.Value); err != nil {
+			return header.Value, false
+		}
+		break
+	}
+	return mediaType, slices.Contains(h.Options.ContentTypeAllowlist, mediaType)
+}
+
+// postmasterMailboxes must always accept mail for the domain.
+//
+// - https://www.rfc-editor.org/rfc/rfc5321#section-4.5.1
+// - https://www.rfc-editor.org/rfc/rfc2142#section-2
+var postmasterMailboxes = []string{"postmaster", "abuse"}
+
+// isPostmasterMessage returns true if PostmasterForward is set and any
+// recipient is one of the postmasterMailboxes at EmailDomainName. Such
+// messages bypass DMARC and spam validation, but not virus scanning, and go to
+// PostmasterForward.
+func (h *Handler) isPostmasterMessage(recipients []string) bool {
+	if h.Options.PostmasterForward == "" {
+		return false
+	}
+	domainName := strings.ToLower(h.Options.EmailDomainName)
+
+	// Postmaster addresses are always case-insensitive, regardless of
+	// CaseSensitiveLocalpart.
+	for _, recipient := range recipients {
+		local, domain, _ := cutLast(normalizeAddress(recipient, false), "@")
+
+		if domain == domainName && slices.Contains(postmasterMailboxes, local) {
+			return true
+		}
+	}
+	return false
+}
+
+func newForwardingLoopError(reason string) error {
+	return &ErrValidation{errors.New("forwarding loop detected: " + reason)}
+}
+
+// normalizeAddress returns addr with its domain lowercased, and its local part
+// lowercased as well unless caseSensitiveLocal is set. Domains are always
+// case-insensitive. RFC 5321 allows case-sensitive local parts, but virtually
+// no mail system treats them that way, so every address comparison should use
+// this function to apply CASE_SENSITIVE_LOCALPART consistently.
+//
+// - https://www.rfc-editor.org/rfc/rfc5321#section-2.4
+func normalizeAddress(addr string, caseSensitiveLocal bool) string {
+	local, domain, found := cutLast(addr, "@")
+	if !caseSensitiveLocal {
+		local = strings.ToLower(local)
+	}
+	if !found {
+		return local
+	}
+	return local + "@" + strings.ToLower(domain)
+}
+
+// sameAddress returns true if a and b are the same address after
+// normalizeAddress applies CaseSensitiveLocalpart.
+func (h *Handler) sameAddress(a, b string) bool {
+	caseSensitive := h.Options.CaseSensitiveLocalpart
+	return normalizeAddress(a, caseSensitive) ==
+		normalizeAddress(b, caseSensitive)
+}
+
+// checkForwardingLoop returns an error if any destination address is also an
+// incoming recipient, since forwarding the message would deliver it back to
+// the forwarder.
+//
+// It always ignores the case of local parts, regardless of
+// CaseSensitiveLocalpart, erring on the side of detecting a loop.
+func checkForwardingLoop(destination, recipients []string) error {
+	for _, dest := range destination {
+		for _, recipient := range recipients {
+			if normalizeAddress(dest, false) ==
+				normalizeAddress(recipient, false) {
+				return newForwardingLoopError(dest + " is also a recipient")
+			}
+		}
+	}
+	return nil
+}
+
+// splitMessage reads the message header block, up to and including the first
+// blank line, and parses it. The returned mail.Message's Body streams the rest
+// of the message from r.
+func splitMessage(r io.Reader) (rawHeader []byte, m *mail.Message, err error) {
+	br := bufio.NewReader(r)
+
+	for {
+		var line []byte
+		line, err = br.ReadBytes('\n')
+		rawHeader = append(rawHeader, line...)
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		} else if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+	}
+
+	var header *mail.Message
+	if header, err = mail.ReadMessage(bytes.NewReader(rawHeader)); err != nil {
+		err = &ErrTransform{fmt.Errorf("failed to parse message: %w", err)}
+		return nil, nil, err
+	}
+	return rawHeader, &mail.Message{Header: header.Header, Body: br}, nil
+}
+
+// https://www.rfc-editor.org/rfc/rfc3464#section-2
+func isDeliveryStatusNotification(header mail.Header) bool {
+	reportType, ok := getReportType(header)
+	return ok && reportType == "delivery-status"
+}
+
+// Rewriting the headers of a multipart/report message, such as a Message
+// Disposition Notification (i.e., a read receipt), can invalidate the report.
+//
+// - https://www.rfc-editor.org/rfc/rfc6522
+// - https://www.rfc-editor.org/rfc/rfc8098
+func isReport(header mail.Header) bool {
+	_, ok := getReportType(header)
+	return ok
+}
+
+func getReportType(header mail.Header) (reportType string, ok bool) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" {
+		return "", false
+	}
+	return strings.ToLower(params["report-type"]), true
+}
+
+func (h *Handler) updateMessage(
+	ctx context.Context,
+	m *mail.Message,
+	key string,
+	info *events.SimpleEmailService,
+	senderAddress string,
+	metadata map[string]string,
+) ([]byte, error) {
+	input := h.newUpdateHeadersInput(
+		ctx, m, key, info, senderAddress, metadata,
+	)
+	var body io.Reader = m.Body
+
+	if h.Options.PlainTextOnly {
+		if pt, err := toPlainText(m.Header, m.Body); err != nil {
+			return nil, &ErrTransform{err}
+		} else if pt != nil {
+			m.Header["Content-Type"] = []string{pt.contentType}
+			if pt.transferEncoding != "" {
+				m.Header["Content-Transfer-Encoding"] = []string{
+					pt.transferEncoding,
+				}
+			}
+			body = bytes.NewReader(pt.body)
+		}
 	}
 
+	if h.Options.StripTrackingPixels {
+		var err error
+		if body, err = stripTrackingPixels(m.Header, body); err != nil {
+			return nil, err
+		}
+	}
+
+	if h.Options.DefangUrls {
+		var err error
+		if body, err = defangUrls(m.Header, body); err != nil {
+			return nil, err
+		}
+	}
+	return h.writeUpdatedMessage(ctx, input, body)
+}
+
+// updateReport rewrites the headers of a multipart/report message, such as a
+// delivery status notification, just like updateMessage. SES won't send from
+// the original, unverified From address, so it must be rewritten. However,
+// updateReport leaves the body untouched, keeping the report itself valid.
+func (h *Handler) updateReport(
+	ctx context.Context,
+	m *mail.Message,
+	key string,
+	info *events.SimpleEmailService,
+	senderAddress string,
+	metadata map[string]string,
+) ([]byte, error) {
+	input := h.newUpdateHeadersInput(
+		ctx, m, key, info, senderAddress, metadata,
+	)
+	return h.writeUpdatedMessage(ctx, input, m.Body)
+}
+
+func (h *Handler) writeUpdatedMessage(
+	ctx context.Context, input *updateHeadersInput, body io.Reader,
+) ([]byte, error) {
 	b := &bytes.Buffer{}
-	hb := headerBuffer{buf: b}
+	hb := headerBuffer{
+		buf:             b,
+		headerNames:     h.headerNames(),
+		foldLongHeaders: h.Options.FoldLongHeaders,
+		logf: func(format string, v ...any) {
+			h.logf(ctx, format, v...)
+		},
+	}
+	if err := hb.WriteUpdatedHeaders(input); err != nil {
+		return nil, &ErrTransform{err}
+	}
+
+	if _, err := b.ReadFrom(body); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (h *Handler) newUpdateHeadersInput(
+	ctx context.Context,
+	m *mail.Message,
+	key string,
+	info *events.SimpleEmailService,
+	senderAddress string,
+	metadata map[string]string,
+) *updateHeadersInput {
 	input := &updateHeadersInput{
-		m.Header, h.Options.SenderAddress, h.Options.BucketName + "/" + key,
+		headers:                  m.Header,
+		senderAddress:            senderAddress,
+		msgPath:                  h.Options.BucketName + "/" + key,
+		receipt:                  &info.Receipt,
+		replyToAddress:           h.Options.ReplyToAddress,
+		replyToIncludeOriginal:   h.Options.ReplyToIncludeOriginal,
+		noReplyReplyTo:           h.Options.NoReplyReplyTo,
+		omitNoReplyReplyTo:       h.Options.OmitNoReplyReplyTo,
+		normalizeSubjectEncoding: h.Options.NormalizeSubjectEncoding,
+		fromAtReplacement:        h.fromAtReplacement(),
+		defaultSubject:           h.Options.DefaultSubject,
+		denylistHeaders:          h.Options.HeaderMode == HeaderModeDenylist,
+		stripHeaders:             h.Options.StripHeaders,
+		keepHeaderPatterns:       h.Options.KeepHeaderPatterns,
+		spamHeaders:              h.Options.SpamAction == SpamActionTag,
+		spamVerdicts:             h.Options.SpamVerdicts,
+		preservePriority:         h.Options.PreservePriority,
+		preserveContentLanguage:  h.Options.PreserveContentLanguage,
+		preserveThreadHeaders:    h.Options.PreserveThreadHeaders,
+		metadataHeaders:          h.metadataHeaders(metadata),
+	}
+	if h.Options.OriginLinkFormat == OriginLinkFormatConsole {
+		input.consoleLinkRegion = h.Options.AwsRegion
+	}
+	if h.Options.RewriteMessageId {
+		input.messageIdDomain = h.Options.EmailDomainName
+	}
+	if h.Options.AddAuthResults {
+		input.authServId = h.Options.EmailDomainName
+	}
+	if h.Options.KeepAlignedFrom {
+		input.keepOriginalFrom = h.keepOriginalFrom(
+			ctx, m.Header, &info.Receipt,
+		)
+	}
+	if h.Options.DateSource == DateSourceReceipt {
+		input.date = info.Receipt.Timestamp
+	}
+	if h.Options.StripPlusFromTo {
+		input.stripPlusFromToDomain = h.Options.EmailDomainName
 	}
+	if h.Options.InternalReplyTo != "" {
+		input.internalReplyTo = h.Options.InternalReplyTo
+		input.internalDomains = h.Options.InternalDomains
+		if len(input.internalDomains) == 0 {
+			input.internalDomains = []string{h.Options.EmailDomainName}
+		}
+	}
+	if h.Options.AddForwardedFor {
+		input.forwardedForHeader = h.Options.ForwardedForHeader
+		if input.forwardedForHeader == "" {
+			input.forwardedForHeader = DefaultForwardedForHeader
+		}
+	}
+	if h.Options.KeepOriginalTo && len(info.Receipt.Recipients) != 0 {
+		// Show which of the forwarder's addresses received the message, even
+		// if it arrived via Bcc or a mailing list.
+		m.Header["To"] = []string{strings.Join(info.Receipt.Recipients, ", ")}
+	}
+	return input
+}
+
+// metadataHeaderPrefix precedes each MetadataHeaders key to form the name of
+// the header conveying its value.
+const metadataHeaderPrefix = "X-SES-"
+
+// metadataHeaders returns a header for each MetadataHeaders key present in
+// the original S3 object's metadata. The S3 API returns metadata keys in lower
+// case, so keys match case insensitively.
+func (h *Handler) metadataHeaders(
+	metadata map[string]string,
+) []metadataHeader {
+	headers := []metadataHeader{}
+
+	for _, key := range h.Options.MetadataHeaders {
+		value, ok := metadata[strings.ToLower(key)]
+		if !ok {
+			value, ok = metadata[key]
+		}
+		// Metadata arrives via HTTP headers, so it shouldn't contain line
+		// breaks, but skip any that would corrupt the header block.
+		if ok && !strings.ContainsAny(value, "\r\n") {
+			name := metadataHeaderPrefix + key
+			headers = append(headers, metadataHeader{name, value})
+		}
+	}
+	return headers
+}
+
+// headerNames returns defaultHeaderNames plus any HeaderNameOverrides.
+func (h *Handler) headerNames() map[string]string {
+	if len(h.Options.HeaderNameOverrides) == 0 {
+		return defaultHeaderNames
+	}
+
+	headerNames := maps.Clone(defaultHeaderNames)
+	maps.Copy(headerNames, newHeaderNames(h.Options.HeaderNameOverrides...))
+	return headerNames
+}
+
+func (h *Handler) fromAtReplacement() string {
+	if h.Options.FromAtReplacement != "" {
+		return h.Options.FromAtReplacement
+	}
+	return DefaultFromAtReplacement
+}
+
+// maxSesMessageSize is the largest raw message SES will send.
+//
+// - https://docs.aws.amazon.com/ses/latest/dg/quotas.html
+const maxSesMessageSize = 40 * 1024 * 1024
+
+// ErrMessageTooLarge indicates that the rewritten message exceeds
+// MAX_MESSAGE_SIZE, which defaults to maxSesMessageSize.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// ErrTooManyRecipients indicates that the forwarding destinations, including
+// any ARCHIVE_BCC address, exceed maxSesDestinations.
+var ErrTooManyRecipients = errors.New("too many recipients")
 
-	if err = hb.WriteUpdatedHeaders(input); err != nil {
+func (h *Handler) maxMessageSize() int64 {
+	if h.Options.MaxMessageSize != 0 {
+		return h.Options.MaxMessageSize
+	}
+	return maxSesMessageSize
+}
+
+// ErrConfigSetNotFound indicates that SES rejected a message because its
+// configuration set doesn't exist.
+var ErrConfigSetNotFound = errors.New("configuration set does not exist")
+
+// isConfigSetNotFound returns true if SES rejected a message because its
+// configuration set doesn't exist. The SES v1 API reports this as a
+// ConfigurationSetDoesNotExistException, while the SES v2 API reports a
+// NotFoundException naming the configuration set.
+//
+// - https://docs.aws.amazon.com/ses/latest/APIReference-V2/API_SendEmail.html#API_SendEmail_Errors
+func isConfigSetNotFound(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "ConfigurationSetDoesNotExistException":
+		return true
+	case "NotFoundException":
+		msg := strings.ToLower(apiErr.ErrorMessage())
+		return strings.Contains(msg, "configuration set")
+	}
+	return false
+}
+
+// sendEmailToConfigSet sends input via sendEmail, replacing a missing
+// configuration set error with an ErrConfigSetNotFound explaining how to fix
+// it. If FallbackNoConfigSet is set, it then tries once more without any
+// configuration set, so that a deployment mistake doesn't block all mail.
+func (h *Handler) sendEmailToConfigSet(
+	ctx context.Context, input *sesv2.SendEmailInput,
+) (*sesv2.SendEmailOutput, error) {
+	output, err := h.sendEmail(ctx, input)
+	if err == nil || !isConfigSetNotFound(err) {
+		return output, err
+	}
+
+	err = fmt.Errorf(
+		"%w: %s (create it in SES, or correct CONFIGURATION_SET or the "+
+			"ROUTING_MAP_S3 entry using it): %w",
+		ErrConfigSetNotFound, aws.ToString(input.ConfigurationSetName), err,
+	)
+	if !h.Options.FallbackNoConfigSet {
 		return nil, err
 	}
+	h.logf(ctx, "WARNING: %s; retrying without a configuration set", err)
+	withoutConfigSet := *input
+	withoutConfigSet.ConfigurationSetName = nil
+	return h.sendEmail(ctx, &withoutConfigSet)
+}
 
-	// mail.ReadMessage practically guararantees the next line will succeed. The
-	// only way it could fail is if the buffer runs out of memory, and ReadFrom
-	// will panic in that case anyway.
-	b.ReadFrom(m.Body)
-	return b.Bytes(), nil
+// verpAddress returns a Variable Envelope Return Path encoding recipient in
+// sender's local part, e.g. "bounce+me=foo.com@forwarder.com" for sender
+// "bounce@forwarder.com" and recipient "me@foo.com". A bounce sent to this
+// address identifies the incoming recipient of the message that bounced.
+//
+// SES sends bounces to the FromEmailAddress of the forwarded message, so the
+// sender's domain must be a verified identity, and must accept mail for these
+// addresses, e.g. via an SES receipt rule matching the whole domain.
+//
+// - https://cr.yp.to/proto/verp.txt
+func verpAddress(sender, recipient string) string {
+	if addr, err := mail.ParseAddress(sender); err == nil {
+		sender = addr.Address
+	}
+	local, domain, _ := cutLast(sender, "@")
+	rcptLocal, rcptDomain, _ := cutLast(recipient, "@")
+	return local + "+" + rcptLocal + "=" + rcptDomain + "@" + domain
 }
 
 func (h *Handler) forwardMessage(
-	ctx context.Context, msg []byte,
+	ctx context.Context, msg []byte, r *route,
 ) (forwardedMessageId string, err error) {
-	sesMsg := &sesv2.SendEmailInput{
-		ConfigurationSetName: aws.String(h.Options.ConfigurationSet),
-		Content: &sesv2types.EmailContent{
-			Raw: &sesv2types.RawMessage{Data: msg},
-		},
-		Destination: &sesv2types.Destination{
-			ToAddresses: []string{h.Options.ForwardingAddress},
-		},
+	ctx, span := h.startSpan(ctx, "forwardMessage")
+	defer func() { endSpan(span, err) }()
+
+	email := &RawEmail{
+		Data:      msg,
+		To:        r.To,
+		ConfigSet: r.ConfigSet,
+		Tags:      h.Options.SesMessageTags,
+	}
+	if h.Options.Verp && len(r.Recipients) != 0 {
+		email.From = verpAddress(r.Sender, r.Recipients[0])
+	} else if h.Options.SetSesFrom {
+		// This matches the From header written by WriteUpdatedHeaders.
+		email.From = r.Sender
+	}
+	if h.Options.ArchiveBcc != "" {
+		email.Bcc = []string{h.Options.ArchiveBcc}
 	}
-	var output *sesv2.SendEmailOutput
 
-	if output, err = h.SesV2.SendEmail(ctx, sesMsg); err != nil {
-		err = fmt.Errorf("send failed: %s", err)
-	} else {
-		forwardedMessageId = aws.ToString(output.MessageId)
+	if limit := h.maxMessageSize(); int64(len(msg)) > limit {
+		err = &ErrForward{fmt.Errorf(
+			"%w: %d bytes exceeds %d byte limit",
+			ErrMessageTooLarge, len(msg), limit,
+		)}
+	} else if n := len(email.To) + len(email.Bcc); n > maxSesDestinations {
+		err = &ErrForward{fmt.Errorf(
+			"%w: %d exceeds the SES limit of %d",
+			ErrTooManyRecipients, n, maxSesDestinations,
+		)}
+	} else if err = h.checkTlsPolicy(ctx, r.ConfigSet); err != nil {
+		err = &ErrForward{err}
+	} else if err = h.waitToSend(ctx); err != nil {
+		err = &ErrForward{err}
+	} else if forwardedMessageId, err = h.forwarder().Forward(
+		ctx, email,
+	); err != nil {
+		err = &ErrForward{fmt.Errorf("send failed: %w", err)}
 	}
 	return
 }
@@ -5,38 +5,73 @@ package handler
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net/mail"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/aws-sdk-go-v2/service/ses"
 	"github.com/aws/aws-sdk-go-v2/service/ses/types"
 	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/smithy-go"
+	"github.com/mbland/ses-forwarder/handler/handlertest"
 	"gotest.tools/assert"
 	is "gotest.tools/assert/cmp"
 )
 
 type TestSes struct {
-	bounceInput  *ses.SendBounceInput
-	bounceOutput *ses.SendBounceOutput
-	bounceErr    error
+	bounceInput     *ses.SendBounceInput
+	bounceOutput    *ses.SendBounceOutput
+	bounceErr       error
+	bounceThrottles int
+	bounceCalls     int
+	rawEmailInput   *ses.SendRawEmailInput
+	rawEmailOutput  *ses.SendRawEmailOutput
+	rawEmailErr     error
 }
 
 func (ses *TestSes) SendBounce(
 	_ context.Context, input *ses.SendBounceInput, _ ...func(*ses.Options),
 ) (*ses.SendBounceOutput, error) {
 	ses.bounceInput = input
+	ses.bounceCalls++
+
+	if ses.bounceThrottles != 0 {
+		ses.bounceThrottles--
+		return nil, newThrottleError()
+	}
 	return ses.bounceOutput, ses.bounceErr
 }
 
+func (ses *TestSes) SendRawEmail(
+	_ context.Context, input *ses.SendRawEmailInput, _ ...func(*ses.Options),
+) (*ses.SendRawEmailOutput, error) {
+	ses.rawEmailInput = input
+	return ses.rawEmailOutput, ses.rawEmailErr
+}
+
 type TestSesV2 struct {
-	sendEmailInput  *sesv2.SendEmailInput
-	sendEmailOutput *sesv2.SendEmailOutput
-	sendEmailErr    error
+	sendEmailInput     *sesv2.SendEmailInput
+	sendEmailOutput    *sesv2.SendEmailOutput
+	sendEmailErr       error
+	sendEmailFailures  []error
+	sendEmailCalls     int
+	getConfigSetInputs []*sesv2.GetConfigurationSetInput
+	getConfigSetOutput *sesv2.GetConfigurationSetOutput
+	getConfigSetErr    error
+	getIdentityInputs  []*sesv2.GetEmailIdentityInput
+	getIdentityOutput  *sesv2.GetEmailIdentityOutput
+	getIdentityErr     error
 }
 
 func (ses *TestSesV2) SendEmail(
@@ -45,15 +80,44 @@ func (ses *TestSesV2) SendEmail(
 	_ ...func(*sesv2.Options),
 ) (*sesv2.SendEmailOutput, error) {
 	ses.sendEmailInput = input
+	ses.sendEmailCalls++
+	if len(ses.sendEmailFailures) != 0 {
+		err := ses.sendEmailFailures[0]
+		ses.sendEmailFailures = ses.sendEmailFailures[1:]
+		return nil, err
+	}
 	return ses.sendEmailOutput, ses.sendEmailErr
 }
 
+func (ses *TestSesV2) GetConfigurationSet(
+	_ context.Context,
+	input *sesv2.GetConfigurationSetInput,
+	_ ...func(*sesv2.Options),
+) (*sesv2.GetConfigurationSetOutput, error) {
+	ses.getConfigSetInputs = append(ses.getConfigSetInputs, input)
+	return ses.getConfigSetOutput, ses.getConfigSetErr
+}
+
+func (ses *TestSesV2) GetEmailIdentity(
+	_ context.Context,
+	input *sesv2.GetEmailIdentityInput,
+	_ ...func(*sesv2.Options),
+) (*sesv2.GetEmailIdentityOutput, error) {
+	ses.getIdentityInputs = append(ses.getIdentityInputs, input)
+	return ses.getIdentityOutput, ses.getIdentityErr
+}
+
 type TestS3 struct {
 	input                   *s3.GetObjectInput
 	returnErrReaderInOutput bool
 	outputMsg               []byte
 	output                  *TestReadCloser
+	contentLength           int64
+	metadata                map[string]string
 	returnErr               error
+	putInput                *s3.PutObjectInput
+	putBody                 []byte
+	putErr                  error
 }
 
 func NewTestS3() *TestS3 {
@@ -70,7 +134,40 @@ func (testS3 *TestS3) GetObject(
 	} else {
 		testS3.output.Reader = bytes.NewReader(testS3.outputMsg)
 	}
-	return &s3.GetObjectOutput{Body: testS3.output}, testS3.returnErr
+	output := &s3.GetObjectOutput{
+		Body:          testS3.output,
+		ContentLength: testS3.contentLength,
+		Metadata:      testS3.metadata,
+	}
+	return output, testS3.returnErr
+}
+
+func (testS3 *TestS3) PutObject(
+	ctx context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options),
+) (*s3.PutObjectOutput, error) {
+	testS3.putInput = input
+
+	if testS3.putErr != nil {
+		return nil, testS3.putErr
+	}
+	body, err := io.ReadAll(input.Body)
+	testS3.putBody = body
+	return &s3.PutObjectOutput{}, err
+}
+
+type KeyErrS3 struct {
+	*TestS3
+	errKey string
+	err    error
+}
+
+func (keyErrS3 *KeyErrS3) GetObject(
+	ctx context.Context, input *s3.GetObjectInput, opts ...func(*s3.Options),
+) (*s3.GetObjectOutput, error) {
+	if *input.Key == keyErrS3.errKey {
+		return nil, keyErrS3.err
+	}
+	return keyErrS3.TestS3.GetObject(ctx, input, opts...)
 }
 
 type ErrReader struct {
@@ -107,10 +204,12 @@ func assertLogsContain(t *testing.T, tl *TestLogs, message string) {
 func TestBounceIfDmarcFails(t *testing.T) {
 	recipient := "mbland@acm.org"
 	bouncedId := "didBounce"
+	now := time.Date(1970, time.September, 18, 12, 45, 0, 0, time.UTC)
 
 	setup := func() (
 		*TestSes, *Handler, *events.SimpleEmailService, context.Context,
 	) {
+		_, logger := testLogger()
 		testSes := &TestSes{
 			bounceOutput: &ses.SendBounceOutput{MessageId: &bouncedId},
 		}
@@ -122,7 +221,15 @@ func TestBounceIfDmarcFails(t *testing.T) {
 				Recipients: []string{recipient},
 			},
 		}
-		return testSes, &Handler{Ses: testSes, Options: opts}, sesInfo, ctx
+		h := &Handler{
+			Ses:     testSes,
+			Options: opts,
+			Log:     logger,
+			Now: func() time.Time {
+				return now.Add(500 * time.Millisecond)
+			},
+		}
+		return testSes, h, sesInfo, ctx
 	}
 
 	t.Run("DoesNothingIfVerdictIsNotFail", func(t *testing.T) {
@@ -149,6 +256,45 @@ func TestBounceIfDmarcFails(t *testing.T) {
 		assert.Assert(t, is.Nil(testSes.bounceInput))
 	})
 
+	t.Run("SkipsQuarantineIfBouncePolicyIsReject", func(t *testing.T) {
+		testSes, h, sesInfo, ctx := setup()
+		h.Options.DmarcBouncePolicy = DmarcBouncePolicyReject
+		sesInfo.Receipt.DMARCVerdict.Status = "fail"
+		sesInfo.Receipt.DMARCPolicy = "quarantine"
+
+		bounceId, err := h.bounceIfDmarcFails(ctx, sesInfo)
+
+		assert.NilError(t, err)
+		assert.Equal(t, bounceId, "")
+		assert.Assert(t, is.Nil(testSes.bounceInput))
+	})
+
+	t.Run("BouncesQuarantineIfBouncePolicyIsAny", func(t *testing.T) {
+		testSes, h, sesInfo, ctx := setup()
+		h.Options.DmarcBouncePolicy = DmarcBouncePolicyAny
+		sesInfo.Receipt.DMARCVerdict.Status = "fail"
+		sesInfo.Receipt.DMARCPolicy = "quarantine"
+
+		bounceId, err := h.bounceIfDmarcFails(ctx, sesInfo)
+
+		assert.NilError(t, err)
+		assert.Equal(t, bounceId, bouncedId)
+		assert.Assert(t, testSes.bounceInput != nil)
+	})
+
+	t.Run("SkipsPassingVerdictIfBouncePolicyIsAny", func(t *testing.T) {
+		testSes, h, sesInfo, ctx := setup()
+		h.Options.DmarcBouncePolicy = DmarcBouncePolicyAny
+		sesInfo.Receipt.DMARCVerdict.Status = "pass"
+		sesInfo.Receipt.DMARCPolicy = "none"
+
+		bounceId, err := h.bounceIfDmarcFails(ctx, sesInfo)
+
+		assert.NilError(t, err)
+		assert.Equal(t, bounceId, "")
+		assert.Assert(t, is.Nil(testSes.bounceInput))
+	})
+
 	t.Run("BouncesIfVerdictFailsAndPolicyRejects", func(t *testing.T) {
 		testSes, h, sesInfo, ctx := setup()
 		sesInfo.Receipt.DMARCVerdict.Status = "fail"
@@ -166,6 +312,61 @@ func TestBounceIfDmarcFails(t *testing.T) {
 		assert.Equal(
 			t, bouncedRecipients[0].BounceType, types.BounceTypeContentRejected,
 		)
+		dsn := testSes.bounceInput.MessageDsn
+		assert.Equal(t, *dsn.ReportingMta, "dns; foo.com")
+		assert.Assert(t, dsn.ArrivalDate.Equal(now))
+	})
+
+	t.Run("UsesReportingMtaOptionIfSet", func(t *testing.T) {
+		testSes, h, sesInfo, ctx := setup()
+		sesInfo.Receipt.DMARCVerdict.Status = "fail"
+		sesInfo.Receipt.DMARCPolicy = "reject"
+		h.Options.ReportingMta = "dns; mx.foo.com"
+
+		_, err := h.bounceIfDmarcFails(ctx, sesInfo)
+
+		assert.NilError(t, err)
+		reportingMta := testSes.bounceInput.MessageDsn.ReportingMta
+		assert.Equal(t, *reportingMta, "dns; mx.foo.com")
+	})
+
+	t.Run("SkipsBounceIfNoRecipients", func(t *testing.T) {
+		testSes, h, sesInfo, ctx := setup()
+		logs, logger := testLogger()
+		h.Log = logger
+		sesInfo.Receipt.DMARCVerdict.Status = "fail"
+		sesInfo.Receipt.DMARCPolicy = "reject"
+		sesInfo.Receipt.Recipients = []string{}
+
+		bounceId, err := h.bounceIfDmarcFails(ctx, sesInfo)
+
+		assert.Equal(t, bounceId, "")
+		assert.ErrorContains(t, err, "no recipients to bounce")
+		var validationErr *ErrValidation
+		assert.Assert(t, errors.As(err, &validationErr))
+		assert.Assert(t, is.Nil(testSes.bounceInput))
+		expected := "WARNING: not bouncing message deadbeef: " +
+			"no recipients in SES receipt"
+		assertLogsContain(t, logs, expected)
+	})
+
+	t.Run("RetriesIfSendBounceThrottled", func(t *testing.T) {
+		testSes, h, sesInfo, ctx := setup()
+		sesInfo.Receipt.DMARCVerdict.Status = "fail"
+		sesInfo.Receipt.DMARCPolicy = "reject"
+		testSes.bounceThrottles = 1
+		delays := []time.Duration{}
+		h.Sleep = func(_ context.Context, d time.Duration) error {
+			delays = append(delays, d)
+			return nil
+		}
+
+		bounceId, err := h.bounceIfDmarcFails(ctx, sesInfo)
+
+		assert.NilError(t, err)
+		assert.Equal(t, bounceId, bouncedId)
+		assert.Equal(t, testSes.bounceCalls, 2)
+		assert.DeepEqual(t, delays, []time.Duration{throttledRetryDelay})
 	})
 
 	t.Run("ErrorsIfSendBounceFails", func(t *testing.T) {
@@ -183,35 +384,49 @@ func TestBounceIfDmarcFails(t *testing.T) {
 }
 
 func TestIsSpam(t *testing.T) {
-	failedVerdict := func(checkType string) *events.SimpleEmailService {
-		sesInfo := &events.SimpleEmailService{}
+	failedVerdict := func(checkType string) *events.SimpleEmailReceipt {
+		receipt := &events.SimpleEmailReceipt{}
 		var verdict *events.SimpleEmailVerdict
 
 		switch checkType {
 		case "SPF":
-			verdict = &sesInfo.Receipt.SPFVerdict
+			verdict = &receipt.SPFVerdict
 		case "DKIM":
-			verdict = &sesInfo.Receipt.DKIMVerdict
+			verdict = &receipt.DKIMVerdict
 		case "Spam":
-			verdict = &sesInfo.Receipt.SpamVerdict
+			verdict = &receipt.SpamVerdict
 		case "Virus":
-			verdict = &sesInfo.Receipt.VirusVerdict
+			verdict = &receipt.VirusVerdict
 		}
 
 		if verdict != nil {
 			verdict.Status = "fail"
 		}
-		return sesInfo
+		return receipt
 	}
 	t.Run("ReturnsFalseIfNoVerdictsFail", func(t *testing.T) {
-		assert.Assert(t, isSpam(failedVerdict("none")) == false)
+		assert.Assert(t, isSpam(failedVerdict("none"), nil) == false)
 	})
 
 	t.Run("ReturnsTrueIfAnyVerdictFails", func(t *testing.T) {
-		assert.Check(t, isSpam(failedVerdict("SPF")) == true)
-		assert.Check(t, isSpam(failedVerdict("DKIM")) == true)
-		assert.Check(t, isSpam(failedVerdict("Spam")) == true)
-		assert.Assert(t, isSpam(failedVerdict("Virus")) == true)
+		assert.Check(t, isSpam(failedVerdict("SPF"), nil) == true)
+		assert.Check(t, isSpam(failedVerdict("DKIM"), nil) == true)
+		assert.Check(t, isSpam(failedVerdict("Spam"), nil) == true)
+		assert.Assert(t, isSpam(failedVerdict("Virus"), nil) == true)
+	})
+
+	t.Run("ChecksOnlySelectedVerdicts", func(t *testing.T) {
+		verdicts := []string{SpamVerdictSpf, SpamVerdictSpam}
+
+		assert.Check(t, isSpam(failedVerdict("SPF"), verdicts) == true)
+		assert.Check(t, isSpam(failedVerdict("DKIM"), verdicts) == false)
+		assert.Assert(t, isSpam(failedVerdict("Spam"), verdicts) == true)
+	})
+
+	t.Run("AlwaysReturnsTrueIfVirusVerdictFails", func(t *testing.T) {
+		verdicts := []string{SpamVerdictSpf}
+
+		assert.Assert(t, isSpam(failedVerdict("Virus"), verdicts) == true)
 	})
 }
 
@@ -224,10 +439,20 @@ func TestValidateMessage(t *testing.T) {
 		testSes := &TestSes{
 			bounceOutput: &ses.SendBounceOutput{MessageId: &bouncedId},
 		}
-		opts := &Options{EmailDomainName: "foo.com"}
+		opts := &Options{
+			EmailDomainName: "foo.com", SenderAddress: "inbox@foo.com",
+		}
 		ctx := context.Background()
 		sesInfo := &events.SimpleEmailService{
-			Mail: events.SimpleEmailMessage{MessageID: "deadbeef"},
+			Mail: events.SimpleEmailMessage{
+				MessageID: "deadbeef",
+				CommonHeaders: events.SimpleEmailCommonHeaders{
+					From: []string{"Mike <mbland@acm.org>"},
+				},
+			},
+			Receipt: events.SimpleEmailReceipt{
+				Recipients: []string{"mbland@acm.org"},
+			},
 		}
 		return testSes, &Handler{Ses: testSes, Options: opts}, sesInfo, ctx
 	}
@@ -249,6 +474,11 @@ func TestValidateMessage(t *testing.T) {
 		err := h.validateMessage(ctx, sesInfo)
 
 		assert.ErrorContains(t, err, "DMARC bounce failed: test error")
+		var forwardErr *ErrForward
+		assert.Assert(t, errors.As(err, &forwardErr))
+		var validationErr *ErrValidation
+		assert.Assert(t, !errors.As(err, &validationErr))
+		assert.Assert(t, errors.Is(err, testSes.bounceErr))
 	})
 
 	t.Run("ErrorsIfMessageBounced", func(t *testing.T) {
@@ -269,6 +499,207 @@ func TestValidateMessage(t *testing.T) {
 		err := h.validateMessage(ctx, sesInfo)
 
 		assert.ErrorContains(t, err, "marked as spam, ignoring")
+		var validationErr *ErrValidation
+		assert.Assert(t, errors.As(err, &validationErr))
+	})
+
+	t.Run("SucceedsIfReceiptWithinReplayWindow", func(t *testing.T) {
+		_, h, sesInfo, ctx := setup()
+		now := time.Date(2023, time.November, 5, 9, 30, 15, 0, time.UTC)
+		h.Now = func() time.Time { return now }
+		h.Options.ReplayWindow = time.Hour
+		sesInfo.Receipt.Timestamp = now.Add(-time.Hour)
+
+		err := h.validateMessage(ctx, sesInfo)
+
+		assert.NilError(t, err)
+	})
+
+	t.Run("ErrorsIfReceiptOutsideReplayWindow", func(t *testing.T) {
+		testSes, h, sesInfo, ctx := setup()
+		now := time.Date(2023, time.November, 5, 9, 30, 15, 0, time.UTC)
+		h.Now = func() time.Time { return now }
+		h.Options.ReplayWindow = time.Hour
+		sesInfo.Receipt.Timestamp = now.Add(-time.Hour - time.Second)
+		sesInfo.Receipt.DMARCVerdict.Status = "fail"
+		sesInfo.Receipt.DMARCPolicy = "reject"
+
+		err := h.validateMessage(ctx, sesInfo)
+
+		expected := "possible replay: receipt is 1h0m1s old, " +
+			"exceeding REPLAY_WINDOW 1h0m0s"
+		assert.Error(t, err, expected)
+		var validationErr *ErrValidation
+		assert.Assert(t, errors.As(err, &validationErr))
+		assert.Assert(t, is.Nil(testSes.bounceInput))
+	})
+
+	t.Run("IgnoresReceiptTimestampIfReplayWindowNotSet", func(t *testing.T) {
+		_, h, sesInfo, ctx := setup()
+
+		err := h.validateMessage(ctx, sesInfo)
+
+		assert.NilError(t, err)
+		assert.Assert(t, sesInfo.Receipt.Timestamp.IsZero())
+	})
+
+	t.Run("ErrorsIfSelfOriginated", func(t *testing.T) {
+		testSes, h, sesInfo, ctx := setup()
+		sesInfo.Mail.CommonHeaders.From = []string{"Forwarder <INBOX@foo.com>"}
+		sesInfo.Receipt.DMARCVerdict.Status = "fail"
+		sesInfo.Receipt.DMARCPolicy = "reject"
+
+		err := h.validateMessage(ctx, sesInfo)
+
+		assert.ErrorContains(t, err, "dropping self-originated message")
+		var validationErr *ErrValidation
+		assert.Assert(t, errors.As(err, &validationErr))
+		assert.Assert(t, is.Nil(testSes.bounceInput))
+	})
+
+	t.Run("SucceedsIfSelfOriginatedAndForwardingEnabled", func(t *testing.T) {
+		_, h, sesInfo, ctx := setup()
+		h.Options.ForwardSelfOriginated = true
+		sesInfo.Mail.CommonHeaders.From = []string{"inbox@foo.com"}
+
+		err := h.validateMessage(ctx, sesInfo)
+
+		assert.NilError(t, err)
+	})
+
+	t.Run("SucceedsIfContentTypeAllowed", func(t *testing.T) {
+		_, h, sesInfo, ctx := setup()
+		h.Options.ContentTypeAllowlist = []string{"text/calendar"}
+		sesInfo.Mail.Headers = []events.SimpleEmailHeader{
+			{Name: "From", Value: "Mike <mbland@acm.org>"},
+			{Name: "content-type", Value: `Text/Calendar; method="REQUEST"`},
+		}
+
+		err := h.validateMessage(ctx, sesInfo)
+
+		assert.NilError(t, err)
+	})
+
+	t.Run("ErrorsIfContentTypeNotAllowed", func(t *testing.T) {
+		_, h, sesInfo, ctx := setup()
+		h.Options.ContentTypeAllowlist = []string{"text/calendar"}
+		sesInfo.Mail.Headers = []events.SimpleEmailHeader{
+			{Name: "Content-Type", Value: `multipart/mixed; boundary="foo"`},
+		}
+
+		err := h.validateMessage(ctx, sesInfo)
+
+		expected := "content type not allowed: multipart/mixed"
+		assert.Error(t, err, expected)
+		var validationErr *ErrValidation
+		assert.Assert(t, errors.As(err, &validationErr))
+	})
+
+	t.Run("ErrorsIfContentTypeInvalid", func(t *testing.T) {
+		_, h, sesInfo, ctx := setup()
+		h.Options.ContentTypeAllowlist = []string{"text/calendar"}
+		sesInfo.Mail.Headers = []events.SimpleEmailHeader{
+			{Name: "Content-Type", Value: "text/calendar; ;"},
+		}
+
+		err := h.validateMessage(ctx, sesInfo)
+
+		assert.Error(t, err, "content type not allowed: text/calendar; ;")
+	})
+
+	t.Run("DefaultsMissingContentTypeToTextPlain", func(t *testing.T) {
+		_, h, sesInfo, ctx := setup()
+		h.Options.ContentTypeAllowlist = []string{"text/calendar"}
+
+		err := h.validateMessage(ctx, sesInfo)
+
+		assert.Error(t, err, "content type not allowed: text/plain")
+
+		h.Options.ContentTypeAllowlist = []string{"text/plain"}
+		assert.NilError(t, h.validateMessage(ctx, sesInfo))
+	})
+
+	t.Run("SucceedsForSpamToPostmasterIfEnabled", func(t *testing.T) {
+		testSes, h, sesInfo, ctx := setup()
+		h.Options.PostmasterForward = "admin@acm.org"
+		sesInfo.Receipt.Recipients = []string{"Abuse@FOO.com"}
+		sesInfo.Receipt.SpamVerdict.Status = "fail"
+		sesInfo.Receipt.DMARCVerdict.Status = "fail"
+		sesInfo.Receipt.DMARCPolicy = "reject"
+
+		err := h.validateMessage(ctx, sesInfo)
+
+		assert.NilError(t, err)
+		assert.Assert(t, is.Nil(testSes.bounceInput))
+	})
+
+	t.Run("ErrorsForVirusToPostmasterIfEnabled", func(t *testing.T) {
+		testSes, h, sesInfo, ctx := setup()
+		h.Options.PostmasterForward = "admin@acm.org"
+		sesInfo.Receipt.Recipients = []string{"postmaster@foo.com"}
+		sesInfo.Receipt.VirusVerdict.Status = "fail"
+
+		err := h.validateMessage(ctx, sesInfo)
+
+		var validationErr *ErrValidation
+		assert.Assert(t, errors.As(err, &validationErr))
+		assert.ErrorContains(t, err, "virus detected, ignoring")
+		assert.Assert(t, is.Nil(testSes.bounceInput))
+	})
+
+	t.Run("ErrorsForSpamToPostmasterByDefault", func(t *testing.T) {
+		_, h, sesInfo, ctx := setup()
+		sesInfo.Receipt.Recipients = []string{"postmaster@foo.com"}
+		sesInfo.Receipt.SpamVerdict.Status = "fail"
+
+		err := h.validateMessage(ctx, sesInfo)
+
+		assert.ErrorContains(t, err, "marked as spam, ignoring")
+	})
+
+	t.Run("ErrorsForSpamToPostmasterAtOtherDomain", func(t *testing.T) {
+		_, h, sesInfo, ctx := setup()
+		h.Options.PostmasterForward = "admin@acm.org"
+		sesInfo.Receipt.Recipients = []string{"postmaster@bar.com"}
+		sesInfo.Receipt.SpamVerdict.Status = "fail"
+
+		err := h.validateMessage(ctx, sesInfo)
+
+		assert.ErrorContains(t, err, "marked as spam, ignoring")
+	})
+
+	t.Run("SucceedsIfOnlyExcludedVerdictFails", func(t *testing.T) {
+		_, h, sesInfo, ctx := setup()
+		sesInfo.Receipt.DKIMVerdict.Status = "fail"
+		h.Options.SpamVerdicts = []string{
+			SpamVerdictSpf, SpamVerdictSpam, SpamVerdictVirus,
+		}
+
+		err := h.validateMessage(ctx, sesInfo)
+
+		assert.NilError(t, err)
+	})
+
+	t.Run("SucceedsIfIsSpamAndSpamActionIsTag", func(t *testing.T) {
+		_, h, sesInfo, ctx := setup()
+		sesInfo.Receipt.SPFVerdict.Status = "fail"
+		h.Options.SpamAction = SpamActionTag
+
+		err := h.validateMessage(ctx, sesInfo)
+
+		assert.NilError(t, err)
+	})
+
+	t.Run("ErrorsIfVirusAndSpamActionIsTag", func(t *testing.T) {
+		_, h, sesInfo, ctx := setup()
+		sesInfo.Receipt.VirusVerdict.Status = "fail"
+		h.Options.SpamAction = SpamActionTag
+
+		err := h.validateMessage(ctx, sesInfo)
+
+		var validationErr *ErrValidation
+		assert.Assert(t, errors.As(err, &validationErr))
+		assert.ErrorContains(t, err, "virus detected, ignoring")
 	})
 }
 
@@ -283,24 +714,80 @@ func TestGetOriginalMessage(t *testing.T) {
 	t.Run("Succeeds", func(t *testing.T) {
 		testS3, h, ctx := setup()
 		testS3.outputMsg = []byte("Hello, world!")
-		msg, err := h.getOriginalMessage(ctx, "prefix/msgId")
+		orig, err := h.getOriginalMessage(ctx, "prefix/msgId")
 
+		assert.NilError(t, err)
+		msg, err := io.ReadAll(orig)
 		assert.NilError(t, err)
 		assert.Equal(t, "Hello, world!", string(msg))
 		assert.Equal(t, h.Options.BucketName, *testS3.input.Bucket)
 		assert.Equal(t, "prefix/msgId", *testS3.input.Key)
+		assert.Equal(t, testS3.input.RequestPayer, s3types.RequestPayer(""))
+		assert.NilError(t, orig.Close())
 		assert.Equal(t, testS3.output.timesClosed, 1)
 	})
 
+	t.Run("ReturnsObjectMetadata", func(t *testing.T) {
+		testS3, h, ctx := setup()
+		testS3.metadata = map[string]string{"receipt-time": "12:45"}
+
+		orig, err := h.getOriginalMessage(ctx, "prefix/msgId")
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, orig.metadata, testS3.metadata)
+	})
+
+	t.Run("SucceedsIfContentLengthMatches", func(t *testing.T) {
+		testS3, h, ctx := setup()
+		testS3.outputMsg = []byte("Hello, world!")
+		testS3.contentLength = int64(len(testS3.outputMsg))
+		orig, err := h.getOriginalMessage(ctx, "prefix/msgId")
+
+		assert.NilError(t, err)
+		msg, err := io.ReadAll(orig)
+		assert.NilError(t, err)
+		assert.Equal(t, "Hello, world!", string(msg))
+	})
+
+	t.Run("ErrorsIfMessageTruncated", func(t *testing.T) {
+		testS3, h, ctx := setup()
+		testS3.outputMsg = []byte("Hello, world!")
+		testS3.contentLength = int64(len(testS3.outputMsg)) + 10
+		orig, err := h.getOriginalMessage(ctx, "prefix/msgId")
+
+		assert.NilError(t, err)
+		_, err = io.ReadAll(orig)
+		expected := "failed to get original message: " +
+			"truncated message: read 13 of 23 bytes"
+		assert.ErrorContains(t, err, expected)
+		assert.Assert(t, errors.Is(err, ErrTruncatedMessage))
+		var fetchErr *ErrFetch
+		assert.Assert(t, errors.As(err, &fetchErr))
+	})
+
+	t.Run("SetsRequestPayerIfRequesterPays", func(t *testing.T) {
+		testS3, h, ctx := setup()
+		h.Options.RequesterPays = true
+
+		_, err := h.getOriginalMessage(ctx, "prefix/msgId")
+
+		assert.NilError(t, err)
+		requestPayer := testS3.input.RequestPayer
+		assert.Equal(t, requestPayer, s3types.RequestPayerRequester)
+	})
+
 	t.Run("ErrorsIfGetObjectFails", func(t *testing.T) {
 		testS3, h, ctx := setup()
 		testS3.returnErr = errors.New("S3 test error")
 
-		msg, err := h.getOriginalMessage(ctx, "prefix/msgId")
+		orig, err := h.getOriginalMessage(ctx, "prefix/msgId")
 
-		assert.Equal(t, string(msg), "")
+		assert.Assert(t, is.Nil(orig))
 		expected := "failed to get original message: S3 test error"
 		assert.ErrorContains(t, err, expected)
+		var fetchErr *ErrFetch
+		assert.Assert(t, errors.As(err, &fetchErr))
+		assert.Assert(t, errors.Is(err, testS3.returnErr))
 		assert.Equal(t, testS3.output.timesClosed, 0)
 	})
 
@@ -309,18 +796,142 @@ func TestGetOriginalMessage(t *testing.T) {
 		testS3.returnErrReaderInOutput = true
 		testS3.outputMsg = []byte("test read error")
 
-		msg, err := h.getOriginalMessage(ctx, "prefix/msgId")
+		orig, err := h.getOriginalMessage(ctx, "prefix/msgId")
 
+		assert.NilError(t, err)
+		msg, err := io.ReadAll(orig)
 		assert.Equal(t, string(msg), "")
 		expected := "failed to get original message: test read error"
 		assert.ErrorContains(t, err, expected)
-		assert.Equal(t, testS3.output.timesClosed, 1)
+		var fetchErr *ErrFetch
+		assert.Assert(t, errors.As(err, &fetchErr))
 	})
 }
 
-func TestForwardMessage(t *testing.T) {
-	var forwardedMsgId string = "forwardedMsgId"
-
+func TestGetOriginalMessageKeyFallbacks(t *testing.T) {
+	ctx := context.Background()
+	key := "incoming/MsgId"
+
+	setup := func() (*handlertest.S3, *Handler, *TestLogs) {
+		objS3 := &handlertest.S3{Objects: map[string][]byte{}}
+		logs, logger := testLogger()
+		h := &Handler{
+			S3:      objS3,
+			Options: &Options{BucketName: "mail.foo.com", KeyFallbacks: true},
+			Log:     logger,
+		}
+		return objS3, h, logs
+	}
+
+	readKeys := func(objS3 *handlertest.S3) []string {
+		keys := []string{}
+		for _, input := range objS3.GetObjectInputs {
+			keys = append(keys, *input.Key)
+		}
+		return keys
+	}
+
+	t.Run("UsesPrimaryKeyIfPresent", func(t *testing.T) {
+		objS3, h, _ := setup()
+		objS3.Objects["incoming/MsgId"] = []byte("primary")
+		objS3.Objects["incoming/msgid"] = []byte("fallback")
+
+		orig, err := h.getOriginalMessage(ctx, key)
+
+		assert.NilError(t, err)
+		msg, err := io.ReadAll(orig)
+		assert.NilError(t, err)
+		assert.Equal(t, string(msg), "primary")
+		assert.Equal(t, orig.key, "incoming/MsgId")
+		assert.DeepEqual(t, readKeys(objS3), []string{"incoming/MsgId"})
+	})
+
+	t.Run("FallsBackToLowercasedKey", func(t *testing.T) {
+		objS3, h, logs := setup()
+		objS3.Objects["incoming/msgid"] = []byte("fallback")
+
+		orig, err := h.getOriginalMessage(ctx, key)
+
+		assert.NilError(t, err)
+		msg, err := io.ReadAll(orig)
+		assert.NilError(t, err)
+		assert.Equal(t, string(msg), "fallback")
+		assert.Equal(t, orig.key, "incoming/msgid")
+		assert.DeepEqual(
+			t, readKeys(objS3), []string{"incoming/MsgId", "incoming/msgid"},
+		)
+		assertLogsContain(
+			t,
+			logs,
+			"found message incoming/MsgId at fallback key incoming/msgid",
+		)
+	})
+
+	t.Run("FallsBackToKeyWithoutPrefix", func(t *testing.T) {
+		objS3, h, _ := setup()
+		objS3.Objects["msgid"] = []byte("fallback")
+
+		orig, err := h.getOriginalMessage(ctx, key)
+
+		assert.NilError(t, err)
+		assert.Equal(t, orig.key, "msgid")
+	})
+
+	t.Run("ReturnsOriginalErrorIfNoKeyFound", func(t *testing.T) {
+		objS3, h, _ := setup()
+
+		orig, err := h.getOriginalMessage(ctx, key)
+
+		assert.Assert(t, is.Nil(orig))
+		assert.Assert(t, errors.Is(err, handlertest.ErrNoSuchKey))
+		var fetchErr *ErrFetch
+		assert.Assert(t, errors.As(err, &fetchErr))
+		expected := []string{
+			"incoming/MsgId", "incoming/msgid", "MsgId", "msgid",
+		}
+		assert.DeepEqual(t, readKeys(objS3), expected)
+	})
+
+	t.Run("StopsAtErrorOtherThanNoSuchKey", func(t *testing.T) {
+		objS3, h, _ := setup()
+		testErr := errors.New("test error")
+		objS3.Errors = map[string]error{"incoming/msgid": testErr}
+
+		_, err := h.getOriginalMessage(ctx, key)
+
+		assert.Assert(t, errors.Is(err, testErr))
+		assert.Equal(t, len(objS3.GetObjectInputs), 2)
+	})
+
+	t.Run("DoesNotFallBackByDefault", func(t *testing.T) {
+		objS3, h, _ := setup()
+		h.Options.KeyFallbacks = false
+		objS3.Objects["incoming/msgid"] = []byte("fallback")
+
+		_, err := h.getOriginalMessage(ctx, key)
+
+		assert.Assert(t, errors.Is(err, handlertest.ErrNoSuchKey))
+		assert.Equal(t, len(objS3.GetObjectInputs), 1)
+	})
+}
+
+func TestOriginalKeyFallbacks(t *testing.T) {
+	t.Run("LowercasesAndRemovesPrefix", func(t *testing.T) {
+		expected := []string{"incoming/msgid", "MsgId", "msgid"}
+
+		assert.DeepEqual(t, originalKeyFallbacks("incoming/MsgId"), expected)
+	})
+
+	t.Run("OmitsDuplicatesIfAlreadyLowercase", func(t *testing.T) {
+		expected := []string{"msgid"}
+
+		assert.DeepEqual(t, originalKeyFallbacks("incoming/msgid"), expected)
+	})
+}
+
+func TestForwardMessage(t *testing.T) {
+	var forwardedMsgId string = "forwardedMsgId"
+
 	setup := func() (*TestSesV2, *Handler, context.Context) {
 		testSesV2 := &TestSesV2{sendEmailOutput: &sesv2.SendEmailOutput{}}
 		opts := &Options{
@@ -338,7 +949,9 @@ func TestForwardMessage(t *testing.T) {
 		configSet := h.Options.ConfigurationSet
 		msg := []byte("Hello, world!")
 
-		fwdId, err := h.forwardMessage(ctx, msg)
+		fwdId, err := h.forwardMessage(
+			ctx, msg, h.newRoute([]string{fwdAddr}),
+		)
 
 		assert.NilError(t, err)
 		assert.Equal(t, forwardedMsgId, fwdId)
@@ -349,16 +962,300 @@ func TestForwardMessage(t *testing.T) {
 		)
 		assert.Equal(t, configSet, *testSes.sendEmailInput.ConfigurationSetName)
 		assert.DeepEqual(t, msg, testSes.sendEmailInput.Content.Raw.Data)
+		bcc := testSes.sendEmailInput.Destination.BccAddresses
+		assert.Assert(t, is.Nil(bcc))
+		assert.Assert(t, is.Nil(testSes.sendEmailInput.FromEmailAddress))
+		assert.Assert(t, is.Nil(testSes.sendEmailInput.EmailTags))
+	})
+
+	t.Run("AddsMessageTagsIfConfigured", func(t *testing.T) {
+		testSes, h, ctx := setup()
+		h.Options.SesMessageTags = []MessageTag{
+			{Name: "category", Value: "forwarded"},
+			{Name: "source", Value: "ses-forwarder"},
+		}
+
+		_, err := h.forwardMessage(
+			ctx, []byte("Hello, world!"), h.newRoute([]string{"foo@bar.com"}),
+		)
+
+		assert.NilError(t, err)
+		tags := testSes.sendEmailInput.EmailTags
+		assert.Equal(t, len(tags), 2)
+		assert.Equal(t, *tags[0].Name, "category")
+		assert.Equal(t, *tags[0].Value, "forwarded")
+		assert.Equal(t, *tags[1].Name, "source")
+		assert.Equal(t, *tags[1].Value, "ses-forwarder")
+	})
+
+	t.Run("SetsFromEmailAddressIfEnabled", func(t *testing.T) {
+		testSes, h, ctx := setup()
+		h.Options.SenderAddress = "ses-forwarder@xyzzy.com"
+		h.Options.SetSesFrom = true
+
+		_, err := h.forwardMessage(
+			ctx, []byte("Hello, world!"), h.newRoute([]string{"foo@bar.com"}),
+		)
+
+		assert.NilError(t, err)
+		fromAddr := testSes.sendEmailInput.FromEmailAddress
+		assert.Equal(t, "ses-forwarder@xyzzy.com", *fromAddr)
+	})
+
+	t.Run("SetsVerpFromEmailAddressIfEnabled", func(t *testing.T) {
+		testSes, h, ctx := setup()
+		h.Options.SenderAddress = "bounce@xyzzy.com"
+		h.Options.SetSesFrom = true
+		h.Options.Verp = true
+		r := h.newRoute([]string{"foo@bar.com"})
+		r.Recipients = []string{"me@foo.com", "you@foo.com"}
+
+		_, err := h.forwardMessage(ctx, []byte("Hello, world!"), r)
+
+		assert.NilError(t, err)
+		fromAddr := testSes.sendEmailInput.FromEmailAddress
+		assert.Equal(t, "bounce+me=foo.com@xyzzy.com", *fromAddr)
+	})
+
+	t.Run("AddsArchiveBccIfConfigured", func(t *testing.T) {
+		testSes, h, ctx := setup()
+		h.Options.ArchiveBcc = "archive@xyzzy.com"
+
+		_, err := h.forwardMessage(
+			ctx, []byte("Hello, world!"), h.newRoute([]string{"foo@bar.com"}),
+		)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(
+			t,
+			[]string{"archive@xyzzy.com"},
+			testSes.sendEmailInput.Destination.BccAddresses,
+		)
 	})
 
 	t.Run("ErrorsIfSendingFails", func(t *testing.T) {
 		testSes, h, ctx := setup()
 		testSes.sendEmailErr = errors.New("SES test error")
 
-		fwdId, err := h.forwardMessage(ctx, []byte("Hello, world!"))
+		fwdId, err := h.forwardMessage(
+			ctx, []byte("Hello, world!"), h.newRoute([]string{"foo@bar.com"}),
+		)
 
 		assert.Equal(t, "", fwdId)
 		assert.ErrorContains(t, err, "send failed: SES test error")
+		var forwardErr *ErrForward
+		assert.Assert(t, errors.As(err, &forwardErr))
+		assert.Assert(t, errors.Is(err, testSes.sendEmailErr))
+	})
+
+	t.Run("ExplainsMissingConfigSet", func(t *testing.T) {
+		testSes, h, ctx := setup()
+		testSes.sendEmailErr = newConfigSetNotFoundError()
+
+		fwdId, err := h.forwardMessage(
+			ctx, []byte("Hello, world!"), h.newRoute([]string{"foo@bar.com"}),
+		)
+
+		assert.Equal(t, "", fwdId)
+		expected := "send failed: configuration set does not exist: " +
+			"ses-forwarder (create it in SES, or correct CONFIGURATION_SET " +
+			"or the ROUTING_MAP_S3 entry using it): "
+		assert.ErrorContains(t, err, expected)
+		assert.Assert(t, errors.Is(err, ErrConfigSetNotFound))
+		assert.Assert(t, errors.Is(err, testSes.sendEmailErr))
+		assert.Equal(t, testSes.sendEmailCalls, 1)
+	})
+
+	t.Run("RetriesWithoutMissingConfigSetIfFallbackEnabled",
+		func(t *testing.T) {
+			testSes, h, ctx := setup()
+			logs, logger := testLogger()
+			h.Log = logger
+			h.Options.FallbackNoConfigSet = true
+			testSes.sendEmailFailures = []error{newConfigSetNotFoundError()}
+			testSes.sendEmailOutput.MessageId = &forwardedMsgId
+			r := h.newRoute([]string{"foo@bar.com"})
+
+			fwdId, err := h.forwardMessage(ctx, []byte("Hello, world!"), r)
+
+			assert.NilError(t, err)
+			assert.Equal(t, fwdId, forwardedMsgId)
+			assert.Equal(t, testSes.sendEmailCalls, 2)
+			configSet := testSes.sendEmailInput.ConfigurationSetName
+			assert.Assert(t, is.Nil(configSet))
+			assertLogsContain(
+				t, logs, "WARNING: configuration set does not exist: "+
+					"ses-forwarder",
+			)
+			assertLogsContain(t, logs, "retrying without a configuration set")
+		},
+	)
+
+	t.Run("DoesNotFallBackForOtherErrors", func(t *testing.T) {
+		testSes, h, ctx := setup()
+		h.Options.FallbackNoConfigSet = true
+		testSes.sendEmailErr = &smithy.GenericAPIError{
+			Code: "NotFoundException", Message: "Contact list not found",
+		}
+
+		_, err := h.forwardMessage(
+			ctx, []byte("Hello, world!"), h.newRoute([]string{"foo@bar.com"}),
+		)
+
+		assert.ErrorContains(t, err, "send failed: api error NotFound")
+		assert.Assert(t, !errors.Is(err, ErrConfigSetNotFound))
+		assert.Equal(t, testSes.sendEmailCalls, 1)
+	})
+
+	t.Run("SendsMessageAtSizeLimit", func(t *testing.T) {
+		testSes, h, ctx := setup()
+		msg := make([]byte, maxSesMessageSize)
+
+		_, err := h.forwardMessage(
+			ctx, msg, h.newRoute([]string{"foo@bar.com"}),
+		)
+
+		assert.NilError(t, err)
+		assert.Equal(t, len(testSes.sendEmailInput.Content.Raw.Data), len(msg))
+	})
+
+	t.Run("ErrorsWithoutSendingIfMessageTooLarge", func(t *testing.T) {
+		testSes, h, ctx := setup()
+		msg := make([]byte, maxSesMessageSize+1)
+
+		fwdId, err := h.forwardMessage(
+			ctx, msg, h.newRoute([]string{"foo@bar.com"}),
+		)
+
+		assert.Equal(t, "", fwdId)
+		expected := fmt.Sprintf(
+			"message too large: %d bytes exceeds %d byte limit",
+			maxSesMessageSize+1, maxSesMessageSize,
+		)
+		assert.ErrorContains(t, err, expected)
+		var forwardErr *ErrForward
+		assert.Assert(t, errors.As(err, &forwardErr))
+		assert.Assert(t, errors.Is(err, ErrMessageTooLarge))
+		assert.Assert(t, is.Nil(testSes.sendEmailInput))
+	})
+
+	t.Run("ErrorsIfMessageExceedsMaxMessageSize", func(t *testing.T) {
+		testSes, h, ctx := setup()
+		h.Options.MaxMessageSize = 1024
+		msg := make([]byte, 1025)
+
+		_, err := h.forwardMessage(
+			ctx, msg, h.newRoute([]string{"foo@bar.com"}),
+		)
+
+		expected := "message too large: 1025 bytes exceeds 1024 byte limit"
+		assert.ErrorContains(t, err, expected)
+		assert.Assert(t, errors.Is(err, ErrMessageTooLarge))
+		assert.Assert(t, is.Nil(testSes.sendEmailInput))
+	})
+
+	t.Run("SendsToMaxSesDestinations", func(t *testing.T) {
+		testSes, h, ctx := setup()
+		h.Options.ArchiveBcc = "archive@bar.com"
+		to := make([]string, maxSesDestinations-1)
+		for i := 0; i < len(to); i++ {
+			to[i] = fmt.Sprintf("user%d@bar.com", i)
+		}
+
+		_, err := h.forwardMessage(ctx, []byte("Hello!"), h.newRoute(to))
+
+		assert.NilError(t, err)
+		assert.Equal(t, testSes.sendEmailCalls, 1)
+	})
+
+	t.Run("ErrorsWithoutSendingIfTooManyRecipients", func(t *testing.T) {
+		testSes, h, ctx := setup()
+		h.Options.ArchiveBcc = "archive@bar.com"
+		to := make([]string, maxSesDestinations)
+		for i := 0; i < len(to); i++ {
+			to[i] = fmt.Sprintf("user%d@bar.com", i)
+		}
+
+		fwdId, err := h.forwardMessage(ctx, []byte("Hello!"), h.newRoute(to))
+
+		assert.Equal(t, "", fwdId)
+		expected := fmt.Sprintf(
+			"too many recipients: %d exceeds the SES limit of %d",
+			maxSesDestinations+1, maxSesDestinations,
+		)
+		assert.ErrorContains(t, err, expected)
+		var forwardErr *ErrForward
+		assert.Assert(t, errors.As(err, &forwardErr))
+		assert.Assert(t, errors.Is(err, ErrTooManyRecipients))
+		assert.Assert(t, is.Nil(testSes.sendEmailInput))
+	})
+
+	setupV1 := func() (*TestSes, *TestSesV2, *Handler, context.Context) {
+		testSesV2, h, ctx := setup()
+		testSes := &TestSes{rawEmailOutput: &ses.SendRawEmailOutput{}}
+		h.Ses = testSes
+		h.Options.SesApiVersion = SesApiVersionV1
+		return testSes, testSesV2, h, ctx
+	}
+
+	t.Run("SendsRawEmailIfSesApiVersionV1", func(t *testing.T) {
+		testSes, testSesV2, h, ctx := setupV1()
+		testSes.rawEmailOutput.MessageId = &forwardedMsgId
+		h.Options.SenderAddress = "ses-forwarder@xyzzy.com"
+		h.Options.SetSesFrom = true
+		h.Options.ArchiveBcc = "archive@xyzzy.com"
+		h.Options.SesMessageTags = []MessageTag{
+			{Name: "category", Value: "forwarded"},
+		}
+		msg := []byte("Hello, world!")
+
+		fwdId, err := h.forwardMessage(
+			ctx, msg, h.newRoute([]string{"foo@bar.com"}),
+		)
+
+		assert.NilError(t, err)
+		assert.Equal(t, forwardedMsgId, fwdId)
+		input := testSes.rawEmailInput
+		assert.DeepEqual(t, msg, input.RawMessage.Data)
+		assert.DeepEqual(
+			t, []string{"foo@bar.com", "archive@xyzzy.com"}, input.Destinations,
+		)
+		assert.Equal(t, "ses-forwarder", *input.ConfigurationSetName)
+		assert.Equal(t, "ses-forwarder@xyzzy.com", *input.Source)
+		assert.Equal(t, len(input.Tags), 1)
+		assert.Equal(t, *input.Tags[0].Name, "category")
+		assert.Equal(t, *input.Tags[0].Value, "forwarded")
+		assert.Assert(t, is.Nil(testSesV2.sendEmailInput))
+	})
+
+	t.Run("OmitsUnsetFieldsIfSesApiVersionV1", func(t *testing.T) {
+		testSes, _, h, ctx := setupV1()
+		h.Options.ConfigurationSet = ""
+
+		_, err := h.forwardMessage(
+			ctx, []byte("Hello, world!"), h.newRoute([]string{"foo@bar.com"}),
+		)
+
+		assert.NilError(t, err)
+		input := testSes.rawEmailInput
+		assert.DeepEqual(t, []string{"foo@bar.com"}, input.Destinations)
+		assert.Assert(t, is.Nil(input.ConfigurationSetName))
+		assert.Assert(t, is.Nil(input.Source))
+		assert.Assert(t, is.Nil(input.Tags))
+	})
+
+	t.Run("ErrorsIfSesApiVersionV1SendingFails", func(t *testing.T) {
+		testSes, _, h, ctx := setupV1()
+		testSes.rawEmailErr = errors.New("SES v1 test error")
+
+		fwdId, err := h.forwardMessage(
+			ctx, []byte("Hello, world!"), h.newRoute([]string{"foo@bar.com"}),
+		)
+
+		assert.Equal(t, "", fwdId)
+		assert.ErrorContains(t, err, "send failed: SES v1 test error")
+		var forwardErr *ErrForward
+		assert.Assert(t, errors.As(err, &forwardErr))
 	})
 }
 
@@ -393,62 +1290,909 @@ var msgBody string = strings.Join([]string{
 	`--random-string--`,
 }, "\r\n")
 
-var testMsg []byte = []byte(beforeHeaders + "\r\n\r\n" + msgBody)
+var testMsg []byte = []byte(beforeHeaders + "\r\n\r\n" + msgBody)
+
+func parseMessage(t *testing.T, msg []byte) *mail.Message {
+	t.Helper()
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	assert.NilError(t, err)
+	return m
+}
+
+func passingSesInfo() *events.SimpleEmailService {
+	pass := events.SimpleEmailVerdict{Status: "PASS"}
+	return &events.SimpleEmailService{
+		Mail: events.SimpleEmailMessage{MessageID: "deadbeef"},
+		Receipt: events.SimpleEmailReceipt{
+			SPFVerdict:   pass,
+			DKIMVerdict:  pass,
+			DMARCVerdict: pass,
+		},
+	}
+}
+
+func newConfigSetNotFoundError() error {
+	return &smithy.GenericAPIError{
+		Code:    "NotFoundException",
+		Message: "Configuration set <ses-forwarder> does not exist.",
+	}
+}
+
+func TestIsConfigSetNotFound(t *testing.T) {
+	t.Run("DetectsSesV2NotFoundException", func(t *testing.T) {
+		err := fmt.Errorf("wrapped: %w", newConfigSetNotFoundError())
+
+		assert.Assert(t, isConfigSetNotFound(err))
+	})
+
+	t.Run("DetectsSesV1Exception", func(t *testing.T) {
+		err := &smithy.GenericAPIError{
+			Code: "ConfigurationSetDoesNotExistException", Message: "nope",
+		}
+
+		assert.Assert(t, isConfigSetNotFound(err))
+	})
+
+	t.Run("IgnoresOtherErrors", func(t *testing.T) {
+		assert.Assert(t, !isConfigSetNotFound(errors.New("not found")))
+		assert.Assert(t, !isConfigSetNotFound(newThrottleError()))
+	})
+}
+
+func TestUpdateMessage(t *testing.T) {
+	ctx := context.Background()
+	sesInfo := passingSesInfo()
+
+	setup := func() (*Handler, *Options) {
+		opts := &Options{
+			BucketName:        "xyzzy.com",
+			SenderAddress:     "ses-updater@xyzzy.com",
+			ForwardingAddress: "quux@xyzzy.com",
+			ConfigurationSet:  "ses-forwarder",
+		}
+		return &Handler{Options: opts}, opts
+	}
+
+	t.Run("Succeeds", func(t *testing.T) {
+		h, opts := setup()
+		msgKey := "prefix/msgId"
+		m := parseMessage(t, testMsg)
+
+		result, err := h.updateMessage(
+			ctx, m, msgKey, sesInfo, h.Options.SenderAddress, nil,
+		)
+
+		assert.NilError(t, err)
+		// The headers appear in the same order as keepHeaders.
+		expected := strings.Join([]string{
+			`From: Mike Bland - mbland at acm.org <` + opts.SenderAddress + `>`,
+			`Reply-To: Mike Bland <mbland@acm.org>`,
+			`To: foo@xyzzy.com`,
+			`Cc: foo@bar.com`,
+			`Bcc: bar@baz.com`,
+			`Subject: There's a reason why we unit test`,
+			`MIME-Version: 1.0`,
+			`Content-Type: multipart/alternative; boundary="random-string"`,
+			`X-Original-Sender: mbland@acm.org`,
+			`X-SES-Forwarder-Original: s3://` + opts.BucketName + `/` + msgKey,
+			``,
+			msgBody,
+		}, "\r\n")
+		assert.Equal(t, expected, string(result))
+	})
+
+	t.Run("AddsAuthenticationResultsIfEnabled", func(t *testing.T) {
+		h, opts := setup()
+		opts.AddAuthResults = true
+		opts.EmailDomainName = "xyzzy.com"
+		m := parseMessage(t, testMsg)
+
+		result, err := h.updateMessage(
+			ctx, m, "prefix/msgId", sesInfo, h.Options.SenderAddress, nil,
+		)
+
+		assert.NilError(t, err)
+		expected := "\r\nAuthentication-Results: xyzzy.com; " +
+			"spf=pass; dkim=pass; dmarc=pass\r\n"
+		assert.Assert(t, is.Contains(string(result), expected))
+	})
+
+	t.Run("SetsDateFromReceiptIfEnabled", func(t *testing.T) {
+		h, opts := setup()
+		opts.DateSource = DateSourceReceipt
+		info := passingSesInfo()
+		info.Receipt.Timestamp = time.Date(
+			1970, time.September, 18, 12, 45, 0, 0, time.UTC,
+		)
+		m := parseMessage(t, testMsg)
+
+		result, err := h.updateMessage(
+			ctx, m, "prefix/msgId", info, h.Options.SenderAddress, nil,
+		)
+
+		assert.NilError(t, err)
+		expected := "\r\nDate: Fri, 18 Sep 1970 12:45:00 +0000\r\n"
+		assert.Assert(t, is.Contains(string(result), expected))
+	})
+
+	setupKeepAlignedFrom := func(verified bool) (*Handler, *TestSesV2) {
+		h, opts := setup()
+		opts.KeepAlignedFrom = true
+		sesV2 := &TestSesV2{
+			getIdentityOutput: &sesv2.GetEmailIdentityOutput{
+				VerifiedForSendingStatus: verified,
+			},
+		}
+		h.SesV2 = sesV2
+		return h, sesV2
+	}
+
+	rewrittenFrom := "From: Mike Bland - mbland at acm.org <" +
+		"ses-updater@xyzzy.com>\r\n" +
+		"Reply-To: Mike Bland <mbland@acm.org>\r\n"
+
+	t.Run("KeepsOriginalFromIfAlignedAndVerified", func(t *testing.T) {
+		h, sesV2 := setupKeepAlignedFrom(true)
+		m := parseMessage(t, testMsg)
+
+		result, err := h.updateMessage(
+			ctx, m, "prefix/msgId", sesInfo, h.Options.SenderAddress, nil,
+		)
+
+		assert.NilError(t, err)
+		expected := "From: Mike Bland <mbland@acm.org>\r\nTo: foo@xyzzy.com\r\n"
+		assert.Assert(t, strings.HasPrefix(string(result), expected))
+		assert.Equal(t, len(sesV2.getIdentityInputs), 1)
+		assert.Equal(t, *sesV2.getIdentityInputs[0].EmailIdentity, "acm.org")
+	})
+
+	t.Run("RewritesFromIfDmarcDidNotPass", func(t *testing.T) {
+		h, sesV2 := setupKeepAlignedFrom(true)
+		info := passingSesInfo()
+		info.Receipt.DMARCVerdict.Status = "FAIL"
+		m := parseMessage(t, testMsg)
+
+		result, err := h.updateMessage(
+			ctx, m, "prefix/msgId", info, h.Options.SenderAddress, nil,
+		)
+
+		assert.NilError(t, err)
+		assert.Assert(t, strings.HasPrefix(string(result), rewrittenFrom))
+		assert.Equal(t, len(sesV2.getIdentityInputs), 0)
+	})
+
+	t.Run("RewritesFromIfDomainNotVerified", func(t *testing.T) {
+		h, _ := setupKeepAlignedFrom(false)
+		m := parseMessage(t, testMsg)
+
+		result, err := h.updateMessage(
+			ctx, m, "prefix/msgId", sesInfo, h.Options.SenderAddress, nil,
+		)
+
+		assert.NilError(t, err)
+		assert.Assert(t, strings.HasPrefix(string(result), rewrittenFrom))
+	})
+
+	t.Run("RewritesFromIfIdentityLookupFails", func(t *testing.T) {
+		h, sesV2 := setupKeepAlignedFrom(true)
+		sesV2.getIdentityErr = errors.New("not found")
+		logs, logger := testLogger()
+		h.Log = logger
+		m := parseMessage(t, testMsg)
+
+		result, err := h.updateMessage(
+			ctx, m, "prefix/msgId", sesInfo, h.Options.SenderAddress, nil,
+		)
+
+		assert.NilError(t, err)
+		assert.Assert(t, strings.HasPrefix(string(result), rewrittenFrom))
+		assertLogsContain(
+			t, logs, "failed to get SES identity acm.org, rewriting From",
+		)
+	})
+
+	t.Run("CachesIdentityLookupPerDomain", func(t *testing.T) {
+		h, sesV2 := setupKeepAlignedFrom(true)
+		now := time.Now()
+		h.Now = func() time.Time { return now }
+		update := func() {
+			t.Helper()
+			_, err := h.updateMessage(
+				ctx, parseMessage(t, testMsg), "prefix/msgId", sesInfo,
+				h.Options.SenderAddress, nil,
+			)
+			assert.NilError(t, err)
+		}
+
+		update()
+		update()
+		assert.Equal(t, len(sesV2.getIdentityInputs), 1)
+
+		now = now.Add(senderIdentityTtl)
+		update()
+		assert.Equal(t, len(sesV2.getIdentityInputs), 2)
+	})
+
+	t.Run("RetriesIdentityLookupIfThrottled", func(t *testing.T) {
+		h, sesV2 := setupKeepAlignedFrom(true)
+		sesV2.getIdentityErr = newThrottleError()
+		_, h.Log = testLogger()
+		h.Sleep = func(context.Context, time.Duration) error { return nil }
+		m := parseMessage(t, testMsg)
+
+		result, err := h.updateMessage(
+			ctx, m, "prefix/msgId", sesInfo, h.Options.SenderAddress, nil,
+		)
+
+		assert.NilError(t, err)
+		assert.Assert(t, strings.HasPrefix(string(result), rewrittenFrom))
+		attempts := len(sesV2.getIdentityInputs)
+		assert.Equal(t, attempts, maxThrottledAttempts)
+	})
+
+	t.Run("SetsToFromReceiptRecipientsIfEnabled", func(t *testing.T) {
+		h, opts := setup()
+		opts.KeepOriginalTo = true
+		info := passingSesInfo()
+		info.Receipt.Recipients = []string{"sales@xyzzy.com", "info@xyzzy.com"}
+		m := parseMessage(t, testMsg)
+
+		result, err := h.updateMessage(
+			ctx, m, "prefix/msgId", info, h.Options.SenderAddress, nil,
+		)
+
+		assert.NilError(t, err)
+		expected := "\r\nTo: sales@xyzzy.com, info@xyzzy.com\r\n"
+		assert.Assert(t, is.Contains(string(result), expected))
+		assert.Assert(t, !strings.Contains(string(result), "foo@xyzzy.com"))
+	})
+
+	t.Run("AddsToFromReceiptRecipientsIfMissing", func(t *testing.T) {
+		h, opts := setup()
+		opts.KeepOriginalTo = true
+		info := passingSesInfo()
+		info.Receipt.Recipients = []string{"sales@xyzzy.com"}
+		m := parseMessage(t, testMsg)
+		delete(m.Header, "To")
+
+		result, err := h.updateMessage(
+			ctx, m, "prefix/msgId", info, h.Options.SenderAddress, nil,
+		)
+
+		assert.NilError(t, err)
+		expected := "\r\nTo: sales@xyzzy.com\r\n"
+		assert.Assert(t, is.Contains(string(result), expected))
+	})
+
+	t.Run("AddsForwardedForHeaderIfEnabled", func(t *testing.T) {
+		h, opts := setup()
+		opts.AddForwardedFor = true
+		info := passingSesInfo()
+		info.Receipt.Recipients = []string{"sales@xyzzy.com"}
+		m := parseMessage(t, testMsg)
+
+		result, err := h.updateMessage(
+			ctx, m, "prefix/msgId", info, h.Options.SenderAddress, nil,
+		)
+
+		assert.NilError(t, err)
+		expected := "\r\nX-Forwarded-For-Mail: sales@xyzzy.com by " +
+			h.Options.SenderAddress + "\r\n"
+		assert.Assert(t, is.Contains(string(result), expected))
+	})
+
+	t.Run("KeepsOriginalToByDefault", func(t *testing.T) {
+		h, _ := setup()
+		info := passingSesInfo()
+		info.Receipt.Recipients = []string{"sales@xyzzy.com"}
+		m := parseMessage(t, testMsg)
+
+		result, err := h.updateMessage(
+			ctx, m, "prefix/msgId", info, h.Options.SenderAddress, nil,
+		)
+
+		assert.NilError(t, err)
+		expected := "\r\nTo: foo@xyzzy.com\r\n"
+		assert.Assert(t, is.Contains(string(result), expected))
+		assert.Assert(t, !strings.Contains(string(result), "sales@xyzzy.com"))
+	})
+
+	t.Run("UsesInternalReplyToForSenderAtEmailDomain", func(t *testing.T) {
+		h, opts := setup()
+		opts.EmailDomainName = "acm.org"
+		opts.InternalReplyTo = "shared@acm.org"
+		m := parseMessage(t, testMsg)
+
+		result, err := h.updateMessage(
+			ctx, m, "prefix/msgId", sesInfo, h.Options.SenderAddress, nil,
+		)
+
+		assert.NilError(t, err)
+		expected := "\r\nReply-To: shared@acm.org\r\n"
+		assert.Assert(t, is.Contains(string(result), expected))
+	})
+
+	t.Run("UsesCustomFromAtReplacement", func(t *testing.T) {
+		h, opts := setup()
+		opts.FromAtReplacement = "_at_"
+		m := parseMessage(t, testMsg)
+
+		result, err := h.updateMessage(
+			ctx, m, "prefix/msgId", sesInfo, h.Options.SenderAddress, nil,
+		)
+
+		assert.NilError(t, err)
+		expected := "From: Mike Bland - mbland_at_acm.org <" +
+			opts.SenderAddress + ">\r\n"
+		assert.Assert(t, is.Contains(string(result), expected))
+	})
+
+	t.Run("KeepsUnstrippedHeadersInDenylistMode", func(t *testing.T) {
+		h, opts := setup()
+		opts.HeaderMode = HeaderModeDenylist
+		opts.StripHeaders = []string{"Received"}
+		m := parseMessage(t, testMsg)
+
+		result, err := h.updateMessage(
+			ctx, m, "prefix/msgId", sesInfo, h.Options.SenderAddress, nil,
+		)
+
+		assert.NilError(t, err)
+		headers := string(result[:bytes.Index(result, []byte("\r\n\r\n"))])
+		assert.Assert(t, is.Contains(headers, "\r\nX-Ses-Spam-Verdict: PASS"))
+		assert.Assert(t, !strings.Contains(headers, "Received:"))
+		assert.Assert(t, !strings.Contains(headers, "Return-Path:"))
+	})
+
+	t.Run("AppliesHeaderNameOverrides", func(t *testing.T) {
+		h, opts := setup()
+		opts.HeaderNameOverrides = []string{"X-ORIGINAL-SENDER"}
+		m := parseMessage(t, testMsg)
+
+		result, err := h.updateMessage(
+			ctx, m, "prefix/msgId", sesInfo, h.Options.SenderAddress, nil,
+		)
+
+		assert.NilError(t, err)
+		assert.Assert(t, is.Contains(string(result), "\r\nMIME-Version: 1.0"))
+		expected := "\r\nX-ORIGINAL-SENDER: mbland@acm.org\r\n"
+		assert.Assert(t, is.Contains(string(result), expected))
+	})
+
+	t.Run("ConvertsToPlainTextIfEnabled", func(t *testing.T) {
+		h, opts := setup()
+		opts.PlainTextOnly = true
+		msgKey := "prefix/msgId"
+		m := parseMessage(t, testMsg)
+
+		result, err := h.updateMessage(
+			ctx, m, msgKey, sesInfo, h.Options.SenderAddress, nil,
+		)
+
+		assert.NilError(t, err)
+		expected := strings.Join([]string{
+			`From: Mike Bland - mbland at acm.org <` + opts.SenderAddress + `>`,
+			`Reply-To: Mike Bland <mbland@acm.org>`,
+			`To: foo@xyzzy.com`,
+			`Cc: foo@bar.com`,
+			`Bcc: bar@baz.com`,
+			`Subject: There's a reason why we unit test`,
+			`MIME-Version: 1.0`,
+			`Content-Type: text/plain; charset=UTF-8`,
+			`Content-Transfer-Encoding: quoted-printable`,
+			`X-Original-Sender: mbland@acm.org`,
+			`X-SES-Forwarder-Original: s3://` + opts.BucketName + `/` + msgKey,
+			``,
+			`Sometimes the getting smallest detail wrong breaks everything.`,
+			``,
+		}, "\r\n")
+		assert.Equal(t, expected, string(result))
+	})
+
+	t.Run("DefangsUrlsIfEnabled", func(t *testing.T) {
+		h, opts := setup()
+		opts.DefangUrls = true
+		m := parseMessage(t, []byte(strings.Join([]string{
+			`From: mbland@acm.org`,
+			`Content-Type: text/plain; charset=UTF-8`,
+			``,
+			`Log in at https://evil.com/login.`,
+		}, "\r\n")))
+
+		result, err := h.updateMessage(
+			ctx, m, "prefix/msgId", sesInfo, h.Options.SenderAddress, nil,
+		)
+
+		assert.NilError(t, err)
+		assert.Assert(t, is.Contains(
+			string(result), "Content-Transfer-Encoding: quoted-printable\r\n",
+		))
+		_, body, _ := strings.Cut(string(result), "\r\n\r\n")
+		assert.Equal(t, body, "Log in at hxxps://evil.com/login.")
+	})
+
+	t.Run("StripsTrackingPixelsIfEnabled", func(t *testing.T) {
+		h, opts := setup()
+		opts.StripTrackingPixels = true
+		m := parseMessage(t, []byte(strings.Join([]string{
+			`From: mbland@acm.org`,
+			`Content-Type: text/html; charset=UTF-8`,
+			``,
+			`<p>Hi</p><img src="https://t.example.com/o" width=1 height=1>`,
+		}, "\r\n")))
+
+		result, err := h.updateMessage(
+			ctx, m, "prefix/msgId", sesInfo, h.Options.SenderAddress, nil,
+		)
+
+		assert.NilError(t, err)
+		_, body, _ := strings.Cut(string(result), "\r\n\r\n")
+		assert.Equal(t, body, "<p>Hi</p>")
+	})
+
+	t.Run("ErrorsIfPlainTextConversionFails", func(t *testing.T) {
+		h, opts := setup()
+		opts.PlainTextOnly = true
+		badMsg := []byte(strings.Join([]string{
+			`From: mbland@acm.org`,
+			`Content-Type: multipart/alternative; boundary="random-string"`,
+			``,
+			`--random-string--`,
+		}, "\r\n"))
+
+		m := parseMessage(t, badMsg)
+
+		result, err := h.updateMessage(
+			ctx, m, "prefix/msgId", sesInfo, h.Options.SenderAddress, nil,
+		)
+
+		assert.Equal(t, string(result), "")
+		expected := "failed to convert message to plain text: "
+		assert.ErrorContains(t, err, expected)
+		var transformErr *ErrTransform
+		assert.Assert(t, errors.As(err, &transformErr))
+	})
+
+	t.Run("ErrorsIfReadingBodyFails", func(t *testing.T) {
+		h, _ := setup()
+		m := parseMessage(t, testMsg)
+		m.Body = &originalMessageReader{
+			ReadCloser: io.NopCloser(
+				&ErrReader{errors.New("test read error")},
+			),
+		}
+
+		result, err := h.updateMessage(
+			ctx, m, "prefix/msgId", sesInfo, h.Options.SenderAddress, nil,
+		)
+
+		assert.Equal(t, string(result), "")
+		expected := "failed to get original message: test read error"
+		assert.ErrorContains(t, err, expected)
+		var fetchErr *ErrFetch
+		assert.Assert(t, errors.As(err, &fetchErr))
+	})
+
+	t.Run("ErrorsIfUpdatingHeadersFails", func(t *testing.T) {
+		h, _ := setup()
+		badMsg := []byte("From: D'oh!\r\n\r\nThis is only a test.\r\n")
+
+		m := parseMessage(t, badMsg)
+
+		result, err := h.updateMessage(
+			ctx, m, "prefix/msgId", sesInfo, h.Options.SenderAddress, nil,
+		)
+
+		assert.Equal(t, string(result), "")
+		expected := "error updating email headers: " +
+			"couldn't parse From address D'oh!:"
+		assert.ErrorContains(t, err, expected)
+		var transformErr *ErrTransform
+		assert.Assert(t, errors.As(err, &transformErr))
+	})
+}
+
+var dsnMsg []byte = []byte(strings.Join([]string{
+	`From: Mail Delivery Subsystem <mailer-daemon@foo.com>`,
+	`To: mbland@acm.org`,
+	`Subject: Delivery Status Notification (Failure)`,
+	`MIME-Version: 1.0`,
+	`Content-Type: multipart/report; report-type=delivery-status;`,
+	` boundary="random-string"`,
+	``,
+	`--random-string`,
+	`Content-Type: text/plain; charset="UTF-8"`,
+	``,
+	`Your message wasn't delivered.`,
+	``,
+	`--random-string`,
+	`Content-Type: message/delivery-status`,
+	``,
+	`Reporting-MTA: dns; foo.com`,
+	``,
+	`Final-Recipient: rfc822; nobody@foo.com`,
+	`Action: failed`,
+	`Status: 5.1.1`,
+	``,
+	`--random-string--`,
+}, "\r\n"))
+
+var mdnMsg []byte = []byte(strings.Join([]string{
+	`From: Mike Bland <mbland@acm.org>`,
+	`To: foo@xyzzy.com`,
+	`Subject: Read: There's a reason why we unit test`,
+	`MIME-Version: 1.0`,
+	`Content-Type: multipart/report; report-type=disposition-notification;`,
+	` boundary="random-string"`,
+	``,
+	`--random-string`,
+	`Content-Type: text/plain; charset="UTF-8"`,
+	``,
+	`Your message was displayed.`,
+	``,
+	`--random-string`,
+	`Content-Type: message/disposition-notification`,
+	``,
+	`Reporting-UA: acm.org; Mail`,
+	`Final-Recipient: rfc822; mbland@acm.org`,
+	`Original-Message-ID: <deadbeef@xyzzy.com>`,
+	`Disposition: manual-action/MDN-sent-manually; displayed`,
+	``,
+	`--random-string--`,
+}, "\r\n"))
+
+func TestNormalizeAddress(t *testing.T) {
+	t.Run("LowercasesWholeAddressByDefault", func(t *testing.T) {
+		assert.Equal(t, normalizeAddress("Mike@ACM.org", false), "mike@acm.org")
+	})
+
+	t.Run("LowercasesOnlyDomainIfCaseSensitive", func(t *testing.T) {
+		assert.Equal(t, normalizeAddress("Mike@ACM.org", true), "Mike@acm.org")
+	})
+
+	t.Run("UsesLastAtSignToFindDomain", func(t *testing.T) {
+		addr := `"Mike@Home"@ACM.org`
+
+		assert.Equal(t, normalizeAddress(addr, true), `"Mike@Home"@acm.org`)
+	})
+
+	t.Run("TreatsAddressWithoutDomainAsLocalPart", func(t *testing.T) {
+		assert.Equal(t, normalizeAddress("Postmaster", false), "postmaster")
+		assert.Equal(t, normalizeAddress("Postmaster", true), "Postmaster")
+	})
+}
+
+func TestSplitMessage(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		rawHeader, m, err := splitMessage(bytes.NewReader(testMsg))
+
+		assert.NilError(t, err)
+		assert.Equal(t, string(rawHeader), beforeHeaders+"\r\n\r\n")
+		subject := m.Header.Get("Subject")
+		assert.Equal(t, subject, "There's a reason why we unit test")
+		body, err := io.ReadAll(m.Body)
+		assert.NilError(t, err)
+		assert.Equal(t, string(body), msgBody)
+	})
+
+	t.Run("SucceedsWithHeadersOnly", func(t *testing.T) {
+		rawHeader, m, err := splitMessage(strings.NewReader("Subject: Hi"))
+
+		assert.NilError(t, err)
+		assert.Equal(t, string(rawHeader), "Subject: Hi")
+		assert.Equal(t, m.Header.Get("Subject"), "Hi")
+	})
+
+	t.Run("ErrorsIfParsingHeadersFails", func(t *testing.T) {
+		_, _, err := splitMessage(strings.NewReader("not an email"))
+
+		assert.ErrorContains(t, err, "failed to parse message: ")
+		var transformErr *ErrTransform
+		assert.Assert(t, errors.As(err, &transformErr))
+	})
+
+	t.Run("ErrorsIfReadingHeadersFails", func(t *testing.T) {
+		orig := &originalMessageReader{
+			ReadCloser: io.NopCloser(
+				&ErrReader{errors.New("test read error")},
+			),
+		}
+
+		_, _, err := splitMessage(orig)
+
+		expected := "failed to get original message: test read error"
+		assert.ErrorContains(t, err, expected)
+		var fetchErr *ErrFetch
+		assert.Assert(t, errors.As(err, &fetchErr))
+	})
+}
+
+func TestIsDeliveryStatusNotification(t *testing.T) {
+	t.Run("ReturnsTrueForDeliveryStatusReport", func(t *testing.T) {
+		header := parseMessage(t, dsnMsg).Header
+
+		assert.Assert(t, isDeliveryStatusNotification(header) == true)
+	})
+
+	t.Run("ReturnsFalseForOtherMessages", func(t *testing.T) {
+		header := parseMessage(t, testMsg).Header
+
+		assert.Check(t, isDeliveryStatusNotification(header) == false)
+		assert.Assert(t, isDeliveryStatusNotification(mail.Header{}) == false)
+	})
+}
+
+func TestIsReport(t *testing.T) {
+	t.Run("ReturnsTrueForAnyReport", func(t *testing.T) {
+		assert.Check(t, isReport(parseMessage(t, dsnMsg).Header) == true)
+		assert.Check(t, isReport(parseMessage(t, mdnMsg).Header) == true)
+	})
+
+	t.Run("ReturnsFalseForOtherMessages", func(t *testing.T) {
+		assert.Check(t, isReport(parseMessage(t, testMsg).Header) == false)
+		assert.Check(t, isReport(mail.Header{}) == false)
+	})
+}
+
+func TestPrepareMessage(t *testing.T) {
+	sesInfo := passingSesInfo()
+	ctx := context.Background()
+
+	setup := func() (*Handler, *TestLogs) {
+		logs, logger := testLogger()
+		opts := &Options{
+			BucketName:        "xyzzy.com",
+			SenderAddress:     "ses-updater@xyzzy.com",
+			ForwardingAddress: "quux@xyzzy.com",
+		}
+		return &Handler{Options: opts, Log: logger}, logs
+	}
+
+	t.Run("UpdatesNormalMessage", func(t *testing.T) {
+		h, _ := setup()
+
+		result, r, err := h.prepareMessage(
+			ctx, bytes.NewReader(testMsg), "prefix/msgId", sesInfo, nil,
+		)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, r.To, []string{h.Options.ForwardingAddress})
+		assert.Assert(t, is.Contains(string(result), origLinkHeaderPrefix))
+	})
+
+	t.Run("SetsRouteRecipientsToIncomingRecipients", func(t *testing.T) {
+		h, _ := setup()
+		info := passingSesInfo()
+		info.Receipt.Recipients = []string{"me@foo.com", "you@foo.com"}
+
+		_, r, err := h.prepareMessage(
+			ctx, bytes.NewReader(testMsg), "prefix/msgId", info, nil,
+		)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, r.Recipients, []string{"me@foo.com", "you@foo.com"})
+	})
+
+	t.Run("OnlyAddsOrigLinkIfRewriteNone", func(t *testing.T) {
+		h, _ := setup()
+		h.Options.Rewrite = RewriteNone
+
+		result, r, err := h.prepareMessage(
+			ctx, bytes.NewReader(testMsg), "prefix/msgId", sesInfo, nil,
+		)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, r.To, []string{h.Options.ForwardingAddress})
+		expected := beforeHeaders + "\r\n" +
+			origLinkHeaderPrefix + "xyzzy.com/prefix/msgId\r\n" +
+			"\r\n" + msgBody
+		assert.Equal(t, string(result), expected)
+	})
+
+	t.Run("AddsConsoleOrigLinkToMessageWithoutBodyIfRewriteNone",
+		func(t *testing.T) {
+			h, _ := setup()
+			h.Options.Rewrite = RewriteNone
+			h.Options.OriginLinkFormat = OriginLinkFormatConsole
+			h.Options.AwsRegion = "us-east-1"
+			msg := "From: mbland@acm.org\r\nSubject: No body\r\n"
+
+			result, _, err := h.prepareMessage(
+				ctx, strings.NewReader(msg), "prefix/msgId", sesInfo, nil,
+			)
+
+			assert.NilError(t, err)
+			link := consoleLink("xyzzy.com/prefix/msgId", "us-east-1")
+			expected := msg + origLinkHeader + ": " + link + "\r\n\r\n"
+			assert.Equal(t, string(result), expected)
+		},
+	)
+
+	t.Run("KeepsLfLineEndingsIfRewriteNone", func(t *testing.T) {
+		h, _ := setup()
+		h.Options.Rewrite = RewriteNone
+		lfHeaders := strings.ReplaceAll(beforeHeaders, "\r\n", "\n")
+		lfBody := strings.ReplaceAll(msgBody, "\r\n", "\n")
+		lfMsg := lfHeaders + "\n\n" + lfBody
+
+		result, _, err := h.prepareMessage(
+			ctx, strings.NewReader(lfMsg), "prefix/msgId", sesInfo, nil,
+		)
+
+		assert.NilError(t, err)
+		expected := lfHeaders + "\n" +
+			origLinkHeaderPrefix + "xyzzy.com/prefix/msgId\n" +
+			"\n" + lfBody
+		assert.Equal(t, string(result), expected)
+	})
+
+	t.Run("NormalizesLineEndings", func(t *testing.T) {
+		h, _ := setup()
+		macMsg := strings.ReplaceAll(string(testMsg), "\r\n", "\r")
+
+		result, _, err := h.prepareMessage(
+			ctx, strings.NewReader(macMsg), "prefix/msgId", sesInfo, nil,
+		)
+
+		assert.NilError(t, err)
+		assert.Assert(t, is.Contains(string(result), "\r\n\r\n"+msgBody))
+		expected := "Subject: There's a reason why we unit test\r\n"
+		assert.Assert(t, is.Contains(string(result), expected))
+	})
+
+	t.Run("DropsMessageAlreadyForwarded", func(t *testing.T) {
+		h, logs := setup()
+		forwarded := origLinkHeaderPrefix + "xyzzy.com/prefix/origId\r\n" +
+			string(testMsg)
+
+		result, _, err := h.prepareMessage(
+			ctx, strings.NewReader(forwarded), "prefix/msgId", sesInfo, nil,
+		)
+
+		assert.Assert(t, is.Nil(result))
+		expected := "forwarding loop detected: " + origLinkHeader + " present"
+		assert.ErrorContains(t, err, expected)
+		var validationErr *ErrValidation
+		assert.Assert(t, errors.As(err, &validationErr))
+		assertLogsContain(
+			t, logs, "re-ingested forward, skipping prefix/msgId: "+
+				"s3://xyzzy.com/prefix/origId",
+		)
+	})
+
+	t.Run("ForwardsMessageAlreadyForwardedIfAllowed", func(t *testing.T) {
+		h, logs := setup()
+		h.Options.AllowReforward = true
+		forwarded := origLinkHeaderPrefix + "xyzzy.com/prefix/origId\r\n" +
+			string(testMsg)
+
+		result, _, err := h.prepareMessage(
+			ctx, strings.NewReader(forwarded), "prefix/msgId", sesInfo, nil,
+		)
+
+		assert.NilError(t, err)
+		links := strings.Count(string(result), origLinkHeader+":")
+		assert.Equal(t, links, 1)
+		expected := origLinkHeaderPrefix + "xyzzy.com/prefix/msgId\r\n"
+		assert.Assert(t, is.Contains(string(result), expected))
+		assertLogsContain(
+			t, logs, "re-forwarding prefix/msgId, "+
+				"originally s3://xyzzy.com/prefix/origId",
+		)
+	})
+
+	t.Run("DropsMessageIfDestinationIsRecipient", func(t *testing.T) {
+		h, _ := setup()
+		loopInfo := passingSesInfo()
+		loopInfo.Receipt.Recipients = []string{"QUUX@xyzzy.com"}
+
+		result, _, err := h.prepareMessage(
+			ctx, bytes.NewReader(testMsg), "prefix/msgId", loopInfo, nil,
+		)
+
+		assert.Assert(t, is.Nil(result))
+		expected := "forwarding loop detected: " +
+			"quux@xyzzy.com is also a recipient"
+		assert.ErrorContains(t, err, expected)
+	})
+
+	t.Run("RewritesOnlyHeadersOfDeliveryStatusNotification",
+		func(t *testing.T) {
+			h, logs := setup()
+			h.Options.PlainTextOnly = true
+
+			result, r, err := h.prepareMessage(
+				ctx, bytes.NewReader(dsnMsg), "prefix/msgId", sesInfo, nil,
+			)
+
+			assert.NilError(t, err)
+			assert.DeepEqual(t, r.To, []string{h.Options.ForwardingAddress})
+			expectedFrom := "From: Mail Delivery Subsystem - " +
+				"mailer-daemon at foo.com <ses-updater@xyzzy.com>\r\n"
+			assert.Assert(t, strings.HasPrefix(string(result), expectedFrom))
+			assert.Assert(t, is.Contains(
+				string(result), origLinkHeaderPrefix+"xyzzy.com/prefix/msgId",
+			))
+			_, origBody, _ := strings.Cut(string(dsnMsg), "\r\n\r\n")
+			_, body, _ := strings.Cut(string(result), "\r\n\r\n")
+			assert.Equal(t, body, origBody)
+			expected := "forwarding delivery status notification prefix/msgId"
+			assertLogsContain(t, logs, expected)
+		},
+	)
+
+	t.Run("SendsDeliveryStatusNotificationToBounceAddress", func(t *testing.T) {
+		h, _ := setup()
+		h.Options.BounceHandlingAddress = "bounces@xyzzy.com"
+
+		result, r, err := h.prepareMessage(
+			ctx, bytes.NewReader(dsnMsg), "prefix/msgId", sesInfo, nil,
+		)
 
-func TestUpdateMessage(t *testing.T) {
-	setup := func() (*Handler, *Options) {
-		opts := &Options{
-			BucketName:        "xyzzy.com",
-			SenderAddress:     "ses-updater@xyzzy.com",
-			ForwardingAddress: "quux@xyzzy.com",
-			ConfigurationSet:  "ses-forwarder",
-		}
-		return &Handler{Options: opts}, opts
-	}
+		assert.NilError(t, err)
+		assert.DeepEqual(t, r.To, []string{"bounces@xyzzy.com"})
+		assert.Assert(t, is.Contains(
+			string(result), "<ses-updater@xyzzy.com>\r\n",
+		))
+	})
 
-	t.Run("Succeeds", func(t *testing.T) {
-		h, opts := setup()
-		msgKey := "prefix/msgId"
+	t.Run("RewritesOnlyHeadersOfReportIfEnabled", func(t *testing.T) {
+		h, logs := setup()
+		h.Options.ForwardReports = true
+		h.Options.BounceHandlingAddress = "bounces@xyzzy.com"
+		h.Options.DefangUrls = true
 
-		result, err := h.updateMessage(testMsg, msgKey)
+		result, r, err := h.prepareMessage(
+			ctx, bytes.NewReader(mdnMsg), "prefix/msgId", sesInfo, nil,
+		)
 
 		assert.NilError(t, err)
-		// The headers appear in the same order as keepHeaders.
-		expected := strings.Join([]string{
-			`From: Mike Bland - mbland at acm.org <` + opts.SenderAddress + `>`,
-			`Reply-To: Mike Bland <mbland@acm.org>`,
-			`To: foo@xyzzy.com`,
-			`Cc: foo@bar.com`,
-			`Bcc: bar@baz.com`,
-			`Subject: There's a reason why we unit test`,
-			`MIME-Version: 1.0`,
-			`Content-Type: multipart/alternative; boundary="random-string"`,
-			`X-SES-Forwarder-Original: s3://` + opts.BucketName + `/` + msgKey,
-			``,
-			msgBody,
-		}, "\r\n")
-		assert.Equal(t, expected, string(result))
+		assert.DeepEqual(t, r.To, []string{h.Options.ForwardingAddress})
+		expectedFrom := "From: Mike Bland - mbland at acm.org " +
+			"<ses-updater@xyzzy.com>\r\n" +
+			"Reply-To: Mike Bland <mbland@acm.org>\r\n"
+		assert.Assert(t, strings.HasPrefix(string(result), expectedFrom))
+		assert.Assert(t, is.Contains(
+			string(result), origLinkHeaderPrefix+"xyzzy.com/prefix/msgId",
+		))
+		assert.Assert(t, is.Contains(
+			string(result),
+			"Content-Type: multipart/report; "+
+				"report-type=disposition-notification;",
+		))
+		_, origBody, _ := strings.Cut(string(mdnMsg), "\r\n\r\n")
+		_, body, _ := strings.Cut(string(result), "\r\n\r\n")
+		assert.Equal(t, body, origBody)
+		assertLogsContain(
+			t, logs, "forwarding report prefix/msgId with body intact",
+		)
 	})
 
-	t.Run("ErrorsIfReadingMessageFails", func(t *testing.T) {
+	t.Run("RewritesReportIfNotEnabled", func(t *testing.T) {
 		h, _ := setup()
 
-		result, err := h.updateMessage([]byte("not an email"), "prefix/msgId")
+		result, _, err := h.prepareMessage(
+			ctx, bytes.NewReader(mdnMsg), "prefix/msgId", sesInfo, nil,
+		)
 
-		assert.Equal(t, string(result), "")
-		assert.ErrorContains(t, err, "failed to parse message: ")
+		assert.NilError(t, err)
+		expected := "From: Mike Bland - mbland at acm.org <" +
+			h.Options.SenderAddress + ">\r\n"
+		assert.Assert(t, strings.HasPrefix(string(result), expected))
 	})
 
-	t.Run("ErrorsIfUpdatingHeadersFails", func(t *testing.T) {
+	t.Run("ErrorsIfUpdatingMessageFails", func(t *testing.T) {
 		h, _ := setup()
-		badMsg := []byte("From: D'oh!\r\n\r\nThis is only a test.\r\n")
 
-		result, err := h.updateMessage(badMsg, "prefix/msgId")
+		_, _, err := h.prepareMessage(
+			ctx,
+			strings.NewReader("not an email"),
+			"prefix/msgId",
+			sesInfo,
+			nil,
+		)
 
-		assert.Equal(t, string(result), "")
-		expected := "error updating email headers: " +
-			"couldn't parse From address D'oh!:"
-		assert.ErrorContains(t, err, expected)
+		assert.ErrorContains(t, err, "failed to parse message: ")
 	})
 }
 
@@ -493,6 +2237,40 @@ func newHandleEventFixture() *handleEventFixture {
 	return &handleEventFixture{testS3, testSesV2, event, forwardedId, logs, h}
 }
 
+func TestLogHeaders(t *testing.T) {
+	setup := func() (*Handler, *TestLogs) {
+		logs, logger := testLogger()
+		h := &Handler{Options: &Options{LogHeaders: true}, Log: logger}
+		return h, logs
+	}
+
+	t.Run("TruncatesLongHeaderLines", func(t *testing.T) {
+		h, logs := setup()
+		longValue := strings.Repeat("x", maxLoggedHeaderLineLen)
+		msg := []byte("Subject: hello\r\nX-Long: " + longValue +
+			"\r\n\r\nbody text")
+
+		h.logHeaders(context.Background(), "prefix/msgId", msg)
+
+		truncated := "X-Long: " +
+			longValue[:maxLoggedHeaderLineLen-len("X-Long: ")] +
+			"...(truncated)"
+		expected := "headers for prefix/msgId:\nSubject: hello\n" + truncated
+		assertLogsContain(t, logs, expected)
+		assert.Assert(t, !strings.Contains(logs.String(), "body text"))
+	})
+
+	t.Run("DoesNotSplitMultibyteCharacters", func(t *testing.T) {
+		h, logs := setup()
+		longValue := "X-Long: x" + strings.Repeat("é", maxLoggedHeaderLineLen)
+
+		h.logHeaders(context.Background(), "prefix/msgId", []byte(longValue))
+
+		expected := longValue[:maxLoggedHeaderLineLen-1] + "...(truncated)"
+		assertLogsContain(t, logs, expected)
+	})
+}
+
 func TestProcessMesssage(t *testing.T) {
 	setup := func() (
 		f *handleEventFixture,
@@ -514,14 +2292,225 @@ func TestProcessMesssage(t *testing.T) {
 	t.Run("Succeeds", func(t *testing.T) {
 		f, sesInfo, msgKey, ctx := setup()
 
-		f.h.processMessage(ctx, sesInfo)
+		result, err := f.h.processMessage(ctx, sesInfo)
 
+		assert.NilError(t, err)
+		assert.DeepEqual(t, result, ProcessResult{
+			Key:         msgKey,
+			MessageId:   "deadbeef",
+			ForwardedId: f.forwardedId,
+		})
 		assertLogsContain(t, f.logs, "forwarding message "+msgKey)
 		successLogMsg := "successfully forwarded message " + msgKey +
 			" as " + f.forwardedId
 		assertLogsContain(t, f.logs, successLogMsg)
 	})
 
+	t.Run("ForwardsIfNoRecipientsInReceipt", func(t *testing.T) {
+		f, sesInfo, msgKey, ctx := setup()
+
+		_, err := f.h.processMessage(ctx, sesInfo)
+
+		assert.NilError(t, err)
+		assertLogsContain(t, f.logs, "[deadbeef] no recipients in receipt")
+		assert.DeepEqual(
+			t,
+			f.sesv2.sendEmailInput.Destination.ToAddresses,
+			[]string{"foo@bar.com"},
+		)
+		assertLogsContain(t, f.logs, "successfully forwarded message "+msgKey)
+	})
+
+	t.Run("DropsIfNoRecipientsInReceiptAndActionIsDrop", func(t *testing.T) {
+		f, sesInfo, msgKey, ctx := setup()
+		f.h.Options.EmptyRecipientsAction = EmptyRecipientsActionDrop
+
+		_, err := f.h.processMessage(ctx, sesInfo)
+
+		var validationErr *ErrValidation
+		assert.Assert(t, errors.As(err, &validationErr))
+		assertLogsContain(t, f.logs, "[deadbeef] no recipients in receipt")
+		assertLogsContain(
+			t, f.logs, errMsg(msgKey, "no recipients in receipt"),
+		)
+		assert.Assert(t, is.Nil(f.sesv2.sendEmailInput))
+	})
+
+	t.Run("WritesDebugCopyBeforeForwarding", func(t *testing.T) {
+		f, sesInfo, _, ctx := setup()
+		f.h.Options.DebugWritePrefix = "debug"
+
+		_, err := f.h.processMessage(ctx, sesInfo)
+
+		assert.NilError(t, err)
+		assert.Assert(t, f.s3.putInput != nil)
+		assert.Equal(t, "mail.bar.com", *f.s3.putInput.Bucket)
+		assert.Equal(t, "debug/deadbeef", *f.s3.putInput.Key)
+		forwarded := f.sesv2.sendEmailInput.Content.Raw.Data
+		assert.Equal(t, string(forwarded), string(f.s3.putBody))
+		assertLogsContain(t, f.logs, "wrote debug copy debug/deadbeef")
+	})
+
+	t.Run("DoesNotWriteDebugCopyByDefault", func(t *testing.T) {
+		f, sesInfo, _, ctx := setup()
+
+		_, err := f.h.processMessage(ctx, sesInfo)
+
+		assert.NilError(t, err)
+		assert.Assert(t, is.Nil(f.s3.putInput))
+	})
+
+	t.Run("ForwardsEvenIfWritingDebugCopyFails", func(t *testing.T) {
+		f, sesInfo, _, ctx := setup()
+		f.h.Options.DebugWritePrefix = "debug"
+		f.s3.putErr = errors.New("S3 put error")
+
+		_, err := f.h.processMessage(ctx, sesInfo)
+
+		assert.NilError(t, err)
+		assert.Assert(t, f.sesv2.sendEmailInput != nil)
+		assertLogsContain(
+			t,
+			f.logs,
+			"failed to write debug copy debug/deadbeef: S3 put error",
+		)
+	})
+
+	t.Run("StoresMessageInS3IfForwardTargetIsS3", func(t *testing.T) {
+		f, sesInfo, msgKey, ctx := setup()
+		f.h.Options.ForwardTarget = ForwardTargetS3
+		f.h.Options.DestBucket = "archive.bar.com"
+		f.h.Options.DestPrefix = "forwarded"
+
+		_, err := f.h.processMessage(ctx, sesInfo)
+
+		assert.NilError(t, err)
+		assert.Assert(t, is.Nil(f.sesv2.sendEmailInput))
+		assert.Assert(t, f.s3.putInput != nil)
+		assert.Equal(t, "archive.bar.com", *f.s3.putInput.Bucket)
+		assert.Equal(t, "forwarded/deadbeef", *f.s3.putInput.Key)
+		assert.Assert(t, is.Contains(string(f.s3.putBody), "\r\n\r\n"))
+		successLogMsg := "successfully forwarded message " + msgKey +
+			" as s3://archive.bar.com/forwarded/deadbeef"
+		assertLogsContain(t, f.logs, successLogMsg)
+	})
+
+	t.Run("StoresMessageWithoutPrefixIfDestPrefixEmpty", func(t *testing.T) {
+		f, sesInfo, _, ctx := setup()
+		f.h.Options.ForwardTarget = ForwardTargetS3
+		f.h.Options.DestBucket = "archive.bar.com"
+
+		_, err := f.h.processMessage(ctx, sesInfo)
+
+		assert.NilError(t, err)
+		assert.Equal(t, "deadbeef", *f.s3.putInput.Key)
+	})
+
+	t.Run("ErrorsIfStoringMessageFails", func(t *testing.T) {
+		f, sesInfo, msgKey, ctx := setup()
+		f.h.Options.ForwardTarget = ForwardTargetS3
+		f.h.Options.DestBucket = "archive.bar.com"
+		f.s3.putErr = errors.New("S3 put error")
+
+		_, err := f.h.processMessage(ctx, sesInfo)
+
+		var forwardErr *ErrForward
+		assert.Assert(t, errors.As(err, &forwardErr))
+		assert.Assert(t, errors.Is(err, f.s3.putErr))
+		expected := "failed to store s3://archive.bar.com/deadbeef: " +
+			"S3 put error"
+		assertLogsContain(t, f.logs, errMsg(msgKey, expected))
+	})
+
+	t.Run("EmitsSelectedObjectMetadataHeaders", func(t *testing.T) {
+		f, sesInfo, _, ctx := setup()
+		f.s3.metadata = map[string]string{
+			"receipt-time": "Fri, 18 Sep 1970 12:45:00 +0000",
+			"other":        "not selected",
+		}
+		f.h.Options.MetadataHeaders = []string{"Receipt-Time", "Missing"}
+
+		_, err := f.h.processMessage(ctx, sesInfo)
+
+		assert.NilError(t, err)
+		forwarded := string(f.sesv2.sendEmailInput.Content.Raw.Data)
+		expected := "\r\nX-SES-Receipt-Time: " +
+			"Fri, 18 Sep 1970 12:45:00 +0000\r\n"
+		assert.Assert(t, is.Contains(forwarded, expected))
+		assert.Assert(t, !strings.Contains(forwarded, "X-SES-Missing"))
+		assert.Assert(t, !strings.Contains(forwarded, "not selected"))
+	})
+
+	t.Run("LogsHeadersButNotBodyIfEnabled", func(t *testing.T) {
+		f, sesInfo, msgKey, ctx := setup()
+		f.h.Options.LogHeaders = true
+
+		_, err := f.h.processMessage(ctx, sesInfo)
+
+		assert.NilError(t, err)
+		assertLogsContain(t, f.logs, "headers for "+msgKey+":\nFrom: ")
+		assertLogsContain(t, f.logs, "\nSubject: There's a reason why")
+		expected := "\n" + origLinkHeaderPrefix + "mail.bar.com/" + msgKey
+		assertLogsContain(t, f.logs, expected)
+		logs := f.logs.String()
+		assert.Assert(t, !strings.Contains(logs, "Sometimes the getting"))
+	})
+
+	t.Run("DoesNotLogHeadersByDefault", func(t *testing.T) {
+		f, sesInfo, _, ctx := setup()
+
+		_, err := f.h.processMessage(ctx, sesInfo)
+
+		assert.NilError(t, err)
+		assert.Assert(t, !strings.Contains(f.logs.String(), "headers for"))
+	})
+
+	t.Run("SkipsRecordWithEmptyMessageId", func(t *testing.T) {
+		f, sesInfo, _, ctx := setup()
+		sesInfo.Mail.MessageID = ""
+
+		_, err := f.h.processMessage(ctx, sesInfo)
+
+		var validationErr *ErrValidation
+		assert.Assert(t, errors.As(err, &validationErr))
+		assertLogsContain(t, f.logs, "skipping record with empty message ID")
+		assert.Assert(t, is.Nil(f.s3.input))
+		assert.Assert(t, is.Nil(f.sesv2.sendEmailInput))
+	})
+
+	t.Run("ForwardsRecordWithValidMessageId", func(t *testing.T) {
+		f, sesInfo, _, ctx := setup()
+		sesInfo.Mail.MessageID = "o3vrnil0e2ic28trm7dfhrc2v0clambda4nbp0g01"
+
+		_, err := f.h.processMessage(ctx, sesInfo)
+
+		assert.NilError(t, err)
+		expected := "incoming/o3vrnil0e2ic28trm7dfhrc2v0clambda4nbp0g01"
+		assert.Equal(t, *f.s3.input.Key, expected)
+	})
+
+	t.Run("SkipsRecordWithInvalidMessageId", func(t *testing.T) {
+		for _, msgId := range []string{"../secret", "foo/bar", ".", "a b"} {
+			f, sesInfo, _, ctx := setup()
+			sesInfo.Mail.MessageID = msgId
+
+			result, err := f.h.processMessage(ctx, sesInfo)
+
+			var validationErr *ErrValidation
+			assert.Assert(t, errors.As(err, &validationErr), msgId)
+			assert.Equal(t, result.Key, "", msgId)
+			assert.Equal(t, result.MessageId, msgId)
+			assert.Assert(t, result.Dropped, msgId)
+			assert.Equal(t, result.Err, err, msgId)
+			assert.Assert(t, errors.Is(err, ErrInvalidMessageId), msgId)
+			expected := "skipping record with invalid message ID " +
+				strconv.Quote(msgId)
+			assertLogsContain(t, f.logs, expected)
+			assert.Assert(t, is.Nil(f.s3.input), msgId)
+			assert.Assert(t, is.Nil(f.sesv2.sendEmailInput), msgId)
+		}
+	})
+
 	t.Run("ErrorsIfValidationFails", func(t *testing.T) {
 		f, sesInfo, msgKey, ctx := setup()
 		sesInfo.Receipt.SpamVerdict.Status = "FAIL"
@@ -531,12 +2520,57 @@ func TestProcessMesssage(t *testing.T) {
 		assertLogsContain(t, f.logs, errMsg(msgKey, "marked as spam, ignoring"))
 	})
 
+	t.Run("DropsSelfOriginatedMessage", func(t *testing.T) {
+		f, sesInfo, msgKey, ctx := setup()
+		f.h.Options.SenderAddress = "inbox@bar.com"
+		sesInfo.Mail.CommonHeaders.From = []string{"inbox@bar.com"}
+
+		_, err := f.h.processMessage(ctx, sesInfo)
+
+		var validationErr *ErrValidation
+		assert.Assert(t, errors.As(err, &validationErr))
+		expected := errMsg(msgKey, "dropping self-originated message")
+		assertLogsContain(t, f.logs, expected)
+		assert.Assert(t, is.Nil(f.sesv2.sendEmailInput))
+	})
+
+	t.Run("ForwardsSpamToPostmasterIfEnabled", func(t *testing.T) {
+		f, sesInfo, _, ctx := setup()
+		f.h.Options.PostmasterForward = "admin@acm.org"
+		sesInfo.Receipt.Recipients = []string{"postmaster@bar.com"}
+		sesInfo.Receipt.SpamVerdict.Status = "FAIL"
+
+		_, err := f.h.processMessage(ctx, sesInfo)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(
+			t,
+			[]string{"admin@acm.org"},
+			f.sesv2.sendEmailInput.Destination.ToAddresses,
+		)
+	})
+
+	t.Run("DropsMessageIfForwardingLoopDetected", func(t *testing.T) {
+		f, sesInfo, msgKey, ctx := setup()
+		sesInfo.Receipt.Recipients = []string{f.h.Options.ForwardingAddress}
+
+		_, err := f.h.processMessage(ctx, sesInfo)
+
+		var validationErr *ErrValidation
+		assert.Assert(t, errors.As(err, &validationErr))
+		assertLogsContain(
+			t, f.logs, errMsg(msgKey, "forwarding loop detected: "),
+		)
+		assert.Assert(t, is.Nil(f.sesv2.sendEmailInput))
+	})
+
 	t.Run("ErrorsIfGettingOriginalFails", func(t *testing.T) {
 		f, sesInfo, msgKey, ctx := setup()
 		f.s3.returnErr = errors.New("s3 error")
 
-		f.h.processMessage(ctx, sesInfo)
+		_, err := f.h.processMessage(ctx, sesInfo)
 
+		assert.Assert(t, errors.Is(err, f.s3.returnErr))
 		expected := errMsg(msgKey, "failed to get original message: s3 error")
 		assertLogsContain(t, f.logs, expected)
 	})
@@ -551,12 +2585,51 @@ func TestProcessMesssage(t *testing.T) {
 		assertLogsContain(t, f.logs, expected)
 	})
 
+	t.Run("ForwardsUnparseableMessageIfEnabled", func(t *testing.T) {
+		f, sesInfo, msgKey, ctx := setup()
+		f.h.Options.ForwardUnparseable = true
+		f.s3.outputMsg = []byte("invalid message")
+
+		_, err := f.h.processMessage(ctx, sesInfo)
+
+		assert.NilError(t, err)
+		expected := "forwarded unparseable message " + msgKey + " as " +
+			f.forwardedId
+		assertLogsContain(t, f.logs, expected)
+		input := f.sesv2.sendEmailInput
+		to := input.Destination.ToAddresses
+		assert.DeepEqual(t, to, []string{"foo@bar.com"})
+		msg := string(input.Content.Raw.Data)
+		assert.Assert(t, is.Contains(msg, "Subject: Unparseable message: "))
+		assert.Assert(t, is.Contains(msg, `filename="original.eml"`))
+		encoded := base64.StdEncoding.EncodeToString(f.s3.outputMsg)
+		assert.Assert(t, is.Contains(msg, encoded))
+	})
+
+	t.Run("ErrorsIfForwardingUnparseableMessageFails", func(t *testing.T) {
+		f, sesInfo, msgKey, ctx := setup()
+		f.h.Options.ForwardUnparseable = true
+		f.s3.outputMsg = []byte("invalid message")
+		f.sesv2.sendEmailErr = errors.New("SES error")
+
+		_, err := f.h.processMessage(ctx, sesInfo)
+
+		assert.Assert(t, errors.Is(err, f.sesv2.sendEmailErr))
+		expected := errMsg(msgKey, "send failed: SES error")
+		assertLogsContain(t, f.logs, expected)
+	})
+
 	t.Run("ErrorsIfForwardingMessageFails", func(t *testing.T) {
 		f, sesInfo, msgKey, ctx := setup()
 		f.sesv2.sendEmailErr = errors.New("SES error")
 
-		f.h.processMessage(ctx, sesInfo)
+		result, err := f.h.processMessage(ctx, sesInfo)
 
+		assert.Assert(t, errors.Is(err, f.sesv2.sendEmailErr))
+		assert.Equal(t, result.Key, msgKey)
+		assert.Equal(t, result.ForwardedId, "")
+		assert.Assert(t, !result.Dropped)
+		assert.Equal(t, result.Err, err)
 		expected := errMsg(msgKey, "send failed: SES error")
 		assertLogsContain(t, f.logs, expected)
 	})
@@ -592,6 +2665,66 @@ func TestHandleEvent(t *testing.T) {
 		assertSuccessLogs(t, f, msgKey)
 	})
 
+	t.Run("PrefixesLogsWithInjectedRequestId", func(t *testing.T) {
+		f, msgKey, ctx := setup()
+		f.h.RequestId = func(context.Context) string { return "req-1234" }
+
+		_, err := f.h.HandleEvent(ctx, f.event)
+
+		assert.NilError(t, err)
+		prefix := "[req-1234] [deadbeef] "
+		assertLogsContain(t, f.logs, prefix+"forwarding message "+msgKey)
+		assertLogsContain(
+			t, f.logs, prefix+"successfully forwarded message "+msgKey,
+		)
+	})
+
+	t.Run("PrefixesLogsWithLambdaRequestId", func(t *testing.T) {
+		f, msgKey, ctx := setup()
+		ctx = lambdacontext.NewContext(
+			ctx, &lambdacontext.LambdaContext{AwsRequestID: "lambda-5678"},
+		)
+
+		_, err := f.h.HandleEvent(ctx, f.event)
+
+		assert.NilError(t, err)
+		assertLogsContain(
+			t, f.logs, "[lambda-5678] [deadbeef] forwarding message "+msgKey,
+		)
+	})
+
+	t.Run("PrefixesEachMessageLogWithCorrelationId", func(t *testing.T) {
+		f, _, ctx := setup()
+		f.event.Records = append(f.event.Records, events.SimpleEmailRecord{
+			SES: events.SimpleEmailService{
+				Mail:    events.SimpleEmailMessage{MessageID: "beefdead"},
+				Receipt: events.SimpleEmailReceipt{},
+			},
+		})
+
+		_, err := f.h.HandleEvent(ctx, f.event)
+
+		assert.NilError(t, err)
+		logs := strings.Split(strings.TrimSpace(f.logs.String()), "\n")
+		prefixed := map[string][]string{}
+		for _, line := range logs {
+			id, msg, _ := strings.Cut(
+				strings.TrimPrefix(line, "test logger: "), " ",
+			)
+			prefixed[id] = append(prefixed[id], msg)
+		}
+		assert.Equal(t, len(prefixed), 2)
+		for _, id := range []string{"deadbeef", "beefdead"} {
+			msgs := prefixed["["+id+"]"]
+			key := f.h.Options.IncomingPrefix + "/" + id
+			assert.Assert(t, is.Contains(msgs, "forwarding message "+key))
+			assert.Assert(t, is.Contains(
+				msgs, "successfully forwarded message "+key+
+					" as "+f.forwardedId,
+			))
+		}
+	})
+
 	t.Run("HandlesMultipleEvents", func(t *testing.T) {
 		f, msgKey, ctx := setup()
 		f.event.Records = append(f.event.Records, events.SimpleEmailRecord{
@@ -610,6 +2743,63 @@ func TestHandleEvent(t *testing.T) {
 		assert.Equal(t, f.s3.output.timesClosed, 2)
 	})
 
+	t.Run("SkipsDuplicateRecords", func(t *testing.T) {
+		f, msgKey, ctx := setup()
+		f.event.Records = append(f.event.Records, f.event.Records[0])
+
+		result, err := f.h.HandleEvent(ctx, f.event)
+
+		assert.NilError(t, err)
+		assert.Equal(t, result.Disposition, events.SimpleEmailStopRuleSet)
+		assertSuccessLogs(t, f, msgKey)
+		assertLogsContain(
+			t, f.logs, "skipping duplicate record for message deadbeef",
+		)
+		assert.Equal(t, f.s3.output.timesClosed, 1)
+	})
+
+	t.Run("ReturnsStatsForMixedBatch", func(t *testing.T) {
+		f, _, ctx := setup()
+		f.h.S3 = &KeyErrS3{f.s3, "incoming/failed", errors.New("S3 error")}
+		addRecord := func(msgId string) *events.SimpleEmailService {
+			f.event.Records = append(f.event.Records, events.SimpleEmailRecord{
+				SES: events.SimpleEmailService{
+					Mail: events.SimpleEmailMessage{MessageID: msgId},
+				},
+			})
+			return &f.event.Records[len(f.event.Records)-1].SES
+		}
+		addRecord("beefdead")
+		addRecord("deadbeef")
+		addRecord("")
+		addRecord("spam").Receipt.SpamVerdict.Status = "FAIL"
+		addRecord("failed")
+
+		result, stats, err := f.h.HandleEventWithStats(ctx, f.event)
+
+		assert.NilError(t, err)
+		assert.Equal(t, result.Disposition, events.SimpleEmailStopRuleSet)
+		assert.DeepEqual(
+			t,
+			stats,
+			&EventStats{Processed: 6, Forwarded: 2, Dropped: 3, Failed: 1},
+		)
+	})
+
+	t.Run("CountsFailedDmarcBounceAsFailed", func(t *testing.T) {
+		f, _, ctx := setup()
+		f.h.Ses = &TestSes{bounceErr: errors.New("SES error")}
+		receipt := &f.event.Records[0].SES.Receipt
+		receipt.DMARCVerdict.Status = "FAIL"
+		receipt.DMARCPolicy = "REJECT"
+		receipt.Recipients = []string{"me@bar.com"}
+
+		_, stats, err := f.h.HandleEventWithStats(ctx, f.event)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, stats, &EventStats{Processed: 1, Failed: 1})
+	})
+
 	t.Run("ErrorsIfNoRecordsInEvent", func(t *testing.T) {
 		f, _, ctx := setup()
 		f.event.Records = []events.SimpleEmailRecord{}
@@ -620,3 +2810,93 @@ func TestHandleEvent(t *testing.T) {
 		assert.ErrorContains(t, err, "SES event contained no records: ")
 	})
 }
+
+func BenchmarkPrepareMessage(b *testing.B) {
+	_, logger := testLogger()
+	h := &Handler{
+		Options: &Options{
+			BucketName:        "xyzzy.com",
+			SenderAddress:     "ses-updater@xyzzy.com",
+			ForwardingAddress: "quux@xyzzy.com",
+		},
+		Log: logger,
+	}
+	sesInfo := passingSesInfo()
+	ctx := context.Background()
+	largeBody := strings.Repeat(msgBody+"\r\n", 1<<14)
+	msg := []byte(beforeHeaders + "\r\n\r\n" + largeBody)
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		orig := bytes.NewReader(msg)
+		_, _, err := h.prepareMessage(ctx, orig, "prefix/msgId", sesInfo, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUpdateMessage(b *testing.B) {
+	ctx := context.Background()
+	h := &Handler{
+		Options: &Options{
+			BucketName:        "xyzzy.com",
+			SenderAddress:     "ses-updater@xyzzy.com",
+			ForwardingAddress: "quux@xyzzy.com",
+		},
+	}
+	sesInfo := passingSesInfo()
+	multipartType := `multipart/alternative; boundary="random-string"`
+
+	smallText := strings.Replace(
+		beforeHeaders, multipartType, `text/plain; charset="UTF-8"`, 1,
+	) + "\r\n\r\nSometimes the getting smallest detail wrong breaks " +
+		"everything.\r\n"
+	largeMultipart := strings.Replace(
+		beforeHeaders,
+		multipartType,
+		`multipart/mixed; boundary="random-string"`,
+		1,
+	) + "\r\n\r\n" + strings.Join([]string{
+		`--random-string`,
+		`Content-Type: text/plain; charset="UTF-8"`,
+		``,
+		`See attached.`,
+		`--random-string`,
+		`Content-Disposition: attachment; filename="large.txt"`,
+		`Content-Transfer-Encoding: base64`,
+		`Content-Type: text/plain`,
+		``,
+		strings.Repeat(largeAttachment+"\r\n", 1<<13) + `--random-string--`,
+	}, "\r\n")
+
+	for _, bm := range []struct {
+		name string
+		msg  string
+	}{
+		{"SmallText", smallText},
+		{"LargeMultipart", largeMultipart},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			msg := []byte(bm.msg)
+			b.SetBytes(int64(len(msg)))
+			b.ResetTimer()
+
+			// Parsing is included, since updateMessage consumes m.Body.
+			for i := 0; i < b.N; i++ {
+				m, err := mail.ReadMessage(bytes.NewReader(msg))
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, err = h.updateMessage(
+					ctx, m, "prefix/msgId", sesInfo, h.Options.SenderAddress,
+					nil,
+				)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
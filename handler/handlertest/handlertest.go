@@ -0,0 +1,239 @@
+// Package handlertest provides fake implementations of the AWS interfaces used
+// by handler.Handler.
+//
+// Each fake records the inputs for every call and returns programmable
+// responses. They're safe for concurrent use.
+package handlertest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	sesv2types "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+)
+
+// ErrNoSuchKey is returned by S3.GetObject when S3.Objects doesn't contain the
+// requested key. Like the error from the real S3 client, it's a
+// *types.NoSuchKey.
+var ErrNoSuchKey error = &s3types.NoSuchKey{Message: aws.String("no such key")}
+
+// S3 is a fake handler.S3Api implementation.
+type S3 struct {
+	// Objects maps object keys to their contents.
+	Objects map[string][]byte
+
+	// Errors maps object keys to errors returned when getting them.
+	Errors map[string]error
+
+	// GetObjectInputs records the input from every GetObject call.
+	GetObjectInputs []*s3.GetObjectInput
+
+	// PutObjectErr, if not nil, is returned by PutObject.
+	PutObjectErr error
+
+	// PutObjectInputs records the input from every PutObject call.
+	PutObjectInputs []*s3.PutObjectInput
+
+	mu sync.Mutex
+}
+
+func (fake *S3) GetObject(
+	_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options),
+) (*s3.GetObjectOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.GetObjectInputs = append(fake.GetObjectInputs, input)
+	key := aws.ToString(input.Key)
+
+	if err, ok := fake.Errors[key]; ok {
+		return nil, err
+	} else if obj, ok := fake.Objects[key]; !ok {
+		return nil, ErrNoSuchKey
+	} else {
+		body := io.NopCloser(bytes.NewReader(obj))
+		output := &s3.GetObjectOutput{
+			Body: body, ContentLength: int64(len(obj)),
+		}
+		return output, nil
+	}
+}
+
+// PutObject stores the object's contents in Objects unless PutObjectErr is
+// set.
+func (fake *S3) PutObject(
+	_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options),
+) (*s3.PutObjectOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.PutObjectInputs = append(fake.PutObjectInputs, input)
+
+	if fake.PutObjectErr != nil {
+		return nil, fake.PutObjectErr
+	}
+
+	var content []byte
+	if input.Body != nil {
+		var err error
+		if content, err = io.ReadAll(input.Body); err != nil {
+			return nil, err
+		}
+	}
+	if fake.Objects == nil {
+		fake.Objects = map[string][]byte{}
+	}
+	fake.Objects[aws.ToString(input.Key)] = content
+	return &s3.PutObjectOutput{}, nil
+}
+
+// Ses is a fake handler.SesApi implementation.
+type Ses struct {
+	// BounceMessageId is the MessageId returned by SendBounce.
+	BounceMessageId string
+
+	// SendBounceErr, if not nil, is returned by SendBounce.
+	SendBounceErr error
+
+	// SendBounceInputs records the input from every SendBounce call.
+	SendBounceInputs []*ses.SendBounceInput
+
+	// RawMessageId is the MessageId returned by SendRawEmail.
+	RawMessageId string
+
+	// SendRawEmailErr, if not nil, is returned by SendRawEmail.
+	SendRawEmailErr error
+
+	// SendRawEmailInputs records the input from every SendRawEmail call.
+	SendRawEmailInputs []*ses.SendRawEmailInput
+
+	mu sync.Mutex
+}
+
+func (fake *Ses) SendBounce(
+	_ context.Context, input *ses.SendBounceInput, _ ...func(*ses.Options),
+) (*ses.SendBounceOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.SendBounceInputs = append(fake.SendBounceInputs, input)
+
+	if fake.SendBounceErr != nil {
+		return nil, fake.SendBounceErr
+	}
+	output := &ses.SendBounceOutput{
+		MessageId: aws.String(fake.BounceMessageId),
+	}
+	return output, nil
+}
+
+func (fake *Ses) SendRawEmail(
+	_ context.Context, input *ses.SendRawEmailInput, _ ...func(*ses.Options),
+) (*ses.SendRawEmailOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.SendRawEmailInputs = append(fake.SendRawEmailInputs, input)
+
+	if fake.SendRawEmailErr != nil {
+		return nil, fake.SendRawEmailErr
+	}
+	output := &ses.SendRawEmailOutput{
+		MessageId: aws.String(fake.RawMessageId),
+	}
+	return output, nil
+}
+
+// SesV2 is a fake handler.SesV2Api implementation.
+type SesV2 struct {
+	// MessageId is the MessageId returned by SendEmail.
+	MessageId string
+
+	// SendEmailErr, if not nil, is returned by SendEmail.
+	SendEmailErr error
+
+	// SendEmailInputs records the input from every SendEmail call.
+	SendEmailInputs []*sesv2.SendEmailInput
+
+	// TlsPolicy is the DeliveryOptions.TlsPolicy returned by
+	// GetConfigurationSet.
+	TlsPolicy sesv2types.TlsPolicy
+
+	// GetConfigurationSetErr, if not nil, is returned by GetConfigurationSet.
+	GetConfigurationSetErr error
+
+	// GetConfigurationSetInputs records the input from every
+	// GetConfigurationSet call.
+	GetConfigurationSetInputs []*sesv2.GetConfigurationSetInput
+
+	// VerificationStatus is the VerificationStatus returned by
+	// GetEmailIdentity. VerifiedForSendingStatus is true only if it's
+	// VerificationStatusSuccess.
+	VerificationStatus sesv2types.VerificationStatus
+
+	// GetEmailIdentityErr, if not nil, is returned by GetEmailIdentity.
+	GetEmailIdentityErr error
+
+	// GetEmailIdentityInputs records the input from every GetEmailIdentity
+	// call.
+	GetEmailIdentityInputs []*sesv2.GetEmailIdentityInput
+
+	mu sync.Mutex
+}
+
+func (fake *SesV2) SendEmail(
+	_ context.Context, input *sesv2.SendEmailInput, _ ...func(*sesv2.Options),
+) (*sesv2.SendEmailOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.SendEmailInputs = append(fake.SendEmailInputs, input)
+
+	if fake.SendEmailErr != nil {
+		return nil, fake.SendEmailErr
+	}
+	return &sesv2.SendEmailOutput{MessageId: aws.String(fake.MessageId)}, nil
+}
+
+func (fake *SesV2) GetConfigurationSet(
+	_ context.Context,
+	input *sesv2.GetConfigurationSetInput,
+	_ ...func(*sesv2.Options),
+) (*sesv2.GetConfigurationSetOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.GetConfigurationSetInputs = append(
+		fake.GetConfigurationSetInputs, input,
+	)
+
+	if fake.GetConfigurationSetErr != nil {
+		return nil, fake.GetConfigurationSetErr
+	}
+	return &sesv2.GetConfigurationSetOutput{
+		ConfigurationSetName: input.ConfigurationSetName,
+		DeliveryOptions: &sesv2types.DeliveryOptions{
+			TlsPolicy: fake.TlsPolicy,
+		},
+	}, nil
+}
+
+func (fake *SesV2) GetEmailIdentity(
+	_ context.Context,
+	input *sesv2.GetEmailIdentityInput,
+	_ ...func(*sesv2.Options),
+) (*sesv2.GetEmailIdentityOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.GetEmailIdentityInputs = append(fake.GetEmailIdentityInputs, input)
+
+	if fake.GetEmailIdentityErr != nil {
+		return nil, fake.GetEmailIdentityErr
+	}
+	return &sesv2.GetEmailIdentityOutput{
+		VerificationStatus: fake.VerificationStatus,
+		VerifiedForSendingStatus: fake.VerificationStatus ==
+			sesv2types.VerificationStatusSuccess,
+	}, nil
+}
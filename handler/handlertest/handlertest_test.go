@@ -0,0 +1,295 @@
+//go:build small_tests || all_tests
+
+package handlertest_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	sesv2types "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+	"github.com/mbland/ses-forwarder/handler"
+	"github.com/mbland/ses-forwarder/handler/handlertest"
+	"gotest.tools/assert"
+)
+
+var (
+	_ handler.S3Api    = &handlertest.S3{}
+	_ handler.SesApi   = &handlertest.Ses{}
+	_ handler.SesV2Api = &handlertest.SesV2{}
+)
+
+func TestS3GetObject(t *testing.T) {
+	testErr := errors.New("test error")
+
+	for _, tc := range []struct {
+		name    string
+		key     string
+		content string
+		err     error
+	}{
+		{name: "ReturnsObject", key: "incoming/foo", content: "foo"},
+		{name: "ReturnsEmptyObject", key: "incoming/empty", content: ""},
+		{name: "ReturnsProgrammedError", key: "incoming/bar", err: testErr},
+		{
+			name: "ReturnsErrNoSuchKey",
+			key:  "incoming/missing",
+			err:  handlertest.ErrNoSuchKey,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &handlertest.S3{
+				Objects: map[string][]byte{
+					"incoming/foo":   []byte("foo"),
+					"incoming/bar":   []byte("bar"),
+					"incoming/empty": {},
+				},
+				Errors: map[string]error{"incoming/bar": testErr},
+			}
+			input := &s3.GetObjectInput{
+				Bucket: aws.String("mail.foo.com"), Key: aws.String(tc.key),
+			}
+
+			output, err := fake.GetObject(context.Background(), input)
+
+			assert.Equal(t, len(fake.GetObjectInputs), 1)
+			assert.Assert(t, fake.GetObjectInputs[0] == input)
+			if tc.err != nil {
+				assert.Assert(t, output == nil)
+				assert.Assert(t, errors.Is(err, tc.err))
+				return
+			}
+			assert.NilError(t, err)
+			content, err := io.ReadAll(output.Body)
+			assert.NilError(t, err)
+			assert.Equal(t, string(content), tc.content)
+			assert.Equal(t, output.ContentLength, int64(len(tc.content)))
+		})
+	}
+}
+
+func TestS3PutObject(t *testing.T) {
+	testErr := errors.New("test error")
+
+	for _, tc := range []struct {
+		name string
+		err  error
+	}{
+		{name: "StoresObject"},
+		{name: "ReturnsProgrammedError", err: testErr},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &handlertest.S3{PutObjectErr: tc.err}
+			input := &s3.PutObjectInput{
+				Bucket: aws.String("mail.foo.com"),
+				Key:    aws.String("debug/foo"),
+				Body:   strings.NewReader("foo"),
+			}
+
+			output, err := fake.PutObject(context.Background(), input)
+
+			assert.Equal(t, len(fake.PutObjectInputs), 1)
+			assert.Assert(t, fake.PutObjectInputs[0] == input)
+			if tc.err != nil {
+				assert.Assert(t, output == nil)
+				assert.Assert(t, errors.Is(err, tc.err))
+				_, stored := fake.Objects["debug/foo"]
+				assert.Assert(t, !stored)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, string(fake.Objects["debug/foo"]), "foo")
+		})
+	}
+}
+
+func TestSesSendBounce(t *testing.T) {
+	testErr := errors.New("test error")
+
+	for _, tc := range []struct {
+		name      string
+		messageId string
+		err       error
+	}{
+		{name: "ReturnsMessageId", messageId: "bounce-id"},
+		{name: "ReturnsProgrammedError", err: testErr},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &handlertest.Ses{
+				BounceMessageId: tc.messageId, SendBounceErr: tc.err,
+			}
+			input := &ses.SendBounceInput{
+				OriginalMessageId: aws.String("deadbeef"),
+			}
+
+			output, err := fake.SendBounce(context.Background(), input)
+
+			assert.Equal(t, len(fake.SendBounceInputs), 1)
+			assert.Assert(t, fake.SendBounceInputs[0] == input)
+			if tc.err != nil {
+				assert.Assert(t, output == nil)
+				assert.Assert(t, errors.Is(err, tc.err))
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, aws.ToString(output.MessageId), tc.messageId)
+		})
+	}
+}
+
+func TestSesSendRawEmail(t *testing.T) {
+	testErr := errors.New("test error")
+
+	for _, tc := range []struct {
+		name      string
+		messageId string
+		err       error
+	}{
+		{name: "ReturnsMessageId", messageId: "raw-id"},
+		{name: "ReturnsProgrammedError", err: testErr},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &handlertest.Ses{
+				RawMessageId: tc.messageId, SendRawEmailErr: tc.err,
+			}
+			input := &ses.SendRawEmailInput{
+				Destinations: []string{"foo@bar.com"},
+			}
+
+			output, err := fake.SendRawEmail(context.Background(), input)
+
+			assert.Equal(t, len(fake.SendRawEmailInputs), 1)
+			assert.Assert(t, fake.SendRawEmailInputs[0] == input)
+			if tc.err != nil {
+				assert.Assert(t, output == nil)
+				assert.Assert(t, errors.Is(err, tc.err))
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, aws.ToString(output.MessageId), tc.messageId)
+		})
+	}
+}
+
+func TestSesV2SendEmail(t *testing.T) {
+	testErr := errors.New("test error")
+
+	for _, tc := range []struct {
+		name      string
+		messageId string
+		err       error
+	}{
+		{name: "ReturnsMessageId", messageId: "forwarded-id"},
+		{name: "ReturnsProgrammedError", err: testErr},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &handlertest.SesV2{
+				MessageId: tc.messageId, SendEmailErr: tc.err,
+			}
+			input := &sesv2.SendEmailInput{
+				ConfigurationSetName: aws.String("ses-forwarder"),
+			}
+
+			output, err := fake.SendEmail(context.Background(), input)
+
+			assert.Equal(t, len(fake.SendEmailInputs), 1)
+			assert.Assert(t, fake.SendEmailInputs[0] == input)
+			if tc.err != nil {
+				assert.Assert(t, output == nil)
+				assert.Assert(t, errors.Is(err, tc.err))
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, aws.ToString(output.MessageId), tc.messageId)
+		})
+	}
+}
+
+func TestSesV2GetConfigurationSet(t *testing.T) {
+	testErr := errors.New("test error")
+
+	for _, tc := range []struct {
+		name      string
+		tlsPolicy sesv2types.TlsPolicy
+		err       error
+	}{
+		{name: "ReturnsTlsPolicy", tlsPolicy: sesv2types.TlsPolicyRequire},
+		{name: "ReturnsProgrammedError", err: testErr},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &handlertest.SesV2{
+				TlsPolicy: tc.tlsPolicy, GetConfigurationSetErr: tc.err,
+			}
+			input := &sesv2.GetConfigurationSetInput{
+				ConfigurationSetName: aws.String("ses-forwarder"),
+			}
+
+			output, err := fake.GetConfigurationSet(
+				context.Background(), input,
+			)
+
+			assert.Equal(t, len(fake.GetConfigurationSetInputs), 1)
+			assert.Assert(t, fake.GetConfigurationSetInputs[0] == input)
+			if tc.err != nil {
+				assert.Assert(t, output == nil)
+				assert.Assert(t, errors.Is(err, tc.err))
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(
+				t, aws.ToString(output.ConfigurationSetName), "ses-forwarder",
+			)
+			assert.Equal(t, output.DeliveryOptions.TlsPolicy, tc.tlsPolicy)
+		})
+	}
+}
+
+func TestSesV2GetEmailIdentity(t *testing.T) {
+	testErr := errors.New("test error")
+
+	for _, tc := range []struct {
+		name     string
+		status   sesv2types.VerificationStatus
+		verified bool
+		err      error
+	}{
+		{
+			name:     "ReturnsVerifiedIdentity",
+			status:   sesv2types.VerificationStatusSuccess,
+			verified: true,
+		},
+		{
+			name:   "ReturnsUnverifiedIdentity",
+			status: sesv2types.VerificationStatusPending,
+		},
+		{name: "ReturnsProgrammedError", err: testErr},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &handlertest.SesV2{
+				VerificationStatus: tc.status, GetEmailIdentityErr: tc.err,
+			}
+			input := &sesv2.GetEmailIdentityInput{
+				EmailIdentity: aws.String("foo.com"),
+			}
+
+			output, err := fake.GetEmailIdentity(context.Background(), input)
+
+			assert.Equal(t, len(fake.GetEmailIdentityInputs), 1)
+			assert.Assert(t, fake.GetEmailIdentityInputs[0] == input)
+			if tc.err != nil {
+				assert.Assert(t, output == nil)
+				assert.Assert(t, errors.Is(err, tc.err))
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, output.VerificationStatus, tc.status)
+			assert.Equal(t, output.VerifiedForSendingStatus, tc.verified)
+		})
+	}
+}
@@ -3,21 +3,76 @@ package handler
 import (
 	"fmt"
 	"io"
+	"mime"
 	"net/mail"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"golang.org/x/text/encoding/htmlindex"
 )
 
 type headerBuffer struct {
 	buf io.Writer
 	err error
+
+	// headerNames maps canonical header names to the exact names to emit.
+	// Defaults to defaultHeaderNames if nil.
+	headerNames map[string]string
+
+	// foldLongHeaders causes writeHeader to fold lines longer than
+	// maxFoldedHeaderLineLen.
+	foldLongHeaders bool
+
+	// logf, if not nil, logs problems with the original headers that
+	// don't prevent writing the updated headers.
+	logf func(format string, v ...any)
 }
 
 type updateHeadersInput struct {
-	headers       mail.Header
-	senderAddress string
-	msgPath       string
+	headers                  mail.Header
+	senderAddress            string
+	msgPath                  string
+	consoleLinkRegion        string
+	receipt                  *events.SimpleEmailReceipt
+	date                     time.Time
+	replyToAddress           string
+	replyToIncludeOriginal   bool
+	internalReplyTo          string
+	internalDomains          []string
+	noReplyReplyTo           string
+	omitNoReplyReplyTo       bool
+	normalizeSubjectEncoding bool
+	stripPlusFromToDomain    string
+	fromAtReplacement        string
+	defaultSubject           string
+	denylistHeaders          bool
+	stripHeaders             []string
+	keepHeaderPatterns       []*regexp.Regexp
+	spamHeaders              bool
+	spamVerdicts             []string
+	authServId               string
+	preservePriority         bool
+	preserveContentLanguage  bool
+	preserveThreadHeaders    bool
+	metadataHeaders          []metadataHeader
+	forwardedForHeader       string
+	keepOriginalFrom         bool
+	messageIdDomain          string
+}
+
+// metadataHeader conveys a value from the original S3 object's metadata.
+type metadataHeader struct {
+	name  string
+	value string
 }
 
+// keepHeaders are always copied from the original message, unless listed in
+// stripHeaders.
 var keepHeaders = []string{
 	"To",
 	"Cc",
@@ -25,19 +80,89 @@ var keepHeaders = []string{
 	"Subject",
 	"Mime-Version",
 	"Content-Type",
+	"Content-Transfer-Encoding",
 }
 
-const origLinkHeaderPrefix = "X-SES-Forwarder-Original: s3://"
+// priorityHeaders are emitted after keepHeaders if preservePriority is set.
+// Their values are normalized to agree with one another. X-MSMail-Priority
+// appears in its canonical form, which is how mail.Header stores it.
+var priorityHeaders = []string{
+	"X-Priority", "Importance", "Priority", "X-Msmail-Priority",
+}
+
+// threadHeaders are emitted after keepHeaders if preserveThreadHeaders is set.
+// They preserve Outlook conversation threading.
+var threadHeaders = []string{"Thread-Topic", "Thread-Index"}
+
+const origLinkHeader = "X-SES-Forwarder-Original"
+
+// replacedHeaders are never copied from the original message when
+// denylistHeaders is set. WriteUpdatedHeaders either writes its own versions
+// of these headers, or the new From header would invalidate them.
+var replacedHeaders = map[string]bool{
+	"From":                   true,
+	"Reply-To":               true,
+	"Sender":                 true,
+	"Return-Path":            true,
+	"Dkim-Signature":         true,
+	"X-Original-Sender":      true,
+	"Authentication-Results": true,
+	"X-Spam-Flag":            true,
+	"X-Spam-Status":          true,
+	textproto.CanonicalMIMEHeaderKey(origLinkHeader): true,
+}
+
+const origLinkHeaderPrefix = origLinkHeader + ": s3://"
 
 func (hb *headerBuffer) WriteUpdatedHeaders(input *updateHeadersInput) error {
-	hb.writeFromAndReplyTo(input.headers, input.senderAddress)
+	input.headers = normalizeHeaders(input.headers)
+	hb.writeFromAndReplyTo(input)
+	if !input.date.IsZero() {
+		hb.writeHeader("Date", []string{formatDate(input.date)})
+	}
 
-	for _, header := range keepHeaders {
+	for _, header := range emittedHeaders(input) {
 		if values, ok := input.headers[header]; ok {
+			if header == "Subject" && input.normalizeSubjectEncoding {
+				values = normalizeEncodedWords(values)
+			} else if header == "To" && input.stripPlusFromToDomain != "" {
+				values = stripPlusTags(values, input.stripPlusFromToDomain)
+			} else if input.preservePriority &&
+				slices.Contains(priorityHeaders, header) {
+				values = normalizePriority(header, values, input.headers)
+			} else if header == "Message-Id" && input.messageIdDomain != "" {
+				values = rewriteMessageIds(values, input.messageIdDomain)
+			}
 			hb.writeHeader(header, values)
+		} else if header == "Subject" && input.defaultSubject != "" {
+			subject := mime.QEncoding.Encode("UTF-8", input.defaultSubject)
+			hb.writeHeader(header, []string{subject})
+		} else if header == "Mime-Version" && isMimeMessage(input.headers) {
+			hb.writeHeader(header, []string{"1.0"})
+		}
+	}
+	hb.writeOriginalSender(input.headers)
+	if input.receipt != nil {
+		if input.authServId != "" {
+			authResults := authenticationResults(
+				input.authServId, input.receipt,
+			)
+			hb.writeHeader("Authentication-Results", []string{authResults})
+		}
+		if input.spamHeaders {
+			hb.writeSpamHeaders(input.receipt, input.spamVerdicts)
 		}
 	}
-	hb.write(origLinkHeaderPrefix + input.msgPath + "\r\n\r\n")
+	for _, mh := range input.metadataHeaders {
+		hb.writeHeader(mh.name, []string{mh.value})
+	}
+	if input.forwardedForHeader != "" && input.receipt != nil {
+		hb.writeHeader(
+			input.forwardedForHeader,
+			forwardedFor(input.receipt.Recipients, input.senderAddress),
+		)
+	}
+	hb.write(origLinkLine(input.msgPath, input.consoleLinkRegion) + "\r\n")
 
 	if hb.err != nil {
 		return fmt.Errorf("error updating email headers: %s", hb.err)
@@ -45,68 +170,639 @@ func (hb *headerBuffer) WriteUpdatedHeaders(input *updateHeadersInput) error {
 	return nil
 }
 
-func (hb *headerBuffer) writeFromAndReplyTo(
-	headers mail.Header, sender string,
-) {
-	origFrom := headers.Get("From")
-	replyTo := headers.Get("Reply-To")
-	var newFrom string
+// DefaultForwardedForHeader is the name of the header added by
+// ADD_FORWARDED_FOR, unless FORWARDED_FOR_HEADER overrides it.
+const DefaultForwardedForHeader = "X-Forwarded-For-Mail"
+
+// forwardedFor returns a value of the form "recipient by sender" for each
+// incoming recipient, recording a link in the forwarding chain for other
+// systems to parse.
+func forwardedFor(recipients []string, senderAddress string) []string {
+	if addr, err := mail.ParseAddress(senderAddress); err == nil {
+		senderAddress = addr.Address
+	}
+	values := make([]string, len(recipients))
+	for i, recipient := range recipients {
+		values[i] = recipient + " by " + senderAddress
+	}
+	return values
+}
+
+// singularHeaders may appear at most once in a message. To, Cc, and Bcc are
+// also singular, but they're left alone, since collapsing them would silently
+// drop recipients.
+//
+// - https://www.rfc-editor.org/rfc/rfc5322#section-3.6
+var singularHeaders = []string{
+	"From",
+	"Sender",
+	"Reply-To",
+	"Subject",
+	"Date",
+	"Message-Id",
+	"In-Reply-To",
+	"References",
+}
+
+// normalizeHeaders returns a copy of headers in which every one of the
+// singularHeaders appearing more than once in a malformed message keeps only
+// its first value. mail.Header.Get already uses the first value, so this
+// ensures every header written agrees with it. Repeatable headers such as
+// Received are left alone.
+func normalizeHeaders(headers mail.Header) mail.Header {
+	normalized := make(mail.Header, len(headers))
+	for name, values := range headers {
+		if len(values) > 1 && slices.Contains(singularHeaders, name) {
+			values = values[:1]
+		}
+		normalized[name] = values
+	}
+	return normalized
+}
+
+// emittedHeaders returns keepHeaders, plus priorityHeaders if
+// preservePriority is set, Content-Language if preserveContentLanguage is
+// set, threadHeaders if preserveThreadHeaders is set, and Message-Id if
+// messageIdDomain is set, minus any stripHeaders. If
+// denylistHeaders is set, it appends every other original header in sorted
+// order, except for replacedHeaders, stripHeaders, and metadataHeaders.
+// Otherwise it appends only those other original headers matching any of the
+// keepHeaderPatterns, subject to the same exceptions.
+func emittedHeaders(input *updateHeadersInput) []string {
+	strip := make(map[string]bool, len(input.stripHeaders))
+	for _, header := range input.stripHeaders {
+		strip[textproto.CanonicalMIMEHeaderKey(header)] = true
+	}
+	metadata := make(map[string]bool, len(input.metadataHeaders))
+	for _, mh := range input.metadataHeaders {
+		metadata[textproto.CanonicalMIMEHeaderKey(mh.name)] = true
+	}
+
+	keep := keepHeaders
+	if input.preservePriority {
+		keep = append(slices.Clip(keep), priorityHeaders...)
+	}
+	if input.preserveContentLanguage {
+		keep = append(slices.Clip(keep), "Content-Language")
+	}
+	if input.preserveThreadHeaders {
+		keep = append(slices.Clip(keep), threadHeaders...)
+	}
+	if input.messageIdDomain != "" {
+		keep = append(slices.Clip(keep), "Message-Id")
+	}
+
+	headers := make([]string, 0, len(keep))
+	for _, header := range keep {
+		if !strip[header] {
+			headers = append(headers, header)
+		}
+	}
+	if !input.denylistHeaders && len(input.keepHeaderPatterns) == 0 {
+		return headers
+	}
 
-	newFrom, hb.err = newFromAddress(origFrom, sender)
+	others := []string{}
+	for header := range input.headers {
+		if strip[header] || replacedHeaders[header] || metadata[header] ||
+			slices.Contains(keep, header) ||
+			(header == "Date" && !input.date.IsZero()) ||
+			!(input.denylistHeaders ||
+				matchesAny(input.keepHeaderPatterns, header)) {
+			continue
+		}
+		others = append(others, header)
+	}
+	slices.Sort(others)
+	return append(headers, others...)
+}
+
+func matchesAny(patterns []*regexp.Regexp, s string) bool {
+	return slices.ContainsFunc(patterns, func(re *regexp.Regexp) bool {
+		return re.MatchString(s)
+	})
+}
+
+// priorityValues maps each of the priorityHeaders to its value for each
+// normalized priority level.
+//
+// - https://www.rfc-editor.org/rfc/rfc2156#section-5.3.6
+var priorityValues = map[string]map[string]string{
+	"X-Priority": {
+		"high": "1 (Highest)", "normal": "3 (Normal)", "low": "5 (Lowest)",
+	},
+	"Importance": {"high": "high", "normal": "normal", "low": "low"},
+	"Priority": {
+		"high": "urgent", "normal": "normal", "low": "non-urgent",
+	},
+	"X-Msmail-Priority": {"high": "High", "normal": "Normal", "low": "Low"},
+}
+
+// normalizePriority returns header's value for the priority level of the
+// first recognized value among the priorityHeaders, so that conflicting
+// X-Priority, Importance, Priority, and X-MSMail-Priority headers agree. It
+// returns the original values if none are recognized.
+func normalizePriority(
+	header string, values []string, headers mail.Header,
+) []string {
+	for _, h := range priorityHeaders {
+		if level := priorityLevel(h, headers.Get(h)); level != "" {
+			return []string{priorityValues[header][level]}
+		}
+	}
+	return values
+}
+
+func priorityLevel(header, value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	if header == "X-Priority" {
+		// X-Priority values are 1 (highest) through 5 (lowest), optionally
+		// followed by a comment, e.g. "1 (Highest)".
+		switch {
+		case strings.HasPrefix(value, "1"), strings.HasPrefix(value, "2"):
+			return "high"
+		case strings.HasPrefix(value, "3"):
+			return "normal"
+		case strings.HasPrefix(value, "4"), strings.HasPrefix(value, "5"):
+			return "low"
+		}
+		return ""
+	}
+	for level, levelValue := range priorityValues[header] {
+		if strings.EqualFold(value, levelValue) {
+			return level
+		}
+	}
+	return ""
+}
+
+// rewriteMessageIds replaces the domain of each msg-id in values with domain,
+// keeping the local part, so the forwarded message's ID is unique to this
+// forwarder while remaining recognizable. Values without a domain are left
+// unchanged.
+//
+// - https://www.rfc-editor.org/rfc/rfc5322#section-3.6.4
+func rewriteMessageIds(values []string, domain string) []string {
+	result := make([]string, len(values))
+
+	for i, value := range values {
+		id := strings.TrimSuffix(
+			strings.TrimPrefix(strings.TrimSpace(value), "<"), ">",
+		)
+		if local, _, found := cutLast(id, "@"); !found || local == "" {
+			result[i] = value
+		} else {
+			result[i] = "<" + local + "@" + domain + ">"
+		}
+	}
+	return result
+}
+
+// cutLast is like strings.Cut, but cuts around the last instance of sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i != -1 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// origLinkLine returns the origLinkHeader line, including the trailing CRLF,
+// linking to the original message at msgPath. It uses a consoleLink if
+// consoleLinkRegion is set, or an s3:// URL otherwise.
+func origLinkLine(msgPath, consoleLinkRegion string) string {
+	if consoleLinkRegion == "" {
+		return origLinkHeaderPrefix + msgPath + "\r\n"
+	}
+	link := consoleLink(msgPath, consoleLinkRegion)
+	return origLinkHeader + ": " + link + "\r\n"
+}
+
+// consoleLink returns the S3 console URL for the object at msgPath, which is
+// of the form "bucket/key".
+func consoleLink(msgPath, region string) string {
+	bucket, key, _ := strings.Cut(msgPath, "/")
+	return "https://s3.console.aws.amazon.com/s3/object/" + bucket +
+		"?region=" + url.QueryEscape(region) +
+		"&prefix=" + url.QueryEscape(key)
+}
+
+func (hb *headerBuffer) writeFromAndReplyTo(input *updateHeadersInput) {
+	origFrom := input.headers.Get("From")
+	var newFrom, replyTo string
+
+	if input.keepOriginalFrom {
+		hb.writeHeader("From", []string{origFrom})
+		if origReplyTo := input.headers.Get("Reply-To"); origReplyTo != "" {
+			hb.writeHeader("Reply-To", []string{origReplyTo})
+		}
+		return
+	}
+
+	newFrom, hb.err = newFromAddress(
+		origFrom, input.senderAddress, input.fromAtReplacement,
+	)
 	if hb.err != nil {
 		return
 	}
 
 	hb.writeHeader("From", []string{newFrom})
-	if replyTo == "" {
-		replyTo = origFrom
+	origReplyTo := input.headers.Get("Reply-To")
+	if origReplyTo == "" {
+		origReplyTo = origFrom
+	}
+	if input.internalReplyTo != "" &&
+		isInternalSender(origFrom, input.internalDomains) {
+		replyTo = input.internalReplyTo
+	} else if (input.noReplyReplyTo != "" || input.omitNoReplyReplyTo) &&
+		isNoReplyAddress(origReplyTo) {
+		if replyTo = input.noReplyReplyTo; replyTo == "" {
+			return
+		}
+	} else {
+		var err error
+		replyTo, err = newReplyTo(
+			origReplyTo, input.replyToAddress, input.replyToIncludeOriginal,
+		)
+
+		// A malformed original Reply-To shouldn't keep the message from
+		// being forwarded, so fall back to replyToAddress alone.
+		if err != nil {
+			if hb.logf != nil {
+				hb.logf("%s; using %s only", err, input.replyToAddress)
+			}
+			replyTo = input.replyToAddress
+		}
 	}
 	hb.writeHeader("Reply-To", []string{replyTo})
 }
 
-func newFromAddress(origFrom, newFrom string) (result string, err error) {
+// isNoReplyAddress returns true if the local part of addr, ignoring any
+// "+tag" suffix, is "noreply" or "no-reply" in any case. Replying to such an
+// address is pointless, so replies go to noReplyReplyTo instead, or the
+// Reply-To header is omitted if omitNoReplyReplyTo is set.
+func isNoReplyAddress(addr string) bool {
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil {
+		return false
+	}
+	local, _, _ := cutLast(parsed.Address, "@")
+	local, _, _ = strings.Cut(local, "+")
+	local = strings.ToLower(local)
+	return local == "noreply" || local == "no-reply"
+}
+
+// isInternalSender returns true if the domain of the From address is one of
+// internalDomains. Replies to such senders go to internalReplyTo instead, so
+// that they're never accidentally sent outside the organization.
+func isInternalSender(from string, internalDomains []string) bool {
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return false
+	}
+	_, domain, _ := cutLast(addr.Address, "@")
+	return slices.ContainsFunc(internalDomains, func(d string) bool {
+		return strings.EqualFold(d, domain)
+	})
+}
+
+// newReplyTo returns the original Reply-To value if replyToAddress is empty.
+// Otherwise it returns replyToAddress, preceded by the original Reply-To value
+// if includeOriginal is true.
+func newReplyTo(
+	origReplyTo, replyToAddress string, includeOriginal bool,
+) (string, error) {
+	if replyToAddress == "" {
+		return origReplyTo, nil
+	} else if !includeOriginal {
+		return replyToAddress, nil
+	}
+
+	replyTo := origReplyTo + ", " + replyToAddress
+	if _, err := mail.ParseAddressList(replyTo); err != nil {
+		return "", fmt.Errorf("invalid Reply-To %s: %s", replyTo, err)
+	}
+	return replyTo, nil
+}
+
+// formatDate returns t in the date-time format from RFC 5322 Section 3.3.
+//
+// - https://www.rfc-editor.org/rfc/rfc5322#section-3.3
+func formatDate(t time.Time) string {
+	return t.Format(time.RFC1123Z)
+}
+
+// RFC 2045 requires MIME-Version for any message with MIME content, but some
+// senders omit it. Any message with a Content-Type header is considered MIME
+// content.
+//
+// - https://www.rfc-editor.org/rfc/rfc2045#section-4
+func isMimeMessage(headers mail.Header) bool {
+	return headers.Get("Content-Type") != ""
+}
+
+func (hb *headerBuffer) writeOriginalSender(headers mail.Header) {
+	if hb.err != nil {
+		return
+	} else if addr, err := mail.ParseAddress(headers.Get("From")); err == nil {
+		hb.writeHeader("X-Original-Sender", []string{addr.Address})
+	}
+}
+
+// authenticationResults conveys the SES SPF, DKIM, and DMARC verdicts so that
+// recipients can perform their own evaluation.
+//
+// authServId must identify an ADMD the forwarder's operator controls, i.e.,
+// EMAIL_DOMAIN_NAME. Receivers must ignore or strip Authentication-Results
+// headers carrying authserv-ids they don't control, so claiming another
+// ADMD's, such as "amazonses.com", would only invite spoofing.
+//
+// - https://www.rfc-editor.org/rfc/rfc8601#section-5
+// - https://docs.aws.amazon.com/ses/latest/dg/receiving-email-notifications-contents.html#receiving-email-notifications-contents-receipt-object
+func authenticationResults(
+	authServId string, receipt *events.SimpleEmailReceipt,
+) string {
+	return authServId +
+		"; spf=" + authResult(receipt.SPFVerdict.Status) +
+		"; dkim=" + authResult(receipt.DKIMVerdict.Status) +
+		"; dmarc=" + authResult(receipt.DMARCVerdict.Status)
+}
+
+func authResult(sesVerdictStatus string) string {
+	switch strings.ToUpper(sesVerdictStatus) {
+	case "PASS":
+		return "pass"
+	case "FAIL":
+		return "fail"
+	case "PROCESSING_FAILED":
+		return "temperror"
+	}
+	return "none"
+}
+
+// writeSpamHeaders emits the SpamAssassin style headers that many mail clients
+// filter on, derived from the same SES verdicts as isSpam.
+//
+// - https://spamassassin.apache.org/full/4.0.x/doc/Mail_SpamAssassin_Conf.html
+func (hb *headerBuffer) writeSpamHeaders(
+	receipt *events.SimpleEmailReceipt, verdicts []string,
+) {
+	flag, status := "NO", "No"
+	if isSpam(receipt, verdicts) {
+		flag, status = "YES", "Yes"
+	}
+	hb.writeHeader("X-Spam-Flag", []string{flag})
+	hb.writeHeader("X-Spam-Status", []string{
+		status +
+			", spf=" + authResult(receipt.SPFVerdict.Status) +
+			" dkim=" + authResult(receipt.DKIMVerdict.Status) +
+			" spam=" + authResult(receipt.SpamVerdict.Status) +
+			" virus=" + authResult(receipt.VirusVerdict.Status),
+	})
+}
+
+// DefaultFromAtReplacement replaces the "@" in the original From address.
+const DefaultFromAtReplacement = " at "
+
+func newFromAddress(
+	origFrom, newFrom, atReplacement string,
+) (result string, err error) {
 	var addr *mail.Address
 
 	if addr, err = mail.ParseAddress(origFrom); err != nil {
 		err = fmt.Errorf("couldn't parse From address %s: %s", origFrom, err)
 	} else {
-		if addr.Name != "" {
-			addr.Name += " - "
+		if name := strings.Join(strings.Fields(addr.Name), " "); name != "" {
+			addr.Name = quoteDisplayName(name) + " - "
 		}
 
 		// Gmail parses the first address out of the From header for the purpose
 		// of checking SPF and DMARC status. It will ignore a later address
 		// appearing within angle brackets, which should be treated as the
-		// actual From address. Replacing the "@" with " at " in the original
-		// address avoids this problem, confirmed by Gmail's "Show Original"
-		// message view.
-		addrReplaced := strings.Replace(addr.Address, "@", " at ", 1)
+		// actual From address. Replacing the "@" with " at " (by default) in
+		// the original address avoids this problem, confirmed by Gmail's "Show
+		// Original" message view.
+		addrReplaced := strings.Replace(addr.Address, "@", atReplacement, 1)
 		result = addr.Name + addrReplaced + " <" + newFrom + ">"
 	}
 	return
 }
 
+// displayNameSpecials are the characters that can't appear in a display name
+// unless it's a quoted string. net/mail also accepts "." in a display name, per
+// the obsolete phrase syntax, so newFromAddress doesn't quote names with
+// periods, just like the original address following the display name.
+//
+// - https://www.rfc-editor.org/rfc/rfc5322#section-3.2.3
+// - https://www.rfc-editor.org/rfc/rfc5322#section-4.1
+const displayNameSpecials = `()<>[]:;@\,"`
+
+var quotedStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// quoteDisplayName returns name as a quoted string if it contains any
+// displayNameSpecials, or unchanged otherwise.
+func quoteDisplayName(name string) string {
+	if !strings.ContainsAny(name, displayNameSpecials) {
+		return name
+	}
+	return `"` + quotedStringEscaper.Replace(name) + `"`
+}
+
+// stripPlusTags removes subaddress tags, as in "me+tag@foo.com", from every
+// address belonging to domain. Values that fail to parse, or that contain no
+// such addresses, are left untouched.
+func stripPlusTags(values []string, domain string) []string {
+	result := make([]string, len(values))
+
+	for i, value := range values {
+		result[i] = value
+		addrs, err := mail.ParseAddressList(value)
+		if err != nil {
+			continue
+		}
+
+		stripped := false
+		for _, addr := range addrs {
+			local, addrDomain, _ := strings.Cut(addr.Address, "@")
+			if !strings.EqualFold(addrDomain, domain) {
+				continue
+			} else if user, _, found := strings.Cut(local, "+"); found {
+				addr.Address = user + "@" + addrDomain
+				stripped = true
+			}
+		}
+		if stripped {
+			result[i] = formatAddressList(addrs)
+		}
+	}
+	return result
+}
+
+func formatAddressList(addrs []*mail.Address) string {
+	formatted := make([]string, len(addrs))
+	for i, addr := range addrs {
+		formatted[i] = addr.String()
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// checkFromAtReplacement ensures that a From header produced using
+// atReplacement will still parse as a single address whose display name
+// contains the original address, and whose actual address is the sender's.
+// This guarantees Gmail and other clients will only see the sender's address.
+func checkFromAtReplacement(atReplacement string) error {
+	const origFrom = "Mike Bland <mbland@acm.org>"
+	const sender = "ses-forwarder@example.com"
+	const expectedName = "Mike Bland - mbland"
+
+	from, err := newFromAddress(origFrom, sender, atReplacement)
+	if err != nil {
+		return err
+	}
+
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return fmt.Errorf("produces unparseable From: %s", from)
+	} else if addr.Address != sender ||
+		addr.Name != expectedName+atReplacement+"acm.org" {
+		return fmt.Errorf("produces ambiguous From: %s", from)
+	}
+	return nil
+}
+
+// Some legacy senders still emit RFC 2047 encoded-words using charsets such as
+// GB2312 or Shift_JIS, which some modern clients render as mojibake. Decoding
+// these values and reencoding them as UTF-8 avoids the problem. Values that
+// fail to decode are left untouched.
+var encodedWordDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		if enc, err := htmlindex.Get(charset); err != nil {
+			return nil, err
+		} else {
+			return enc.NewDecoder().Reader(input), nil
+		}
+	},
+}
+
+func normalizeEncodedWords(values []string) []string {
+	result := make([]string, len(values))
+
+	for i, value := range values {
+		decoded, err := encodedWordDecoder.DecodeHeader(value)
+		if err != nil || decoded == value {
+			result[i] = value
+		} else {
+			result[i] = mime.BEncoding.Encode("UTF-8", decoded)
+		}
+	}
+	return result
+}
+
+// Note that according to RFC 2045 Section 4, the header must be verbatim:
+// "MIME-Version: 1.0".
+// - https://www.rfc-editor.org/rfc/rfc2045#section-4
+//
+// Technically the headers should be case insensitive; see
+// https://stackoverflow.com/a/6143644, which explains RFC 5322. In fact,
+// the Go standard library net/textproto package parses all email headers
+// using CanonicalMIMEHeaderKey:
+// - https://pkg.go.dev/net/textproto#CanonicalMIMEHeaderKey
+//
+// However, it's been reported that some mail servers choke on messages
+// that don't use "MIME-Version" exactly. For this reason, we make sure to
+// always emit it, along with other headers whose conventional forms differ
+// from their canonical forms.
+var defaultHeaderNames = newHeaderNames(
+	"MIME-Version", "Message-ID", "Content-ID", "DKIM-Signature",
+	"X-MSMail-Priority",
+)
+
+// newHeaderNames returns a map from the canonical form of each name to the
+// name itself.
+func newHeaderNames(names ...string) map[string]string {
+	headerNames := make(map[string]string, len(names))
+	for _, name := range names {
+		headerNames[textproto.CanonicalMIMEHeaderKey(name)] = name
+	}
+	return headerNames
+}
+
 func (hb *headerBuffer) writeHeader(name string, values []string) {
-	// Note that according to RFC 2045 Section 4, the header must be verbatim:
-	// "MIME-Version: 1.0".
-	// - https://www.rfc-editor.org/rfc/rfc2045#section-4
-	//
-	// Technically the headers should be case insensitive; see
-	// https://stackoverflow.com/a/6143644, which explains RFC 5322. In fact,
-	// the Go standard library net/textproto package parses all email headers
-	// using CanonicalMIMEHeaderKey:
-	// - https://pkg.go.dev/net/textproto#CanonicalMIMEHeaderKey
-	//
-	// However, it's been reported that some mail servers choke on messages
-	// that don't use "MIME-Version" exactly. For this reason, we make sure to
-	// always emit it.
-	if name == "Mime-Version" {
-		name = "MIME-Version"
+	headerNames := hb.headerNames
+	if headerNames == nil {
+		headerNames = defaultHeaderNames
+	}
+	if emitted, ok := headerNames[textproto.CanonicalMIMEHeaderKey(name)]; ok {
+		name = emitted
 	}
 
 	for _, value := range values {
-		hb.write(name + ": " + value + "\r\n")
+		line := name + ": " + value
+		if hb.foldLongHeaders {
+			line = foldHeaderLine(line, len(name)+2)
+		}
+		hb.write(line + "\r\n")
+	}
+}
+
+// RFC 5322 recommends that lines not exceed 78 characters, and requires that
+// they not exceed 998 characters.
+//
+// - https://www.rfc-editor.org/rfc/rfc5322#section-2.1.1
+// - https://www.rfc-editor.org/rfc/rfc5322#section-2.2.3
+const maxFoldedHeaderLineLen = 78
+
+// foldHeaderLine inserts CRLF before whitespace in line so that each line is
+// no longer than maxFoldedHeaderLineLen where possible. The whitespace
+// following each CRLF begins the continuation line.
+//
+// valueStart is the index of the value following the header name, which
+// folding never precedes. A run of characters with no whitespace longer than
+// maxFoldedHeaderLineLen is folded at the next whitespace, if any, so a line
+// may still exceed 998 characters if the value lacks whitespace entirely.
+func foldHeaderLine(line string, valueStart int) string {
+	b := strings.Builder{}
+
+	for len(line) > maxFoldedHeaderLineLen {
+		i := lastFoldIndex(line[:maxFoldedHeaderLineLen+1], valueStart)
+		if i == -1 {
+			if i = nextFoldIndex(line, maxFoldedHeaderLineLen); i == -1 {
+				break
+			}
+		}
+		b.WriteString(line[:i] + "\r\n")
+		line = line[i:]
+		valueStart = 1
 	}
+	b.WriteString(line)
+	return b.String()
+}
+
+// lastFoldIndex returns the index of the last whitespace character in s at
+// or after start that follows a non-whitespace character, or -1 if none.
+// Folding there ensures each line contains more than just whitespace.
+func lastFoldIndex(s string, start int) int {
+	for i := len(s) - 1; i > start; i-- {
+		if isFoldingSpace(s[i]) && !isFoldingSpace(s[i-1]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// nextFoldIndex returns the index of the first whitespace character in s
+// after start that follows a non-whitespace character, or -1 if none.
+func nextFoldIndex(s string, start int) int {
+	for i := start + 1; i < len(s); i++ {
+		if isFoldingSpace(s[i]) && !isFoldingSpace(s[i-1]) {
+			return i
+		}
+	}
+	return -1
+}
+
+func isFoldingSpace(c byte) bool {
+	return c == ' ' || c == '\t'
 }
 
 func (hb *headerBuffer) write(s string) {
@@ -3,18 +3,27 @@
 package handler
 
 import (
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
+	"mime"
 	"net/mail"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-lambda-go/events"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
 	"gotest.tools/assert"
 )
 
 func newHeaderBuffer() (*strings.Builder, *headerBuffer) {
 	builder := &strings.Builder{}
-	return builder, &headerBuffer{builder, nil}
+	return builder, &headerBuffer{buf: builder}
 }
 
 func TestWrite(t *testing.T) {
@@ -58,6 +67,95 @@ func TestWriteHearder(t *testing.T) {
 		assert.NilError(t, hb.err)
 		assert.Equal(t, result.String(), "MIME-Version: 1.0\r\n")
 	})
+
+	t.Run("CapitalizesMessageID", func(t *testing.T) {
+		result, hb := newHeaderBuffer()
+
+		hb.writeHeader("Message-Id", []string{"<deadbeef@acm.org>"})
+
+		assert.NilError(t, hb.err)
+		assert.Equal(t, result.String(), "Message-ID: <deadbeef@acm.org>\r\n")
+	})
+
+	t.Run("FoldsLongHeadersIfEnabled", func(t *testing.T) {
+		result, hb := newHeaderBuffer()
+		hb.foldLongHeaders = true
+		value := strings.Repeat("word ", 20)
+
+		hb.writeHeader("X-Test-Header", []string{value, "short"})
+
+		assert.NilError(t, hb.err)
+		expected := "X-Test-Header: " + strings.Repeat("word ", 11) + "word" +
+			"\r\n" + strings.Repeat(" word", 8) + " \r\n" +
+			"X-Test-Header: short\r\n"
+		assert.Equal(t, result.String(), expected)
+	})
+
+	t.Run("DoesNotFoldLongHeadersByDefault", func(t *testing.T) {
+		result, hb := newHeaderBuffer()
+		value := strings.Repeat("word ", 20)
+
+		hb.writeHeader("X-Test-Header", []string{value})
+
+		assert.NilError(t, hb.err)
+		assert.Equal(t, result.String(), "X-Test-Header: "+value+"\r\n")
+	})
+
+	t.Run("UsesCustomOverrides", func(t *testing.T) {
+		result, hb := newHeaderBuffer()
+		hb.headerNames = newHeaderNames("X-MS-Has-Attach")
+
+		hb.writeHeader("X-Ms-Has-Attach", []string{"yes"})
+		hb.writeHeader("Mime-Version", []string{"1.0"})
+
+		assert.NilError(t, hb.err)
+		expected := "X-MS-Has-Attach: yes\r\nMime-Version: 1.0\r\n"
+		assert.Equal(t, result.String(), expected)
+	})
+}
+
+func TestFoldHeaderLine(t *testing.T) {
+	t.Run("LeavesShortLineUntouched", func(t *testing.T) {
+		line := "Subject: There's a reason why we unit test"
+
+		assert.Equal(t, foldHeaderLine(line, len("Subject: ")), line)
+	})
+
+	t.Run("FoldsLongLineAtWhitespace", func(t *testing.T) {
+		refs := []string{}
+		for i := 0; i != 8; i++ {
+			refs = append(refs, fmt.Sprintf("<message-%d@example.com>", i))
+		}
+		line := "References: " + strings.Join(refs, " ")
+
+		result := foldHeaderLine(line, len("References: "))
+
+		expected := "References: " +
+			"<message-0@example.com> <message-1@example.com>" +
+			"\r\n <message-2@example.com> <message-3@example.com>" +
+			" <message-4@example.com>" +
+			"\r\n <message-5@example.com> <message-6@example.com>" +
+			" <message-7@example.com>"
+		assert.Equal(t, result, expected)
+		for _, folded := range strings.Split(result, "\r\n") {
+			assert.Assert(t, len(folded) <= maxFoldedHeaderLineLen, folded)
+		}
+	})
+
+	t.Run("FoldsAtNextWhitespaceAfterLongWord", func(t *testing.T) {
+		word := strings.Repeat("x", maxFoldedHeaderLineLen)
+		line := "X-Long: " + word + " next"
+
+		result := foldHeaderLine(line, len("X-Long: "))
+
+		assert.Equal(t, result, "X-Long: "+word+"\r\n next")
+	})
+
+	t.Run("LeavesLongLineWithoutWhitespaceUntouched", func(t *testing.T) {
+		line := "X-Long: " + strings.Repeat("x", maxFoldedHeaderLineLen)
+
+		assert.Equal(t, foldHeaderLine(line, len("X-Long: ")), line)
+	})
 }
 
 func TestNewFromAddress(t *testing.T) {
@@ -65,7 +163,7 @@ func TestNewFromAddress(t *testing.T) {
 
 	t.Run("Succeeds", func(t *testing.T) {
 		newFrom, err := newFromAddress(
-			"Mike Bland <mbland@acm.org>", senderAddress,
+			"Mike Bland <mbland@acm.org>", senderAddress, " at ",
 		)
 
 		assert.NilError(t, err)
@@ -74,7 +172,9 @@ func TestNewFromAddress(t *testing.T) {
 	})
 
 	t.Run("SucceedsWhenAddressOnly", func(t *testing.T) {
-		newFrom, err := newFromAddress("mbland@acm.org", senderAddress)
+		newFrom, err := newFromAddress(
+			"mbland@acm.org", senderAddress, " at ",
+		)
 
 		assert.NilError(t, err)
 		expected := "mbland at acm.org <ses-forwarder@foo.com>"
@@ -82,22 +182,118 @@ func TestNewFromAddress(t *testing.T) {
 
 	})
 
+	t.Run("UsesCustomAtReplacement", func(t *testing.T) {
+		newFrom, err := newFromAddress(
+			"Mike Bland <mbland@acm.org>", senderAddress, "_at_",
+		)
+
+		assert.NilError(t, err)
+		expected := "Mike Bland - mbland_at_acm.org <ses-forwarder@foo.com>"
+		assert.Equal(t, expected, newFrom)
+	})
+
+	t.Run("CollapsesWhitespaceInDisplayName", func(t *testing.T) {
+		newFrom, err := newFromAddress(
+			"\"Mike\t\tBland\" <mbland@acm.org>", senderAddress, " at ",
+		)
+
+		assert.NilError(t, err)
+		expected := "Mike Bland - mbland at acm.org <ses-forwarder@foo.com>"
+		assert.Equal(t, expected, newFrom)
+	})
+
+	t.Run("TrimsDisplayName", func(t *testing.T) {
+		newFrom, err := newFromAddress(
+			"\"  Mike Bland   \" <mbland@acm.org>", senderAddress, " at ",
+		)
+
+		assert.NilError(t, err)
+		expected := "Mike Bland - mbland at acm.org <ses-forwarder@foo.com>"
+		assert.Equal(t, expected, newFrom)
+	})
+
+	t.Run("QuotesDisplayNameContainingSpecials", func(t *testing.T) {
+		newFrom, err := newFromAddress(
+			`"Bland,  Mike \"mbland\"" <mbland@acm.org>`, senderAddress, " at ",
+		)
+
+		assert.NilError(t, err)
+		expected := `"Bland, Mike \"mbland\"" - mbland at acm.org ` +
+			"<ses-forwarder@foo.com>"
+		assert.Equal(t, expected, newFrom)
+		addr, err := mail.ParseAddress(newFrom)
+		assert.NilError(t, err)
+		assert.Equal(t, addr.Name, `Bland, Mike "mbland" - mbland at acm.org`)
+		assert.Equal(t, addr.Address, senderAddress)
+	})
+
 	t.Run("FailsIfOriginalFromMalformed", func(t *testing.T) {
 		const addr = "Mike Bland mbland@acm.org"
 
-		newFrom, err := newFromAddress(addr, senderAddress)
+		newFrom, err := newFromAddress(addr, senderAddress, " at ")
 
 		assert.Equal(t, "", newFrom)
 		assert.ErrorContains(t, err, "couldn't parse From address "+addr)
 	})
 }
 
+func TestNormalizeHeaders(t *testing.T) {
+	headers := mail.Header{
+		"Subject":  []string{"First", "Second"},
+		"Received": []string{"from a", "from b"},
+		"To":       []string{"foo@bar.com", "baz@bar.com"},
+	}
+
+	normalized := normalizeHeaders(headers)
+
+	assert.DeepEqual(
+		t,
+		normalized,
+		mail.Header{
+			"Subject":  []string{"First"},
+			"Received": []string{"from a", "from b"},
+			"To":       []string{"foo@bar.com", "baz@bar.com"},
+		},
+	)
+	assert.Equal(t, len(headers["Subject"]), 2)
+}
+
+func TestCheckFromAtReplacement(t *testing.T) {
+	t.Run("AcceptsDefault", func(t *testing.T) {
+		assert.NilError(t, checkFromAtReplacement(DefaultFromAtReplacement))
+	})
+
+	t.Run("AcceptsCustomToken", func(t *testing.T) {
+		assert.NilError(t, checkFromAtReplacement("_at_"))
+	})
+
+	t.Run("RejectsTokenContainingAt", func(t *testing.T) {
+		err := checkFromAtReplacement("@")
+
+		assert.ErrorContains(t, err, "produces unparseable From: ")
+	})
+
+	t.Run("RejectsTokenDroppedAsComment", func(t *testing.T) {
+		err := checkFromAtReplacement("(at)")
+
+		assert.ErrorContains(t, err, "produces ambiguous From: ")
+	})
+}
+
 func TestWriteFromAndReplyTo(t *testing.T) {
+	newInput := func(headers mail.Header) *updateHeadersInput {
+		return &updateHeadersInput{
+			headers:           headers,
+			senderAddress:     "foo@bar.com",
+			fromAtReplacement: DefaultFromAtReplacement,
+		}
+	}
+
 	t.Run("Succeeds", func(t *testing.T) {
 		result, hb := newHeaderBuffer()
 		headers := mail.Header{"From": []string{"Mike <mbland@acm.org>"}}
 
-		hb.writeFromAndReplyTo(headers, "foo@bar.com")
+		hb.writeFromAndReplyTo(newInput(headers))
 
 		assert.NilError(t, hb.err)
 		expected := "From: Mike - mbland at acm.org <foo@bar.com>\r\n" +
@@ -112,7 +308,7 @@ func TestWriteFromAndReplyTo(t *testing.T) {
 			"Reply-To": []string{"xyzzy@plugh.com"},
 		}
 
-		hb.writeFromAndReplyTo(headers, "foo@bar.com")
+		hb.writeFromAndReplyTo(newInput(headers))
 
 		assert.NilError(t, hb.err)
 		expected := "From: Mike - mbland at acm.org <foo@bar.com>\r\n" +
@@ -124,95 +320,1142 @@ func TestWriteFromAndReplyTo(t *testing.T) {
 		result, hb := newHeaderBuffer()
 		headers := mail.Header{"From": []string{"mbland AT acm.org"}}
 
-		hb.writeFromAndReplyTo(headers, "foo@bar.com")
+		hb.writeFromAndReplyTo(newInput(headers))
 
 		assert.Equal(t, result.String(), "")
 		assert.ErrorContains(t, hb.err, "mbland AT acm.org")
 	})
+
+	t.Run("UsesReplyToAddressOnlyIfConfigured", func(t *testing.T) {
+		result, hb := newHeaderBuffer()
+		input := newInput(
+			mail.Header{"From": []string{"Mike <mbland@acm.org>"}},
+		)
+		input.replyToAddress = "team@bar.com"
+
+		hb.writeFromAndReplyTo(input)
+
+		assert.NilError(t, hb.err)
+		expected := "From: Mike - mbland at acm.org <foo@bar.com>\r\n" +
+			"Reply-To: team@bar.com\r\n"
+		assert.Equal(t, result.String(), expected)
+	})
+
+	t.Run("CombinesOriginalAndReplyToAddress", func(t *testing.T) {
+		result, hb := newHeaderBuffer()
+		input := newInput(mail.Header{
+			"From":     []string{"Mike <mbland@acm.org>"},
+			"Reply-To": []string{"xyzzy@plugh.com"},
+		})
+		input.replyToAddress = "team@bar.com"
+		input.replyToIncludeOriginal = true
+
+		hb.writeFromAndReplyTo(input)
+
+		assert.NilError(t, hb.err)
+		expected := "From: Mike - mbland at acm.org <foo@bar.com>\r\n" +
+			"Reply-To: xyzzy@plugh.com, team@bar.com\r\n"
+		assert.Equal(t, result.String(), expected)
+	})
+
+	t.Run("UsesReplyToAddressIfCombinedReplyToInvalid", func(t *testing.T) {
+		result, hb := newHeaderBuffer()
+		logs := &strings.Builder{}
+		hb.logf = func(format string, v ...any) {
+			fmt.Fprintf(logs, format, v...)
+		}
+		input := newInput(mail.Header{
+			"From":     []string{"Mike <mbland@acm.org>"},
+			"Reply-To": []string{"xyzzy AT plugh.com"},
+		})
+		input.replyToAddress = "team@bar.com"
+		input.replyToIncludeOriginal = true
+
+		hb.writeFromAndReplyTo(input)
+
+		assert.NilError(t, hb.err)
+		expected := "From: Mike - mbland at acm.org <foo@bar.com>\r\n" +
+			"Reply-To: team@bar.com\r\n"
+		assert.Equal(t, result.String(), expected)
+		expectedLog := "invalid Reply-To xyzzy AT plugh.com, team@bar.com"
+		assert.Assert(t, strings.HasPrefix(logs.String(), expectedLog))
+		assert.Assert(
+			t, strings.HasSuffix(logs.String(), "; using team@bar.com only"),
+		)
+	})
 }
 
-type ErrWriter struct {
-	buf              io.Writer
-	errorOnSubstring string
+func TestWriteFromAndReplyToWithInternalReplyTo(t *testing.T) {
+	setup := func(from string) *updateHeadersInput {
+		return &updateHeadersInput{
+			headers: mail.Header{
+				"From":     []string{from},
+				"Reply-To": []string{"Mike <other@acm.org>"},
+			},
+			senderAddress:     "foo@bar.com",
+			fromAtReplacement: DefaultFromAtReplacement,
+			internalReplyTo:   "shared@bar.com",
+			internalDomains:   []string{"bar.com", "baz.com"},
+		}
+	}
+
+	t.Run("UsesInternalReplyToForInternalSender", func(t *testing.T) {
+		result, hb := newHeaderBuffer()
+
+		hb.writeFromAndReplyTo(setup("Mike <mbland@BAZ.com>"))
+
+		assert.NilError(t, hb.err)
+		expected := "From: Mike - mbland at BAZ.com <foo@bar.com>\r\n" +
+			"Reply-To: shared@bar.com\r\n"
+		assert.Equal(t, result.String(), expected)
+	})
+
+	t.Run("KeepsOriginalReplyToForExternalSender", func(t *testing.T) {
+		result, hb := newHeaderBuffer()
+		input := setup("Mike <mbland@acm.org>")
+		delete(input.headers, "Reply-To")
+
+		hb.writeFromAndReplyTo(input)
+
+		assert.NilError(t, hb.err)
+		expected := "From: Mike - mbland at acm.org <foo@bar.com>\r\n" +
+			"Reply-To: Mike <mbland@acm.org>\r\n"
+		assert.Equal(t, result.String(), expected)
+	})
+
+	t.Run("TreatsSubdomainAsExternal", func(t *testing.T) {
+		result, hb := newHeaderBuffer()
+
+		hb.writeFromAndReplyTo(setup("Mike <mbland@mail.bar.com>"))
+
+		assert.NilError(t, hb.err)
+		expected := "Reply-To: Mike <other@acm.org>\r\n"
+		assert.Assert(t, strings.HasSuffix(result.String(), expected))
+	})
 }
 
-func (w *ErrWriter) Write(b []byte) (int, error) {
-	if strings.Contains(string(b), w.errorOnSubstring) {
-		return 0, errors.New("found: " + w.errorOnSubstring)
+func TestWriteFromAndReplyToWithNoReplySender(t *testing.T) {
+	setup := func(from string) *updateHeadersInput {
+		return &updateHeadersInput{
+			headers:           mail.Header{"From": []string{from}},
+			senderAddress:     "foo@bar.com",
+			fromAtReplacement: DefaultFromAtReplacement,
+			noReplyReplyTo:    "support@bar.com",
+		}
 	}
-	return w.buf.Write(b)
+
+	t.Run("UsesNoReplyReplyToForNoReplySender", func(t *testing.T) {
+		result, hb := newHeaderBuffer()
+
+		hb.writeFromAndReplyTo(setup("Acme <No-Reply@acme.com>"))
+
+		assert.NilError(t, hb.err)
+		expected := "From: Acme - No-Reply at acme.com <foo@bar.com>\r\n" +
+			"Reply-To: support@bar.com\r\n"
+		assert.Equal(t, result.String(), expected)
+	})
+
+	t.Run("OmitsReplyToForNoReplySenderIfConfigured", func(t *testing.T) {
+		result, hb := newHeaderBuffer()
+		input := setup("noreply+alerts@acme.com")
+		input.noReplyReplyTo = ""
+		input.omitNoReplyReplyTo = true
+
+		hb.writeFromAndReplyTo(input)
+
+		assert.NilError(t, hb.err)
+		expected := "From: noreply+alerts at acme.com <foo@bar.com>\r\n"
+		assert.Equal(t, result.String(), expected)
+	})
+
+	t.Run("ChecksOriginalReplyToInsteadOfFrom", func(t *testing.T) {
+		result, hb := newHeaderBuffer()
+		input := setup("Acme <no-reply@acme.com>")
+		input.headers["Reply-To"] = []string{"Help <help@acme.com>"}
+
+		hb.writeFromAndReplyTo(input)
+
+		assert.NilError(t, hb.err)
+		expected := "Reply-To: Help <help@acme.com>\r\n"
+		assert.Assert(t, strings.HasSuffix(result.String(), expected))
+	})
+
+	t.Run("KeepsOriginalReplyToForNormalSender", func(t *testing.T) {
+		result, hb := newHeaderBuffer()
+
+		hb.writeFromAndReplyTo(setup("Mike <mbland@acm.org>"))
+
+		assert.NilError(t, hb.err)
+		expected := "Reply-To: Mike <mbland@acm.org>\r\n"
+		assert.Assert(t, strings.HasSuffix(result.String(), expected))
+	})
 }
 
-func TestWriteUpdatedHeaders(t *testing.T) {
+func TestIsNoReplyAddress(t *testing.T) {
+	assert.Assert(t, isNoReplyAddress("noreply@acme.com"))
+	assert.Assert(t, isNoReplyAddress("Acme <NO-REPLY+x@acme.com>"))
+	assert.Assert(t, !isNoReplyAddress("noreplies@acme.com"))
+	assert.Assert(t, !isNoReplyAddress("mbland@acm.org"))
+	assert.Assert(t, !isNoReplyAddress("not an address"))
+}
+
+func encodedWord(
+	t *testing.T, enc encoding.Encoding, charset, s string,
+) string {
+	t.Helper()
+	encoded, err := enc.NewEncoder().String(s)
+	assert.NilError(t, err)
+	return "=?" + charset + "?B?" +
+		base64.StdEncoding.EncodeToString([]byte(encoded)) + "?="
+}
+
+func TestWriteFromAndReplyToKeepingOriginalFrom(t *testing.T) {
 	setup := func() (*updateHeadersInput, *strings.Builder, *headerBuffer) {
 		input := &updateHeadersInput{
-			headers:       mail.Header{},
-			senderAddress: "foo@bar.com",
-			msgPath:       "bar.com/incoming/msgId",
+			headers:           mail.Header{},
+			senderAddress:     "foo@bar.com",
+			fromAtReplacement: DefaultFromAtReplacement,
+			replyToAddress:    "replies@bar.com",
+			keepOriginalFrom:  true,
 		}
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
 		builder := &strings.Builder{}
 		return input, builder, &headerBuffer{buf: builder}
 	}
 
-	t.Run("EmitsOnlySpecificHeadersInSpecificOrder", func(t *testing.T) {
+	t.Run("KeepsFromAndOmitsReplyToIfNotPresent", func(t *testing.T) {
 		input, result, hb := setup()
-		for name, value := range map[string]string{
-			"Return-Path":  "<bounce@foo.com>",
-			"Mime-Version": "1.0",
-			"From":         "Mike <mbland@acm.org>",
-			"Reply-To":     "Mike <some@other.com>",
-			"Cc":           "foo@bar.com",
-			"Bcc":          "bar@baz.com",
-			"Date":         "Fri, 18 Sep 1970 12:45:00 +0000",
-			"Subject":      "There's a reason why we unit test",
-			"To":           "foo@xyzzy.com",
-			"Content-Type": `multipart/alternative; boundary="random-string"`,
-		} {
-			input.headers[name] = []string{value}
-		}
 
-		err := hb.WriteUpdatedHeaders(input)
+		hb.writeFromAndReplyTo(input)
 
-		assert.NilError(t, err)
-		expected := strings.Join(
-			[]string{
-				"From: Mike - mbland at acm.org <foo@bar.com>",
-				"Reply-To: Mike <some@other.com>",
-				"To: foo@xyzzy.com",
-				"Cc: foo@bar.com",
-				"Bcc: bar@baz.com",
-				"Subject: There's a reason why we unit test",
-				"MIME-Version: 1.0",
-				`Content-Type: multipart/alternative; boundary="random-string"`,
-				origLinkHeaderPrefix + input.msgPath,
-			},
-			"\r\n",
-		) + "\r\n\r\n"
-		assert.Equal(t, result.String(), expected)
+		assert.NilError(t, hb.err)
+		assert.Equal(t, result.String(), "From: Mike <mbland@acm.org>\r\n")
 	})
 
-	t.Run("ErrorsIfUpdatingAnyHeaderFailed", func(t *testing.T) {
+	t.Run("KeepsOriginalReplyTo", func(t *testing.T) {
 		input, result, hb := setup()
-		ew := &ErrWriter{result, "There's a reason why we unit test"}
-		hb.buf = ew
-		for name, value := range map[string]string{
-			"From":    "Mike <mbland@acm.org>",
-			"Date":    "Fri, 18 Sep 1970 12:45:00 +0000",
-			"Subject": ew.errorOnSubstring,
-			"To":      "foo@xyzzy.com",
-		} {
-			input.headers[name] = []string{value}
-		}
+		input.headers["Reply-To"] = []string{"Mike <other@acm.org>"}
 
-		err := hb.WriteUpdatedHeaders(input)
+		hb.writeFromAndReplyTo(input)
 
-		expectedErr := "error updating email headers: found: " +
-			ew.errorOnSubstring
-		assert.ErrorContains(t, err, expectedErr)
+		assert.NilError(t, hb.err)
+		expected := "From: Mike <mbland@acm.org>\r\n" +
+			"Reply-To: Mike <other@acm.org>\r\n"
+		assert.Equal(t, result.String(), expected)
+	})
+}
 
-		expectedHeaders := "From: Mike - mbland at acm.org <foo@bar.com>\r\n" +
-			"Reply-To: Mike <mbland@acm.org>\r\n" +
-			"To: foo@xyzzy.com\r\n"
-		assert.Equal(t, result.String(), expectedHeaders)
+func TestRewriteMessageIds(t *testing.T) {
+	values := []string{
+		"<CAF=abc.123@mail.gmail.com>",
+		" <odd@local@example.com> ",
+		"<no-domain>",
+	}
+
+	result := rewriteMessageIds(values, "xyzzy.com")
+
+	expected := []string{
+		"<CAF=abc.123@xyzzy.com>",
+		"<odd@local@xyzzy.com>",
+		"<no-domain>",
+	}
+	assert.DeepEqual(t, result, expected)
+}
+
+func TestNormalizeEncodedWords(t *testing.T) {
+	const chineseText = "你好，世界"
+	const japaneseText = "こんにちは世界"
+
+	t.Run("ConvertsGB2312ToUTF8", func(t *testing.T) {
+		subject := encodedWord(t, simplifiedchinese.GBK, "GB2312", chineseText)
+
+		result := normalizeEncodedWords([]string{subject})
+
+		assert.DeepEqual(
+			t, result, []string{mime.BEncoding.Encode("UTF-8", chineseText)},
+		)
 	})
+
+	t.Run("ConvertsShiftJISToUTF8", func(t *testing.T) {
+		subject := encodedWord(t, japanese.ShiftJIS, "Shift_JIS", japaneseText)
+
+		result := normalizeEncodedWords([]string{subject})
+
+		assert.DeepEqual(
+			t, result, []string{mime.BEncoding.Encode("UTF-8", japaneseText)},
+		)
+	})
+
+	t.Run("LeavesPlainValuesUnchanged", func(t *testing.T) {
+		subject := "There's a reason why we unit test"
+
+		result := normalizeEncodedWords([]string{subject})
+
+		assert.DeepEqual(t, result, []string{subject})
+	})
+
+	t.Run("LeavesUnknownCharsetsUnchanged", func(t *testing.T) {
+		subject := "=?x-bogus-charset?B?Zm9vYmFy?="
+
+		result := normalizeEncodedWords([]string{subject})
+
+		assert.DeepEqual(t, result, []string{subject})
+	})
+}
+
+func TestStripPlusTags(t *testing.T) {
+	t.Run("StripsPlusTagFromDomainAddress", func(t *testing.T) {
+		values := []string{"Mike <me+tag@foo.com>"}
+
+		result := stripPlusTags(values, "foo.com")
+
+		assert.DeepEqual(t, result, []string{`"Mike" <me@foo.com>`})
+	})
+
+	t.Run("LeavesPlainAddressUnchanged", func(t *testing.T) {
+		values := []string{"Mike <me@foo.com>"}
+
+		result := stripPlusTags(values, "foo.com")
+
+		assert.DeepEqual(t, result, values)
+	})
+
+	t.Run("LeavesOtherDomainsUnchanged", func(t *testing.T) {
+		values := []string{"me+tag@bar.com, you+tag@FOO.com"}
+
+		result := stripPlusTags(values, "foo.com")
+
+		assert.DeepEqual(
+			t, result, []string{"<me+tag@bar.com>, <you@FOO.com>"},
+		)
+	})
+
+	t.Run("LeavesUnparseableValuesUnchanged", func(t *testing.T) {
+		values := []string{"not an address+tag@foo.com"}
+
+		result := stripPlusTags(values, "foo.com")
+
+		assert.DeepEqual(t, result, values)
+	})
+}
+
+func TestAuthenticationResults(t *testing.T) {
+	verdict := func(status string) events.SimpleEmailVerdict {
+		return events.SimpleEmailVerdict{Status: status}
+	}
+
+	t.Run("AllPass", func(t *testing.T) {
+		receipt := &events.SimpleEmailReceipt{
+			SPFVerdict:   verdict("PASS"),
+			DKIMVerdict:  verdict("PASS"),
+			DMARCVerdict: verdict("PASS"),
+		}
+
+		result := authenticationResults("foo.com", receipt)
+
+		expected := "foo.com; spf=pass; dkim=pass; dmarc=pass"
+		assert.Equal(t, result, expected)
+	})
+
+	t.Run("MixedVerdicts", func(t *testing.T) {
+		receipt := &events.SimpleEmailReceipt{
+			SPFVerdict:   verdict("FAIL"),
+			DKIMVerdict:  verdict("PROCESSING_FAILED"),
+			DMARCVerdict: verdict("DISABLED"),
+		}
+
+		result := authenticationResults("foo.com", receipt)
+
+		expected := "foo.com; spf=fail; dkim=temperror; dmarc=none"
+		assert.Equal(t, result, expected)
+	})
+}
+
+type ErrWriter struct {
+	buf              io.Writer
+	errorOnSubstring string
+}
+
+func (w *ErrWriter) Write(b []byte) (int, error) {
+	if strings.Contains(string(b), w.errorOnSubstring) {
+		return 0, errors.New("found: " + w.errorOnSubstring)
+	}
+	return w.buf.Write(b)
+}
+
+func TestWriteUpdatedHeaders(t *testing.T) {
+	setup := func() (*updateHeadersInput, *strings.Builder, *headerBuffer) {
+		input := &updateHeadersInput{
+			headers:           mail.Header{},
+			senderAddress:     "foo@bar.com",
+			msgPath:           "bar.com/incoming/msgId",
+			fromAtReplacement: DefaultFromAtReplacement,
+		}
+		builder := &strings.Builder{}
+		return input, builder, &headerBuffer{buf: builder}
+	}
+
+	t.Run("EmitsOnlySpecificHeadersInSpecificOrder", func(t *testing.T) {
+		input, result, hb := setup()
+		for name, value := range map[string]string{
+			"Return-Path":  "<bounce@foo.com>",
+			"Mime-Version": "1.0",
+			"From":         "Mike <mbland@acm.org>",
+			"Reply-To":     "Mike <some@other.com>",
+			"Cc":           "foo@bar.com",
+			"Bcc":          "bar@baz.com",
+			"Date":         "Fri, 18 Sep 1970 12:45:00 +0000",
+			"Subject":      "There's a reason why we unit test",
+			"To":           "foo@xyzzy.com",
+			"Content-Type": `multipart/alternative; boundary="random-string"`,
+		} {
+			input.headers[name] = []string{value}
+		}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := strings.Join(
+			[]string{
+				"From: Mike - mbland at acm.org <foo@bar.com>",
+				"Reply-To: Mike <some@other.com>",
+				"To: foo@xyzzy.com",
+				"Cc: foo@bar.com",
+				"Bcc: bar@baz.com",
+				"Subject: There's a reason why we unit test",
+				"MIME-Version: 1.0",
+				`Content-Type: multipart/alternative; boundary="random-string"`,
+				"X-Original-Sender: mbland@acm.org",
+				origLinkHeaderPrefix + input.msgPath,
+			},
+			"\r\n",
+		) + "\r\n\r\n"
+		assert.Equal(t, result.String(), expected)
+	})
+
+	t.Run("StripsHeadersInAllowlistMode", func(t *testing.T) {
+		input, result, hb := setup()
+		input.stripHeaders = []string{"Cc", "BCC"}
+		for name, value := range map[string]string{
+			"From":    "Mike <mbland@acm.org>",
+			"To":      "foo@xyzzy.com",
+			"Cc":      "foo@bar.com",
+			"Bcc":     "bar@baz.com",
+			"Subject": "There's a reason why we unit test",
+		} {
+			input.headers[name] = []string{value}
+		}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := "To: foo@xyzzy.com\r\n" +
+			"Subject: There's a reason why we unit test\r\n"
+		assert.Assert(t, strings.Contains(result.String(), expected))
+	})
+
+	t.Run("EmitsAllButStrippedHeadersInDenylistMode", func(t *testing.T) {
+		input, result, hb := setup()
+		input.denylistHeaders = true
+		input.stripHeaders = []string{"X-Originating-Ip", "Received"}
+		input.headers = mail.Header{
+			"Return-Path":      {"<bounce@foo.com>"},
+			"Received":         {"from a by b", "from c by d"},
+			"Dkim-Signature":   {"v=1; a=rsa-sha256; d=acm.org"},
+			"From":             {"Mike <mbland@acm.org>"},
+			"Reply-To":         {"Mike <some@other.com>"},
+			"To":               {"foo@xyzzy.com"},
+			"Subject":          {"There's a reason why we unit test"},
+			"Date":             {"Fri, 18 Sep 1970 12:45:00 +0000"},
+			"Message-Id":       {"<deadbeef@acm.org>"},
+			"X-Originating-Ip": {"192.0.2.1"},
+			"X-Mailer":         {"unit test"},
+		}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := strings.Join(
+			[]string{
+				"From: Mike - mbland at acm.org <foo@bar.com>",
+				"Reply-To: Mike <some@other.com>",
+				"To: foo@xyzzy.com",
+				"Subject: There's a reason why we unit test",
+				"Date: Fri, 18 Sep 1970 12:45:00 +0000",
+				"Message-ID: <deadbeef@acm.org>",
+				"X-Mailer: unit test",
+				"X-Original-Sender: mbland@acm.org",
+				origLinkHeaderPrefix + input.msgPath,
+			},
+			"\r\n",
+		) + "\r\n\r\n"
+		assert.Equal(t, result.String(), expected)
+	})
+
+	t.Run("KeepsHeadersMatchingPatternsInAllowlistMode", func(t *testing.T) {
+		input, result, hb := setup()
+		input.stripHeaders = []string{"X-Company-Secret"}
+		input.keepHeaderPatterns = []*regexp.Regexp{
+			regexp.MustCompile("(?i)^X-Company-.*$"),
+			regexp.MustCompile("(?i)^organization$"),
+			regexp.MustCompile("(?i)^From$"),
+		}
+		input.headers = mail.Header{
+			"From":             {"Mike <mbland@acm.org>"},
+			"To":               {"foo@xyzzy.com"},
+			"Subject":          {"There's a reason why we unit test"},
+			"X-Company-Team":   {"Platform"},
+			"X-Company-Dept":   {"Engineering"},
+			"X-Company-Secret": {"hunter2"},
+			"Organization":     {"ACM"},
+			"X-Mailer":         {"unit test"},
+		}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := strings.Join(
+			[]string{
+				"From: Mike - mbland at acm.org <foo@bar.com>",
+				"Reply-To: Mike <mbland@acm.org>",
+				"To: foo@xyzzy.com",
+				"Subject: There's a reason why we unit test",
+				"Organization: ACM",
+				"X-Company-Dept: Engineering",
+				"X-Company-Team: Platform",
+				"X-Original-Sender: mbland@acm.org",
+				origLinkHeaderPrefix + input.msgPath,
+			},
+			"\r\n",
+		) + "\r\n\r\n"
+		assert.Equal(t, result.String(), expected)
+	})
+
+	t.Run("ReplacesOriginalDateInDenylistModeIfDateSet", func(t *testing.T) {
+		input, result, hb := setup()
+		input.denylistHeaders = true
+		input.date = time.Date(2023, time.November, 5, 9, 30, 15, 0, time.UTC)
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["Date"] = []string{"Fri, 18 Sep 1970 12:45:00 +0000"}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		assert.Assert(t, strings.Contains(
+			result.String(), "Date: Sun, 05 Nov 2023 09:30:15 +0000\r\n",
+		))
+		assert.Assert(t, !strings.Contains(result.String(), "1970"))
+	})
+
+	t.Run("AddsMissingMIMEVersionIfContentTypePresent", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["Subject"] = []string{"No MIME-Version"}
+		input.headers["Content-Type"] = []string{
+			`multipart/alternative; boundary="random-string"`,
+		}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := "Subject: No MIME-Version\r\n" +
+			"MIME-Version: 1.0\r\n" +
+			`Content-Type: multipart/alternative; boundary="random-string"`
+		assert.Assert(t, strings.Contains(result.String(), expected))
+	})
+
+	t.Run("OmitsMIMEVersionIfNotMIMEContent", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["Subject"] = []string{"Plain RFC 822 message"}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		assert.Assert(t, !strings.Contains(result.String(), "MIME-Version"))
+	})
+
+	t.Run("EmitsAuthenticationResultsIfEnabled", func(t *testing.T) {
+		input, result, hb := setup()
+		input.authServId = "foo.com"
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.receipt = &events.SimpleEmailReceipt{
+			SPFVerdict:   events.SimpleEmailVerdict{Status: "PASS"},
+			DKIMVerdict:  events.SimpleEmailVerdict{Status: "FAIL"},
+			DMARCVerdict: events.SimpleEmailVerdict{Status: "GRAY"},
+		}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := "X-Original-Sender: mbland@acm.org\r\n" +
+			"Authentication-Results: foo.com; " +
+			"spf=pass; dkim=fail; dmarc=none\r\n" +
+			origLinkHeaderPrefix + input.msgPath + "\r\n\r\n"
+		assert.Assert(t, strings.HasSuffix(result.String(), expected))
+	})
+
+	t.Run("OmitsAuthenticationResultsByDefault", func(t *testing.T) {
+		input, result, hb := setup()
+		input.denylistHeaders = true
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["Authentication-Results"] = []string{"mx.foo.com; none"}
+		input.receipt = &events.SimpleEmailReceipt{
+			SPFVerdict: events.SimpleEmailVerdict{Status: "PASS"},
+		}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := "X-Original-Sender: mbland@acm.org\r\n" +
+			origLinkHeaderPrefix + input.msgPath + "\r\n\r\n"
+		assert.Assert(t, strings.HasSuffix(result.String(), expected))
+		assert.Assert(
+			t, !strings.Contains(result.String(), "Authentication-Results"),
+		)
+	})
+
+	t.Run("EmitsSpamHeadersForSpamIfEnabled", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["X-Spam-Flag"] = []string{"NO"}
+		input.denylistHeaders = true
+		input.spamHeaders = true
+		input.receipt = &events.SimpleEmailReceipt{
+			SPFVerdict:   events.SimpleEmailVerdict{Status: "PASS"},
+			DKIMVerdict:  events.SimpleEmailVerdict{Status: "PASS"},
+			SpamVerdict:  events.SimpleEmailVerdict{Status: "FAIL"},
+			VirusVerdict: events.SimpleEmailVerdict{Status: "PASS"},
+		}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := "X-Spam-Flag: YES\r\n" +
+			"X-Spam-Status: Yes, spf=pass dkim=pass spam=fail virus=pass\r\n" +
+			origLinkHeaderPrefix + input.msgPath + "\r\n\r\n"
+		assert.Assert(t, strings.HasSuffix(result.String(), expected))
+		assert.Equal(t, strings.Count(result.String(), "X-Spam-Flag"), 1)
+	})
+
+	t.Run("EmitsSpamHeadersForNonSpamIfEnabled", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.spamHeaders = true
+		input.receipt = &events.SimpleEmailReceipt{
+			SPFVerdict:   events.SimpleEmailVerdict{Status: "PASS"},
+			DKIMVerdict:  events.SimpleEmailVerdict{Status: "PASS"},
+			SpamVerdict:  events.SimpleEmailVerdict{Status: "PASS"},
+			VirusVerdict: events.SimpleEmailVerdict{Status: "PASS"},
+		}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := "X-Spam-Flag: NO\r\n" +
+			"X-Spam-Status: No, spf=pass dkim=pass spam=pass virus=pass\r\n"
+		assert.Assert(t, strings.Contains(result.String(), expected))
+	})
+
+	t.Run("OmitsSpamHeadersByDefault", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.receipt = &events.SimpleEmailReceipt{
+			SpamVerdict: events.SimpleEmailVerdict{Status: "FAIL"},
+		}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		assert.Assert(t, !strings.Contains(result.String(), "X-Spam-"))
+	})
+
+	threadIndex := "AdnT+/z9Q2w0Xk1bTd6Ou8R3w/Ag=="
+
+	t.Run("OmitsOutlookThreadingHeadersByDefault", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["Thread-Topic"] = []string{"Status"}
+		input.headers["Thread-Index"] = []string{threadIndex}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		assert.Assert(t, !strings.Contains(result.String(), "Thread-"))
+	})
+
+	t.Run("PreservesOutlookThreadingHeadersIfEnabled", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["Subject"] = []string{"RE: Status"}
+		input.headers["Thread-Topic"] = []string{"Status"}
+		input.headers["Thread-Index"] = []string{threadIndex}
+		input.preserveThreadHeaders = true
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := "Thread-Topic: Status\r\n" +
+			"Thread-Index: " + threadIndex + "\r\n"
+		assert.Assert(t, strings.Contains(result.String(), expected))
+	})
+
+	t.Run("StripsOutlookThreadingHeadersIfConfigured", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["Thread-Topic"] = []string{"Status"}
+		input.headers["Thread-Index"] = []string{threadIndex}
+		input.preserveThreadHeaders = true
+		input.stripHeaders = []string{"thread-index"}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		assert.Assert(t, strings.Contains(result.String(), "Thread-Topic"))
+		assert.Assert(t, !strings.Contains(result.String(), "Thread-Index"))
+	})
+
+	t.Run("ReplacesOriginalMetadataHeadersInDenylistMode",
+		func(t *testing.T) {
+			input, result, hb := setup()
+			input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+			input.headers["X-Ses-Receipt-Time"] = []string{"spoofed"}
+			input.denylistHeaders = true
+			input.metadataHeaders = []metadataHeader{
+				{"X-SES-Receipt-Time", "12:45"},
+			}
+
+			err := hb.WriteUpdatedHeaders(input)
+
+			assert.NilError(t, err)
+			expected := "X-SES-Receipt-Time: 12:45\r\n"
+			assert.Assert(t, strings.Contains(result.String(), expected))
+			assert.Assert(t, !strings.Contains(result.String(), "spoofed"))
+		},
+	)
+
+	t.Run("EmitsOnlyFirstValueOfDuplicateSingularHeaders", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{
+			"Mike <mbland@acm.org>", "Spoofer <spoof@foo.com>",
+		}
+		input.headers["Subject"] = []string{"First subject", "Second subject"}
+		input.headers["Received"] = []string{"from a", "from b"}
+		input.denylistHeaders = true
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		assert.Equal(t, strings.Count(result.String(), "\r\nSubject: "), 1)
+		expected := "\r\nSubject: First subject\r\n"
+		assert.Assert(t, strings.Contains(result.String(), expected))
+		assert.Assert(t, !strings.Contains(result.String(), "Second subject"))
+		assert.Assert(t, !strings.Contains(result.String(), "spoof@foo.com"))
+		expected = "Received: from a\r\nReceived: from b\r\n"
+		assert.Assert(t, strings.Contains(result.String(), expected))
+	})
+
+	t.Run("EmitsForwardedForHeaderForSingleRecipient", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.receipt = &events.SimpleEmailReceipt{
+			Recipients: []string{"me@xyzzy.com"},
+		}
+		input.forwardedForHeader = DefaultForwardedForHeader
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := "X-Forwarded-For-Mail: me@xyzzy.com by foo@bar.com\r\n"
+		assert.Assert(t, strings.Contains(result.String(), expected))
+	})
+
+	t.Run("EmitsForwardedForHeaderForEachRecipient", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.receipt = &events.SimpleEmailReceipt{
+			Recipients: []string{"me@xyzzy.com", "you@xyzzy.com"},
+		}
+		input.forwardedForHeader = "X-Forward-Chain"
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := "X-Forward-Chain: me@xyzzy.com by foo@bar.com\r\n" +
+			"X-Forward-Chain: you@xyzzy.com by foo@bar.com\r\n"
+		assert.Assert(t, strings.Contains(result.String(), expected))
+	})
+
+	t.Run("OmitsForwardedForHeaderIfDisabled", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.receipt = &events.SimpleEmailReceipt{
+			Recipients: []string{"me@xyzzy.com"},
+		}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		assert.Assert(t, !strings.Contains(result.String(), "Forwarded-For"))
+	})
+
+	t.Run("EmitsRewrittenMessageIdIfEnabled", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["Message-Id"] = []string{"<deadbeef@acm.org>"}
+		input.messageIdDomain = "xyzzy.com"
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := "\r\nMessage-ID: <deadbeef@xyzzy.com>\r\n"
+		assert.Assert(t, strings.Contains(result.String(), expected))
+		assert.Assert(t, !strings.Contains(result.String(), "deadbeef@acm"))
+	})
+
+	t.Run("RewritesMessageIdOnceInDenylistMode", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["Message-Id"] = []string{"<deadbeef@acm.org>"}
+		input.denylistHeaders = true
+		input.messageIdDomain = "xyzzy.com"
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		assert.Equal(t, strings.Count(result.String(), "Message-ID:"), 1)
+		assert.Assert(t, !strings.Contains(result.String(), "deadbeef@acm"))
+	})
+
+	t.Run("OmitsPriorityHeadersByDefault", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["X-Priority"] = []string{"1 (Highest)"}
+		input.headers["Importance"] = []string{"high"}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		assert.Assert(t, !strings.Contains(result.String(), "X-Priority"))
+		assert.Assert(t, !strings.Contains(result.String(), "Importance"))
+	})
+
+	t.Run("PreservesHighPriorityIfEnabled", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["X-Priority"] = []string{"1 (Highest)"}
+		input.headers["Importance"] = []string{"High"}
+		input.headers["Priority"] = []string{"urgent"}
+		input.preservePriority = true
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := "X-Priority: 1 (Highest)\r\n" +
+			"Importance: high\r\n" +
+			"Priority: urgent\r\n"
+		assert.Assert(t, strings.Contains(result.String(), expected))
+	})
+
+	t.Run("PreservesMSMailPriorityIfEnabled", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["X-Msmail-Priority"] = []string{"high"}
+		input.preservePriority = true
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		assert.Assert(t, strings.Contains(
+			result.String(), "X-MSMail-Priority: High\r\n",
+		))
+	})
+
+	t.Run("NormalizesMSMailPriorityToXPriority", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["X-Priority"] = []string{"5 (Lowest)"}
+		input.headers["X-Msmail-Priority"] = []string{"High"}
+		input.preservePriority = true
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := "X-Priority: 5 (Lowest)\r\nX-MSMail-Priority: Low\r\n"
+		assert.Assert(t, strings.Contains(result.String(), expected))
+	})
+
+	t.Run("OmitsAbsentPriorityHeaders", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.preservePriority = true
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		assert.Assert(t, !strings.Contains(result.String(), "Priority"))
+	})
+
+	t.Run("NormalizesConflictingPriorityToXPriority", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["X-Priority"] = []string{"2"}
+		input.headers["Importance"] = []string{"low"}
+		input.preservePriority = true
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := "X-Priority: 1 (Highest)\r\nImportance: high\r\n"
+		assert.Assert(t, strings.Contains(result.String(), expected))
+	})
+
+	t.Run("NormalizesPriorityOnceInDenylistMode", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["X-Priority"] = []string{"bogus"}
+		input.headers["Importance"] = []string{"low"}
+		input.denylistHeaders = true
+		input.preservePriority = true
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := "X-Priority: 5 (Lowest)\r\nImportance: low\r\n"
+		assert.Assert(t, strings.Contains(result.String(), expected))
+		assert.Equal(t, strings.Count(result.String(), "Importance:"), 1)
+	})
+
+	t.Run("OmitsContentLanguageByDefault", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["Content-Language"] = []string{"fr-CA"}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		assert.Assert(t, !strings.Contains(result.String(), "Content-Language"))
+	})
+
+	t.Run("PreservesContentLanguageIfEnabled", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["Content-Language"] = []string{"fr-CA"}
+		input.preserveContentLanguage = true
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		assert.Assert(t, strings.Contains(
+			result.String(), "Content-Language: fr-CA\r\n",
+		))
+	})
+
+	t.Run("OmitsAbsentContentLanguage", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.preserveContentLanguage = true
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		assert.Assert(t, !strings.Contains(result.String(), "Content-Language"))
+	})
+
+	t.Run("EmitsContentLanguageOnceInDenylistMode", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["Content-Language"] = []string{"de"}
+		input.denylistHeaders = true
+		input.preserveContentLanguage = true
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		assert.Equal(t, strings.Count(result.String(), "Content-Language:"), 1)
+	})
+
+	t.Run("EmitsConsoleLinkIfRegionSet", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.msgPath = "mail.foo.com/inbox/msg id"
+		input.consoleLinkRegion = "us-east-1"
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := origLinkHeader + ": " +
+			"https://s3.console.aws.amazon.com/s3/object/mail.foo.com" +
+			"?region=us-east-1&prefix=inbox%2Fmsg+id\r\n\r\n"
+		assert.Assert(t, strings.HasSuffix(result.String(), expected))
+		assert.Assert(t, !strings.Contains(result.String(), "s3://"))
+	})
+
+	t.Run("EmitsDateIfSet", func(t *testing.T) {
+		input, result, hb := setup()
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["Date"] = []string{"Fri, 18 Sep 1970 12:45:00 +0000"}
+		input.date = time.Date(
+			2023, time.November, 5, 9, 30, 15, 0, time.FixedZone("", -5*3600),
+		)
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := "Reply-To: Mike <mbland@acm.org>\r\n" +
+			"Date: Sun, 05 Nov 2023 09:30:15 -0500\r\n"
+		assert.Assert(t, strings.Contains(result.String(), expected))
+		assert.Assert(t, !strings.Contains(result.String(), "1970"))
+	})
+
+	t.Run("StripsPlusTagsFromToIfEnabled", func(t *testing.T) {
+		input, result, hb := setup()
+		input.stripPlusFromToDomain = "foo.com"
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["To"] = []string{"me+tag@foo.com"}
+		input.headers["Cc"] = []string{"you+tag@foo.com"}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := "To: <me@foo.com>\r\nCc: you+tag@foo.com\r\n"
+		assert.Assert(t, strings.Contains(result.String(), expected))
+	})
+
+	t.Run("EmitsDefaultSubjectIfSubjectMissing", func(t *testing.T) {
+		input, result, hb := setup()
+		input.defaultSubject = "(no subject)"
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["To"] = []string{"foo@xyzzy.com"}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := "To: foo@xyzzy.com\r\nSubject: (no subject)\r\n"
+		assert.Assert(t, strings.Contains(result.String(), expected))
+	})
+
+	t.Run("EncodesNonAsciiDefaultSubject", func(t *testing.T) {
+		input, result, hb := setup()
+		input.defaultSubject = "(sans objet — vide)"
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := "Subject: " +
+			mime.QEncoding.Encode("UTF-8", input.defaultSubject) + "\r\n"
+		assert.Assert(t, strings.Contains(result.String(), expected))
+	})
+
+	t.Run("KeepsOriginalSubjectIfPresent", func(t *testing.T) {
+		input, result, hb := setup()
+		input.defaultSubject = "(no subject)"
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["Subject"] = []string{"Original subject"}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		assert.Assert(
+			t, strings.Contains(result.String(), "Subject: Original subject"),
+		)
+		assert.Assert(t, !strings.Contains(result.String(), "(no subject)"))
+	})
+
+	t.Run("NormalizesSubjectEncodingIfEnabled", func(t *testing.T) {
+		input, result, hb := setup()
+		input.normalizeSubjectEncoding = true
+		subject := encodedWord(t, japanese.ShiftJIS, "Shift_JIS", "こんにちは")
+		input.headers["From"] = []string{"Mike <mbland@acm.org>"}
+		input.headers["Subject"] = []string{subject}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		assert.NilError(t, err)
+		expected := "Subject: " + mime.BEncoding.Encode("UTF-8", "こんにちは")
+		assert.Assert(t, strings.Contains(result.String(), expected+"\r\n"))
+	})
+
+	t.Run("ErrorsIfUpdatingAnyHeaderFailed", func(t *testing.T) {
+		input, result, hb := setup()
+		ew := &ErrWriter{result, "There's a reason why we unit test"}
+		hb.buf = ew
+		for name, value := range map[string]string{
+			"From":    "Mike <mbland@acm.org>",
+			"Date":    "Fri, 18 Sep 1970 12:45:00 +0000",
+			"Subject": ew.errorOnSubstring,
+			"To":      "foo@xyzzy.com",
+		} {
+			input.headers[name] = []string{value}
+		}
+
+		err := hb.WriteUpdatedHeaders(input)
+
+		expectedErr := "error updating email headers: found: " +
+			ew.errorOnSubstring
+		assert.ErrorContains(t, err, expectedErr)
+
+		expectedHeaders := "From: Mike - mbland at acm.org <foo@bar.com>\r\n" +
+			"Reply-To: Mike <mbland@acm.org>\r\n" +
+			"To: foo@xyzzy.com\r\n"
+		assert.Equal(t, result.String(), expectedHeaders)
+	})
+}
+
+func BenchmarkWriteUpdatedHeaders(b *testing.B) {
+	headers := mail.Header{
+		"Return-Path":  {"<bounce@foo.com>"},
+		"Mime-Version": {"1.0"},
+		"From":         {"=?UTF-8?Q?Mike_Bland_=E2=9C=89?= <mbland@acm.org>"},
+		"Reply-To":     {"Mike <some@other.com>"},
+		"Cc":           {"foo@bar.com"},
+		"Date":         {"Fri, 18 Sep 1970 12:45:00 +0000"},
+		"Subject":      {"=?UTF-8?Q?There=E2=80=99s_a_reason_to_unit_test?="},
+		"To":           {"foo@xyzzy.com"},
+		"Content-Type": {`multipart/alternative; boundary="random-string"`},
+		"Dkim-Signature": {
+			"v=1; a=rsa-sha256; d=acm.org; " + strings.Repeat("x", 512),
+		},
+	}
+	receipt := &events.SimpleEmailReceipt{}
+	builder := &strings.Builder{}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		builder.Reset()
+		hb := &headerBuffer{buf: builder}
+		input := &updateHeadersInput{
+			headers:           headers,
+			senderAddress:     "foo@bar.com",
+			msgPath:           "bar.com/incoming/msgId",
+			receipt:           receipt,
+			fromAtReplacement: DefaultFromAtReplacement,
+		}
+		if err := hb.WriteUpdatedHeaders(input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNewFromAddress(b *testing.B) {
+	for _, bm := range []struct {
+		name string
+		from string
+	}{
+		{"Ascii", "Mike Bland <mbland@acm.org>"},
+		{"QEncoded", "=?UTF-8?Q?Caf=C3=A9_Owner?= <owner@cafe.com>"},
+		{"BEncoded", "=?UTF-8?B?5pel5pys6Kqe44Gu5ZCN5YmN?= <jp@example.jp>"},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := newFromAddress(
+					bm.from, "ses-forwarder@foo.com", DefaultFromAtReplacement,
+				)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
 }
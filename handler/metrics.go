@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"encoding/json"
+)
+
+// metricsNamespace is the CloudWatch namespace of the metrics emitted if
+// EMIT_METRICS is set.
+const metricsNamespace = "SesForwarder"
+
+// metricMessageBytes is the size in bytes of every forwarded message, after
+// updateMessage.
+const metricMessageBytes = "MessageBytes"
+
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+type emfMetadata struct {
+	Timestamp         int64                `json:"Timestamp"`
+	CloudWatchMetrics []emfMetricDirective `json:"CloudWatchMetrics"`
+}
+
+type emfMetricDirective struct {
+	Namespace  string         `json:"Namespace"`
+	Dimensions [][]string     `json:"Dimensions"`
+	Metrics    []emfMetricDef `json:"Metrics"`
+}
+
+type emfMetricDef struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+// emitMetric logs a single metric value using the CloudWatch Embedded Metric
+// Format if EmitMetrics is set, so CloudWatch Logs extracts it from the
+// function's log stream.
+//
+// The line isn't passed through logf, since the request ID prefix would
+// prevent CloudWatch from parsing it as JSON.
+func (h *Handler) emitMetric(name, unit string, value float64) {
+	if !h.Options.EmitMetrics {
+		return
+	}
+
+	// Marshaling a map[string]any containing only these types can't fail,
+	// so we can ignore the error.
+	line, _ := json.Marshal(map[string]any{
+		"_aws": emfMetadata{
+			Timestamp: h.now().UnixMilli(),
+			CloudWatchMetrics: []emfMetricDirective{{
+				Namespace:  metricsNamespace,
+				Dimensions: [][]string{{}},
+				Metrics:    []emfMetricDef{{Name: name, Unit: unit}},
+			}},
+		},
+		name: value,
+	})
+	h.Log.Print(string(line))
+}
@@ -0,0 +1,86 @@
+//go:build small_tests || all_tests
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestEmitMetrics(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	setup := func() (*handleEventFixture, context.Context) {
+		f := newHandleEventFixture()
+		f.h.Options.EmitMetrics = true
+		f.h.Now = func() time.Time { return now }
+		return f, context.Background()
+	}
+
+	// metricLines returns every log line that's a JSON object, minus the
+	// test logger prefix.
+	metricLines := func(logs *TestLogs) []map[string]any {
+		metrics := []map[string]any{}
+		for _, line := range strings.Split(logs.String(), "\n") {
+			line = strings.TrimPrefix(line, "test logger: ")
+			if !strings.HasPrefix(line, "{") {
+				continue
+			}
+			metric := map[string]any{}
+			if err := json.Unmarshal([]byte(line), &metric); err == nil {
+				metrics = append(metrics, metric)
+			}
+		}
+		return metrics
+	}
+
+	t.Run("EmitsForwardedMessageBytes", func(t *testing.T) {
+		f, ctx := setup()
+
+		_, err := f.h.processMessage(ctx, &f.event.Records[0].SES)
+
+		assert.NilError(t, err)
+		metrics := metricLines(f.logs)
+		assert.Equal(t, len(metrics), 1)
+		forwarded := f.sesv2.sendEmailInput.Content.Raw.Data
+		assert.Equal(t, metrics[0]["MessageBytes"], float64(len(forwarded)))
+
+		aws := metrics[0]["_aws"].(map[string]any)
+		assert.Equal(t, aws["Timestamp"], float64(now.UnixMilli()))
+		directives := aws["CloudWatchMetrics"].([]any)
+		assert.DeepEqual(t, directives[0], map[string]any{
+			"Namespace":  "SesForwarder",
+			"Dimensions": []any{[]any{}},
+			"Metrics": []any{
+				map[string]any{"Name": "MessageBytes", "Unit": "Bytes"},
+			},
+		})
+	})
+
+	t.Run("DoesNotEmitIfForwardingFails", func(t *testing.T) {
+		f, ctx := setup()
+		f.sesv2.sendEmailErr = errors.New("SES error")
+
+		_, err := f.h.processMessage(ctx, &f.event.Records[0].SES)
+
+		assert.Assert(t, err != nil)
+		assert.Assert(t, is.Len(metricLines(f.logs), 0))
+	})
+
+	t.Run("DoesNotEmitByDefault", func(t *testing.T) {
+		f, ctx := setup()
+		f.h.Options.EmitMetrics = false
+
+		_, err := f.h.processMessage(ctx, &f.event.Records[0].SES)
+
+		assert.NilError(t, err)
+		assert.Assert(t, is.Len(metricLines(f.logs), 0))
+	})
+}
@@ -1,6 +1,18 @@
 package handler
 
-import "strings"
+import (
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type Options struct {
 	BucketName        string
@@ -9,6 +21,186 @@ type Options struct {
 	SenderAddress     string
 	ForwardingAddress string
 	ConfigurationSet  string
+
+	// The following options are not required.
+	ArchiveBcc                 string
+	BounceHandlingAddress      string
+	ForwardingListS3           string
+	RoutingMapS3               string
+	ReportingMta               string
+	DmarcBouncePolicy          string
+	DebugWritePrefix           string
+	ForwardTarget              string
+	DestBucket                 string
+	DestPrefix                 string
+	WebhookUrl                 string
+	SpamAction                 string
+	EmptyRecipientsAction      string
+	SpamVerdicts               []string
+	OriginLinkFormat           string
+	AwsRegion                  string
+	DateSource                 string
+	DefaultSubject             string
+	HeaderMode                 string
+	Rewrite                    string
+	SesApiVersion              string
+	StripHeaders               []string
+	HeaderNameOverrides        []string
+	MetadataHeaders            []string
+	ForwardedForHeader         string
+	KeepHeaderPatterns         []*regexp.Regexp
+	ContentTypeAllowlist       []string
+	ReplyToAddress             string
+	PostmasterForward          string
+	InternalReplyTo            string
+	InternalDomains            []string
+	NoReplyReplyTo             string
+	OmitNoReplyReplyTo         bool
+	ReplyToIncludeOriginal     bool
+	NormalizeSubjectEncoding   bool
+	StripPlusFromTo            bool
+	CaseSensitiveLocalpart     bool
+	KeepOriginalTo             bool
+	AddForwardedFor            bool
+	ForwardReports             bool
+	ForwardSelfOriginated      bool
+	ForwardUnparseable         bool
+	AllowReforward             bool
+	FallbackNoConfigSet        bool
+	StrictLoopCheck            bool
+	FromAtReplacement          string
+	PlainTextOnly              bool
+	DefangUrls                 bool
+	StripTrackingPixels        bool
+	SetSesFrom                 bool
+	Verp                       bool
+	RequesterPays              bool
+	KeyFallbacks               bool
+	RequireTls                 bool
+	LogHeaders                 bool
+	EmitMetrics                bool
+	PreservePriority           bool
+	PreserveContentLanguage    bool
+	PreserveThreadHeaders      bool
+	FoldLongHeaders            bool
+	KeepAlignedFrom            bool
+	RewriteMessageId           bool
+	AddAuthResults             bool
+	ValidateSenderIdentity     bool
+	SesMessageTags             []MessageTag
+	SubjectRoutes              []SubjectRoute
+	ConfigCacheTtl             time.Duration
+	ReplayWindow               time.Duration
+	WebhookTimeout             time.Duration
+	S3Timeout                  time.Duration
+	SesTimeout                 time.Duration
+	SesV2Timeout               time.Duration
+	MaxMessageSize             int64
+	SendRatePerSec             float64
+	DetachAttachmentsPrefix    string
+	DetachAttachmentsThreshold int64
+	DetachAttachmentsLinkTtl   time.Duration
+}
+
+// DateSourceReceipt sets the forwarded message's Date header to the SES
+// receipt timestamp.
+const DateSourceReceipt = "receipt"
+
+// DmarcBouncePolicyReject, the default, bounces messages failing DMARC only if
+// the sender's DMARC policy is "reject". DmarcBouncePolicyAny bounces every
+// message failing DMARC, regardless of the sender's policy.
+const (
+	DmarcBouncePolicyReject = "reject"
+	DmarcBouncePolicyAny    = "any"
+)
+
+// SpamVerdicts are the SES receipt verdicts that SPAM_VERDICTS may select to
+// mark a message as spam. All of them apply by default.
+//
+// - https://docs.aws.amazon.com/ses/latest/dg/receiving-email-notifications-contents.html#receiving-email-notifications-contents-receipt-object
+const (
+	SpamVerdictSpf   = "spf"
+	SpamVerdictDkim  = "dkim"
+	SpamVerdictSpam  = "spam"
+	SpamVerdictVirus = "virus"
+)
+
+var SpamVerdicts = []string{
+	SpamVerdictSpf, SpamVerdictDkim, SpamVerdictSpam, SpamVerdictVirus,
+}
+
+// ForwardTargetSes, the default, sends forwarded messages via SES.
+// ForwardTargetS3 writes them to DEST_BUCKET under DEST_PREFIX instead.
+// ForwardTargetHttp POSTs them to WEBHOOK_URL as JSON instead.
+const (
+	ForwardTargetSes  = "ses"
+	ForwardTargetS3   = "s3"
+	ForwardTargetHttp = "http"
+)
+
+// SpamActionDrop, the default, drops messages that fail SPF, DKIM, spam, or
+// virus checks. SpamActionTag forwards every message that passes the virus
+// check with X-Spam-Flag and X-Spam-Status headers derived from the other
+// checks instead.
+const (
+	SpamActionDrop = "drop"
+	SpamActionTag  = "tag"
+)
+
+// EmptyRecipientsActionForward, the default, forwards messages with no SES
+// receipt recipients to FORWARDING_ADDRESS, or to FORWARDING_LIST_S3
+// addresses. EmptyRecipientsActionDrop drops them instead.
+const (
+	EmptyRecipientsActionForward = "forward"
+	EmptyRecipientsActionDrop    = "drop"
+)
+
+// OriginLinkFormatS3, the default, links to the original message using an
+// s3:// URL. OriginLinkFormatConsole links to the original message in the S3
+// console, in the AWS_REGION of the Lambda function.
+const (
+	OriginLinkFormatS3      = "s3"
+	OriginLinkFormatConsole = "console"
+)
+
+// HeaderModeAllowlist, the default, emits only a fixed set of original headers.
+// HeaderModeDenylist emits every original header except those replaced by the
+// forwarder. Either mode omits any STRIP_HEADERS.
+const (
+	HeaderModeAllowlist = "allowlist"
+	HeaderModeDenylist  = "denylist"
+)
+
+// RewriteFull, the default, rewrites the From header and the other original
+// headers as described by HeaderMode. RewriteNone forwards the original
+// message unchanged, except for adding the X-SES-Forwarder-Original header,
+// for setups that don't need header rewriting.
+const (
+	RewriteFull = "full"
+	RewriteNone = "none"
+)
+
+// SesApiVersionV2, the default, forwards messages via the SES v2 SendEmail
+// API. SesApiVersionV1 uses the SES v1 SendRawEmail API instead, for accounts
+// or IAM policies that only permit ses:SendRawEmail.
+const (
+	SesApiVersionV2 = "v2"
+	SesApiVersionV1 = "v1"
+)
+
+// MessageTag is an SES message tag applied to every forwarded message.
+//
+// - https://docs.aws.amazon.com/ses/latest/APIReference-V2/API_MessageTag.html
+type MessageTag struct {
+	Name  string
+	Value string
+}
+
+// SubjectRoute forwards messages whose decoded Subject matches Pattern to
+// Address, in addition to their usual destinations.
+type SubjectRoute struct {
+	Pattern *regexp.Regexp
+	Address string
 }
 
 type UndefinedEnvVarsError struct {
@@ -20,14 +212,41 @@ func (e *UndefinedEnvVarsError) Error() string {
 		strings.Join(e.UndefinedVars, ", ")
 }
 
+type InvalidEnvVarsError struct {
+	InvalidVars []string
+}
+
+func (e *InvalidEnvVarsError) Error() string {
+	return "invalid environment variables: " +
+		strings.Join(e.InvalidVars, ", ")
+}
+
 func GetOptions(getenv func(string) string) (*Options, error) {
-	env := environment{getenv: getenv}
+	return GetPrefixedOptions("", getenv)
+}
+
+// GetPrefixedOptions is the same as GetOptions, except that it reads each
+// variable with prefix prepended to its name, e.g. "ACME_BUCKET_NAME" for the
+// prefix "ACME_". This enables one process to build several Options sets.
+//
+// AWS_REGION is the exception, since the Lambda runtime sets it.
+func GetPrefixedOptions(
+	prefix string, getenv func(string) string,
+) (*Options, error) {
+	env := environment{getenv: getenv, prefix: prefix}
 	return env.options()
 }
 
 type environment struct {
 	getenv        func(string) string
+	prefix        string
 	undefinedVars []string
+	invalidVars   []string
+}
+
+// get returns the value of varname with the environment's prefix applied.
+func (env *environment) get(varname string) string {
+	return env.getenv(env.prefix + varname)
 }
 
 func (env *environment) options() (*Options, error) {
@@ -38,17 +257,801 @@ func (env *environment) options() (*Options, error) {
 	env.assign(&opts.SenderAddress, "SENDER_ADDRESS")
 	env.assign(&opts.ForwardingAddress, "FORWARDING_ADDRESS")
 	env.assign(&opts.ConfigurationSet, "CONFIGURATION_SET")
+	env.assignOptionalAddress(&opts.ArchiveBcc, "ARCHIVE_BCC")
+	env.assignOptionalAddress(
+		&opts.BounceHandlingAddress, "BOUNCE_HANDLING_ADDRESS",
+	)
+	env.assignOptional(&opts.ForwardingListS3, "FORWARDING_LIST_S3")
+	env.assignOptional(&opts.RoutingMapS3, "ROUTING_MAP_S3")
+	env.assignOptional(&opts.ReportingMta, "REPORTING_MTA")
+	if opts.ReportingMta != "" && !strings.Contains(opts.ReportingMta, ";") {
+		// RFC 3464 requires an MTA-name-type, which is nearly always "dns".
+		//
+		// - https://www.rfc-editor.org/rfc/rfc3464#section-2.2.2
+		opts.ReportingMta = "dns; " + opts.ReportingMta
+	}
+	env.assignOptionalChoice(
+		&opts.DmarcBouncePolicy,
+		"DMARC_BOUNCE_POLICY",
+		DmarcBouncePolicyReject,
+		DmarcBouncePolicyAny,
+	)
+	env.assignOptional(&opts.DebugWritePrefix, "DEBUG_WRITE_PREFIX")
+	env.assignOptionalChoice(
+		&opts.ForwardTarget,
+		"FORWARD_TARGET",
+		ForwardTargetSes,
+		ForwardTargetS3,
+		ForwardTargetHttp,
+	)
+	env.assignOptional(&opts.DestBucket, "DEST_BUCKET")
+	env.assignOptional(&opts.DestPrefix, "DEST_PREFIX")
+	if opts.ForwardTarget == ForwardTargetS3 && opts.DestBucket == "" {
+		env.invalid("FORWARD_TARGET", opts.ForwardTarget, "DEST_BUCKET not set")
+	}
+	env.assignOptionalWebhookUrl(&opts.WebhookUrl, "WEBHOOK_URL")
+	if opts.ForwardTarget == ForwardTargetHttp && opts.WebhookUrl == "" {
+		env.invalid("FORWARD_TARGET", opts.ForwardTarget, "WEBHOOK_URL not set")
+	}
+	env.assignOptionalDuration(&opts.WebhookTimeout, "WEBHOOK_TIMEOUT")
+	env.assignOptionalChoice(
+		&opts.SpamAction, "SPAM_ACTION", SpamActionDrop, SpamActionTag,
+	)
+	env.assignOptionalSpamVerdicts(&opts.SpamVerdicts, "SPAM_VERDICTS")
+	env.assignOptionalChoice(
+		&opts.EmptyRecipientsAction,
+		"EMPTY_RECIPIENTS_ACTION",
+		EmptyRecipientsActionForward,
+		EmptyRecipientsActionDrop,
+	)
+	env.assignOptionalChoice(
+		&opts.OriginLinkFormat,
+		"ORIGIN_LINK_FORMAT",
+		OriginLinkFormatS3,
+		OriginLinkFormatConsole,
+	)
+	opts.AwsRegion = env.getenv("AWS_REGION")
+	if opts.OriginLinkFormat == OriginLinkFormatConsole &&
+		opts.AwsRegion == "" {
+		env.invalid(
+			"ORIGIN_LINK_FORMAT", opts.OriginLinkFormat, "AWS_REGION not set",
+		)
+	}
+	env.assignOptionalChoice(
+		&opts.DateSource, "DATE_SOURCE", DateSourceReceipt,
+	)
+	env.assignOptional(&opts.DefaultSubject, "DEFAULT_SUBJECT")
+	env.assignOptionalChoice(
+		&opts.HeaderMode,
+		"HEADER_MODE",
+		HeaderModeAllowlist,
+		HeaderModeDenylist,
+	)
+	env.assignOptionalChoice(
+		&opts.Rewrite, "REWRITE", RewriteFull, RewriteNone,
+	)
+	env.assignOptionalChoice(
+		&opts.SesApiVersion,
+		"SES_API_VERSION",
+		SesApiVersionV2,
+		SesApiVersionV1,
+	)
+	env.assignOptionalHeaderNames(&opts.StripHeaders, "STRIP_HEADERS")
+	env.assignOptionalHeaderNames(
+		&opts.HeaderNameOverrides, "HEADER_NAME_OVERRIDES",
+	)
+	env.assignOptionalHeaderNames(&opts.MetadataHeaders, "METADATA_HEADERS")
+	env.assignOptionalHeaderPatterns(
+		&opts.KeepHeaderPatterns, "KEEP_HEADER_PATTERNS",
+	)
+	env.assignOptionalMediaTypes(
+		&opts.ContentTypeAllowlist, "CONTENT_TYPE_ALLOWLIST",
+	)
+	env.assignOptionalAddress(&opts.ReplyToAddress, "REPLY_TO_ADDRESS")
+	env.assignOptionalAddress(&opts.PostmasterForward, "POSTMASTER_FORWARD")
+	env.assignOptionalAddress(&opts.InternalReplyTo, "INTERNAL_REPLY_TO")
+	env.assignOptionalDomains(&opts.InternalDomains, "INTERNAL_DOMAINS")
+	env.assignOptionalAddress(&opts.NoReplyReplyTo, "NOREPLY_REPLY_TO")
+	env.assignOptionalBool(
+		&opts.OmitNoReplyReplyTo, "OMIT_NOREPLY_REPLY_TO",
+	)
+	env.assignOptionalBool(
+		&opts.ReplyToIncludeOriginal, "REPLY_TO_INCLUDE_ORIGINAL",
+	)
+	env.assignOptionalBool(
+		&opts.NormalizeSubjectEncoding, "NORMALIZE_SUBJECT_ENCODING",
+	)
+	env.assignOptionalBool(&opts.StripPlusFromTo, "STRIP_PLUS_FROM_TO")
+	env.assignOptionalBool(&opts.KeepOriginalTo, "KEEP_ORIGINAL_TO")
+	env.assignOptionalBool(&opts.ForwardReports, "FORWARD_REPORTS")
+	env.assignOptionalBool(
+		&opts.ForwardSelfOriginated, "FORWARD_SELF_ORIGINATED",
+	)
+	env.assignOptionalBool(&opts.ForwardUnparseable, "FORWARD_UNPARSEABLE")
+	env.assignOptionalBool(&opts.AllowReforward, "ALLOW_REFORWARD")
+	env.assignOptionalBool(
+		&opts.FallbackNoConfigSet, "FALLBACK_NO_CONFIG_SET",
+	)
+	env.assignOptionalBool(&opts.StrictLoopCheck, "STRICT_LOOP_CHECK")
+	if reason := opts.forwardingLoopRisk(); reason != "" &&
+		opts.StrictLoopCheck {
+		env.invalid(
+			"FORWARDING_ADDRESS", maskAddress(opts.ForwardingAddress), reason,
+		)
+	}
+	env.assignOptionalFromAtReplacement(
+		&opts.FromAtReplacement, "FROM_AT_REPLACEMENT",
+	)
+	env.assignOptionalBool(&opts.PlainTextOnly, "PLAINTEXT_ONLY")
+	env.assignOptionalBool(&opts.DefangUrls, "DEFANG_URLS")
+	env.assignOptionalBool(
+		&opts.StripTrackingPixels, "STRIP_TRACKING_PIXELS",
+	)
+	env.assignOptionalBool(&opts.SetSesFrom, "SET_SES_FROM")
+	env.assignOptionalBool(&opts.Verp, "VERP")
+	env.assignOptionalBool(&opts.AddForwardedFor, "ADD_FORWARDED_FOR")
+	env.assignOptional(&opts.ForwardedForHeader, "FORWARDED_FOR_HEADER")
+	if name := opts.ForwardedForHeader; name != "" &&
+		!validHeaderName.MatchString(name) {
+		env.invalid("FORWARDED_FOR_HEADER", name, "invalid header name")
+	}
+	env.assignOptionalBool(
+		&opts.CaseSensitiveLocalpart, "CASE_SENSITIVE_LOCALPART",
+	)
+	env.assignOptionalBool(&opts.RequesterPays, "REQUESTER_PAYS")
+	env.assignOptionalBool(&opts.KeyFallbacks, "KEY_FALLBACKS")
+	env.assignOptionalBool(&opts.RequireTls, "REQUIRE_TLS")
+	env.assignOptionalBool(&opts.LogHeaders, "LOG_HEADERS")
+	env.assignOptionalBool(&opts.EmitMetrics, "EMIT_METRICS")
+	env.assignOptionalBool(&opts.PreservePriority, "PRESERVE_PRIORITY")
+	env.assignOptionalBool(
+		&opts.PreserveContentLanguage, "PRESERVE_CONTENT_LANGUAGE",
+	)
+	env.assignOptionalBool(
+		&opts.PreserveThreadHeaders, "PRESERVE_THREAD_HEADERS",
+	)
+	env.assignOptionalBool(&opts.FoldLongHeaders, "FOLD_LONG_HEADERS")
+	env.assignOptionalBool(
+		&opts.KeepAlignedFrom, "KEEP_ORIGINAL_FROM_IF_ALIGNED",
+	)
+	env.assignOptionalBool(&opts.RewriteMessageId, "REWRITE_MESSAGE_ID")
+	env.assignOptionalBool(&opts.AddAuthResults, "ADD_AUTH_RESULTS")
+	env.assignOptionalBool(
+		&opts.ValidateSenderIdentity, "VALIDATE_SENDER_IDENTITY",
+	)
+	env.assignOptionalMessageTags(&opts.SesMessageTags, "SES_MESSAGE_TAGS")
+	env.assignOptionalSubjectRoutes(&opts.SubjectRoutes, "SUBJECT_ROUTES")
+	env.assignOptionalDuration(&opts.ConfigCacheTtl, "CONFIG_CACHE_TTL")
+	env.assignOptionalDuration(&opts.ReplayWindow, "REPLAY_WINDOW")
+	env.assignOptionalDuration(&opts.S3Timeout, "S3_TIMEOUT")
+	env.assignOptionalDuration(&opts.SesTimeout, "SES_TIMEOUT")
+	env.assignOptionalDuration(&opts.SesV2Timeout, "SESV2_TIMEOUT")
+	env.assignOptionalByteSize(&opts.MaxMessageSize, "MAX_MESSAGE_SIZE")
+	env.assignOptionalRate(&opts.SendRatePerSec, "SEND_RATE_PER_SEC")
+	if opts.MaxMessageSize > maxSesMessageSize {
+		env.invalid(
+			"MAX_MESSAGE_SIZE",
+			env.get("MAX_MESSAGE_SIZE"),
+			fmt.Sprintf("exceeds SES limit of %d bytes", maxSesMessageSize),
+		)
+	}
+
+	env.assignOptional(
+		&opts.DetachAttachmentsPrefix, "DETACH_ATTACHMENTS_PREFIX",
+	)
+	env.assignOptionalByteSize(
+		&opts.DetachAttachmentsThreshold, "DETACH_ATTACHMENTS_THRESHOLD",
+	)
+	env.assignOptionalDuration(
+		&opts.DetachAttachmentsLinkTtl, "DETACH_ATTACHMENTS_LINK_TTL",
+	)
+	if opts.DetachAttachmentsLinkTtl > maxPresignedLinkTtl {
+		env.invalid(
+			"DETACH_ATTACHMENTS_LINK_TTL",
+			env.get("DETACH_ATTACHMENTS_LINK_TTL"),
+			"exceeds S3 presigned URL limit of "+maxPresignedLinkTtl.String(),
+		)
+	}
 
 	if len(env.undefinedVars) != 0 {
 		return nil, &UndefinedEnvVarsError{UndefinedVars: env.undefinedVars}
+	} else if len(env.invalidVars) != 0 {
+		return nil, &InvalidEnvVarsError{InvalidVars: env.invalidVars}
 	}
 	return &opts, nil
 }
 
 func (env *environment) assign(opt *string, varname string) {
-	if value := env.getenv(varname); value == "" {
-		env.undefinedVars = append(env.undefinedVars, varname)
+	if value := env.get(varname); value == "" {
+		env.undefinedVars = append(env.undefinedVars, env.prefix+varname)
 	} else {
 		*opt = value
 	}
 }
+
+func (env *environment) assignOptional(opt *string, varname string) {
+	*opt = env.get(varname)
+}
+
+func (env *environment) assignOptionalAddress(opt *string, varname string) {
+	if value := env.get(varname); value == "" {
+		return
+	} else if _, err := mail.ParseAddress(value); err != nil {
+		env.invalid(varname, value, err.Error())
+	} else {
+		*opt = value
+	}
+}
+
+func (env *environment) assignOptionalBool(opt *bool, varname string) {
+	if value := env.get(varname); value == "" {
+		return
+	} else if b, err := strconv.ParseBool(value); err != nil {
+		env.invalid(varname, value, "not a boolean value")
+	} else {
+		*opt = b
+	}
+}
+
+func (env *environment) assignOptionalChoice(
+	opt *string, varname string, choices ...string,
+) {
+	if value := env.get(varname); value == "" {
+		return
+	} else if !slices.Contains(choices, value) {
+		reason := "must be one of: " + strings.Join(choices, ", ")
+		env.invalid(varname, value, reason)
+	} else {
+		*opt = value
+	}
+}
+
+func (env *environment) assignOptionalFromAtReplacement(
+	opt *string, varname string,
+) {
+	if value := env.get(varname); value == "" {
+		return
+	} else if err := checkFromAtReplacement(value); err != nil {
+		env.invalid(varname, value, err.Error())
+	} else {
+		*opt = value
+	}
+}
+
+// RFC 5322 header field names consist of printable ASCII characters other than
+// the colon.
+//
+// - https://www.rfc-editor.org/rfc/rfc5322#section-3.6.8
+var validHeaderName = regexp.MustCompile(`^[!-9;-~]+$`)
+
+// assignOptionalWebhookUrl parses an absolute http or https URL.
+func (env *environment) assignOptionalWebhookUrl(opt *string, varname string) {
+	value := env.get(varname)
+	if value == "" {
+		return
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		u.Host == "" {
+		env.invalid(varname, maskedValue, "not an http or https URL")
+		return
+	}
+	*opt = value
+}
+
+// assignOptionalHeaderNames parses a comma separated list of header names.
+func (env *environment) assignOptionalHeaderNames(
+	opt *[]string, varname string,
+) {
+	value := env.get(varname)
+	if value == "" {
+		return
+	}
+
+	names := []string{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+
+		if !validHeaderName.MatchString(name) {
+			env.invalid(varname, value, "invalid header name: "+name)
+			return
+		}
+		names = append(names, name)
+	}
+	*opt = names
+}
+
+// assignOptionalHeaderPatterns parses a comma separated list of case
+// insensitive header name patterns. A pattern enclosed in slashes, e.g.
+// "/^X-(Foo|Bar)-/", is a regular expression. Any other pattern is a glob in
+// which "*" matches any sequence of characters and "?" matches any single
+// character, e.g. "X-Company-*".
+func (env *environment) assignOptionalHeaderPatterns(
+	opt *[]*regexp.Regexp, varname string,
+) {
+	value := env.get(varname)
+	if value == "" {
+		return
+	}
+
+	patterns := []*regexp.Regexp{}
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		re, err := compileHeaderPattern(pattern)
+
+		if err != nil {
+			env.invalid(varname, value, err.Error())
+			return
+		}
+		patterns = append(patterns, re)
+	}
+	*opt = patterns
+}
+
+func compileHeaderPattern(pattern string) (*regexp.Regexp, error) {
+	if expr, isRegexp := strings.CutPrefix(pattern, "/"); isRegexp {
+		if expr, isRegexp = strings.CutSuffix(expr, "/"); isRegexp {
+			return regexp.Compile("(?i)" + expr)
+		}
+	}
+	if !validHeaderName.MatchString(pattern) {
+		return nil, errors.New("invalid header pattern: " + pattern)
+	}
+
+	expr := &strings.Builder{}
+	expr.WriteString("(?i)^")
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+// assignOptionalMediaTypes parses a comma separated list of media types without
+// parameters, e.g. "text/calendar,text/plain", converting each to lowercase.
+func (env *environment) assignOptionalMediaTypes(
+	opt *[]string, varname string,
+) {
+	value := env.get(varname)
+	if value == "" {
+		return
+	}
+
+	mediaTypes := []string{}
+	for _, mediaType := range strings.Split(value, ",") {
+		mediaType = strings.TrimSpace(mediaType)
+		parsed, params, err := mime.ParseMediaType(mediaType)
+
+		if err != nil || len(params) != 0 || !strings.Contains(parsed, "/") {
+			env.invalid(varname, value, "invalid media type: "+mediaType)
+			return
+		}
+		mediaTypes = append(mediaTypes, parsed)
+	}
+	*opt = mediaTypes
+}
+
+// validDomain matches a domain name's letters, digits, hyphens, and dots.
+var validDomain = regexp.MustCompile(`^[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)*$`)
+
+// assignOptionalDomains parses a comma separated list of domain names.
+func (env *environment) assignOptionalDomains(opt *[]string, varname string) {
+	value := env.get(varname)
+	if value == "" {
+		return
+	}
+
+	domains := []string{}
+	for _, domain := range strings.Split(value, ",") {
+		domain = strings.TrimSpace(domain)
+
+		if !validDomain.MatchString(domain) {
+			env.invalid(varname, value, "invalid domain: "+domain)
+			return
+		}
+		domains = append(domains, domain)
+	}
+	*opt = domains
+}
+
+// assignOptionalSpamVerdicts parses a comma separated list of SpamVerdicts.
+func (env *environment) assignOptionalSpamVerdicts(
+	opt *[]string, varname string,
+) {
+	value := env.get(varname)
+	if value == "" {
+		return
+	}
+
+	verdicts := []string{}
+	for _, verdict := range strings.Split(value, ",") {
+		verdict = strings.ToLower(strings.TrimSpace(verdict))
+
+		if !slices.Contains(SpamVerdicts, verdict) {
+			env.invalid(varname, value, "invalid verdict: "+verdict)
+			return
+		}
+		verdicts = append(verdicts, verdict)
+	}
+	*opt = verdicts
+}
+
+// SES message tag names and values may contain only ASCII letters, numbers,
+// underscores, or dashes, and may not exceed 256 characters.
+var validMessageTagPart = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
+// assignOptionalMessageTags parses a comma separated list of name=value pairs.
+func (env *environment) assignOptionalMessageTags(
+	opt *[]MessageTag, varname string,
+) {
+	value := env.get(varname)
+	if value == "" {
+		return
+	}
+
+	tags := []MessageTag{}
+	for _, pair := range strings.Split(value, ",") {
+		name, tagValue, _ := strings.Cut(strings.TrimSpace(pair), "=")
+
+		if !validMessageTagPart.MatchString(name) ||
+			!validMessageTagPart.MatchString(tagValue) {
+			env.invalid(varname, value, "invalid message tag: "+pair)
+			return
+		}
+		tags = append(tags, MessageTag{Name: name, Value: tagValue})
+	}
+	*opt = tags
+}
+
+// assignOptionalSubjectRoutes parses a semicolon separated list of
+// pattern=address rules, e.g. "\[URGENT\]=pager@foo.com". Each rule is split
+// at its last "=", so patterns may contain "=" but not ";".
+func (env *environment) assignOptionalSubjectRoutes(
+	opt *[]SubjectRoute, varname string,
+) {
+	value := env.get(varname)
+	if value == "" {
+		return
+	}
+
+	routes := []SubjectRoute{}
+	for _, rule := range strings.Split(value, ";") {
+		rule = strings.TrimSpace(rule)
+		i := strings.LastIndex(rule, "=")
+
+		if i <= 0 {
+			env.invalid(varname, value, "invalid subject route: "+rule)
+			return
+		}
+		pattern, err := regexp.Compile(rule[:i])
+		if err != nil {
+			env.invalid(varname, value, err.Error())
+			return
+		}
+		address := strings.TrimSpace(rule[i+1:])
+		if _, err := mail.ParseAddress(address); err != nil {
+			env.invalid(varname, value, err.Error())
+			return
+		}
+		routes = append(routes, SubjectRoute{pattern, address})
+	}
+	*opt = routes
+}
+
+// assignOptionalDuration parses a positive time.ParseDuration value, e.g.
+// "90s" or "5m".
+func (env *environment) assignOptionalDuration(
+	opt *time.Duration, varname string,
+) {
+	if value := env.get(varname); value == "" {
+		return
+	} else if d, err := time.ParseDuration(value); err != nil {
+		env.invalid(varname, value, "not a duration")
+	} else if d <= 0 {
+		env.invalid(varname, value, "must be positive")
+	} else {
+		*opt = d
+	}
+}
+
+// assignOptionalByteSize parses a positive byte size, e.g. "512KB" or "10MB".
+func (env *environment) assignOptionalByteSize(opt *int64, varname string) {
+	if value := env.get(varname); value == "" {
+		return
+	} else if size, err := parseByteSize(value); err != nil {
+		env.invalid(varname, value, err.Error())
+	} else {
+		*opt = size
+	}
+}
+
+// assignOptionalRate parses a positive number of operations per second,
+// e.g. "14" or "0.5".
+func (env *environment) assignOptionalRate(opt *float64, varname string) {
+	if value := env.get(varname); value == "" {
+		return
+	} else if rate, err := strconv.ParseFloat(value, 64); err != nil {
+		env.invalid(varname, value, "not a number")
+	} else if rate <= 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		env.invalid(varname, value, "must be positive")
+	} else {
+		*opt = rate
+	}
+}
+
+// byteSizeUnits are the suffixes accepted by parseByteSize, longest first so
+// that "B" doesn't match before "KB", "MB", or "GB". Multiples are powers of
+// 1024.
+var byteSizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"KB", 1 << 10},
+	{"MB", 1 << 20},
+	{"GB", 1 << 30},
+	{"B", 1},
+}
+
+// parseByteSize parses a positive integer number of bytes, optionally followed
+// by a case insensitive B, KB, MB, or GB suffix.
+func parseByteSize(value string) (int64, error) {
+	digits := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+
+	for _, unit := range byteSizeUnits {
+		if before, found := strings.CutSuffix(digits, unit.suffix); found {
+			digits, multiplier = strings.TrimSpace(before), unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+
+	if err != nil {
+		return 0, errors.New("not a byte size")
+	} else if n <= 0 {
+		return 0, errors.New("must be positive")
+	} else if n > (1<<63-1)/multiplier {
+		return 0, errors.New("too large")
+	}
+	return n * multiplier, nil
+}
+
+func (env *environment) invalid(varname, value, reason string) {
+	env.invalidVars = append(
+		env.invalidVars,
+		env.prefix+varname+"=\""+value+"\" ("+reason+")",
+	)
+}
+
+// Summary returns a human readable summary of the effective configuration,
+// one VARIABLE=value pair per line, omitting unset optional values.
+//
+// Forwarding destination addresses and message tag values are masked, since
+// they may identify individuals or carry sensitive data.
+func (opts *Options) Summary() string {
+	s := &summary{}
+	s.add("BUCKET_NAME", opts.BucketName)
+	s.add("INCOMING_PREFIX", opts.IncomingPrefix)
+	s.add("EMAIL_DOMAIN_NAME", opts.EmailDomainName)
+	s.add("SENDER_ADDRESS", opts.SenderAddress)
+	s.add("FORWARDING_ADDRESS", maskAddress(opts.ForwardingAddress))
+	s.add("CONFIGURATION_SET", opts.ConfigurationSet)
+	s.add("ARCHIVE_BCC", maskAddress(opts.ArchiveBcc))
+	s.add(
+		"BOUNCE_HANDLING_ADDRESS", maskAddress(opts.BounceHandlingAddress),
+	)
+	s.add("FORWARDING_LIST_S3", opts.ForwardingListS3)
+	s.add("ROUTING_MAP_S3", opts.RoutingMapS3)
+	s.add("REPORTING_MTA", opts.ReportingMta)
+	s.add("DMARC_BOUNCE_POLICY", opts.DmarcBouncePolicy)
+	s.add("DEBUG_WRITE_PREFIX", opts.DebugWritePrefix)
+	s.add("FORWARD_TARGET", opts.ForwardTarget)
+	s.add("DEST_BUCKET", opts.DestBucket)
+	if opts.WebhookUrl != "" {
+		// The path and query may contain credentials.
+		s.add("WEBHOOK_URL", maskedValue)
+	}
+	if opts.WebhookTimeout != 0 {
+		s.add("WEBHOOK_TIMEOUT", opts.WebhookTimeout.String())
+	}
+	s.add("DEST_PREFIX", opts.DestPrefix)
+	s.add("SPAM_ACTION", opts.SpamAction)
+	s.add("SPAM_VERDICTS", strings.Join(opts.SpamVerdicts, ","))
+	s.add("EMPTY_RECIPIENTS_ACTION", opts.EmptyRecipientsAction)
+	s.add("ORIGIN_LINK_FORMAT", opts.OriginLinkFormat)
+	s.add("AWS_REGION", opts.AwsRegion)
+	s.add("DATE_SOURCE", opts.DateSource)
+	s.add("DEFAULT_SUBJECT", opts.DefaultSubject)
+	s.add("HEADER_MODE", opts.HeaderMode)
+	s.add("REWRITE", opts.Rewrite)
+	s.add("SES_API_VERSION", opts.SesApiVersion)
+	s.add("STRIP_HEADERS", strings.Join(opts.StripHeaders, ","))
+	s.add(
+		"HEADER_NAME_OVERRIDES", strings.Join(opts.HeaderNameOverrides, ","),
+	)
+	s.add("METADATA_HEADERS", strings.Join(opts.MetadataHeaders, ","))
+
+	keepPatterns := make([]string, len(opts.KeepHeaderPatterns))
+	for i, pattern := range opts.KeepHeaderPatterns {
+		keepPatterns[i] = pattern.String()
+	}
+	s.add("KEEP_HEADER_PATTERNS", strings.Join(keepPatterns, ","))
+	s.add(
+		"CONTENT_TYPE_ALLOWLIST", strings.Join(opts.ContentTypeAllowlist, ","),
+	)
+	s.add("REPLY_TO_ADDRESS", maskAddress(opts.ReplyToAddress))
+	s.add("POSTMASTER_FORWARD", maskAddress(opts.PostmasterForward))
+	s.add("INTERNAL_REPLY_TO", maskAddress(opts.InternalReplyTo))
+	s.add("INTERNAL_DOMAINS", strings.Join(opts.InternalDomains, ","))
+	s.add("NOREPLY_REPLY_TO", maskAddress(opts.NoReplyReplyTo))
+	s.addBool("OMIT_NOREPLY_REPLY_TO", opts.OmitNoReplyReplyTo)
+	s.addBool("REPLY_TO_INCLUDE_ORIGINAL", opts.ReplyToIncludeOriginal)
+	s.addBool("NORMALIZE_SUBJECT_ENCODING", opts.NormalizeSubjectEncoding)
+	s.addBool("STRIP_PLUS_FROM_TO", opts.StripPlusFromTo)
+	s.addBool("KEEP_ORIGINAL_TO", opts.KeepOriginalTo)
+	s.addBool("FORWARD_REPORTS", opts.ForwardReports)
+	s.addBool("FORWARD_SELF_ORIGINATED", opts.ForwardSelfOriginated)
+	s.addBool("FORWARD_UNPARSEABLE", opts.ForwardUnparseable)
+	s.addBool("ALLOW_REFORWARD", opts.AllowReforward)
+	s.addBool("FALLBACK_NO_CONFIG_SET", opts.FallbackNoConfigSet)
+	s.addBool("STRICT_LOOP_CHECK", opts.StrictLoopCheck)
+	s.add("FROM_AT_REPLACEMENT", opts.FromAtReplacement)
+	s.addBool("PLAINTEXT_ONLY", opts.PlainTextOnly)
+	s.addBool("DEFANG_URLS", opts.DefangUrls)
+	s.addBool("STRIP_TRACKING_PIXELS", opts.StripTrackingPixels)
+	s.addBool("SET_SES_FROM", opts.SetSesFrom)
+	s.addBool("VERP", opts.Verp)
+	s.addBool("ADD_FORWARDED_FOR", opts.AddForwardedFor)
+	s.add("FORWARDED_FOR_HEADER", opts.ForwardedForHeader)
+	s.addBool("CASE_SENSITIVE_LOCALPART", opts.CaseSensitiveLocalpart)
+	s.addBool("REQUESTER_PAYS", opts.RequesterPays)
+	s.addBool("KEY_FALLBACKS", opts.KeyFallbacks)
+	s.addBool("REQUIRE_TLS", opts.RequireTls)
+	s.addBool("LOG_HEADERS", opts.LogHeaders)
+	s.addBool("EMIT_METRICS", opts.EmitMetrics)
+	s.addBool("PRESERVE_PRIORITY", opts.PreservePriority)
+	s.addBool("PRESERVE_CONTENT_LANGUAGE", opts.PreserveContentLanguage)
+	s.addBool("PRESERVE_THREAD_HEADERS", opts.PreserveThreadHeaders)
+	s.addBool("FOLD_LONG_HEADERS", opts.FoldLongHeaders)
+	s.addBool("KEEP_ORIGINAL_FROM_IF_ALIGNED", opts.KeepAlignedFrom)
+	s.addBool("REWRITE_MESSAGE_ID", opts.RewriteMessageId)
+	s.addBool("ADD_AUTH_RESULTS", opts.AddAuthResults)
+	s.addBool("VALIDATE_SENDER_IDENTITY", opts.ValidateSenderIdentity)
+
+	tags := make([]string, len(opts.SesMessageTags))
+	for i, tag := range opts.SesMessageTags {
+		tags[i] = tag.Name + "=" + maskedValue
+	}
+	s.add("SES_MESSAGE_TAGS", strings.Join(tags, ","))
+
+	subjectRoutes := make([]string, len(opts.SubjectRoutes))
+	for i, sr := range opts.SubjectRoutes {
+		subjectRoutes[i] = sr.Pattern.String() + "=" + maskAddress(sr.Address)
+	}
+	s.add("SUBJECT_ROUTES", strings.Join(subjectRoutes, ";"))
+
+	if opts.ConfigCacheTtl != 0 {
+		s.add("CONFIG_CACHE_TTL", opts.ConfigCacheTtl.String())
+	}
+	if opts.ReplayWindow != 0 {
+		s.add("REPLAY_WINDOW", opts.ReplayWindow.String())
+	}
+	if opts.S3Timeout != 0 {
+		s.add("S3_TIMEOUT", opts.S3Timeout.String())
+	}
+	if opts.SesTimeout != 0 {
+		s.add("SES_TIMEOUT", opts.SesTimeout.String())
+	}
+	if opts.SesV2Timeout != 0 {
+		s.add("SESV2_TIMEOUT", opts.SesV2Timeout.String())
+	}
+	if opts.MaxMessageSize != 0 {
+		s.add(
+			"MAX_MESSAGE_SIZE", strconv.FormatInt(opts.MaxMessageSize, 10),
+		)
+	}
+	if opts.SendRatePerSec != 0 {
+		s.add(
+			"SEND_RATE_PER_SEC",
+			strconv.FormatFloat(opts.SendRatePerSec, 'g', -1, 64),
+		)
+	}
+	s.add("DETACH_ATTACHMENTS_PREFIX", opts.DetachAttachmentsPrefix)
+	if threshold := opts.DetachAttachmentsThreshold; threshold != 0 {
+		s.add(
+			"DETACH_ATTACHMENTS_THRESHOLD", strconv.FormatInt(threshold, 10),
+		)
+	}
+	if opts.DetachAttachmentsLinkTtl != 0 {
+		s.add(
+			"DETACH_ATTACHMENTS_LINK_TTL",
+			opts.DetachAttachmentsLinkTtl.String(),
+		)
+	}
+	return strings.Join(s.lines, "\n")
+}
+
+const maskedValue = "****"
+
+type summary struct {
+	lines []string
+}
+
+func (s *summary) add(varname, value string) {
+	if value != "" {
+		s.lines = append(s.lines, varname+"="+strconv.Quote(value))
+	}
+}
+
+// Warnings returns descriptions of likely misconfigurations that aren't
+// invalid enough for GetOptions to fail, unless STRICT_LOOP_CHECK is set.
+func (opts *Options) Warnings() []string {
+	warnings := []string{}
+	if reason := opts.forwardingLoopRisk(); reason != "" {
+		warnings = append(
+			warnings,
+			"FORWARDING_ADDRESS="+maskAddress(opts.ForwardingAddress)+
+				" may cause a forwarding loop ("+reason+")",
+		)
+	}
+	return warnings
+}
+
+// forwardingLoopRisk returns a reason why forwarding to ForwardingAddress
+// likely routes the message back into SES, or the empty string otherwise.
+//
+// A ForwardingAddress within EmailDomainName or the SenderAddress domain
+// likely matches the same receipt rule that invoked the handler.
+func (opts *Options) forwardingLoopRisk() string {
+	domain := addressDomain(opts.ForwardingAddress)
+
+	if domain == "" {
+		return ""
+	} else if strings.EqualFold(domain, opts.EmailDomainName) {
+		return "same domain as EMAIL_DOMAIN_NAME"
+	} else if strings.EqualFold(domain, addressDomain(opts.SenderAddress)) {
+		return "same domain as SENDER_ADDRESS"
+	}
+	return ""
+}
+
+// addressDomain returns the domain of an email address, or the empty string
+// if it has none.
+func addressDomain(address string) string {
+	if addr, err := mail.ParseAddress(address); err == nil {
+		address = addr.Address
+	}
+	if i := strings.LastIndex(address, "@"); i != -1 {
+		return address[i+1:]
+	}
+	return ""
+}
+
+func (s *summary) addBool(varname string, value bool) {
+	if value {
+		s.lines = append(s.lines, varname+"=true")
+	}
+}
+
+// maskAddress replaces the local part of an email address with maskedValue,
+// leaving the domain visible. It masks the entire value if it isn't an email
+// address.
+func maskAddress(address string) string {
+	if address == "" {
+		return ""
+	} else if addr, err := mail.ParseAddress(address); err == nil {
+		address = addr.Address
+	}
+	if i := strings.LastIndex(address, "@"); i != -1 {
+		return maskedValue + address[i:]
+	}
+	return maskedValue
+}
@@ -3,9 +3,12 @@
 package handler
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
 )
 
 func TestUndefinedEnvVarsErrorFormat(t *testing.T) {
@@ -16,6 +19,14 @@ func TestUndefinedEnvVarsErrorFormat(t *testing.T) {
 	)
 }
 
+func TestInvalidEnvVarsErrorFormat(t *testing.T) {
+	assert.ErrorContains(
+		t,
+		&InvalidEnvVarsError{InvalidVars: []string{"FOO=\"bar\" (baz)"}},
+		`invalid environment variables: FOO="bar" (baz)`,
+	)
+}
+
 func TestReportUndefinedEnviromentVariables(t *testing.T) {
 	_, err := GetOptions(func(string) string { return "" })
 
@@ -35,8 +46,8 @@ func TestReportUndefinedEnviromentVariables(t *testing.T) {
 	)
 }
 
-func TestAllRequiredEnvironmentVariablesDefined(t *testing.T) {
-	env := map[string]string{
+func requiredEnv() map[string]string {
+	return map[string]string{
 		"BUCKET_NAME":        "my-bucket",
 		"INCOMING_PREFIX":    "inbox",
 		"EMAIL_DOMAIN_NAME":  "foo.com",
@@ -44,9 +55,16 @@ func TestAllRequiredEnvironmentVariablesDefined(t *testing.T) {
 		"FORWARDING_ADDRESS": "me@bar.com",
 		"CONFIGURATION_SET":  "config-set",
 	}
-	opts, err := GetOptions(func(varname string) string {
+}
+
+func getOptions(env map[string]string) (*Options, error) {
+	return GetOptions(func(varname string) string {
 		return env[varname]
 	})
+}
+
+func TestAllRequiredEnvironmentVariablesDefined(t *testing.T) {
+	opts, err := getOptions(requiredEnv())
 
 	assert.NilError(t, err)
 	assert.DeepEqual(
@@ -62,3 +80,1409 @@ func TestAllRequiredEnvironmentVariablesDefined(t *testing.T) {
 		},
 	)
 }
+
+func TestGetPrefixedOptions(t *testing.T) {
+	prefixedEnv := func() map[string]string {
+		env := map[string]string{"AWS_REGION": "us-east-1"}
+		for varname, value := range requiredEnv() {
+			env["ACME_"+varname] = value
+		}
+		return env
+	}
+	getPrefixedOptions := func(
+		prefix string, env map[string]string,
+	) (*Options, error) {
+		return GetPrefixedOptions(prefix, func(varname string) string {
+			return env[varname]
+		})
+	}
+
+	t.Run("ReadsPrefixedVariables", func(t *testing.T) {
+		env := prefixedEnv()
+		env["ACME_ARCHIVE_BCC"] = "archive@foo.com"
+		env["ARCHIVE_BCC"] = "unprefixed@foo.com"
+
+		opts, err := getPrefixedOptions("ACME_", env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.BucketName, "my-bucket")
+		assert.Equal(t, opts.ArchiveBcc, "archive@foo.com")
+	})
+
+	t.Run("ReadsUnprefixedAwsRegion", func(t *testing.T) {
+		env := prefixedEnv()
+		env["ACME_ORIGIN_LINK_FORMAT"] = OriginLinkFormatConsole
+
+		opts, err := getPrefixedOptions("ACME_", env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.AwsRegion, "us-east-1")
+	})
+
+	t.Run("IgnoresUnprefixedVariables", func(t *testing.T) {
+		env := requiredEnv()
+
+		_, err := getPrefixedOptions("ACME_", env)
+
+		expected := "undefined environment variables: ACME_BUCKET_NAME, "
+		assert.ErrorContains(t, err, expected)
+	})
+
+	t.Run("ReportsInvalidPrefixedVariables", func(t *testing.T) {
+		env := prefixedEnv()
+		env["ACME_REQUIRE_TLS"] = "maybe"
+
+		opts, err := getPrefixedOptions("ACME_", env)
+
+		assert.Assert(t, opts == nil)
+		expected := `ACME_REQUIRE_TLS="maybe" (not a boolean value)`
+		assert.ErrorContains(t, err, expected)
+	})
+
+	t.Run("ReadsUnprefixedVariablesWithEmptyPrefix", func(t *testing.T) {
+		opts, err := getPrefixedOptions("", requiredEnv())
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.BucketName, "my-bucket")
+	})
+}
+
+func TestOptionalArchiveBcc(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["ARCHIVE_BCC"] = "archive@foo.com"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.ArchiveBcc, "archive@foo.com")
+	})
+
+	t.Run("ReportsInvalidAddress", func(t *testing.T) {
+		env := requiredEnv()
+		env["ARCHIVE_BCC"] = "not an address"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `invalid environment variables: ` +
+			`ARCHIVE_BCC="not an address"`
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+func TestOptionalBounceHandlingAddress(t *testing.T) {
+	env := requiredEnv()
+	env["BOUNCE_HANDLING_ADDRESS"] = "bounces@foo.com"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.BounceHandlingAddress, "bounces@foo.com")
+}
+
+func TestOptionalRoutingMapS3(t *testing.T) {
+	env := requiredEnv()
+	env["ROUTING_MAP_S3"] = "config/routing-map.json"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.RoutingMapS3, "config/routing-map.json")
+}
+
+func TestOptionalReportingMta(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["REPORTING_MTA"] = "dns; mx.foo.com"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.ReportingMta, "dns; mx.foo.com")
+	})
+
+	t.Run("AddsDnsTypeIfMissing", func(t *testing.T) {
+		env := requiredEnv()
+		env["REPORTING_MTA"] = "mx.foo.com"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.ReportingMta, "dns; mx.foo.com")
+	})
+}
+
+func TestOptionalDmarcBouncePolicy(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["DMARC_BOUNCE_POLICY"] = "any"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.DmarcBouncePolicy, DmarcBouncePolicyAny)
+	})
+
+	t.Run("ReportsInvalidValue", func(t *testing.T) {
+		env := requiredEnv()
+		env["DMARC_BOUNCE_POLICY"] = "quarantine"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `invalid environment variables: ` +
+			`DMARC_BOUNCE_POLICY="quarantine" (must be one of: reject, any)`
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+func TestOptionalDebugWritePrefix(t *testing.T) {
+	env := requiredEnv()
+	env["DEBUG_WRITE_PREFIX"] = "debug"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.DebugWritePrefix, "debug")
+}
+
+func TestOptionalSpamVerdicts(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["SPAM_VERDICTS"] = "SPF, spam,virus"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		expected := []string{SpamVerdictSpf, SpamVerdictSpam, SpamVerdictVirus}
+		assert.DeepEqual(t, opts.SpamVerdicts, expected)
+	})
+
+	t.Run("DefaultsToNil", func(t *testing.T) {
+		opts, err := getOptions(requiredEnv())
+
+		assert.NilError(t, err)
+		assert.Assert(t, opts.SpamVerdicts == nil)
+	})
+
+	t.Run("ReportsInvalidVerdict", func(t *testing.T) {
+		env := requiredEnv()
+		env["SPAM_VERDICTS"] = "spf,dmarc"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `invalid environment variables: ` +
+			`SPAM_VERDICTS="spf,dmarc" (invalid verdict: dmarc)`
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+func TestOptionalForwardTarget(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["FORWARD_TARGET"] = "s3"
+		env["DEST_BUCKET"] = "archive.foo.com"
+		env["DEST_PREFIX"] = "forwarded"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.ForwardTarget, ForwardTargetS3)
+		assert.Equal(t, opts.DestBucket, "archive.foo.com")
+		assert.Equal(t, opts.DestPrefix, "forwarded")
+	})
+
+	t.Run("ReportsInvalidValue", func(t *testing.T) {
+		env := requiredEnv()
+		env["FORWARD_TARGET"] = "sns"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `invalid environment variables: ` +
+			`FORWARD_TARGET="sns" (must be one of: ses, s3, http)`
+		assert.ErrorContains(t, err, expected)
+	})
+
+	t.Run("SucceedsWithHttpTarget", func(t *testing.T) {
+		env := requiredEnv()
+		env["FORWARD_TARGET"] = "http"
+		env["WEBHOOK_URL"] = "https://tickets.foo.com/hooks/mail"
+		env["WEBHOOK_TIMEOUT"] = "30s"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.ForwardTarget, ForwardTargetHttp)
+		assert.Equal(t, opts.WebhookUrl, "https://tickets.foo.com/hooks/mail")
+		assert.Equal(t, opts.WebhookTimeout, 30*time.Second)
+	})
+
+	t.Run("ReportsMissingWebhookUrlForHttpTarget", func(t *testing.T) {
+		env := requiredEnv()
+		env["FORWARD_TARGET"] = "http"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `FORWARD_TARGET="http" (WEBHOOK_URL not set)`
+		assert.ErrorContains(t, err, expected)
+	})
+
+	t.Run("ReportsInvalidWebhookUrlWithoutRevealingIt", func(t *testing.T) {
+		env := requiredEnv()
+		env["FORWARD_TARGET"] = "http"
+		env["WEBHOOK_URL"] = "ftp://tickets.foo.com/?token=secret"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `WEBHOOK_URL="****" (not an http or https URL)`
+		assert.ErrorContains(t, err, expected)
+		assert.Assert(t, !strings.Contains(err.Error(), "secret"))
+	})
+
+	t.Run("ReportsMissingDestBucketForS3Target", func(t *testing.T) {
+		env := requiredEnv()
+		env["FORWARD_TARGET"] = "s3"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `invalid environment variables: ` +
+			`FORWARD_TARGET="s3" (DEST_BUCKET not set)`
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+func TestOptionalSpamAction(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["SPAM_ACTION"] = "tag"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.SpamAction, SpamActionTag)
+	})
+
+	t.Run("ReportsInvalidValue", func(t *testing.T) {
+		env := requiredEnv()
+		env["SPAM_ACTION"] = "quarantine"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `invalid environment variables: ` +
+			`SPAM_ACTION="quarantine" (must be one of: drop, tag)`
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+func TestOptionalOriginLinkFormat(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["ORIGIN_LINK_FORMAT"] = "console"
+		env["AWS_REGION"] = "us-east-1"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.OriginLinkFormat, OriginLinkFormatConsole)
+		assert.Equal(t, opts.AwsRegion, "us-east-1")
+	})
+
+	t.Run("ReportsInvalidValue", func(t *testing.T) {
+		env := requiredEnv()
+		env["ORIGIN_LINK_FORMAT"] = "https"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `invalid environment variables: ` +
+			`ORIGIN_LINK_FORMAT="https" (must be one of: s3, console)`
+		assert.ErrorContains(t, err, expected)
+	})
+
+	t.Run("ReportsMissingRegionForConsoleFormat", func(t *testing.T) {
+		env := requiredEnv()
+		env["ORIGIN_LINK_FORMAT"] = "console"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `invalid environment variables: ` +
+			`ORIGIN_LINK_FORMAT="console" (AWS_REGION not set)`
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+func TestOptionalDateSource(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["DATE_SOURCE"] = "receipt"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.DateSource, DateSourceReceipt)
+	})
+
+	t.Run("ReportsInvalidValue", func(t *testing.T) {
+		env := requiredEnv()
+		env["DATE_SOURCE"] = "original"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `invalid environment variables: ` +
+			`DATE_SOURCE="original" (must be one of: receipt)`
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+func TestOptionalDefaultSubject(t *testing.T) {
+	env := requiredEnv()
+	env["DEFAULT_SUBJECT"] = "(no subject)"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.DefaultSubject, "(no subject)")
+}
+
+func TestOptionalHeaderMode(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["HEADER_MODE"] = "denylist"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.HeaderMode, HeaderModeDenylist)
+	})
+
+	t.Run("ReportsInvalidValue", func(t *testing.T) {
+		env := requiredEnv()
+		env["HEADER_MODE"] = "blocklist"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `invalid environment variables: ` +
+			`HEADER_MODE="blocklist" (must be one of: allowlist, denylist)`
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+func TestOptionalStripHeaders(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["STRIP_HEADERS"] = "X-Originating-IP, received"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(
+			t, opts.StripHeaders, []string{"X-Originating-IP", "received"},
+		)
+	})
+
+	t.Run("ReportsInvalidHeaderName", func(t *testing.T) {
+		env := requiredEnv()
+		env["STRIP_HEADERS"] = "Received,X Originating IP"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `invalid environment variables: ` +
+			`STRIP_HEADERS="Received,X Originating IP" ` +
+			`(invalid header name: X Originating IP)`
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+func TestOptionalHeaderNameOverrides(t *testing.T) {
+	env := requiredEnv()
+	env["HEADER_NAME_OVERRIDES"] = "X-MS-Has-Attach, Message-Id"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.DeepEqual(
+		t,
+		opts.HeaderNameOverrides,
+		[]string{"X-MS-Has-Attach", "Message-Id"},
+	)
+}
+
+func TestOptionalStripPlusFromTo(t *testing.T) {
+	env := requiredEnv()
+	env["STRIP_PLUS_FROM_TO"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.StripPlusFromTo, true)
+}
+
+func TestOptionalFromAtReplacement(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["FROM_AT_REPLACEMENT"] = "_at_"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.FromAtReplacement, "_at_")
+	})
+
+	t.Run("ReportsAmbiguousToken", func(t *testing.T) {
+		env := requiredEnv()
+		env["FROM_AT_REPLACEMENT"] = "(at)"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `invalid environment variables: ` +
+			`FROM_AT_REPLACEMENT="(at)" (produces ambiguous From: `
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+func TestOptionalRequireTls(t *testing.T) {
+	env := requiredEnv()
+	env["REQUIRE_TLS"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.RequireTls, true)
+}
+
+func TestOptionalKeepOriginalTo(t *testing.T) {
+	env := requiredEnv()
+	env["KEEP_ORIGINAL_TO"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.KeepOriginalTo, true)
+}
+
+func TestOptionalForwardReports(t *testing.T) {
+	env := requiredEnv()
+	env["FORWARD_REPORTS"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.ForwardReports, true)
+}
+
+func TestOptionalForwardSelfOriginated(t *testing.T) {
+	env := requiredEnv()
+	env["FORWARD_SELF_ORIGINATED"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.ForwardSelfOriginated, true)
+}
+
+func TestOptionalForwardUnparseable(t *testing.T) {
+	env := requiredEnv()
+	env["FORWARD_UNPARSEABLE"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.ForwardUnparseable, true)
+}
+
+func TestOptionalLogHeaders(t *testing.T) {
+	env := requiredEnv()
+	env["LOG_HEADERS"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.LogHeaders, true)
+}
+
+func TestOptionalMetadataHeaders(t *testing.T) {
+	env := requiredEnv()
+	env["METADATA_HEADERS"] = "Receipt-Time, Spam-Score"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	expected := []string{"Receipt-Time", "Spam-Score"}
+	assert.DeepEqual(t, opts.MetadataHeaders, expected)
+}
+
+func TestOptionalKeepHeaderPatterns(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["KEEP_HEADER_PATTERNS"] = "X-Company-*, Organizatio?, " +
+			"/^X-(Foo|Bar)$/"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, len(opts.KeepHeaderPatterns), 3)
+		for _, header := range []string{
+			"X-Company-Team", "x-company-dept", "Organization", "X-Bar",
+		} {
+			assert.Assert(
+				t, matchesAny(opts.KeepHeaderPatterns, header), header,
+			)
+		}
+		for _, header := range []string{
+			"X-Company", "Organizations", "X-Baz", "X-Foo-Bar", "X-Mailer",
+		} {
+			assert.Assert(
+				t, !matchesAny(opts.KeepHeaderPatterns, header), header,
+			)
+		}
+	})
+
+	t.Run("ReportsInvalidGlob", func(t *testing.T) {
+		env := requiredEnv()
+		env["KEEP_HEADER_PATTERNS"] = "X-Company-*,X Foo"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `KEEP_HEADER_PATTERNS="X-Company-*,X Foo" ` +
+			"(invalid header pattern: X Foo)"
+		assert.ErrorContains(t, err, expected)
+	})
+
+	t.Run("ReportsInvalidRegexp", func(t *testing.T) {
+		env := requiredEnv()
+		env["KEEP_HEADER_PATTERNS"] = "/^X-(Foo/"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		assert.ErrorContains(t, err, `KEEP_HEADER_PATTERNS="/^X-(Foo/"`)
+	})
+}
+
+func TestOptionalContentTypeAllowlist(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["CONTENT_TYPE_ALLOWLIST"] = "Text/Calendar, application/ics"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		expected := []string{"text/calendar", "application/ics"}
+		assert.DeepEqual(t, opts.ContentTypeAllowlist, expected)
+	})
+
+	t.Run("ReportsInvalidMediaType", func(t *testing.T) {
+		env := requiredEnv()
+		env["CONTENT_TYPE_ALLOWLIST"] = "text/calendar,text"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `CONTENT_TYPE_ALLOWLIST="text/calendar,text" ` +
+			"(invalid media type: text)"
+		assert.ErrorContains(t, err, expected)
+	})
+
+	t.Run("ReportsMediaTypeWithParameters", func(t *testing.T) {
+		env := requiredEnv()
+		env["CONTENT_TYPE_ALLOWLIST"] = "text/plain; charset=utf-8"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := "(invalid media type: text/plain; charset=utf-8)"
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+func TestOptionalNoReplyReplyTo(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["NOREPLY_REPLY_TO"] = "support@foo.com"
+		env["OMIT_NOREPLY_REPLY_TO"] = "true"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.NoReplyReplyTo, "support@foo.com")
+		assert.Equal(t, opts.OmitNoReplyReplyTo, true)
+	})
+
+	t.Run("ReportsInvalidAddress", func(t *testing.T) {
+		env := requiredEnv()
+		env["NOREPLY_REPLY_TO"] = "support"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		assert.ErrorContains(t, err, `NOREPLY_REPLY_TO="support"`)
+	})
+}
+
+func TestOptionalInternalReplyTo(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["INTERNAL_REPLY_TO"] = "shared@foo.com"
+		env["INTERNAL_DOMAINS"] = "foo.com, mail.foo.com"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.InternalReplyTo, "shared@foo.com")
+		expected := []string{"foo.com", "mail.foo.com"}
+		assert.DeepEqual(t, opts.InternalDomains, expected)
+	})
+
+	t.Run("ReportsInvalidAddress", func(t *testing.T) {
+		env := requiredEnv()
+		env["INTERNAL_REPLY_TO"] = "shared"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		assert.ErrorContains(t, err, `INTERNAL_REPLY_TO="shared"`)
+	})
+
+	t.Run("ReportsInvalidDomain", func(t *testing.T) {
+		env := requiredEnv()
+		env["INTERNAL_DOMAINS"] = "foo.com,@bar.com"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `INTERNAL_DOMAINS="foo.com,@bar.com" ` +
+			"(invalid domain: @bar.com)"
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+func TestOptionalPostmasterForward(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["POSTMASTER_FORWARD"] = "admin@bar.com"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.PostmasterForward, "admin@bar.com")
+	})
+
+	t.Run("ReportsInvalidAddress", func(t *testing.T) {
+		env := requiredEnv()
+		env["POSTMASTER_FORWARD"] = "admin"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		assert.ErrorContains(t, err, `POSTMASTER_FORWARD="admin"`)
+	})
+}
+
+func TestOptionalFoldLongHeaders(t *testing.T) {
+	env := requiredEnv()
+	env["FOLD_LONG_HEADERS"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.FoldLongHeaders, true)
+}
+
+func TestOptionalKeepAlignedFrom(t *testing.T) {
+	env := requiredEnv()
+	env["KEEP_ORIGINAL_FROM_IF_ALIGNED"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.KeepAlignedFrom, true)
+}
+
+func TestOptionalRewriteMessageId(t *testing.T) {
+	env := requiredEnv()
+	env["REWRITE_MESSAGE_ID"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.RewriteMessageId, true)
+}
+
+func TestOptionalAddAuthResults(t *testing.T) {
+	t.Run("DefaultsToFalse", func(t *testing.T) {
+		opts, err := getOptions(requiredEnv())
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.AddAuthResults, false)
+	})
+
+	t.Run("EnablesIfTrue", func(t *testing.T) {
+		env := requiredEnv()
+		env["ADD_AUTH_RESULTS"] = "true"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.AddAuthResults, true)
+		assert.Assert(t, is.Contains(opts.Summary(), "ADD_AUTH_RESULTS=true"))
+	})
+}
+
+func TestOptionalValidateSenderIdentity(t *testing.T) {
+	env := requiredEnv()
+	env["VALIDATE_SENDER_IDENTITY"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.ValidateSenderIdentity, true)
+}
+
+func TestOptionalPreservePriority(t *testing.T) {
+	env := requiredEnv()
+	env["PRESERVE_PRIORITY"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.PreservePriority, true)
+}
+
+func TestOptionalPreserveContentLanguage(t *testing.T) {
+	env := requiredEnv()
+	env["PRESERVE_CONTENT_LANGUAGE"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.PreserveContentLanguage, true)
+}
+
+func TestOptionalPreserveThreadHeaders(t *testing.T) {
+	env := requiredEnv()
+	env["PRESERVE_THREAD_HEADERS"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.PreserveThreadHeaders, true)
+}
+
+func TestOptionalNormalizeSubjectEncoding(t *testing.T) {
+	t.Run("DefaultsToFalse", func(t *testing.T) {
+		opts, err := getOptions(requiredEnv())
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.NormalizeSubjectEncoding, false)
+	})
+
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["NORMALIZE_SUBJECT_ENCODING"] = "true"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.NormalizeSubjectEncoding, true)
+	})
+
+	t.Run("ReportsInvalidBoolean", func(t *testing.T) {
+		env := requiredEnv()
+		env["NORMALIZE_SUBJECT_ENCODING"] = "maybe"
+
+		_, err := getOptions(env)
+
+		expected := `NORMALIZE_SUBJECT_ENCODING="maybe" (not a boolean value)`
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+func TestOptionalPlainTextOnly(t *testing.T) {
+	env := requiredEnv()
+	env["PLAINTEXT_ONLY"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.PlainTextOnly, true)
+}
+
+func TestOptionalSetSesFrom(t *testing.T) {
+	env := requiredEnv()
+	env["SET_SES_FROM"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.SetSesFrom, true)
+}
+
+func TestOptionalVerp(t *testing.T) {
+	env := requiredEnv()
+	env["VERP"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.Verp, true)
+}
+
+func TestOptionalCaseSensitiveLocalpart(t *testing.T) {
+	env := requiredEnv()
+	env["CASE_SENSITIVE_LOCALPART"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.CaseSensitiveLocalpart, true)
+}
+
+func TestOptionalForwardedFor(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["ADD_FORWARDED_FOR"] = "true"
+		env["FORWARDED_FOR_HEADER"] = "X-Forward-Chain"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.AddForwardedFor, true)
+		assert.Equal(t, opts.ForwardedForHeader, "X-Forward-Chain")
+	})
+
+	t.Run("ReportsInvalidHeaderName", func(t *testing.T) {
+		env := requiredEnv()
+		env["FORWARDED_FOR_HEADER"] = "X-Forward Chain"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `FORWARDED_FOR_HEADER="X-Forward Chain" ` +
+			"(invalid header name)"
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+func TestOptionalAllowReforward(t *testing.T) {
+	env := requiredEnv()
+	env["ALLOW_REFORWARD"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.AllowReforward, true)
+}
+
+func TestOptionalFallbackNoConfigSet(t *testing.T) {
+	env := requiredEnv()
+	env["FALLBACK_NO_CONFIG_SET"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.FallbackNoConfigSet, true)
+}
+
+func TestOptionalEmitMetrics(t *testing.T) {
+	env := requiredEnv()
+	env["EMIT_METRICS"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.EmitMetrics, true)
+}
+
+func TestOptionalRewrite(t *testing.T) {
+	env := requiredEnv()
+	env["REWRITE"] = "none"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.Rewrite, RewriteNone)
+}
+
+func TestOptionalSesApiVersion(t *testing.T) {
+	t.Run("SetsV1", func(t *testing.T) {
+		env := requiredEnv()
+		env["SES_API_VERSION"] = "v1"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.SesApiVersion, SesApiVersionV1)
+	})
+
+	t.Run("ErrorsIfInvalid", func(t *testing.T) {
+		env := requiredEnv()
+		env["SES_API_VERSION"] = "v3"
+
+		_, err := getOptions(env)
+
+		assert.ErrorContains(
+			t, err, `SES_API_VERSION="v3" (must be one of: v2, v1)`,
+		)
+	})
+}
+
+func TestOptionalEmptyRecipientsAction(t *testing.T) {
+	env := requiredEnv()
+	env["EMPTY_RECIPIENTS_ACTION"] = "drop"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.EmptyRecipientsAction, EmptyRecipientsActionDrop)
+}
+
+func TestForwardingLoopCheck(t *testing.T) {
+	t.Run("NoWarningsForDifferentDomain", func(t *testing.T) {
+		env := requiredEnv()
+		env["STRICT_LOOP_CHECK"] = "true"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.StrictLoopCheck, true)
+		assert.DeepEqual(t, opts.Warnings(), []string{})
+	})
+
+	t.Run("WarnsIfSameDomainAsEmailDomainName", func(t *testing.T) {
+		env := requiredEnv()
+		env["FORWARDING_ADDRESS"] = "Me <me@FOO.com>"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		expected := "FORWARDING_ADDRESS=****@FOO.com may cause a " +
+			"forwarding loop (same domain as EMAIL_DOMAIN_NAME)"
+		assert.DeepEqual(t, opts.Warnings(), []string{expected})
+	})
+
+	t.Run("WarnsIfSameDomainAsSenderAddress", func(t *testing.T) {
+		env := requiredEnv()
+		env["SENDER_ADDRESS"] = "inbox@bar.com"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		expected := "FORWARDING_ADDRESS=****@bar.com may cause a " +
+			"forwarding loop (same domain as SENDER_ADDRESS)"
+		assert.DeepEqual(t, opts.Warnings(), []string{expected})
+	})
+
+	t.Run("ReportsSameDomainIfStrict", func(t *testing.T) {
+		env := requiredEnv()
+		env["FORWARDING_ADDRESS"] = "me@foo.com"
+		env["STRICT_LOOP_CHECK"] = "true"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `FORWARDING_ADDRESS="****@foo.com" ` +
+			"(same domain as EMAIL_DOMAIN_NAME)"
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+func TestOptionalReplyTo(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["REPLY_TO_ADDRESS"] = "team@foo.com"
+		env["REPLY_TO_INCLUDE_ORIGINAL"] = "true"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.ReplyToAddress, "team@foo.com")
+		assert.Equal(t, opts.ReplyToIncludeOriginal, true)
+	})
+
+	t.Run("ReportsInvalidAddress", func(t *testing.T) {
+		env := requiredEnv()
+		env["REPLY_TO_ADDRESS"] = "team AT foo.com"
+
+		_, err := getOptions(env)
+
+		assert.ErrorContains(t, err, `REPLY_TO_ADDRESS="team AT foo.com"`)
+	})
+}
+
+func TestOptionalSesMessageTags(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["SES_MESSAGE_TAGS"] = "category=forwarded, source=ses-forwarder"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(
+			t,
+			opts.SesMessageTags,
+			[]MessageTag{
+				{Name: "category", Value: "forwarded"},
+				{Name: "source", Value: "ses-forwarder"},
+			},
+		)
+	})
+
+	t.Run("ReportsInvalidTags", func(t *testing.T) {
+		for _, tags := range []string{
+			"category",
+			"category=",
+			"=forwarded",
+			"category=for warded",
+			"cat.egory=forwarded",
+			"category=" + strings.Repeat("x", 257),
+		} {
+			env := requiredEnv()
+			env["SES_MESSAGE_TAGS"] = tags
+
+			_, err := getOptions(env)
+
+			assert.ErrorContains(t, err, "invalid message tag: ", tags)
+		}
+	})
+}
+
+func TestOptionalRequesterPays(t *testing.T) {
+	env := requiredEnv()
+	env["REQUESTER_PAYS"] = "true"
+
+	opts, err := getOptions(env)
+
+	assert.NilError(t, err)
+	assert.Equal(t, opts.RequesterPays, true)
+}
+
+func TestOptionalSubjectRoutes(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["SUBJECT_ROUTES"] = `\[URGENT\]=pager@foo.com; a=b=billing@foo.com`
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, len(opts.SubjectRoutes), 2)
+		assert.Equal(t, opts.SubjectRoutes[0].Pattern.String(), `\[URGENT\]`)
+		assert.Equal(t, opts.SubjectRoutes[0].Address, "pager@foo.com")
+		assert.Equal(t, opts.SubjectRoutes[1].Pattern.String(), "a=b")
+		assert.Equal(t, opts.SubjectRoutes[1].Address, "billing@foo.com")
+	})
+
+	t.Run("ReportsMissingPattern", func(t *testing.T) {
+		env := requiredEnv()
+		env["SUBJECT_ROUTES"] = "=pager@foo.com"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `SUBJECT_ROUTES="=pager@foo.com" ` +
+			`(invalid subject route: =pager@foo.com)`
+		assert.ErrorContains(t, err, expected)
+	})
+
+	t.Run("ReportsInvalidPattern", func(t *testing.T) {
+		env := requiredEnv()
+		env["SUBJECT_ROUTES"] = "[URGENT=pager@foo.com"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		assert.ErrorContains(t, err, "missing closing ]")
+	})
+
+	t.Run("ReportsInvalidAddress", func(t *testing.T) {
+		env := requiredEnv()
+		env["SUBJECT_ROUTES"] = "URGENT=pager"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		assert.ErrorContains(t, err, `SUBJECT_ROUTES="URGENT=pager"`)
+	})
+}
+
+func TestOptionalConfigCacheTtl(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["CONFIG_CACHE_TTL"] = "90s"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.ConfigCacheTtl, 90*time.Second)
+	})
+
+	t.Run("ReportsInvalidDuration", func(t *testing.T) {
+		env := requiredEnv()
+		env["CONFIG_CACHE_TTL"] = "5 minutes"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `CONFIG_CACHE_TTL="5 minutes" (not a duration)`
+		assert.ErrorContains(t, err, expected)
+	})
+
+	t.Run("ReportsNonPositiveDuration", func(t *testing.T) {
+		env := requiredEnv()
+		env["CONFIG_CACHE_TTL"] = "-1m"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `CONFIG_CACHE_TTL="-1m" (must be positive)`
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+func TestOptionalReplayWindow(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["REPLAY_WINDOW"] = "24h"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.ReplayWindow, 24*time.Hour)
+	})
+
+	t.Run("ReportsInvalidDuration", func(t *testing.T) {
+		env := requiredEnv()
+		env["REPLAY_WINDOW"] = "1d"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		assert.ErrorContains(t, err, `REPLAY_WINDOW="1d" (not a duration)`)
+	})
+}
+
+func TestOptionalClientTimeouts(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["S3_TIMEOUT"] = "5s"
+		env["SES_TIMEOUT"] = "3s"
+		env["SESV2_TIMEOUT"] = "1m"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.S3Timeout, 5*time.Second)
+		assert.Equal(t, opts.SesTimeout, 3*time.Second)
+		assert.Equal(t, opts.SesV2Timeout, time.Minute)
+	})
+
+	t.Run("ReportsInvalidDurations", func(t *testing.T) {
+		env := requiredEnv()
+		env["S3_TIMEOUT"] = "5 seconds"
+		env["SESV2_TIMEOUT"] = "0s"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		assert.ErrorContains(t, err, `S3_TIMEOUT="5 seconds" (not a duration)`)
+		assert.ErrorContains(t, err, `SESV2_TIMEOUT="0s" (must be positive)`)
+	})
+}
+
+func TestOptionalMaxMessageSize(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["MAX_MESSAGE_SIZE"] = "10MB"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.MaxMessageSize, int64(10*1024*1024))
+	})
+
+	t.Run("ReportsInvalidSize", func(t *testing.T) {
+		env := requiredEnv()
+		env["MAX_MESSAGE_SIZE"] = "10 megs"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `MAX_MESSAGE_SIZE="10 megs" (not a byte size)`
+		assert.ErrorContains(t, err, expected)
+	})
+
+	t.Run("ReportsSizeExceedingSesLimit", func(t *testing.T) {
+		env := requiredEnv()
+		env["MAX_MESSAGE_SIZE"] = "41MB"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `MAX_MESSAGE_SIZE="41MB" ` +
+			"(exceeds SES limit of 41943040 bytes)"
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+func TestOptionalSendRatePerSec(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["SEND_RATE_PER_SEC"] = "0.5"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.SendRatePerSec, 0.5)
+	})
+
+	t.Run("ReportsInvalidRate", func(t *testing.T) {
+		for _, value := range []string{"fast", "0", "-1", "NaN", "Inf"} {
+			env := requiredEnv()
+			env["SEND_RATE_PER_SEC"] = value
+
+			opts, err := getOptions(env)
+
+			assert.Assert(t, opts == nil)
+			assert.ErrorContains(t, err, `SEND_RATE_PER_SEC="`+value+`"`)
+		}
+	})
+}
+
+func TestOptionalDetachAttachments(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		env := requiredEnv()
+		env["DETACH_ATTACHMENTS_PREFIX"] = "detached"
+		env["DETACH_ATTACHMENTS_THRESHOLD"] = "5MB"
+		env["DETACH_ATTACHMENTS_LINK_TTL"] = "24h"
+
+		opts, err := getOptions(env)
+
+		assert.NilError(t, err)
+		assert.Equal(t, opts.DetachAttachmentsPrefix, "detached")
+		assert.Equal(t, opts.DetachAttachmentsThreshold, int64(5*1024*1024))
+		assert.Equal(t, opts.DetachAttachmentsLinkTtl, 24*time.Hour)
+	})
+
+	t.Run("ReportsLinkTtlExceedingPresignLimit", func(t *testing.T) {
+		env := requiredEnv()
+		env["DETACH_ATTACHMENTS_PREFIX"] = "detached"
+		env["DETACH_ATTACHMENTS_LINK_TTL"] = "169h"
+
+		opts, err := getOptions(env)
+
+		assert.Assert(t, opts == nil)
+		expected := `DETACH_ATTACHMENTS_LINK_TTL="169h" ` +
+			"(exceeds S3 presigned URL limit of 168h0m0s)"
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+func TestParseByteSize(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		for value, expected := range map[string]int64{
+			"1024":   1024,
+			"100B":   100,
+			"512KB":  512 * 1024,
+			"512kb":  512 * 1024,
+			"10MB":   10 * 1024 * 1024,
+			" 2 GB ": 2 * 1024 * 1024 * 1024,
+		} {
+			size, err := parseByteSize(value)
+
+			assert.NilError(t, err, "value: %q", value)
+			assert.Equal(t, size, expected, "value: %q", value)
+		}
+	})
+
+	t.Run("ReportsInvalidSizes", func(t *testing.T) {
+		for value, expected := range map[string]string{
+			"":                       "not a byte size",
+			"MB":                     "not a byte size",
+			"1.5MB":                  "not a byte size",
+			"10TB":                   "not a byte size",
+			"0KB":                    "must be positive",
+			"-1MB":                   "must be positive",
+			"9223372036854775807KB":  "too large",
+			"99999999999999999999GB": "not a byte size",
+		} {
+			_, err := parseByteSize(value)
+
+			assert.Error(t, err, expected, "value: %q", value)
+		}
+	})
+}
+
+func TestSummary(t *testing.T) {
+	t.Run("IncludesRequiredFields", func(t *testing.T) {
+		opts, err := getOptions(requiredEnv())
+		assert.NilError(t, err)
+
+		summary := opts.Summary()
+
+		expected := strings.Join([]string{
+			`BUCKET_NAME="my-bucket"`,
+			`INCOMING_PREFIX="inbox"`,
+			`EMAIL_DOMAIN_NAME="foo.com"`,
+			`SENDER_ADDRESS="inbox@foo.com"`,
+			`FORWARDING_ADDRESS="****@bar.com"`,
+			`CONFIGURATION_SET="config-set"`,
+		}, "\n")
+		assert.Equal(t, summary, expected)
+	})
+
+	t.Run("IncludesSetOptionalFieldsAndMasksSensitiveValues",
+		func(t *testing.T) {
+			env := requiredEnv()
+			env["ARCHIVE_BCC"] = "Archive <archive@bar.com>"
+			env["BOUNCE_HANDLING_ADDRESS"] = "bounces@bar.com"
+			env["REPLY_TO_ADDRESS"] = "replies@bar.com"
+			env["DEFAULT_SUBJECT"] = "(no subject)"
+			env["STRIP_HEADERS"] = "X-Foo,X-Bar"
+			env["REQUIRE_TLS"] = "true"
+			env["PLAINTEXT_ONLY"] = "false"
+			env["SES_MESSAGE_TAGS"] = "category=secret-value"
+			env["CONFIG_CACHE_TTL"] = "90s"
+			env["MAX_MESSAGE_SIZE"] = "1KB"
+			env["KEEP_HEADER_PATTERNS"] = "X-Company-*"
+			opts, err := getOptions(env)
+			assert.NilError(t, err)
+
+			summary := opts.Summary()
+
+			assert.Assert(t, is.Contains(summary, `ARCHIVE_BCC="****@bar.com"`))
+			expected := `BOUNCE_HANDLING_ADDRESS="****@bar.com"`
+			assert.Assert(t, is.Contains(summary, expected))
+			expected = `REPLY_TO_ADDRESS="****@bar.com"`
+			assert.Assert(t, is.Contains(summary, expected))
+			expected = `DEFAULT_SUBJECT="(no subject)"`
+			assert.Assert(t, is.Contains(summary, expected))
+			expected = `STRIP_HEADERS="X-Foo,X-Bar"`
+			assert.Assert(t, is.Contains(summary, expected))
+			assert.Assert(t, is.Contains(summary, "REQUIRE_TLS=true"))
+			assert.Assert(t, !strings.Contains(summary, "PLAINTEXT_ONLY"))
+			expected = `SES_MESSAGE_TAGS="category=****"`
+			assert.Assert(t, is.Contains(summary, expected))
+			expected = `CONFIG_CACHE_TTL="1m30s"`
+			assert.Assert(t, is.Contains(summary, expected))
+			expected = `MAX_MESSAGE_SIZE="1024"`
+			assert.Assert(t, is.Contains(summary, expected))
+			expected = `KEEP_HEADER_PATTERNS="(?i)^X-Company-.*$"`
+			assert.Assert(t, is.Contains(summary, expected))
+			assert.Assert(t, !strings.Contains(summary, "archive@"))
+			assert.Assert(t, !strings.Contains(summary, "replies@"))
+			assert.Assert(t, !strings.Contains(summary, "secret-value"))
+		},
+	)
+}
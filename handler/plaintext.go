@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+type plainTextMessage struct {
+	contentType      string
+	transferEncoding string
+	body             []byte
+}
+
+// toPlainText converts text/html and multipart/alternative messages to
+// text/plain.
+//
+// For multipart/alternative messages, it keeps the text/plain part and drops
+// the text/html part. If there's no text/plain part, it generates one by
+// stripping the tags from the text/html part.
+//
+// For other multipart messages, such as multipart/mixed, it converts each
+// inline text/html or multipart part the same way, recursively, and leaves
+// every other part, including attachments, as is. It leaves multipart/signed
+// messages alone, since converting them would invalidate their signatures.
+//
+// Returns nil without reading the body if the message is neither text/html nor
+// multipart.
+func toPlainText(
+	header mail.Header, body io.Reader,
+) (msg *plainTextMessage, err error) {
+	if msg, err = convertToPlainText(header, body); err != nil {
+		err = fmt.Errorf("failed to convert message to plain text: %w", err)
+	}
+	return
+}
+
+func convertToPlainText(
+	header mail.Header, body io.Reader,
+) (*plainTextMessage, error) {
+	contentType := header.Get("Content-Type")
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, nil
+	}
+	cte := header.Get("Content-Transfer-Encoding")
+
+	switch {
+	case mediaType == "text/html":
+		return htmlToPlainText(params["charset"], cte, body)
+	case mediaType == "multipart/alternative":
+		return alternativeToPlainText(params["boundary"], body)
+	case mediaType == "multipart/signed":
+		return nil, nil
+	case strings.HasPrefix(mediaType, "multipart/"):
+		return multipartToPlainText(contentType, params["boundary"], cte, body)
+	}
+	return nil, nil
+}
+
+func htmlToPlainText(
+	charset, cte string, body io.Reader,
+) (*plainTextMessage, error) {
+	content, err := io.ReadAll(decodeTransferEncoding(cte, body))
+	if err != nil {
+		return nil, err
+	}
+	return newPlainTextMessage(charset, stripHtmlTags(content)), nil
+}
+
+func alternativeToPlainText(
+	boundary string, body io.Reader,
+) (*plainTextMessage, error) {
+	var htmlPart *plainTextMessage
+	mr := multipart.NewReader(body, boundary)
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		contentType := part.Header.Get("Content-Type")
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		isText := mediaType == "text/plain" || mediaType == "text/html"
+		if err != nil || !isText {
+			continue
+		}
+
+		// multipart.Reader already decodes quoted-printable parts.
+		cte := part.Header.Get("Content-Transfer-Encoding")
+		content, err := io.ReadAll(decodeTransferEncoding(cte, part))
+		if err != nil {
+			return nil, err
+		} else if mediaType == "text/plain" {
+			return newPlainTextMessage(params["charset"], content), nil
+		} else if htmlPart == nil {
+			htmlPart = newPlainTextMessage(
+				params["charset"], stripHtmlTags(content),
+			)
+		}
+	}
+
+	if htmlPart == nil {
+		return nil, errors.New("no text/plain or text/html part")
+	}
+	return htmlPart, nil
+}
+
+// multipartToPlainText rewrites the multipart body, replacing each part that
+// convertToPlainText converts. It keeps the original Content-Type, boundary
+// and Content-Transfer-Encoding, since quoted-printable parts are 7bit.
+func multipartToPlainText(
+	contentType, boundary, cte string, body io.Reader,
+) (*plainTextMessage, error) {
+	b := &bytes.Buffer{}
+	w := multipart.NewWriter(b)
+	if err := w.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+	mr := multipart.NewReader(body, boundary)
+
+	for {
+		// NextRawPart doesn't decode quoted-printable parts, so parts that
+		// aren't converted are copied exactly.
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		header := part.Header
+		var content io.Reader = part
+		var pt *plainTextMessage
+		if !isAttachment(part) {
+			pt, err = convertToPlainText(mail.Header(header), part)
+		}
+		if err != nil {
+			return nil, err
+		} else if pt != nil {
+			header.Set("Content-Type", pt.contentType)
+			if pt.transferEncoding != "" {
+				header.Set("Content-Transfer-Encoding", pt.transferEncoding)
+			}
+			content = bytes.NewReader(pt.body)
+		}
+
+		// Writing to a bytes.Buffer can't fail, but reading part can.
+		pw, _ := w.CreatePart(header)
+		if _, err := io.Copy(pw, content); err != nil {
+			return nil, err
+		}
+	}
+	w.Close()
+
+	return &plainTextMessage{
+		contentType: contentType, transferEncoding: cte, body: b.Bytes(),
+	}, nil
+}
+
+func decodeTransferEncoding(cte string, r io.Reader) io.Reader {
+	switch strings.ToLower(cte) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+func newPlainTextMessage(charset string, content []byte) *plainTextMessage {
+	if charset == "" {
+		charset = "utf-8"
+	}
+	return &plainTextMessage{
+		contentType: mime.FormatMediaType(
+			"text/plain", map[string]string{"charset": charset},
+		),
+		transferEncoding: "quoted-printable",
+		body:             encodeQuotedPrintable(content),
+	}
+}
+
+func encodeQuotedPrintable(content []byte) []byte {
+	b := &bytes.Buffer{}
+	w := quotedprintable.NewWriter(b)
+
+	// Writing to a bytes.Buffer can't fail, so we can ignore the errors.
+	w.Write(content)
+	w.Close()
+	return b.Bytes()
+}
+
+var (
+	htmlInvisibleElements = regexp.MustCompile(
+		`(?is)<(head|script|style)\b.*?</(head|script|style)\s*>`,
+	)
+	htmlLineBreaks = regexp.MustCompile(
+		`(?i)<br\s*/?>|</(p|div|h[1-6]|li|tr|blockquote)\s*>`,
+	)
+	htmlTags = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+func stripHtmlTags(content []byte) []byte {
+	content = htmlInvisibleElements.ReplaceAll(content, nil)
+	content = htmlLineBreaks.ReplaceAll(content, []byte("\n"))
+	content = htmlTags.ReplaceAll(content, nil)
+	return []byte(html.UnescapeString(string(content)))
+}
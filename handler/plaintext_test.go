@@ -0,0 +1,181 @@
+//go:build small_tests || all_tests
+
+package handler
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func plainTextInput(
+	contentType, cte, body string,
+) (mail.Header, *strings.Reader) {
+	header := mail.Header{"Content-Type": []string{contentType}}
+	if cte != "" {
+		header["Content-Transfer-Encoding"] = []string{cte}
+	}
+	return header, strings.NewReader(body)
+}
+
+func TestToPlainText(t *testing.T) {
+	const alternative = `multipart/alternative; boundary="random-string"`
+
+	t.Run("KeepsPlainTextPartOfAlternative", func(t *testing.T) {
+		header, body := plainTextInput(alternative, "", msgBody)
+
+		msg, err := toPlainText(header, body)
+
+		assert.NilError(t, err)
+		assert.Equal(t, msg.contentType, "text/plain; charset=UTF-8")
+		expected := "Sometimes the getting smallest detail wrong " +
+			"breaks everything.\r\n"
+		assert.Equal(t, string(msg.body), expected)
+	})
+
+	t.Run("ConvertsHtmlOnlyAlternative", func(t *testing.T) {
+		header, body := plainTextInput(alternative, "", strings.Join([]string{
+			`--random-string`,
+			`Content-Type: text/html; charset="UTF-8"`,
+			`Content-Transfer-Encoding: base64`,
+			``,
+			`PGRpdj5IZWxsbyw8YnI+d29ybGQgJmFtcDsgYWxsITwvZGl2Pg==`,
+			`--random-string--`,
+		}, "\r\n"))
+
+		msg, err := toPlainText(header, body)
+
+		assert.NilError(t, err)
+		assert.Equal(t, msg.contentType, "text/plain; charset=UTF-8")
+		assert.Equal(t, string(msg.body), "Hello,\r\nworld & all!\r\n")
+	})
+
+	t.Run("ConvertsHtmlOnlyMessage", func(t *testing.T) {
+		header, body := plainTextInput(
+			"text/html",
+			"quoted-printable",
+			`<html><head><style>p {}</style></head>`+
+				`<body><p>Caf=C3=A9 &lt;open&gt;</p></body></html>`,
+		)
+
+		msg, err := toPlainText(header, body)
+
+		assert.NilError(t, err)
+		assert.Equal(t, msg.contentType, "text/plain; charset=utf-8")
+		assert.Equal(t, string(msg.body), "Caf=C3=A9 <open>\r\n")
+	})
+
+	const mixed = `multipart/mixed; boundary="mixed-boundary"`
+
+	attachment := strings.Join([]string{
+		`--mixed-boundary`,
+		`Content-Disposition: attachment; filename="report.html"`,
+		`Content-Transfer-Encoding: quoted-printable`,
+		`Content-Type: text/html; charset="UTF-8"`,
+		``,
+		`<p>Caf=C3=A9</p>`,
+		`--mixed-boundary--`,
+		``,
+	}, "\r\n")
+
+	t.Run("ConvertsHtmlPartOfMixedAndKeepsAttachment", func(t *testing.T) {
+		header, body := plainTextInput(mixed, "7bit", strings.Join([]string{
+			`--mixed-boundary`,
+			`Content-Type: text/html; charset="UTF-8"`,
+			`Content-Transfer-Encoding: base64`,
+			``,
+			`PGRpdj5IZWxsbyw8YnI+d29ybGQgJmFtcDsgYWxsITwvZGl2Pg==`,
+			attachment,
+		}, "\r\n"))
+
+		msg, err := toPlainText(header, body)
+
+		assert.NilError(t, err)
+		assert.Equal(t, msg.contentType, mixed)
+		assert.Equal(t, msg.transferEncoding, "7bit")
+		expected := strings.Join([]string{
+			`--mixed-boundary`,
+			`Content-Transfer-Encoding: quoted-printable`,
+			`Content-Type: text/plain; charset=UTF-8`,
+			``,
+			`Hello,`,
+			`world & all!`,
+			``,
+			attachment,
+		}, "\r\n")
+		assert.Equal(t, string(msg.body), expected)
+	})
+
+	t.Run("ConvertsAlternativeNestedInMixed", func(t *testing.T) {
+		header, body := plainTextInput(mixed, "", strings.Join([]string{
+			`--mixed-boundary`,
+			`Content-Type: ` + alternative,
+			``,
+			msgBody,
+			attachment,
+		}, "\r\n"))
+
+		msg, err := toPlainText(header, body)
+
+		assert.NilError(t, err)
+		expected := strings.Join([]string{
+			`--mixed-boundary`,
+			`Content-Transfer-Encoding: quoted-printable`,
+			`Content-Type: text/plain; charset=UTF-8`,
+			``,
+			"Sometimes the getting smallest detail wrong breaks everything.",
+			``,
+			attachment,
+		}, "\r\n")
+		assert.Equal(t, string(msg.body), expected)
+	})
+
+	t.Run("ReturnsNilForSignedMessage", func(t *testing.T) {
+		const signed = `multipart/signed; boundary="mixed-boundary"`
+		header, body := plainTextInput(signed, "", attachment)
+
+		msg, err := toPlainText(header, body)
+
+		assert.NilError(t, err)
+		assert.Assert(t, is.Nil(msg))
+		assert.Equal(t, body.Len(), len(attachment))
+	})
+
+	t.Run("ReturnsNilForPlainTextOnlyMessage", func(t *testing.T) {
+		header, body := plainTextInput("text/plain", "", "Hello, world!")
+
+		msg, err := toPlainText(header, body)
+
+		assert.NilError(t, err)
+		assert.Assert(t, is.Nil(msg))
+		assert.Equal(t, body.Len(), len("Hello, world!"))
+	})
+
+	t.Run("ErrorsIfAlternativeHasNoTextParts", func(t *testing.T) {
+		header, body := plainTextInput(alternative, "", strings.Join([]string{
+			`--random-string`,
+			`Content-Type: image/png`,
+			``,
+			`not really a PNG`,
+			`--random-string--`,
+		}, "\r\n"))
+
+		msg, err := toPlainText(header, body)
+
+		assert.Assert(t, is.Nil(msg))
+		expected := "failed to convert message to plain text: " +
+			"no text/plain or text/html part"
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+func TestStripHtmlTags(t *testing.T) {
+	result := stripHtmlTags([]byte(
+		`<script>alert("hi")</script><div>Foo<br/>bar &amp; baz</div>`,
+	))
+
+	assert.Equal(t, string(result), "Foo\nbar & baz\n")
+}
@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+)
+
+// maxThrottledAttempts is the maximum number of times withRetry will call an
+// AWS operation that keeps failing due to throttling.
+const maxThrottledAttempts = 4
+
+// throttledRetryDelay is the delay before the first retry of a throttled
+// operation. The delay doubles before each subsequent retry.
+const throttledRetryDelay = 250 * time.Millisecond
+
+var throttleErrors = retry.IsErrorThrottles(retry.DefaultThrottles)
+
+func isThrottleError(err error) bool {
+	return throttleErrors.IsErrorThrottle(err).Bool()
+}
+
+// withRetry calls an AWS operation, retrying with exponential backoff if it
+// fails due to throttling. Any other error is returned immediately. If ctx is
+// done before a retry, the error wraps both the throttling error and the
+// reason the retry was aborted.
+//
+// The AWS SDK clients already retry throttled requests a few times, but a
+// burst of incoming messages can still exhaust those attempts.
+func withRetry[T any](
+	ctx context.Context, h *Handler, op string, call func() (T, error),
+) (result T, err error) {
+	delay := throttledRetryDelay
+
+	for attempt := 1; ; attempt++ {
+		result, err = call()
+		if err == nil || !isThrottleError(err) ||
+			attempt == maxThrottledAttempts {
+			return
+		}
+
+		h.logf(ctx, "%s throttled, retrying in %s: %s", op, delay, err)
+		if sleepErr := h.sleep(ctx, delay); sleepErr != nil {
+			err = fmt.Errorf(
+				"%s throttled: %w (retry aborted: %w)", op, err, sleepErr,
+			)
+			return
+		}
+		delay *= 2
+	}
+}
+
+func (h *Handler) getObject(
+	ctx context.Context, input *s3.GetObjectInput,
+) (*s3.GetObjectOutput, error) {
+	return withRetry(ctx, h, "GetObject",
+		func() (*s3.GetObjectOutput, error) {
+			return h.S3.GetObject(ctx, input)
+		},
+	)
+}
+
+// sendBounce applies SES_TIMEOUT to each attempt separately.
+func (h *Handler) sendBounce(
+	ctx context.Context, input *ses.SendBounceInput,
+) (*ses.SendBounceOutput, error) {
+	return withRetry(ctx, h, "SendBounce",
+		func() (*ses.SendBounceOutput, error) {
+			ctx, cancel := withTimeout(ctx, h.Options.SesTimeout)
+			defer cancel()
+			return h.Ses.SendBounce(ctx, input)
+		},
+	)
+}
+
+// sendRawEmail applies SES_TIMEOUT to each attempt separately.
+func (h *Handler) sendRawEmail(
+	ctx context.Context, input *ses.SendRawEmailInput,
+) (*ses.SendRawEmailOutput, error) {
+	return withRetry(ctx, h, "SendRawEmail",
+		func() (*ses.SendRawEmailOutput, error) {
+			ctx, cancel := withTimeout(ctx, h.Options.SesTimeout)
+			defer cancel()
+			return h.Ses.SendRawEmail(ctx, input)
+		},
+	)
+}
+
+// sendEmail applies SESV2_TIMEOUT to each attempt separately.
+func (h *Handler) sendEmail(
+	ctx context.Context, input *sesv2.SendEmailInput,
+) (*sesv2.SendEmailOutput, error) {
+	return withRetry(ctx, h, "SendEmail",
+		func() (*sesv2.SendEmailOutput, error) {
+			ctx, cancel := withTimeout(ctx, h.Options.SesV2Timeout)
+			defer cancel()
+			return h.SesV2.SendEmail(ctx, input)
+		},
+	)
+}
+
+// getConfigurationSet applies SESV2_TIMEOUT to each attempt separately.
+func (h *Handler) getConfigurationSet(
+	ctx context.Context, input *sesv2.GetConfigurationSetInput,
+) (*sesv2.GetConfigurationSetOutput, error) {
+	return withRetry(ctx, h, "GetConfigurationSet",
+		func() (*sesv2.GetConfigurationSetOutput, error) {
+			ctx, cancel := withTimeout(ctx, h.Options.SesV2Timeout)
+			defer cancel()
+			return h.SesV2.GetConfigurationSet(ctx, input)
+		},
+	)
+}
+
+// getEmailIdentity applies SESV2_TIMEOUT to each attempt separately.
+func (h *Handler) getEmailIdentity(
+	ctx context.Context, input *sesv2.GetEmailIdentityInput,
+) (*sesv2.GetEmailIdentityOutput, error) {
+	return withRetry(ctx, h, "GetEmailIdentity",
+		func() (*sesv2.GetEmailIdentityOutput, error) {
+			ctx, cancel := withTimeout(ctx, h.Options.SesV2Timeout)
+			defer cancel()
+			return h.SesV2.GetEmailIdentity(ctx, input)
+		},
+	)
+}
+
+// withTimeout returns a context that expires after timeout, or ctx itself if
+// timeout is zero, i.e., if the corresponding option isn't set.
+func withTimeout(
+	ctx context.Context, timeout time.Duration,
+) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (h *Handler) sleep(ctx context.Context, d time.Duration) error {
+	if h.Sleep != nil {
+		return h.Sleep(ctx, d)
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
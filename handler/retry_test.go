@@ -0,0 +1,248 @@
+//go:build small_tests || all_tests
+
+package handler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/smithy-go"
+	"gotest.tools/assert"
+)
+
+func newThrottleError() error {
+	return &smithy.GenericAPIError{
+		Code: "ThrottlingException", Message: "Rate exceeded",
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	setup := func() (*Handler, *TestLogs, *[]time.Duration, context.Context) {
+		logs, logger := testLogger()
+		delays := []time.Duration{}
+		h := &Handler{
+			Log: logger,
+			Sleep: func(_ context.Context, d time.Duration) error {
+				delays = append(delays, d)
+				return nil
+			},
+		}
+		return h, logs, &delays, context.Background()
+	}
+
+	// callFailing returns a function that returns each of errs in turn before
+	// succeeding, and a pointer to the number of times it's been called.
+	callFailing := func(errs ...error) (func() (string, error), *int) {
+		calls := 0
+		return func() (string, error) {
+			calls++
+			if calls <= len(errs) {
+				return "", errs[calls-1]
+			}
+			return "success", nil
+		}, &calls
+	}
+
+	t.Run("SucceedsWithoutRetrying", func(t *testing.T) {
+		h, _, delays, ctx := setup()
+		call, calls := callFailing()
+
+		result, err := withRetry(ctx, h, "TestOp", call)
+
+		assert.NilError(t, err)
+		assert.Equal(t, result, "success")
+		assert.Equal(t, *calls, 1)
+		assert.Equal(t, len(*delays), 0)
+	})
+
+	t.Run("RetriesWithBackoffIfThrottled", func(t *testing.T) {
+		h, logs, delays, ctx := setup()
+		call, calls := callFailing(newThrottleError(), newThrottleError())
+
+		result, err := withRetry(ctx, h, "TestOp", call)
+
+		assert.NilError(t, err)
+		assert.Equal(t, result, "success")
+		assert.Equal(t, *calls, 3)
+		assert.DeepEqual(
+			t,
+			*delays,
+			[]time.Duration{throttledRetryDelay, 2 * throttledRetryDelay},
+		)
+		assertLogsContain(t, logs, "TestOp throttled, retrying in 250ms: ")
+	})
+
+	t.Run("DoesNotRetryOtherErrors", func(t *testing.T) {
+		h, _, delays, ctx := setup()
+		testErr := errors.New("test error")
+		call, calls := callFailing(testErr)
+
+		_, err := withRetry(ctx, h, "TestOp", call)
+
+		assert.Assert(t, errors.Is(err, testErr))
+		assert.Equal(t, *calls, 1)
+		assert.Equal(t, len(*delays), 0)
+	})
+
+	t.Run("GivesUpAfterMaxAttempts", func(t *testing.T) {
+		h, _, delays, ctx := setup()
+		errs := make([]error, maxThrottledAttempts)
+		for i := range errs {
+			errs[i] = newThrottleError()
+		}
+		call, calls := callFailing(errs...)
+
+		_, err := withRetry(ctx, h, "TestOp", call)
+
+		assert.Assert(t, isThrottleError(err))
+		assert.Equal(t, *calls, maxThrottledAttempts)
+		assert.Equal(t, len(*delays), maxThrottledAttempts-1)
+	})
+
+	t.Run("StopsIfContextIsDone", func(t *testing.T) {
+		h, _, _, ctx := setup()
+		h.Sleep = nil
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		call, calls := callFailing(newThrottleError())
+
+		_, err := withRetry(ctx, h, "TestOp", call)
+
+		assert.ErrorContains(t, err, "TestOp throttled: ")
+		assert.ErrorContains(t, err, " (retry aborted: context canceled)")
+		assert.Assert(t, isThrottleError(err))
+		assert.Assert(t, errors.Is(err, context.Canceled))
+		assert.Equal(t, *calls, 1)
+	})
+}
+
+// blockingClient implements the AWS client interfaces with calls that block
+// until their context is done.
+type blockingClient struct {
+	S3Api
+	SesApi
+	SesV2Api
+}
+
+func (*blockingClient) GetObject(
+	ctx context.Context, _ *s3.GetObjectInput, _ ...func(*s3.Options),
+) (*s3.GetObjectOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (*blockingClient) SendBounce(
+	ctx context.Context, _ *ses.SendBounceInput, _ ...func(*ses.Options),
+) (*ses.SendBounceOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (*blockingClient) SendEmail(
+	ctx context.Context, _ *sesv2.SendEmailInput, _ ...func(*sesv2.Options),
+) (*sesv2.SendEmailOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (*blockingClient) GetEmailIdentity(
+	ctx context.Context,
+	_ *sesv2.GetEmailIdentityInput,
+	_ ...func(*sesv2.Options),
+) (*sesv2.GetEmailIdentityOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (*blockingClient) GetConfigurationSet(
+	ctx context.Context,
+	_ *sesv2.GetConfigurationSetInput,
+	_ ...func(*sesv2.Options),
+) (*sesv2.GetConfigurationSetOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestClientTimeouts(t *testing.T) {
+	const timeout = 10 * time.Millisecond
+
+	setup := func() (*Handler, context.Context) {
+		client := &blockingClient{}
+		h := &Handler{
+			S3: client, Ses: client, SesV2: client, Options: &Options{},
+		}
+		return h, context.Background()
+	}
+
+	t.Run("S3Timeout", func(t *testing.T) {
+		h, ctx := setup()
+		h.Options.S3Timeout = timeout
+
+		orig, err := h.getOriginalMessage(ctx, "incoming/msgId")
+
+		assert.Assert(t, orig == nil)
+		assert.Assert(t, errors.Is(err, context.DeadlineExceeded))
+		var fetchErr *ErrFetch
+		assert.Assert(t, errors.As(err, &fetchErr))
+	})
+
+	t.Run("SesTimeout", func(t *testing.T) {
+		h, ctx := setup()
+		h.Options.SesTimeout = timeout
+
+		_, err := h.sendBounce(ctx, &ses.SendBounceInput{})
+
+		assert.Assert(t, errors.Is(err, context.DeadlineExceeded))
+	})
+
+	t.Run("SesV2Timeout", func(t *testing.T) {
+		h, ctx := setup()
+		h.Options.SesV2Timeout = timeout
+
+		_, err := h.forwardMessage(
+			ctx, []byte("Hello, world!"), h.newRoute([]string{"foo@bar.com"}),
+		)
+
+		assert.Assert(t, errors.Is(err, context.DeadlineExceeded))
+		var forwardErr *ErrForward
+		assert.Assert(t, errors.As(err, &forwardErr))
+	})
+
+	t.Run("SesV2TimeoutAppliesToTlsPolicyCheck", func(t *testing.T) {
+		h, ctx := setup()
+		h.Options.SesV2Timeout = timeout
+		h.Options.RequireTls = true
+
+		err := h.checkTlsPolicy(ctx, "ses-forwarder")
+
+		assert.Assert(t, errors.Is(err, context.DeadlineExceeded))
+	})
+
+	t.Run("SesV2TimeoutAppliesToSenderIdentityCheck", func(t *testing.T) {
+		h, ctx := setup()
+		h.Options.SesV2Timeout = timeout
+
+		_, err := h.verifiedForSending(ctx, "foo.com")
+
+		assert.Assert(t, errors.Is(err, context.DeadlineExceeded))
+	})
+
+	t.Run("TimeoutsAreIndependent", func(t *testing.T) {
+		h, ctx := setup()
+		h.Options.SesTimeout = timeout
+		ctx, cancel := context.WithTimeout(ctx, 20*timeout)
+		defer cancel()
+
+		_, err := h.sendEmail(ctx, &sesv2.SendEmailInput{})
+
+		// Only the caller's deadline applies, since SESV2_TIMEOUT isn't set.
+		assert.Assert(t, errors.Is(err, context.DeadlineExceeded))
+		deadline, _ := ctx.Deadline()
+		assert.Assert(t, !time.Now().Before(deadline))
+	})
+}
@@ -0,0 +1,273 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/mail"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// route specifies the destination addresses, sender address, and SES
+// configuration set used to forward a message.
+//
+// It's also the schema for each entry of the ROUTING_MAP_S3 object, which maps
+// incoming recipient addresses to routes, e.g.:
+//
+//	{
+//	  "sales@foo.com": {
+//	    "to": ["x@y.com"], "sender": "sales-fwd@foo.com", "configSet": "sales"
+//	  },
+//	  "newsletters@foo.com": {"spamVerdicts": ["spam", "virus"]},
+//	  "old-alias@foo.com": {"to": "x@y.com", "enabled": false}
+//	}
+//
+// "to" may be either a list of addresses or a single address string. Any field
+// omitted from an entry falls back to the global setting.
+// SpamVerdicts overrides SPAM_VERDICTS when validating messages to that
+// recipient; it has no effect if SPAM_ACTION is "tag". Setting Enabled to
+// false temporarily disables an entry without deleting it, dropping messages
+// to that recipient instead of forwarding them.
+//
+// Recipients isn't part of the schema. It holds the incoming recipients on
+// whose behalf the message is forwarded. VERP encodes the first of them in the
+// envelope sender.
+type route struct {
+	To           []string `json:"to"`
+	Sender       string   `json:"sender"`
+	ConfigSet    string   `json:"configSet"`
+	SpamVerdicts []string `json:"spamVerdicts"`
+	Enabled      *bool    `json:"enabled"`
+	Recipients   []string `json:"-"`
+}
+
+// UnmarshalJSON parses a routing map entry, accepting either a single address
+// string or a list of addresses for "to".
+func (r *route) UnmarshalJSON(data []byte) error {
+	type routeFields route
+	entry := struct {
+		*routeFields
+		To json.RawMessage `json:"to"`
+	}{routeFields: (*routeFields)(r)}
+
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return err
+	} else if len(entry.To) == 0 || string(entry.To) == "null" {
+		return nil
+	} else if entry.To[0] != '"' {
+		return json.Unmarshal(entry.To, &r.To)
+	}
+
+	var to string
+	if err := json.Unmarshal(entry.To, &to); err != nil {
+		return err
+	}
+	r.To = []string{to}
+	return nil
+}
+
+// disabled returns true only if the entry explicitly sets Enabled to false.
+func (r *route) disabled() bool {
+	return r.Enabled != nil && !*r.Enabled
+}
+
+// routingMapTtl determines how long the routing map retrieved from
+// ROUTING_MAP_S3 remains cached before it's retrieved again.
+// CONFIG_CACHE_TTL overrides it.
+const routingMapTtl = 5 * time.Minute
+
+type routingMapCache struct {
+	mu      sync.Mutex
+	routes  map[string]*route
+	expires time.Time
+}
+
+// newRoute returns a route to the to addresses using the global sender address
+// and configuration set.
+func (h *Handler) newRoute(to []string) *route {
+	return &route{
+		To:        to,
+		Sender:    h.Options.SenderAddress,
+		ConfigSet: h.Options.ConfigurationSet,
+	}
+}
+
+// recipientRoute returns the route for the first incoming recipient with an
+// entry in the ROUTING_MAP_S3 object, with global fallbacks for any fields the
+// entry omits. Without a matching entry, it returns the global route.
+func (h *Handler) recipientRoute(
+	ctx context.Context, recipients []string,
+) (*route, error) {
+	entry, err := h.routingMapEntry(ctx, recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	r := h.newRoute(entry.To)
+	if len(r.To) == 0 {
+		if r.To, err = h.forwardingAddresses(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if entry.Sender != "" {
+		r.Sender = entry.Sender
+	}
+	if entry.ConfigSet != "" {
+		r.ConfigSet = entry.ConfigSet
+	}
+	return r, nil
+}
+
+// addSubjectRoutes appends the Address of every SubjectRoute whose Pattern
+// matches the decoded Subject to r.To, skipping any already present.
+func (h *Handler) addSubjectRoutes(r *route, header mail.Header) {
+	if len(h.Options.SubjectRoutes) == 0 {
+		return
+	}
+
+	subject := header.Get("Subject")
+	if decoded, err := encodedWordDecoder.DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+
+	// Clip r.To so appending never modifies a cached routing map entry or
+	// forwarding list.
+	to := slices.Clip(r.To)
+	for _, sr := range h.Options.SubjectRoutes {
+		isDuplicate := func(addr string) bool {
+			return h.sameAddress(addr, sr.Address)
+		}
+		if sr.Pattern.MatchString(subject) &&
+			!slices.ContainsFunc(to, isDuplicate) {
+			to = append(to, sr.Address)
+		}
+	}
+	r.To = to
+}
+
+func (h *Handler) routingMapEntry(
+	ctx context.Context, recipients []string,
+) (*route, error) {
+	if h.Options.RoutingMapS3 == "" {
+		return &route{}, nil
+	}
+
+	routes, err := h.routingMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	caseSensitive := h.Options.CaseSensitiveLocalpart
+	for _, recipient := range recipients {
+		if entry, ok := routes[normalizeAddress(recipient, caseSensitive)]; ok {
+			return entry, nil
+		}
+	}
+	return &route{}, nil
+}
+
+// routingMap returns the cached ROUTING_MAP_S3 routes, retrieving them again
+// once the cache expires. If retrieving them fails after a prior success, it
+// returns the last good routes, and tries again on the next call.
+func (h *Handler) routingMap(ctx context.Context) (map[string]*route, error) {
+	cache := &h.routingMapCache
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := h.now()
+	if cache.routes != nil && now.Before(cache.expires) {
+		return cache.routes, nil
+	}
+
+	routes, err := h.getRoutingMap(ctx)
+	if err != nil && cache.routes != nil {
+		h.logf(ctx, "WARNING: using last good routing map: %s", err)
+		return cache.routes, nil
+	} else if err != nil {
+		return nil, err
+	}
+	cache.routes = routes
+	cache.expires = now.Add(h.cacheTtl(routingMapTtl))
+	return routes, nil
+}
+
+func (h *Handler) getRoutingMap(
+	ctx context.Context,
+) (routes map[string]*route, err error) {
+	ctx, cancel := withTimeout(ctx, h.Options.S3Timeout)
+	defer cancel()
+
+	input := &s3.GetObjectInput{
+		Bucket:       aws.String(h.Options.BucketName),
+		Key:          aws.String(h.Options.RoutingMapS3),
+		RequestPayer: h.requestPayer(),
+	}
+	var output *s3.GetObjectOutput
+	var content []byte
+
+	if output, err = h.getObject(ctx, input); err == nil {
+		defer output.Body.Close()
+		if content, err = io.ReadAll(output.Body); err == nil {
+			routes, err = parseRoutingMap(
+				content, h.Options.CaseSensitiveLocalpart,
+			)
+		}
+	}
+	if err != nil {
+		err = &ErrFetch{fmt.Errorf("failed to get routing map: %w", err)}
+	}
+	return
+}
+
+// parseRoutingMap parses the JSON routing map, validating every address and
+// normalizing the recipient address keys via normalizeAddress.
+func parseRoutingMap(
+	content []byte, caseSensitiveLocal bool,
+) (map[string]*route, error) {
+	parsed := map[string]*route{}
+	if err := json.Unmarshal(content, &parsed); err != nil {
+		return nil, err
+	}
+
+	routes := make(map[string]*route, len(parsed))
+	for recipient, entry := range parsed {
+		if entry == nil {
+			return nil, fmt.Errorf("%s: entry is null", recipient)
+		} else if err := validateRoute(entry); err != nil {
+			return nil, fmt.Errorf("%s: %w", recipient, err)
+		}
+		routes[normalizeAddress(recipient, caseSensitiveLocal)] = entry
+	}
+	return routes, nil
+}
+
+// validateRoute validates every address in entry. It also lowercases its
+// SpamVerdicts, which are case-insensitive like SPAM_VERDICTS.
+func validateRoute(entry *route) error {
+	for _, addr := range entry.To {
+		if _, err := mail.ParseAddress(addr); err != nil {
+			return fmt.Errorf("invalid to address %s: %w", addr, err)
+		}
+	}
+	for i, verdict := range entry.SpamVerdicts {
+		if verdict = strings.ToLower(verdict); !slices.Contains(
+			SpamVerdicts, verdict,
+		) {
+			return fmt.Errorf("invalid spam verdict: %s", verdict)
+		}
+		entry.SpamVerdicts[i] = verdict
+	}
+	if entry.Sender == "" {
+		return nil
+	} else if _, err := mail.ParseAddress(entry.Sender); err != nil {
+		return fmt.Errorf("invalid sender %s: %w", entry.Sender, err)
+	}
+	return nil
+}
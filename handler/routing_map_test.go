@@ -0,0 +1,580 @@
+//go:build small_tests || all_tests
+
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/mbland/ses-forwarder/handler/handlertest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+const routingMapKey = "config/routing-map.json"
+
+const routingMap = `{
+  "Sales@xyzzy.com": {
+    "to": ["x@y.com", "z@y.com"],
+    "sender": "sales-fwd@xyzzy.com",
+    "configSet": "sales"
+  },
+  "support@xyzzy.com": {"configSet": "support"},
+  "info@xyzzy.com": {"to": ["info-team@y.com"]}
+}`
+
+func TestParseRoutingMap(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		routes, err := parseRoutingMap([]byte(routingMap), false)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(
+			t,
+			routes,
+			map[string]*route{
+				"sales@xyzzy.com": {
+					To:        []string{"x@y.com", "z@y.com"},
+					Sender:    "sales-fwd@xyzzy.com",
+					ConfigSet: "sales",
+				},
+				"support@xyzzy.com": {ConfigSet: "support"},
+				"info@xyzzy.com":    {To: []string{"info-team@y.com"}},
+			},
+		)
+	})
+
+	t.Run("AcceptsToAsStringOrList", func(t *testing.T) {
+		content := []byte(`{
+  "one@xyzzy.com": {"to": "x@y.com"},
+  "many@xyzzy.com": {"to": ["x@y.com", "z@y.com"]},
+  "none@xyzzy.com": {"to": null}
+}`)
+
+		routes, err := parseRoutingMap(content, false)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(
+			t,
+			routes,
+			map[string]*route{
+				"one@xyzzy.com":  {To: []string{"x@y.com"}},
+				"many@xyzzy.com": {To: []string{"x@y.com", "z@y.com"}},
+				"none@xyzzy.com": {},
+			},
+		)
+	})
+
+	t.Run("ErrorsIfToIsNotStringOrList", func(t *testing.T) {
+		content := []byte(`{"sales@xyzzy.com": {"to": 42}}`)
+
+		routes, err := parseRoutingMap(content, false)
+
+		assert.Assert(t, routes == nil)
+		assert.ErrorContains(t, err, "cannot unmarshal number")
+	})
+
+	t.Run("ParsesEnabled", func(t *testing.T) {
+		content := []byte(`{
+  "old@xyzzy.com": {"enabled": false},
+  "new@xyzzy.com": {"enabled": true}
+}`)
+
+		routes, err := parseRoutingMap(content, false)
+
+		assert.NilError(t, err)
+		assert.Assert(t, routes["old@xyzzy.com"].disabled())
+		assert.Assert(t, !routes["new@xyzzy.com"].disabled())
+		assert.Assert(t, !(&route{}).disabled())
+	})
+
+	t.Run("PreservesLocalPartCaseIfCaseSensitive", func(t *testing.T) {
+		routes, err := parseRoutingMap([]byte(routingMap), true)
+
+		assert.NilError(t, err)
+		assert.Assert(t, routes["Sales@xyzzy.com"] != nil)
+		assert.Assert(t, is.Nil(routes["sales@xyzzy.com"]))
+	})
+
+	t.Run("ErrorsIfNotJson", func(t *testing.T) {
+		content := []byte("sales@xyzzy.com: x@y.com")
+
+		routes, err := parseRoutingMap(content, false)
+
+		assert.Assert(t, routes == nil)
+		assert.ErrorContains(t, err, "invalid character")
+	})
+
+	t.Run("ErrorsIfEntryIsNull", func(t *testing.T) {
+		content := []byte(`{"sales@xyzzy.com": null}`)
+
+		routes, err := parseRoutingMap(content, false)
+
+		assert.Assert(t, routes == nil)
+		assert.ErrorContains(t, err, "sales@xyzzy.com: entry is null")
+	})
+
+	t.Run("ErrorsIfToAddressInvalid", func(t *testing.T) {
+		content := `{"sales@xyzzy.com": {"to": ["not valid"]}}`
+
+		routes, err := parseRoutingMap([]byte(content), false)
+
+		assert.Assert(t, routes == nil)
+		expected := "sales@xyzzy.com: invalid to address not valid: "
+		assert.ErrorContains(t, err, expected)
+	})
+
+	t.Run("ParsesSpamVerdicts", func(t *testing.T) {
+		content := `{"news@xyzzy.com": {"spamVerdicts": ["spam", "virus"]}}`
+
+		routes, err := parseRoutingMap([]byte(content), false)
+
+		assert.NilError(t, err)
+		expected := []string{SpamVerdictSpam, SpamVerdictVirus}
+		assert.DeepEqual(t, routes["news@xyzzy.com"].SpamVerdicts, expected)
+	})
+
+	t.Run("LowercasesSpamVerdicts", func(t *testing.T) {
+		content := `{"news@xyzzy.com": {"spamVerdicts": ["SPF", "Dkim"]}}`
+
+		routes, err := parseRoutingMap([]byte(content), false)
+
+		assert.NilError(t, err)
+		expected := []string{SpamVerdictSpf, SpamVerdictDkim}
+		assert.DeepEqual(t, routes["news@xyzzy.com"].SpamVerdicts, expected)
+	})
+
+	t.Run("ErrorsIfSpamVerdictInvalid", func(t *testing.T) {
+		content := `{"news@xyzzy.com": {"spamVerdicts": ["spf", "DMARC"]}}`
+
+		routes, err := parseRoutingMap([]byte(content), false)
+
+		assert.Assert(t, routes == nil)
+		assert.Error(t, err, "news@xyzzy.com: invalid spam verdict: dmarc")
+	})
+
+	t.Run("ErrorsIfSenderInvalid", func(t *testing.T) {
+		content := `{"sales@xyzzy.com": {"sender": "not valid"}}`
+
+		routes, err := parseRoutingMap([]byte(content), false)
+
+		assert.Assert(t, routes == nil)
+		expected := "sales@xyzzy.com: invalid sender not valid: "
+		assert.ErrorContains(t, err, expected)
+	})
+}
+
+func TestRecipientRoute(t *testing.T) {
+	setup := func() (
+		*handlertest.S3, *Handler, *time.Time, context.Context,
+	) {
+		objS3 := &handlertest.S3{
+			Objects: map[string][]byte{routingMapKey: []byte(routingMap)},
+		}
+		now := time.Date(1970, time.September, 18, 12, 45, 0, 0, time.UTC)
+		h := &Handler{
+			S3: objS3,
+			Options: &Options{
+				BucketName:        "mail.xyzzy.com",
+				SenderAddress:     "fwd@xyzzy.com",
+				ForwardingAddress: "quux@xyzzy.com",
+				ConfigurationSet:  "default",
+				RoutingMapS3:      routingMapKey,
+			},
+			Now: func() time.Time { return now },
+		}
+		return objS3, h, &now, context.Background()
+	}
+
+	t.Run("ReturnsGlobalRouteIfNoMapConfigured", func(t *testing.T) {
+		objS3, h, _, ctx := setup()
+		h.Options.RoutingMapS3 = ""
+
+		r, err := h.recipientRoute(ctx, []string{"sales@xyzzy.com"})
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, r, h.newRoute([]string{"quux@xyzzy.com"}))
+		assert.Equal(t, len(objS3.GetObjectInputs), 0)
+	})
+
+	t.Run("AppliesFullOverride", func(t *testing.T) {
+		_, h, _, ctx := setup()
+
+		r, err := h.recipientRoute(ctx, []string{"sales@XYZZY.com"})
+
+		assert.NilError(t, err)
+		assert.DeepEqual(
+			t,
+			r,
+			&route{
+				To:        []string{"x@y.com", "z@y.com"},
+				Sender:    "sales-fwd@xyzzy.com",
+				ConfigSet: "sales",
+			},
+		)
+	})
+
+	t.Run("MatchesMixedCaseRecipient", func(t *testing.T) {
+		_, h, _, ctx := setup()
+
+		r, err := h.recipientRoute(ctx, []string{"SALES@Xyzzy.com"})
+
+		assert.NilError(t, err)
+		assert.Equal(t, r.ConfigSet, "sales")
+	})
+
+	t.Run("MatchesLocalPartCaseIfCaseSensitive", func(t *testing.T) {
+		_, h, _, ctx := setup()
+		h.Options.CaseSensitiveLocalpart = true
+
+		r, err := h.recipientRoute(ctx, []string{"SALES@xyzzy.com"})
+
+		assert.NilError(t, err)
+		assert.Equal(t, r.ConfigSet, "default")
+
+		r, err = h.recipientRoute(ctx, []string{"Sales@XYZZY.com"})
+
+		assert.NilError(t, err)
+		assert.Equal(t, r.ConfigSet, "sales")
+	})
+
+	t.Run("AppliesPartialOverride", func(t *testing.T) {
+		_, h, _, ctx := setup()
+
+		r, err := h.recipientRoute(ctx, []string{"support@xyzzy.com"})
+
+		assert.NilError(t, err)
+		assert.DeepEqual(
+			t,
+			r,
+			&route{
+				To:        []string{"quux@xyzzy.com"},
+				Sender:    "fwd@xyzzy.com",
+				ConfigSet: "support",
+			},
+		)
+	})
+
+	t.Run("AppliesDestinationOnlyOverride", func(t *testing.T) {
+		_, h, _, ctx := setup()
+
+		r, err := h.recipientRoute(ctx, []string{"info@xyzzy.com"})
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, r, h.newRoute([]string{"info-team@y.com"}))
+	})
+
+	t.Run("UsesFirstRecipientWithAnEntry", func(t *testing.T) {
+		_, h, _, ctx := setup()
+		recipients := []string{
+			"nobody@xyzzy.com", "info@xyzzy.com", "sales@xyzzy.com",
+		}
+
+		r, err := h.recipientRoute(ctx, recipients)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, r.To, []string{"info-team@y.com"})
+	})
+
+	t.Run("ReturnsGlobalRouteIfNoEntryMatches", func(t *testing.T) {
+		_, h, _, ctx := setup()
+
+		r, err := h.recipientRoute(ctx, []string{"nobody@xyzzy.com"})
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, r, h.newRoute([]string{"quux@xyzzy.com"}))
+	})
+
+	t.Run("CachesMapUntilTtlExpires", func(t *testing.T) {
+		objS3, h, now, ctx := setup()
+		recipients := []string{"info@xyzzy.com"}
+
+		_, err := h.recipientRoute(ctx, recipients)
+		assert.NilError(t, err)
+		objS3.Objects[routingMapKey] = []byte("{}")
+		*now = now.Add(routingMapTtl - time.Second)
+
+		r, err := h.recipientRoute(ctx, recipients)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, r.To, []string{"info-team@y.com"})
+		assert.Equal(t, len(objS3.GetObjectInputs), 1)
+
+		*now = now.Add(time.Second)
+
+		r, err = h.recipientRoute(ctx, recipients)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, r.To, []string{"quux@xyzzy.com"})
+		assert.Equal(t, len(objS3.GetObjectInputs), 2)
+	})
+
+	t.Run("KeepsLastGoodMapIfRefreshFails", func(t *testing.T) {
+		objS3, h, now, ctx := setup()
+		logs, logger := testLogger()
+		h.Log = logger
+		recipients := []string{"info@xyzzy.com"}
+
+		_, err := h.recipientRoute(ctx, recipients)
+		assert.NilError(t, err)
+		objS3.Objects[routingMapKey] = []byte("not JSON")
+		*now = now.Add(routingMapTtl)
+
+		r, err := h.recipientRoute(ctx, recipients)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, r.To, []string{"info-team@y.com"})
+		assert.Equal(t, len(objS3.GetObjectInputs), 2)
+		assertLogsContain(
+			t, logs, "WARNING: using last good routing map: "+
+				"failed to get routing map: invalid character",
+		)
+
+		objS3.Objects[routingMapKey] = []byte("{}")
+
+		r, err = h.recipientRoute(ctx, recipients)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, r.To, []string{"quux@xyzzy.com"})
+		assert.Equal(t, len(objS3.GetObjectInputs), 3)
+	})
+
+	t.Run("ErrorsIfGettingMapFails", func(t *testing.T) {
+		objS3, h, _, ctx := setup()
+		delete(objS3.Objects, routingMapKey)
+
+		r, err := h.recipientRoute(ctx, []string{"sales@xyzzy.com"})
+
+		assert.Assert(t, is.Nil(r))
+		expected := "failed to get routing map: NoSuchKey: no such key"
+		assert.ErrorContains(t, err, expected)
+		assert.Assert(t, errors.Is(err, handlertest.ErrNoSuchKey))
+		var fetchErr *ErrFetch
+		assert.Assert(t, errors.As(err, &fetchErr))
+	})
+}
+
+func TestValidateMessageUsingRecipientSpamVerdicts(t *testing.T) {
+	const spamPolicyMap = `{
+  "newsletters@xyzzy.com": {"spamVerdicts": ["spam", "virus"]},
+  "banking@xyzzy.com": {"configSet": "banking"}
+}`
+	setup := func(
+		recipient string,
+	) (*handlertest.S3, *Handler, *events.SimpleEmailService) {
+		objS3 := &handlertest.S3{
+			Objects: map[string][]byte{routingMapKey: []byte(spamPolicyMap)},
+		}
+		h := &Handler{
+			S3: objS3,
+			Options: &Options{
+				BucketName:   "mail.xyzzy.com",
+				RoutingMapS3: routingMapKey,
+			},
+		}
+		sesInfo := passingSesInfo()
+		sesInfo.Receipt.Recipients = []string{recipient}
+		sesInfo.Receipt.SPFVerdict.Status = "FAIL"
+		return objS3, h, sesInfo
+	}
+
+	t.Run("AcceptsSpfFailureForRecipientExcludingSpf", func(t *testing.T) {
+		_, h, sesInfo := setup("Newsletters@xyzzy.com")
+
+		err := h.validateMessage(context.Background(), sesInfo)
+
+		assert.NilError(t, err)
+	})
+
+	t.Run("RejectsSpfFailureForRecipientUsingGlobalPolicy", func(t *testing.T) {
+		_, h, sesInfo := setup("banking@xyzzy.com")
+
+		err := h.validateMessage(context.Background(), sesInfo)
+
+		assert.Error(t, err, "marked as spam, ignoring")
+	})
+
+	t.Run("RejectsVirusForRecipientExcludingSpf", func(t *testing.T) {
+		_, h, sesInfo := setup("newsletters@xyzzy.com")
+		sesInfo.Receipt.SPFVerdict.Status = "PASS"
+		sesInfo.Receipt.VirusVerdict.Status = "FAIL"
+
+		err := h.validateMessage(context.Background(), sesInfo)
+
+		assert.Error(t, err, "marked as spam, ignoring")
+	})
+
+	t.Run("ErrorsIfGettingRoutingMapFails", func(t *testing.T) {
+		objS3, h, sesInfo := setup("newsletters@xyzzy.com")
+		delete(objS3.Objects, routingMapKey)
+
+		err := h.validateMessage(context.Background(), sesInfo)
+
+		var fetchErr *ErrFetch
+		assert.Assert(t, errors.As(err, &fetchErr))
+		assert.ErrorContains(t, err, "failed to get routing map: ")
+	})
+}
+
+func TestValidateMessageUsingRecipientEnabled(t *testing.T) {
+	const enabledMap = `{
+  "old-alias@xyzzy.com": {"to": ["x@y.com"], "enabled": false},
+  "new-alias@xyzzy.com": {"to": ["x@y.com"], "enabled": true}
+}`
+	setup := func(
+		recipient string,
+	) (*TestLogs, *Handler, *events.SimpleEmailService) {
+		logs, logger := testLogger()
+		h := &Handler{
+			S3: &handlertest.S3{
+				Objects: map[string][]byte{routingMapKey: []byte(enabledMap)},
+			},
+			Options: &Options{
+				BucketName:   "mail.xyzzy.com",
+				RoutingMapS3: routingMapKey,
+			},
+			Log: logger,
+		}
+		sesInfo := passingSesInfo()
+		sesInfo.Receipt.Recipients = []string{recipient}
+		return logs, h, sesInfo
+	}
+
+	t.Run("AcceptsEnabledEntry", func(t *testing.T) {
+		_, h, sesInfo := setup("new-alias@xyzzy.com")
+
+		err := h.validateMessage(context.Background(), sesInfo)
+
+		assert.NilError(t, err)
+	})
+
+	t.Run("AcceptsRecipientWithoutEntry", func(t *testing.T) {
+		_, h, sesInfo := setup("other@xyzzy.com")
+
+		err := h.validateMessage(context.Background(), sesInfo)
+
+		assert.NilError(t, err)
+	})
+
+	t.Run("DropsDisabledEntry", func(t *testing.T) {
+		logs, h, sesInfo := setup("Old-Alias@xyzzy.com")
+
+		err := h.validateMessage(context.Background(), sesInfo)
+
+		assert.Error(t, err, "routing map entry disabled, dropping")
+		var validationErr *ErrValidation
+		assert.Assert(t, errors.As(err, &validationErr))
+		assertLogsContain(
+			t, logs, "ROUTING_MAP_S3 entry disabled, not forwarding",
+		)
+	})
+}
+
+func TestForwardUsingRoutingMap(t *testing.T) {
+	f := newHandleEventFixture()
+	f.h.Options.RoutingMapS3 = routingMapKey
+	f.h.Options.SetSesFrom = true
+	f.h.S3 = &handlertest.S3{
+		Objects: map[string][]byte{
+			"incoming/deadbeef": testMsg,
+			routingMapKey:       []byte(routingMap),
+		},
+	}
+	f.event.Records[0].SES.Receipt.Recipients = []string{"sales@xyzzy.com"}
+
+	_, err := f.h.HandleEvent(context.Background(), f.event)
+
+	assert.NilError(t, err)
+	input := f.sesv2.sendEmailInput
+	assert.DeepEqual(
+		t, input.Destination.ToAddresses, []string{"x@y.com", "z@y.com"},
+	)
+	assert.Equal(t, *input.ConfigurationSetName, "sales")
+	assert.Equal(t, *input.FromEmailAddress, "sales-fwd@xyzzy.com")
+	expectedFrom := "From: Mike Bland - mbland at acm.org " +
+		"<sales-fwd@xyzzy.com>\r\n"
+	assert.Assert(t, is.Contains(string(input.Content.Raw.Data), expectedFrom))
+}
+
+func TestAddSubjectRoutes(t *testing.T) {
+	setup := func() (*Handler, *route) {
+		opts := &Options{
+			SubjectRoutes: []SubjectRoute{
+				{regexp.MustCompile(`\[URGENT\]`), "pager@foo.com"},
+				{regexp.MustCompile(`(?i)invoice`), "billing@foo.com"},
+			},
+		}
+		return &Handler{Options: opts}, &route{To: []string{"me@foo.com"}}
+	}
+
+	t.Run("AddsMatchingDestinations", func(t *testing.T) {
+		h, r := setup()
+		header := mail.Header{"Subject": {"[URGENT] Invoice overdue"}}
+
+		h.addSubjectRoutes(r, header)
+
+		expected := []string{"me@foo.com", "pager@foo.com", "billing@foo.com"}
+		assert.DeepEqual(t, r.To, expected)
+	})
+
+	t.Run("LeavesDestinationsUnchangedIfNoMatch", func(t *testing.T) {
+		h, r := setup()
+		header := mail.Header{"Subject": {"Lunch?"}}
+
+		h.addSubjectRoutes(r, header)
+
+		assert.DeepEqual(t, r.To, []string{"me@foo.com"})
+	})
+
+	t.Run("MatchesDecodedSubject", func(t *testing.T) {
+		h, r := setup()
+		header := mail.Header{"Subject": {"=?UTF-8?Q?=5BURGENT=5D_help?="}}
+
+		h.addSubjectRoutes(r, header)
+
+		assert.DeepEqual(t, r.To, []string{"me@foo.com", "pager@foo.com"})
+	})
+
+	t.Run("SkipsDuplicateDestination", func(t *testing.T) {
+		h, r := setup()
+		r.To = []string{"Pager@foo.com"}
+		header := mail.Header{"Subject": {"[URGENT] help"}}
+
+		h.addSubjectRoutes(r, header)
+
+		assert.DeepEqual(t, r.To, []string{"Pager@foo.com"})
+	})
+
+	t.Run("DoesNotModifyOriginalDestinations", func(t *testing.T) {
+		h, r := setup()
+		cached := make([]string, 1, 2)
+		cached[0] = "me@foo.com"
+		r.To = cached
+		header := mail.Header{"Subject": {"[URGENT] help"}}
+
+		h.addSubjectRoutes(r, header)
+
+		assert.DeepEqual(t, r.To, []string{"me@foo.com", "pager@foo.com"})
+		assert.Equal(t, cached[:2][1], "")
+	})
+}
+
+func TestForwardUsingSubjectRoutes(t *testing.T) {
+	f := newHandleEventFixture()
+	f.h.Options.SubjectRoutes = []SubjectRoute{
+		{regexp.MustCompile(`unit test`), "pager@bar.com"},
+	}
+
+	_, err := f.h.HandleEvent(context.Background(), f.event)
+
+	assert.NilError(t, err)
+	assert.DeepEqual(
+		t,
+		f.sesv2.sendEmailInput.Destination.ToAddresses,
+		[]string{"foo@bar.com", "pager@bar.com"},
+	)
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// sendRateLimiter is a token bucket pacing forwardMessage calls to
+// SEND_RATE_PER_SEC, so a large batch doesn't exceed the SES maximum send
+// rate.
+//
+// The bucket holds up to max(rate, 1) tokens, so up to a second's worth of
+// sends may proceed at once. Each reservation takes a token even if none is
+// left, leaving a deficit that later reservations wait to refill. Its zero
+// value is ready to use.
+//
+// - https://docs.aws.amazon.com/ses/latest/dg/manage-sending-quotas.html
+type sendRateLimiter struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes a token at the given rate, returning how long to wait before
+// sending.
+func (l *sendRateLimiter) reserve(now time.Time, rate float64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	burst := max(rate, 1)
+
+	if l.last.IsZero() {
+		l.tokens = burst
+	} else if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens = min(burst, l.tokens+elapsed.Seconds()*rate)
+	}
+	if now.After(l.last) {
+		l.last = now
+	}
+
+	if l.tokens--; l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / rate * float64(time.Second))
+}
+
+// cancel returns the token taken by a reservation that wasn't used.
+func (l *sendRateLimiter) cancel() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens++
+}
+
+// waitToSend blocks until SendRatePerSec permits another send. It returns an
+// error without waiting if the wait would outlast the ctx deadline, or if ctx
+// is done first. It never waits if SendRatePerSec is zero.
+func (h *Handler) waitToSend(ctx context.Context) error {
+	rate := h.Options.SendRatePerSec
+	if rate == 0 {
+		return nil
+	}
+
+	now := h.now()
+	wait := h.sendRate.reserve(now, rate)
+	if wait == 0 {
+		return nil
+	}
+
+	err := context.DeadlineExceeded
+	if deadline, ok := ctx.Deadline(); ok && now.Add(wait).After(deadline) {
+		h.sendRate.cancel()
+	} else if err = h.sleep(ctx, wait); err != nil {
+		h.sendRate.cancel()
+	} else {
+		return nil
+	}
+	return fmt.Errorf("waiting %s for SEND_RATE_PER_SEC: %w", wait, err)
+}
@@ -0,0 +1,130 @@
+//go:build small_tests || all_tests
+
+package handler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestSendRateLimiter(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	t.Run("AllowsBurstUpToRateThenSpacesReservations", func(t *testing.T) {
+		l := &sendRateLimiter{}
+
+		assert.Equal(t, l.reserve(start, 2), time.Duration(0))
+		assert.Equal(t, l.reserve(start, 2), time.Duration(0))
+		assert.Equal(t, l.reserve(start, 2), 500*time.Millisecond)
+		assert.Equal(t, l.reserve(start, 2), time.Second)
+	})
+
+	t.Run("RefillsOverTime", func(t *testing.T) {
+		l := &sendRateLimiter{}
+
+		assert.Equal(t, l.reserve(start, 1), time.Duration(0))
+		assert.Equal(t, l.reserve(start, 1), time.Second)
+		later := start.Add(3 * time.Second)
+		assert.Equal(t, l.reserve(later, 1), time.Duration(0))
+	})
+
+	t.Run("CancelReturnsToken", func(t *testing.T) {
+		l := &sendRateLimiter{}
+		l.reserve(start, 1)
+		l.reserve(start, 1)
+
+		l.cancel()
+
+		assert.Equal(t, l.reserve(start, 1), time.Second)
+	})
+}
+
+func TestForwardMessagePacedBySendRate(t *testing.T) {
+	start := time.Now()
+
+	setup := func() (*TestSesV2, *Handler, *[]time.Duration) {
+		testSesV2 := &TestSesV2{sendEmailOutput: &sesv2.SendEmailOutput{}}
+		sleeps := []time.Duration{}
+		h := &Handler{
+			SesV2:   testSesV2,
+			Options: &Options{ConfigurationSet: "ses-forwarder"},
+			Now:     func() time.Time { return start },
+			Sleep: func(_ context.Context, d time.Duration) error {
+				sleeps = append(sleeps, d)
+				return nil
+			},
+		}
+		return testSesV2, h, &sleeps
+	}
+
+	forward := func(ctx context.Context, h *Handler, n int) error {
+		for i := 0; i < n; i++ {
+			_, err := h.forwardMessage(
+				ctx, []byte("Hello, world!"),
+				h.newRoute([]string{"foo@bar.com"}),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	t.Run("SpacesCallsIfRateIsLow", func(t *testing.T) {
+		testSesV2, h, sleeps := setup()
+		h.Options.SendRatePerSec = 1
+
+		err := forward(context.Background(), h, 3)
+
+		assert.NilError(t, err)
+		assert.Equal(t, testSesV2.sendEmailCalls, 3)
+		expected := []time.Duration{time.Second, 2 * time.Second}
+		assert.DeepEqual(t, *sleeps, expected)
+	})
+
+	t.Run("DoesNotThrottleIfUnset", func(t *testing.T) {
+		testSesV2, h, sleeps := setup()
+
+		err := forward(context.Background(), h, 10)
+
+		assert.NilError(t, err)
+		assert.Equal(t, testSesV2.sendEmailCalls, 10)
+		assert.Assert(t, is.Len(*sleeps, 0))
+	})
+
+	t.Run("ErrorsIfWaitWouldExceedDeadline", func(t *testing.T) {
+		testSesV2, h, sleeps := setup()
+		h.Options.SendRatePerSec = 1
+		ctx, cancel := context.WithDeadline(
+			context.Background(), start.Add(1500*time.Millisecond),
+		)
+		defer cancel()
+
+		err := forward(ctx, h, 3)
+
+		assert.ErrorContains(t, err, "waiting 2s for SEND_RATE_PER_SEC: ")
+		assert.Assert(t, errors.Is(err, context.DeadlineExceeded))
+		var forwardErr *ErrForward
+		assert.Assert(t, errors.As(err, &forwardErr))
+		assert.Equal(t, testSesV2.sendEmailCalls, 2)
+		assert.DeepEqual(t, *sleeps, []time.Duration{time.Second})
+	})
+
+	t.Run("ErrorsIfContextDoneWhileWaiting", func(t *testing.T) {
+		_, h, _ := setup()
+		h.Options.SendRatePerSec = 1
+		h.Sleep = nil
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := forward(ctx, h, 2)
+
+		assert.Assert(t, errors.Is(err, context.Canceled))
+	})
+}
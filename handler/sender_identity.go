@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+)
+
+// ErrSenderIdentityNotVerified indicates that VALIDATE_SENDER_IDENTITY is set,
+// but the SENDER_ADDRESS domain isn't verified for sending in SES. Every
+// forwarded message would fail to send.
+//
+// - https://docs.aws.amazon.com/ses/latest/dg/creating-identities.html
+var ErrSenderIdentityNotVerified = errors.New(
+	"sender identity not verified for sending",
+)
+
+// senderIdentityTtl determines how long keepOriginalFrom caches whether a From
+// domain is verified for sending before checking it again. CONFIG_CACHE_TTL
+// overrides it.
+const senderIdentityTtl = 5 * time.Minute
+
+type senderIdentityCache struct {
+	mu      sync.Mutex
+	domains map[string]senderIdentity
+}
+
+type senderIdentity struct {
+	verified bool
+	expires  time.Time
+}
+
+// ValidateSenderIdentity ensures that the SENDER_ADDRESS domain is a verified
+// SES identity enabled for sending when VALIDATE_SENDER_IDENTITY is set. It's
+// meant to be called once at startup, so the function fails fast instead of
+// failing to forward every message.
+func (h *Handler) ValidateSenderIdentity(ctx context.Context) error {
+	if !h.Options.ValidateSenderIdentity {
+		return nil
+	}
+
+	addr, err := mail.ParseAddress(h.Options.SenderAddress)
+	if err != nil {
+		return fmt.Errorf("invalid SENDER_ADDRESS: %w", err)
+	}
+	_, domain, _ := cutLast(addr.Address, "@")
+	input := &sesv2.GetEmailIdentityInput{EmailIdentity: aws.String(domain)}
+	output, err := h.getEmailIdentity(ctx, input)
+
+	if err != nil {
+		return fmt.Errorf("failed to get SES identity %s: %w", domain, err)
+	} else if !output.VerifiedForSendingStatus {
+		return fmt.Errorf(
+			"%w: SENDER_ADDRESS domain %s has verification status %q",
+			ErrSenderIdentityNotVerified, domain, output.VerificationStatus,
+		)
+	}
+	return nil
+}
+
+// keepOriginalFrom returns true if the message is aligned and the domain of
+// its From address is a verified SES identity enabled for sending. SES won't
+// send a message from any other domain, so keepOriginalFrom returns false,
+// and the From header is rewritten as usual, if it can't confirm both.
+func (h *Handler) keepOriginalFrom(
+	ctx context.Context, header mail.Header, receipt *events.SimpleEmailReceipt,
+) bool {
+	if !isAligned(receipt) {
+		return false
+	}
+
+	addr, err := mail.ParseAddress(header.Get("From"))
+	if err != nil {
+		return false
+	}
+	_, domain, _ := cutLast(addr.Address, "@")
+	verified, err := h.verifiedForSending(ctx, domain)
+
+	if err != nil {
+		h.logf(
+			ctx, "failed to get SES identity %s, rewriting From: %s",
+			domain, err,
+		)
+		return false
+	}
+	return verified
+}
+
+// verifiedForSending returns whether domain is a verified SES identity enabled
+// for sending, caching the result. Errors aren't cached, so the next message
+// from domain checks again.
+func (h *Handler) verifiedForSending(
+	ctx context.Context, domain string,
+) (bool, error) {
+	cache := &h.senderIdentityCache
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := h.now()
+	if id, ok := cache.domains[domain]; ok && now.Before(id.expires) {
+		return id.verified, nil
+	}
+
+	input := &sesv2.GetEmailIdentityInput{EmailIdentity: aws.String(domain)}
+	output, err := h.getEmailIdentity(ctx, input)
+	if err != nil {
+		return false, err
+	}
+	if cache.domains == nil {
+		cache.domains = map[string]senderIdentity{}
+	}
+	cache.domains[domain] = senderIdentity{
+		verified: output.VerifiedForSendingStatus,
+		expires:  now.Add(h.cacheTtl(senderIdentityTtl)),
+	}
+	return output.VerifiedForSendingStatus, nil
+}
@@ -0,0 +1,80 @@
+//go:build small_tests || all_tests
+
+package handler
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	sesv2types "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+	"github.com/mbland/ses-forwarder/handler/handlertest"
+	"gotest.tools/assert"
+)
+
+func TestValidateSenderIdentity(t *testing.T) {
+	setup := func() (*handlertest.SesV2, *Handler, context.Context) {
+		fake := &handlertest.SesV2{
+			VerificationStatus: sesv2types.VerificationStatusSuccess,
+		}
+		opts := &Options{
+			SenderAddress:          "Forwarder <inbox@foo.com>",
+			ValidateSenderIdentity: true,
+		}
+		return fake, &Handler{SesV2: fake, Options: opts}, context.Background()
+	}
+
+	t.Run("SkipsCheckIfNotEnabled", func(t *testing.T) {
+		fake, h, ctx := setup()
+		h.Options.ValidateSenderIdentity = false
+
+		err := h.ValidateSenderIdentity(ctx)
+
+		assert.NilError(t, err)
+		assert.Equal(t, len(fake.GetEmailIdentityInputs), 0)
+	})
+
+	t.Run("SucceedsIfDomainVerified", func(t *testing.T) {
+		fake, h, ctx := setup()
+
+		err := h.ValidateSenderIdentity(ctx)
+
+		assert.NilError(t, err)
+		assert.Equal(t, len(fake.GetEmailIdentityInputs), 1)
+		input := fake.GetEmailIdentityInputs[0]
+		assert.Equal(t, *input.EmailIdentity, "foo.com")
+	})
+
+	t.Run("ErrorsIfDomainNotVerified", func(t *testing.T) {
+		fake, h, ctx := setup()
+		fake.VerificationStatus = sesv2types.VerificationStatusPending
+
+		err := h.ValidateSenderIdentity(ctx)
+
+		assert.Assert(t, errors.Is(err, ErrSenderIdentityNotVerified))
+		expected := "sender identity not verified for sending: " +
+			`SENDER_ADDRESS domain foo.com has verification status "PENDING"`
+		assert.Error(t, err, expected)
+	})
+
+	t.Run("ErrorsIfGetEmailIdentityFails", func(t *testing.T) {
+		fake, h, ctx := setup()
+		fake.GetEmailIdentityErr = errors.New("not found")
+
+		err := h.ValidateSenderIdentity(ctx)
+
+		assert.Assert(t, errors.Is(err, fake.GetEmailIdentityErr))
+		expected := "failed to get SES identity foo.com: not found"
+		assert.Error(t, err, expected)
+	})
+
+	t.Run("ErrorsIfSenderAddressInvalid", func(t *testing.T) {
+		fake, h, ctx := setup()
+		h.Options.SenderAddress = "inbox"
+
+		err := h.ValidateSenderIdentity(ctx)
+
+		assert.ErrorContains(t, err, "invalid SENDER_ADDRESS: ")
+		assert.Equal(t, len(fake.GetEmailIdentityInputs), 0)
+	})
+}
@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+)
+
+// textTransform returns the rewritten content of a text/plain or text/html
+// part, after decoding its Content-Transfer-Encoding. It returns content
+// unchanged if there's nothing to rewrite.
+type textTransform func(mediaType string, content []byte) []byte
+
+// transformTextParts applies transform to the decoded content of every
+// text/plain and text/html part of a message, recursing into nested
+// multipart parts.
+//
+// Rewritten parts are reencoded as quoted-printable, updating the
+// Content-Transfer-Encoding in header or in the part's own header. Attachments
+// and parts of other types remain unchanged.
+//
+// Returns body without reading it if the message is neither text nor
+// multipart.
+func transformTextParts(
+	header mail.Header, body io.Reader, transform textTransform,
+) (io.Reader, error) {
+	contentType := header.Get("Content-Type")
+	if _, ok := textMediaType(contentType); !ok && !isMultipart(contentType) {
+		return body, nil
+	}
+
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	cte := header.Get("Content-Transfer-Encoding")
+	cte, content, changed, err := transformEntity(
+		contentType, cte, content, transform,
+	)
+	if err != nil {
+		return nil, &ErrTransform{err}
+	} else if changed {
+		header["Content-Transfer-Encoding"] = []string{cte}
+	}
+	return bytes.NewReader(content), nil
+}
+
+// textMediaType returns the media type and true for text/plain and text/html
+// content types. An empty content type is text/plain by default.
+//
+// - https://www.rfc-editor.org/rfc/rfc2045#section-5.2
+func textMediaType(contentType string) (string, bool) {
+	if contentType == "" {
+		return "text/plain", true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	isText := mediaType == "text/plain" || mediaType == "text/html"
+	return mediaType, err == nil && isText
+}
+
+func isMultipart(contentType string) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	return err == nil && strings.HasPrefix(mediaType, "multipart/") &&
+		params["boundary"] != ""
+}
+
+func transformEntity(
+	contentType, cte string, content []byte, transform textTransform,
+) (newCte string, result []byte, changed bool, err error) {
+	if mediaType, ok := textMediaType(contentType); ok {
+		decoded, err := io.ReadAll(
+			decodeTransferEncoding(cte, bytes.NewReader(content)),
+		)
+		if err != nil {
+			return "", nil, false, err
+		}
+		transformed := transform(mediaType, decoded)
+		if bytes.Equal(transformed, decoded) {
+			return cte, content, false, nil
+		}
+		return "quoted-printable", encodeQuotedPrintable(transformed), true, nil
+	} else if isMultipart(contentType) {
+		_, params, _ := mime.ParseMediaType(contentType)
+		result, changed, err = transformParts(
+			params["boundary"], content, transform,
+		)
+		return cte, result, changed, err
+	}
+	return cte, content, false, nil
+}
+
+// transformParts applies transform to every text part of a multipart body.
+// It returns content unchanged if no part changed, preserving the original
+// preamble and epilogue.
+func transformParts(
+	boundary string, content []byte, transform textTransform,
+) (result []byte, changed bool, err error) {
+	b := &bytes.Buffer{}
+	mw := multipart.NewWriter(b)
+	if err = mw.SetBoundary(boundary); err != nil {
+		return nil, false, err
+	}
+	mr := multipart.NewReader(bytes.NewReader(content), boundary)
+
+	for {
+		// NextRawPart doesn't decode quoted-printable parts, so unchanged
+		// parts are written back exactly as they were.
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, false, err
+		}
+
+		partContent, err := io.ReadAll(part)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if !isAttachment(part) {
+			cte := part.Header.Get("Content-Transfer-Encoding")
+			contentType := part.Header.Get("Content-Type")
+			var partChanged bool
+			cte, partContent, partChanged, err = transformEntity(
+				contentType, cte, partContent, transform,
+			)
+			if err != nil {
+				return nil, false, err
+			} else if partChanged {
+				part.Header.Set("Content-Transfer-Encoding", cte)
+				changed = true
+			}
+		}
+
+		// Writing to a bytes.Buffer can't fail, so we can ignore the errors.
+		w, _ := mw.CreatePart(part.Header)
+		w.Write(partContent)
+	}
+
+	if !changed {
+		return content, false, nil
+	}
+	mw.Close()
+	return b.Bytes(), true, nil
+}
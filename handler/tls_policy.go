@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	sesv2types "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+)
+
+// ErrTlsNotRequired indicates that REQUIRE_TLS is set, but CONFIGURATION_SET
+// doesn't enforce TLS delivery. SES delivery options only exist at the
+// configuration set level, not on individual SendEmail requests.
+//
+// - https://docs.aws.amazon.com/ses/latest/APIReference-V2/API_DeliveryOptions.html
+var ErrTlsNotRequired = errors.New("configuration set doesn't require TLS")
+
+// checkTlsPolicy ensures that configSet has its TlsPolicy set to REQUIRE when
+// REQUIRE_TLS is set. Forwarding must fail rather than risk sending a message
+// over an unencrypted connection. A successful check is cached for each
+// configuration set for the lifetime of the Handler.
+func (h *Handler) checkTlsPolicy(ctx context.Context, configSet string) error {
+	if !h.Options.RequireTls {
+		return nil
+	} else if _, verified := h.tlsPolicyVerified.Load(configSet); verified {
+		return nil
+	}
+
+	input := &sesv2.GetConfigurationSetInput{
+		ConfigurationSetName: aws.String(configSet),
+	}
+	output, err := h.getConfigurationSet(ctx, input)
+
+	if err != nil {
+		const errFmt = "failed to get configuration set %s: %w"
+		return fmt.Errorf(errFmt, configSet, err)
+	} else if output.DeliveryOptions == nil ||
+		output.DeliveryOptions.TlsPolicy != sesv2types.TlsPolicyRequire {
+		return fmt.Errorf("%w: %s", ErrTlsNotRequired, configSet)
+	}
+	h.tlsPolicyVerified.Store(configSet, true)
+	return nil
+}
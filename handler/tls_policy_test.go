@@ -0,0 +1,126 @@
+//go:build small_tests || all_tests
+
+package handler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	sesv2types "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+	"github.com/mbland/ses-forwarder/handler/handlertest"
+	"gotest.tools/assert"
+)
+
+func TestCheckTlsPolicy(t *testing.T) {
+	setup := func() (*handlertest.SesV2, *Handler, context.Context) {
+		fake := &handlertest.SesV2{
+			MessageId: "forwarded-id", TlsPolicy: sesv2types.TlsPolicyRequire,
+		}
+		opts := &Options{
+			ForwardingAddress: "quux@xyzzy.com",
+			ConfigurationSet:  "ses-forwarder",
+			RequireTls:        true,
+		}
+		return fake, &Handler{SesV2: fake, Options: opts}, context.Background()
+	}
+
+	t.Run("SkipsCheckIfNotEnabled", func(t *testing.T) {
+		fake, h, ctx := setup()
+		h.Options.RequireTls = false
+
+		err := h.checkTlsPolicy(ctx, "ses-forwarder")
+
+		assert.NilError(t, err)
+		assert.Equal(t, len(fake.GetConfigurationSetInputs), 0)
+	})
+
+	t.Run("SucceedsAndCachesResultIfTlsRequired", func(t *testing.T) {
+		fake, h, ctx := setup()
+
+		assert.NilError(t, h.checkTlsPolicy(ctx, "ses-forwarder"))
+		assert.NilError(t, h.checkTlsPolicy(ctx, "ses-forwarder"))
+
+		assert.Equal(t, len(fake.GetConfigurationSetInputs), 1)
+		input := fake.GetConfigurationSetInputs[0]
+		assert.Equal(t, *input.ConfigurationSetName, "ses-forwarder")
+	})
+
+	t.Run("ChecksEachConfigurationSet", func(t *testing.T) {
+		fake, h, ctx := setup()
+
+		assert.NilError(t, h.checkTlsPolicy(ctx, "ses-forwarder"))
+		assert.NilError(t, h.checkTlsPolicy(ctx, "sales"))
+
+		assert.Equal(t, len(fake.GetConfigurationSetInputs), 2)
+		input := fake.GetConfigurationSetInputs[1]
+		assert.Equal(t, *input.ConfigurationSetName, "sales")
+	})
+
+	t.Run("ErrorsIfTlsNotRequired", func(t *testing.T) {
+		fake, h, ctx := setup()
+		fake.TlsPolicy = sesv2types.TlsPolicyOptional
+
+		err := h.checkTlsPolicy(ctx, "ses-forwarder")
+
+		assert.Assert(t, errors.Is(err, ErrTlsNotRequired))
+		expected := "configuration set doesn't require TLS: ses-forwarder"
+		assert.ErrorContains(t, err, expected)
+	})
+
+	t.Run("ErrorsIfGettingConfigurationSetFails", func(t *testing.T) {
+		fake, h, ctx := setup()
+		fake.GetConfigurationSetErr = errors.New("SES error")
+
+		err := h.checkTlsPolicy(ctx, "ses-forwarder")
+
+		assert.Assert(t, errors.Is(err, fake.GetConfigurationSetErr))
+		expected := "failed to get configuration set ses-forwarder: SES error"
+		assert.ErrorContains(t, err, expected)
+	})
+
+	t.Run("RetriesIfThrottled", func(t *testing.T) {
+		fake, h, ctx := setup()
+		fake.GetConfigurationSetErr = newThrottleError()
+		_, h.Log = testLogger()
+		h.Sleep = func(context.Context, time.Duration) error { return nil }
+
+		err := h.checkTlsPolicy(ctx, "ses-forwarder")
+
+		assert.Assert(t, isThrottleError(err))
+		attempts := len(fake.GetConfigurationSetInputs)
+		assert.Equal(t, attempts, maxThrottledAttempts)
+	})
+
+	t.Run("ForwardMessageFailsWithoutSendingIfTlsNotRequired",
+		func(t *testing.T) {
+			fake, h, ctx := setup()
+			fake.TlsPolicy = sesv2types.TlsPolicyOptional
+
+			_, err := h.forwardMessage(
+				ctx,
+				[]byte("Hello, world!"),
+				h.newRoute([]string{"foo@bar.com"}),
+			)
+
+			var forwardErr *ErrForward
+			assert.Assert(t, errors.As(err, &forwardErr))
+			assert.Assert(t, errors.Is(err, ErrTlsNotRequired))
+			assert.Equal(t, len(fake.SendEmailInputs), 0)
+		},
+	)
+
+	t.Run("ForwardMessageSendsIfTlsRequired", func(t *testing.T) {
+		fake, h, ctx := setup()
+
+		fwdId, err := h.forwardMessage(
+			ctx, []byte("Hello, world!"), h.newRoute([]string{"foo@bar.com"}),
+		)
+
+		assert.NilError(t, err)
+		assert.Equal(t, fwdId, "forwarded-id")
+		assert.Equal(t, len(fake.GetConfigurationSetInputs), 1)
+		assert.Equal(t, len(fake.SendEmailInputs), 1)
+	})
+}
@@ -0,0 +1,36 @@
+package handler
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+var noopTracer = noop.NewTracerProvider().Tracer("")
+
+func (h *Handler) tracer() trace.Tracer {
+	if h.Tracer == nil {
+		return noopTracer
+	}
+	return h.Tracer
+}
+
+// startSpan starts a span for a stage of processing a message as a child of
+// any span in ctx.
+func (h *Handler) startSpan(
+	ctx context.Context, name string,
+) (context.Context, trace.Span) {
+	return h.tracer().Start(ctx, name)
+}
+
+// endSpan ends span, recording err and marking the span as failed if err is
+// not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,81 @@
+//go:build small_tests || all_tests
+
+package handler
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"gotest.tools/assert"
+)
+
+func TestTracing(t *testing.T) {
+	setup := func() (*handleEventFixture, *tracetest.SpanRecorder) {
+		f := newHandleEventFixture()
+		recorder := tracetest.NewSpanRecorder()
+		provider := sdktrace.NewTracerProvider(
+			sdktrace.WithSpanProcessor(recorder),
+		)
+		f.h.Tracer = provider.Tracer("ses-forwarder-test")
+		return f, recorder
+	}
+
+	spanNames := func(recorder *tracetest.SpanRecorder) []string {
+		names := []string{}
+		for _, span := range recorder.Ended() {
+			names = append(names, span.Name())
+		}
+		return names
+	}
+
+	t.Run("EmitsSpanForEachStage", func(t *testing.T) {
+		f, recorder := setup()
+		ctx, parent := f.h.Tracer.Start(context.Background(), "upstream")
+
+		_, err := f.h.processMessage(ctx, &f.event.Records[0].SES)
+		parent.End()
+
+		assert.NilError(t, err)
+		expected := []string{
+			"getOriginalMessage", "updateMessage", "forwardMessage", "upstream",
+		}
+		assert.DeepEqual(t, spanNames(recorder), expected)
+
+		parentId := parent.SpanContext().SpanID()
+		for _, span := range recorder.Ended()[:3] {
+			assert.Equal(t, span.Parent().SpanID(), parentId, span.Name())
+			assert.Equal(t, span.Status().Code, codes.Unset, span.Name())
+		}
+	})
+
+	t.Run("RecordsErrors", func(t *testing.T) {
+		f, recorder := setup()
+		f.sesv2.sendEmailErr = errors.New("SES test error")
+
+		_, err := f.h.processMessage(
+			context.Background(), &f.event.Records[0].SES,
+		)
+
+		assert.ErrorContains(t, err, "SES test error")
+		spans := recorder.Ended()
+		forwardSpan := spans[len(spans)-1]
+		assert.Equal(t, forwardSpan.Name(), "forwardMessage")
+		assert.Equal(t, forwardSpan.Status().Code, codes.Error)
+		assert.Equal(t, len(forwardSpan.Events()), 1)
+	})
+
+	t.Run("DefaultsToNoopTracer", func(t *testing.T) {
+		f := newHandleEventFixture()
+
+		_, err := f.h.processMessage(
+			context.Background(), &f.event.Records[0].SES,
+		)
+
+		assert.NilError(t, err)
+		assert.Equal(t, f.h.tracer(), noopTracer)
+	})
+}
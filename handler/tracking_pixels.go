@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"bytes"
+	"io"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+var cssPixelLength = regexp.MustCompile(`^(\d+)(px)?$`)
+
+// stripTrackingPixels removes likely tracking pixels from every text/html
+// part of a message: images hidden by their style attribute, and external
+// images no larger than one pixel square.
+//
+// See transformTextParts for how it updates header and body.
+func stripTrackingPixels(
+	header mail.Header, body io.Reader,
+) (io.Reader, error) {
+	return transformTextParts(
+		header, body, func(mediaType string, content []byte) []byte {
+			if mediaType != "text/html" {
+				return content
+			}
+			return stripImgTags(content)
+		},
+	)
+}
+
+// stripImgTags returns content without any img tags that are tracking
+// pixels. Every other token is copied exactly as it appeared, so "<img" text
+// inside comments, scripts, or attribute values is left alone.
+func stripImgTags(content []byte) []byte {
+	z := html.NewTokenizer(bytes.NewReader(content))
+	b := &bytes.Buffer{}
+
+	for {
+		tt := z.Next()
+		raw := z.Raw()
+
+		// The tokenizer only fails at the end of content, since it reads
+		// from memory and its buffer is unlimited.
+		if tt == html.ErrorToken {
+			b.Write(raw)
+			return b.Bytes()
+		} else if !(tt == html.StartTagToken ||
+			tt == html.SelfClosingTagToken) || !isTrackingPixelTag(z) {
+			b.Write(raw)
+		}
+	}
+}
+
+// isTrackingPixelTag returns true if the tokenizer's current tag is an img
+// tag that's a tracking pixel. It consumes the tag's name and attributes.
+func isTrackingPixelTag(z *html.Tokenizer) bool {
+	name, hasAttr := z.TagName()
+	if string(name) != "img" {
+		return false
+	}
+
+	// Attribute names are lowercased and values unescaped by TagAttr. Like
+	// browsers, keep the first of any duplicates.
+	attrs := map[string]string{}
+	for hasAttr {
+		var key, value []byte
+		key, value, hasAttr = z.TagAttr()
+		if _, ok := attrs[string(key)]; !ok {
+			attrs[string(key)] = string(value)
+		}
+	}
+	return isTrackingPixel(attrs)
+}
+
+func isTrackingPixel(attrs map[string]string) bool {
+	style := cssDeclarations(attrs["style"])
+
+	if style["display"] == "none" || style["visibility"] == "hidden" {
+		return true
+	}
+
+	src := strings.ToLower(strings.TrimSpace(attrs["src"]))
+	isExternal := strings.HasPrefix(src, "http://") ||
+		strings.HasPrefix(src, "https://") || strings.HasPrefix(src, "//")
+	return isExternal &&
+		isAtMostOnePixel(attrs["width"], style["width"]) &&
+		isAtMostOnePixel(attrs["height"], style["height"])
+}
+
+// cssDeclarations parses a style attribute into a map of lowercased property
+// names to lowercased values, without whitespace or "!important".
+func cssDeclarations(style string) map[string]string {
+	declarations := map[string]string{}
+
+	for _, decl := range strings.Split(style, ";") {
+		prop, value, ok := strings.Cut(decl, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSuffix(
+			strings.ToLower(strings.TrimSpace(value)), "!important",
+		)
+		declarations[strings.ToLower(strings.TrimSpace(prop))] =
+			strings.TrimSpace(value)
+	}
+	return declarations
+}
+
+// isAtMostOnePixel returns true if either the attribute or the CSS value is a
+// length of zero or one pixel.
+func isAtMostOnePixel(attrValue, cssValue string) bool {
+	for _, value := range []string{attrValue, cssValue} {
+		match := cssPixelLength.FindStringSubmatch(strings.TrimSpace(value))
+		if match == nil {
+			continue
+		} else if n, err := strconv.Atoi(match[1]); err == nil && n <= 1 {
+			return true
+		}
+	}
+	return false
+}
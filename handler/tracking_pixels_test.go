@@ -0,0 +1,79 @@
+//go:build small_tests || all_tests
+
+package handler
+
+import (
+	"io"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestStripTrackingPixels(t *testing.T) {
+	strip := func(t *testing.T, content string) string {
+		t.Helper()
+		header, body := plainTextInput("text/html; charset=utf-8", "", content)
+
+		result, err := stripTrackingPixels(header, body)
+
+		assert.NilError(t, err)
+		stripped, err := io.ReadAll(decodeTransferEncoding(
+			header.Get("Content-Transfer-Encoding"), result,
+		))
+		assert.NilError(t, err)
+		return string(stripped)
+	}
+
+	t.Run("RemovesKnownTrackingPixels", func(t *testing.T) {
+		const trackingHtml = `<p>Hello!</p>` +
+			`<img src="https://t.example.com/open?id=1" width="1" height="1">` +
+			`<IMG SRC='//t.example.com/o.gif' style="width:1px; height: 0px">` +
+			`<img src="https://t.example.com/p.gif" width=0 height=0 alt="">` +
+			`<img src="cid:pixel" style="display: none !important">` +
+			`<img src="https://example.com/hidden.png" ` +
+			`style="visibility:hidden">` +
+			`<p>Goodbye!</p>`
+
+		assert.Equal(t, strip(t, trackingHtml), "<p>Hello!</p><p>Goodbye!</p>")
+	})
+
+	t.Run("KeepsOrdinaryImages", func(t *testing.T) {
+		const ordinaryHtml = `<img src="https://example.com/logo.png" ` +
+			`width="120" height="1">` +
+			`<img src="cid:spacer" width="1" height="1">` +
+			`<img src="https://example.com/photo.jpg">` +
+			`<img alt="width=1 height=1" src="https://example.com/a.png">`
+
+		assert.Equal(t, strip(t, ordinaryHtml), ordinaryHtml)
+	})
+
+	t.Run("HandlesGreaterThanInQuotedAttribute", func(t *testing.T) {
+		const trackingHtml = `<p>Hello!</p>` +
+			`<img alt="a>b" src="https://t.example/p.gif" width="1" ` +
+			`height="1"><p>Goodbye!</p>`
+
+		assert.Equal(t, strip(t, trackingHtml), "<p>Hello!</p><p>Goodbye!</p>")
+	})
+
+	t.Run("IgnoresImgTextOutsideTags", func(t *testing.T) {
+		const pixel = `<img src="https://t.example/p.gif" width=1 height=1>`
+		const otherHtml = `<!-- ` + pixel + ` -->` +
+			`<script>document.write('` + pixel + `')</script>` +
+			`<a title='` + pixel + `' href="https://example.com">link</a>`
+
+		assert.Equal(t, strip(t, otherHtml), otherHtml)
+	})
+
+	t.Run("LeavesPlainTextUnchanged", func(t *testing.T) {
+		const text = `<img src="https://t.example.com/o" width=1 height=1>`
+		header, body := plainTextInput("text/plain", "", text)
+
+		result, err := stripTrackingPixels(header, body)
+
+		assert.NilError(t, err)
+		content, err := io.ReadAll(result)
+		assert.NilError(t, err)
+		assert.Equal(t, string(content), text)
+		assert.Equal(t, header.Get("Content-Transfer-Encoding"), "")
+	})
+}
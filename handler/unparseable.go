@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+// unparseableAttachmentName is the file name of the original message attached
+// to the wrapper sent by forwardUnparseable.
+const unparseableAttachmentName = "original.eml"
+
+// canForwardUnparseable returns true if ForwardUnparseable is set and err
+// indicates that the original message couldn't be parsed or rewritten.
+func (h *Handler) canForwardUnparseable(err error) bool {
+	var transformErr *ErrTransform
+	return h.Options.ForwardUnparseable && errors.As(err, &transformErr)
+}
+
+// forwardUnparseable sends a new message to ForwardingAddress explaining
+// parseErr, with the original message attached, so that a message the
+// forwarder can't rewrite is never silently dropped.
+//
+// It retrieves the original message again, since reading it the first time
+// may have consumed the stream before parsing failed.
+func (h *Handler) forwardUnparseable(
+	ctx context.Context, key string, parseErr error,
+) (string, error) {
+	orig, err := h.getOriginalMessage(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer orig.Close()
+	key = orig.key
+
+	raw, err := io.ReadAll(orig)
+	if err != nil {
+		return "", err
+	}
+	msg, err := h.unparseableWrapper(key, raw, parseErr)
+	if err != nil {
+		return "", &ErrTransform{err}
+	}
+	_, messageId, _ := cutLast(key, "/")
+	r := h.newRoute([]string{h.Options.ForwardingAddress})
+	return h.deliverMessage(ctx, messageId, msg, r)
+}
+
+// unparseableWrapper returns a multipart/mixed message containing a text/plain
+// explanation of parseErr and the raw original message as a base64 encoded
+// attachment. The original isn't attached as message/rfc822, since it may not
+// be a valid message.
+func (h *Handler) unparseableWrapper(
+	key string, raw []byte, parseErr error,
+) ([]byte, error) {
+	b := &bytes.Buffer{}
+	mw := multipart.NewWriter(b)
+	msgPath := h.Options.BucketName + "/" + key
+
+	for _, header := range [][2]string{
+		{"From", h.Options.SenderAddress},
+		{"To", h.Options.ForwardingAddress},
+		{"Subject", "Unparseable message: " + key},
+		{"Date", formatDate(h.now())},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/mixed; boundary=" + mw.Boundary()},
+	} {
+		b.WriteString(header[0] + ": " + header[1] + "\r\n")
+	}
+	b.WriteString(origLinkHeaderPrefix + msgPath + "\r\n\r\n")
+
+	text, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=UTF-8"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(
+		text,
+		"The message s3://%s couldn't be forwarded:\r\n\r\n%s\r\n\r\n"+
+			"The original message is attached as %s.\r\n",
+		msgPath, parseErr, unparseableAttachmentName,
+	)
+
+	attachment, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"application/octet-stream"},
+		"Content-Disposition": {
+			`attachment; filename="` + unparseableAttachmentName + `"`,
+		},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	attachment.Write([]byte(wrapBase64(raw)))
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// maxBase64LineLen is the maximum encoded line length from RFC 2045.
+//
+// - https://www.rfc-editor.org/rfc/rfc2045#section-6.8
+const maxBase64LineLen = 76
+
+func wrapBase64(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	sb := &strings.Builder{}
+
+	for len(encoded) > maxBase64LineLen {
+		sb.WriteString(encoded[:maxBase64LineLen] + "\r\n")
+		encoded = encoded[maxBase64LineLen:]
+	}
+	sb.WriteString(encoded + "\r\n")
+	return sb.String()
+}
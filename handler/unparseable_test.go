@@ -0,0 +1,89 @@
+//go:build small_tests || all_tests
+
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestUnparseableWrapper(t *testing.T) {
+	now := time.Date(1970, time.September, 18, 12, 45, 0, 0, time.UTC)
+	h := &Handler{
+		Options: &Options{
+			BucketName:        "mail.bar.com",
+			SenderAddress:     "fwd@bar.com",
+			ForwardingAddress: "foo@bar.com",
+		},
+		Now: func() time.Time { return now },
+	}
+	raw := []byte("invalid message")
+
+	msg, err := h.unparseableWrapper(
+		"incoming/deadbeef", raw, errors.New("failed to parse message: bad"),
+	)
+
+	assert.NilError(t, err)
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	assert.NilError(t, err)
+	assert.Equal(t, m.Header.Get("From"), "fwd@bar.com")
+	assert.Equal(t, m.Header.Get("To"), "foo@bar.com")
+	assert.Equal(
+		t, m.Header.Get("Subject"), "Unparseable message: incoming/deadbeef",
+	)
+	assert.Equal(t, m.Header.Get("Date"), "Fri, 18 Sep 1970 12:45:00 +0000")
+	assert.Equal(
+		t, m.Header.Get(origLinkHeader), "s3://mail.bar.com/incoming/deadbeef",
+	)
+
+	mediaType, params, err := mime.ParseMediaType(
+		m.Header.Get("Content-Type"),
+	)
+	assert.NilError(t, err)
+	assert.Equal(t, mediaType, "multipart/mixed")
+	mr := multipart.NewReader(m.Body, params["boundary"])
+
+	text, err := mr.NextPart()
+	assert.NilError(t, err)
+	body, err := io.ReadAll(text)
+	assert.NilError(t, err)
+	expected := "The message s3://mail.bar.com/incoming/deadbeef couldn't " +
+		"be forwarded:\r\n\r\nfailed to parse message: bad\r\n\r\n" +
+		"The original message is attached as original.eml.\r\n"
+	assert.Equal(t, string(body), expected)
+
+	attachment, err := mr.NextPart()
+	assert.NilError(t, err)
+	assert.Equal(t, attachment.FileName(), "original.eml")
+	encoded, err := io.ReadAll(attachment)
+	assert.NilError(t, err)
+	decoded, err := base64.StdEncoding.DecodeString(string(encoded))
+	assert.NilError(t, err)
+	assert.Equal(t, string(decoded), string(raw))
+
+	_, err = mr.NextPart()
+	assert.Equal(t, err, io.EOF)
+}
+
+func TestWrapBase64(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 100)
+
+	result := wrapBase64(data)
+
+	lines := strings.Split(strings.TrimSuffix(result, "\r\n"), "\r\n")
+	assert.Equal(t, len(lines), 2)
+	assert.Equal(t, len(lines[0]), maxBase64LineLen)
+	decoded, err := base64.StdEncoding.DecodeString(strings.Join(lines, ""))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, decoded, data)
+}
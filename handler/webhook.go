@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"time"
+)
+
+// HttpApi is the subset of *http.Client used to POST messages to WEBHOOK_URL.
+type HttpApi interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// defaultWebhookTimeout limits how long a WEBHOOK_URL request may take,
+// unless WEBHOOK_TIMEOUT overrides it.
+const defaultWebhookTimeout = 10 * time.Second
+
+// maxWebhookErrorBodyLen limits how much of an unsuccessful webhook response
+// body appears in the resulting error.
+const maxWebhookErrorBodyLen = 256
+
+// webhookPayload is the JSON body POSTed to WEBHOOK_URL if FORWARD_TARGET is
+// ForwardTargetHttp.
+//
+// From is the original sender's address. Body is the prepared message body,
+// which remains MIME encoded. It's a []byte, which encoding/json encodes as
+// base64, since the body may contain 8bit text in any charset, or even binary
+// data, that isn't valid UTF-8. Link is the X-SES-Forwarder-Original value
+// identifying the original message in S3.
+type webhookPayload struct {
+	MessageId  string   `json:"messageId"`
+	From       string   `json:"from"`
+	Subject    string   `json:"subject"`
+	Recipients []string `json:"recipients"`
+	Body       []byte   `json:"body"`
+	Link       string   `json:"link"`
+}
+
+func (h *Handler) httpClient() HttpApi {
+	if h.HttpClient == nil {
+		return http.DefaultClient
+	}
+	return h.HttpClient
+}
+
+func (h *Handler) webhookTimeout() time.Duration {
+	if h.Options.WebhookTimeout != 0 {
+		return h.Options.WebhookTimeout
+	}
+	return defaultWebhookTimeout
+}
+
+// postWebhook POSTs the prepared message to WEBHOOK_URL as a webhookPayload,
+// returning the scheme and host of WEBHOOK_URL. It omits the path and query,
+// which may contain credentials, so the result is safe to log.
+func (h *Handler) postWebhook(
+	ctx context.Context, messageId string, msg []byte, r *route,
+) (endpoint string, err error) {
+	payload, err := newWebhookPayload(messageId, msg, r.Recipients)
+	if err != nil {
+		return "", &ErrTransform{err}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", &ErrTransform{err}
+	}
+
+	u, err := url.Parse(h.Options.WebhookUrl)
+	if err != nil {
+		return "", &ErrForward{err}
+	}
+	endpoint = u.Scheme + "://" + u.Host
+
+	ctx, cancel := context.WithTimeout(ctx, h.webhookTimeout())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, u.String(), bytes.NewReader(body),
+	)
+	if err != nil {
+		return "", &ErrForward{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.httpClient().Do(req)
+	if err != nil {
+		err = fmt.Errorf("webhook request to %s failed: %w", endpoint, err)
+		return "", &ErrForward{err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(
+			io.LimitReader(resp.Body, maxWebhookErrorBodyLen),
+		)
+		err = fmt.Errorf(
+			"webhook %s returned %s: %s", endpoint, resp.Status, respBody,
+		)
+		return "", &ErrForward{err}
+	}
+	return endpoint, nil
+}
+
+func newWebhookPayload(
+	messageId string, msg []byte, recipients []string,
+) (*webhookPayload, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(m.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	from := m.Header.Get("X-Original-Sender")
+	if from == "" {
+		from = m.Header.Get("From")
+	}
+	subject := m.Header.Get("Subject")
+	if decoded, err := encodedWordDecoder.DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+	if recipients == nil {
+		recipients = []string{}
+	}
+
+	return &webhookPayload{
+		MessageId:  messageId,
+		From:       from,
+		Subject:    subject,
+		Recipients: recipients,
+		Body:       body,
+		Link:       m.Header.Get(origLinkHeader),
+	}, nil
+}
@@ -0,0 +1,147 @@
+//go:build small_tests || all_tests
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+const webhookMsg = "From: Mike - mbland at acm.org <fwd@xyzzy.com>\r\n" +
+	"Reply-To: Mike <mbland@acm.org>\r\n" +
+	"Subject: =?UTF-8?Q?Caf=C3=A9?=\r\n" +
+	"X-Original-Sender: mbland@acm.org\r\n" +
+	origLinkHeaderPrefix + "mail.xyzzy.com/incoming/msgId\r\n" +
+	"\r\n" +
+	"Hello, world!\r\n"
+
+type webhookRequest struct {
+	method      string
+	path        string
+	contentType string
+	payload     *webhookPayload
+}
+
+func TestPostWebhook(t *testing.T) {
+	setup := func(
+		t *testing.T, handler http.HandlerFunc,
+	) (*Handler, *webhookRequest, *route) {
+		received := &webhookRequest{}
+		server := httptest.NewServer(
+			http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				received.method = req.Method
+				received.path = req.URL.RequestURI()
+				received.contentType = req.Header.Get("Content-Type")
+				received.payload = &webhookPayload{}
+				body, _ := io.ReadAll(req.Body)
+				json.Unmarshal(body, received.payload)
+				handler(w, req)
+			}),
+		)
+		t.Cleanup(server.Close)
+
+		h := &Handler{
+			Options: &Options{
+				ForwardTarget: ForwardTargetHttp,
+				WebhookUrl:    server.URL + "/hooks/mail?token=secret",
+			},
+			HttpClient: server.Client(),
+		}
+		r := &route{Recipients: []string{"sales@xyzzy.com"}}
+		return h, received, r
+	}
+	succeed := func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	t.Run("Succeeds", func(t *testing.T) {
+		h, received, r := setup(t, succeed)
+
+		endpoint, err := h.deliverMessage(
+			context.Background(), "msgId", []byte(webhookMsg), r,
+		)
+
+		assert.NilError(t, err)
+		assert.Assert(t, strings.HasPrefix(endpoint, "http://127.0.0.1:"))
+		assert.Assert(t, !strings.Contains(endpoint, "secret"))
+		assert.Equal(t, received.method, http.MethodPost)
+		assert.Equal(t, received.path, "/hooks/mail?token=secret")
+		assert.Equal(t, received.contentType, "application/json")
+		assert.DeepEqual(
+			t,
+			received.payload,
+			&webhookPayload{
+				MessageId:  "msgId",
+				From:       "mbland@acm.org",
+				Subject:    "Café",
+				Recipients: []string{"sales@xyzzy.com"},
+				Body:       []byte("Hello, world!\r\n"),
+				Link:       "s3://mail.xyzzy.com/incoming/msgId",
+			},
+		)
+	})
+
+	t.Run("PreservesBodyThatIsNotUtf8", func(t *testing.T) {
+		h, received, r := setup(t, succeed)
+		msg := strings.Replace(webhookMsg, "Hello, world!", "Caf\xe9", 1)
+
+		_, err := h.postWebhook(context.Background(), "msgId", []byte(msg), r)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, received.payload.Body, []byte("Caf\xe9\r\n"))
+	})
+
+	t.Run("ErrorsIfResponseUnsuccessful", func(t *testing.T) {
+		h, _, r := setup(t, func(w http.ResponseWriter, _ *http.Request) {
+			http.Error(w, "ticket system down", http.StatusBadGateway)
+		})
+
+		endpoint, err := h.postWebhook(
+			context.Background(), "msgId", []byte(webhookMsg), r,
+		)
+
+		assert.Equal(t, endpoint, "")
+		assert.ErrorContains(t, err, "returned 502 Bad Gateway: ")
+		assert.ErrorContains(t, err, "ticket system down")
+		assert.Assert(t, !strings.Contains(err.Error(), "secret"))
+		var forwardErr *ErrForward
+		assert.Assert(t, errors.As(err, &forwardErr))
+	})
+
+	t.Run("ErrorsIfRequestTimesOut", func(t *testing.T) {
+		h, _, r := setup(t, func(w http.ResponseWriter, req *http.Request) {
+			<-req.Context().Done()
+		})
+		h.Options.WebhookTimeout = 10 * time.Millisecond
+
+		_, err := h.postWebhook(
+			context.Background(), "msgId", []byte(webhookMsg), r,
+		)
+
+		assert.ErrorContains(t, err, "webhook request to http://127.0.0.1:")
+		assert.Assert(t, errors.Is(err, context.DeadlineExceeded))
+	})
+
+	t.Run("ErrorsIfMessageUnparseable", func(t *testing.T) {
+		h, received, r := setup(t, succeed)
+
+		_, err := h.postWebhook(
+			context.Background(), "msgId", []byte("not a message"), r,
+		)
+
+		assert.Assert(t, err != nil)
+		var transformErr *ErrTransform
+		assert.Assert(t, errors.As(err, &transformErr))
+		assert.Assert(t, is.Nil(received.payload))
+	})
+}
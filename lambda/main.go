@@ -4,6 +4,7 @@ import (
 	"context"
 	"log"
 	"os"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -14,18 +15,31 @@ import (
 )
 
 func buildHandler() (*handler.Handler, error) {
-	if cfg, err := config.LoadDefaultConfig(context.Background()); err != nil {
+	ctx := context.Background()
+
+	if cfg, err := config.LoadDefaultConfig(ctx); err != nil {
 		return nil, err
 	} else if opts, err := handler.GetOptions(os.Getenv); err != nil {
 		return nil, err
 	} else {
-		return &handler.Handler{
-			S3:      s3.NewFromConfig(cfg),
-			Ses:     ses.NewFromConfig(cfg),
-			SesV2:   sesv2.NewFromConfig(cfg),
-			Options: opts,
-			Log:     log.Default(),
-		}, nil
+		log.Printf("configuration:\n%s", opts.Summary())
+		for _, warning := range opts.Warnings() {
+			log.Printf("WARNING: %s", warning)
+		}
+		s3Client := s3.NewFromConfig(cfg)
+		h := &handler.Handler{
+			S3:        s3Client,
+			S3Presign: s3.NewPresignClient(s3Client),
+			Ses:       ses.NewFromConfig(cfg),
+			SesV2:     sesv2.NewFromConfig(cfg),
+			Options:   opts,
+			Log:       log.Default(),
+			Now:       time.Now,
+		}
+		if err := h.ValidateSenderIdentity(ctx); err != nil {
+			return nil, err
+		}
+		return h, nil
 	}
 }
 